@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"github.com/pkg/errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// adminListen is the address of the admin api, disabled when empty
+	adminListen string
+	// adminToken is the bearer token the admin api requires
+	adminToken string
+)
+
+// recentJobs bounds the finished jobs kept for inspection and requeueing
+const recentJobs = 256
+
+const (
+	jobQueued      = "queued"
+	jobDownloading = "downloading"
+	// jobVerifying is published once the CAR is downloaded, before it passed verification
+	jobVerifying = "verifying"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobDeferred  = "deferred"
+	// jobSkipped is a job out of the size range of the node, reported once
+	jobSkipped   = "skipped"
+	jobCancelled = "cancelled"
+)
+
+var (
+	errJobNotFound = errors.New("job not found")
+	errJobActive   = errors.New("job is queued or downloading")
+	// errDeferred is the outcome of a job handed back for lack of space
+	errDeferred = errors.New("not enough space, deferred")
+)
+
+// runningJob is a download in progress, cancel aborts its transfers
+type runningJob struct {
+	asset     *model.Asset
+	startedAt time.Time
+	cancel    context.CancelFunc
+	// cancelled is set by the admin api, guarded by dlk
+	cancelled bool
+}
+
+// JobStatus is a job as listed by the admin api
+type JobStatus struct {
+	Cid        string    `json:"cid"`
+	State      string    `json:"state"`
+	Size       int64     `json:"size"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+
+	asset *model.Asset
+}
+
+// finished records the outcome of a download in the recent jobs, dropping the oldest one when full
+func (d *Downloader) finished(r *runningJob, err error) {
+	status := &JobStatus{
+		Cid:        r.asset.Cid,
+		State:      jobDone,
+		Size:       r.asset.TotalSize,
+		StartedAt:  r.startedAt,
+		FinishedAt: time.Now(),
+		asset:      r.asset,
+	}
+
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	switch {
+	case r.cancelled:
+		status.State = jobCancelled
+	case errors.Is(err, errDeferred):
+		status.State = jobDeferred
+	case err != nil:
+		status.State = jobFailed
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	d.remember(status)
+}
+
+// remember adds status to the recent jobs and publishes it, the caller holds dlk
+func (d *Downloader) remember(status *JobStatus) {
+	d.events.publish(&JobEvent{Cid: status.Cid, State: status.State, Size: status.Size, Error: status.Error})
+
+	d.recent[status.Cid] = status
+	if len(d.recent) <= recentJobs {
+		return
+	}
+
+	var oldest *JobStatus
+	for _, s := range d.recent {
+		if oldest == nil || s.FinishedAt.Before(oldest.FinishedAt) {
+			oldest = s
+		}
+	}
+	delete(d.recent, oldest.Cid)
+}
+
+// jobs lists the running, queued and recent jobs
+func (d *Downloader) jobs() []*JobStatus {
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	out := make([]*JobStatus, 0, len(d.downloading)+len(d.queued)+len(d.recent))
+	for _, r := range d.downloading {
+		out = append(out, &JobStatus{Cid: r.asset.Cid, State: jobDownloading, Size: r.asset.TotalSize, StartedAt: r.startedAt})
+	}
+	for _, a := range d.queued {
+		out = append(out, &JobStatus{Cid: a.Cid, State: jobQueued, Size: a.TotalSize})
+	}
+	for _, s := range d.recent {
+		out = append(out, s)
+	}
+
+	slices.SortFunc(out, func(a, b *JobStatus) int {
+		return strings.Compare(a.Cid, b.Cid)
+	})
+	return out
+}
+
+// job returns the state of cid, a running or queued job shadows a finished one
+func (d *Downloader) job(cid string) (*JobStatus, error) {
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	if r, ok := d.downloading[cid]; ok {
+		return &JobStatus{Cid: cid, State: jobDownloading, Size: r.asset.TotalSize, StartedAt: r.startedAt}, nil
+	}
+	if a, ok := d.queued[cid]; ok {
+		return &JobStatus{Cid: cid, State: jobQueued, Size: a.TotalSize}, nil
+	}
+	if s, ok := d.recent[cid]; ok {
+		return s, nil
+	}
+	return nil, errJobNotFound
+}
+
+// cancelJob aborts the download of cid or drops it from the queue. A cancelled download is reported as failed, so
+// it's handed out again later.
+func (d *Downloader) cancelJob(cid string) error {
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	if r, ok := d.downloading[cid]; ok {
+		r.cancelled = true
+		r.cancel()
+		log.Infof("admin: cancel download of %s", cid)
+		return nil
+	}
+
+	if a, ok := d.queued[cid]; ok {
+		delete(d.queued, cid)
+		d.remember(&JobStatus{Cid: cid, State: jobCancelled, Size: a.TotalSize, FinishedAt: time.Now(), asset: a})
+		log.Infof("admin: cancel queued %s", cid)
+		return nil
+	}
+	return errJobNotFound
+}
+
+// requeue queues a finished job again, failed and cancelled ones mostly
+func (d *Downloader) requeue(cid string) error {
+	d.dlk.Lock()
+	_, downloading := d.downloading[cid]
+	_, queued := d.queued[cid]
+	status, recent := d.recent[cid]
+	if !downloading && !queued && recent {
+		delete(d.recent, cid)
+	}
+	d.dlk.Unlock()
+
+	if downloading || queued {
+		return errJobActive
+	}
+	if !recent {
+		return errJobNotFound
+	}
+
+	asset := *status.asset
+	log.Infof("admin: requeue %s", cid)
+	go d.dispatch([]*model.Asset{&asset})
+	return nil
+}
+
+// waitResumed blocks while the downloader is paused, a handover ends the pause
+func (d *Downloader) waitResumed() {
+	for d.paused.Load() && !d.draining.Load() {
+		time.Sleep(time.Second)
+	}
+}
+
+// serveAdmin serves the admin api on listen. Observers read, operators also change the queue and the worker pool.
+// /inventory and /archive serve the whole archive to the secondary instances replicating it.
+func serveAdmin(listen string, d *Downloader) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /v1/jobs", authorize(roleObserver, d.handleJobs))
+	mux.Handle("GET /v1/jobs/{cid}", authorize(roleObserver, d.handleJob))
+	mux.Handle("POST /v1/jobs/{cid}/cancel", authorize(roleOperator, d.handleCancel))
+	mux.Handle("POST /v1/jobs/{cid}/requeue", authorize(roleOperator, d.handleRequeue))
+	mux.Handle("POST /v1/pause", authorize(roleOperator, d.handlePause))
+	mux.Handle("POST /v1/resume", authorize(roleOperator, d.handleResume))
+	mux.Handle("GET /v1/concurrency", authorize(roleObserver, d.handleConcurrency))
+	mux.Handle("PUT /v1/concurrency", authorize(roleOperator, d.handleSetConcurrency))
+	mux.Handle("POST /v1/upgrade", authorize(roleOperator, d.handleUpgrade))
+	mux.Handle("GET /v1/config", authorize(roleObserver, handleConfig))
+	mux.Handle("POST /v1/prune", authorize(roleOperator, d.handlePrune))
+	mux.Handle("POST /v1/restore/{cid}", authorize(roleOperator, d.handleRestore))
+	mux.Handle("GET /inventory", authorize(roleObserver, handleInventory))
+	mux.Handle("GET /archive/{dir}/{file}", authorize(roleObserver, handleArchive))
+
+	log.Infof("serve admin api on %s", listen)
+	if err := serveControlHTTP(listen, mux); err != nil {
+		log.Errorf("serve admin api: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJobError maps the errors of the job and archive operations to status codes
+func writeJobError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errJobNotFound), errors.Is(err, errNotArchived):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errJobActive), errors.Is(err, errRetentionDisabled):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleJobs lists the jobs, ?state= filters them
+func (d *Downloader) handleJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := d.jobs()
+	if state := r.URL.Query().Get("state"); state != "" {
+		jobs = slices.DeleteFunc(jobs, func(j *JobStatus) bool { return j.State != state })
+	}
+	writeJSON(w, jobs)
+}
+
+func (d *Downloader) handleJob(w http.ResponseWriter, r *http.Request) {
+	status, err := d.job(r.PathValue("cid"))
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func (d *Downloader) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if err := d.cancelJob(r.PathValue("cid")); err != nil {
+		writeJobError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (d *Downloader) handleRequeue(w http.ResponseWriter, r *http.Request) {
+	if err := d.requeue(r.PathValue("cid")); err != nil {
+		writeJobError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlePause stops polling for jobs and starting queued ones, the running downloads go on
+func (d *Downloader) handlePause(w http.ResponseWriter, r *http.Request) {
+	d.paused.Store(true)
+	log.Infof("admin: paused")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Downloader) handleResume(w http.ResponseWriter, r *http.Request) {
+	d.paused.Store(false)
+	log.Infof("admin: resumed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Concurrency is the worker pool as reported and set by the admin api
+type Concurrency struct {
+	Concurrent int  `json:"concurrent"`
+	Running    int  `json:"running"`
+	Queued     int  `json:"queued"`
+	Paused     bool `json:"paused"`
+}
+
+func (d *Downloader) concurrency() *Concurrency {
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	return &Concurrency{Concurrent: d.concurrent, Running: len(d.downloading), Queued: len(d.queued), Paused: d.paused.Load()}
+}
+
+func (d *Downloader) handleConcurrency(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, d.concurrency())
+}
+
+// handleSetConcurrency resizes the worker pool to the concurrent field of the body
+func (d *Downloader) handleSetConcurrency(w http.ResponseWriter, r *http.Request) {
+	var c Concurrency
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := d.setConcurrency(c.Concurrent); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.handleConcurrency(w, r)
+}
+
+// handlePrune applies the retention policy once, ?dry_run=true reports what would be deleted
+func (d *Downloader) handlePrune(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	report, err := d.prune(dryRun)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// handleRestore publishes the archived CAR of the cid to the Titan network again, ?user= sets the user the asset is
+// created for, titan_user when missing
+func (d *Downloader) handleRestore(w http.ResponseWriter, r *http.Request) {
+	userID, err := restoreUser(r.URL.Query().Get("user"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := d.restoreOne(r.Context(), r.PathValue("cid"), userID)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// handleUpgrade hands over to the binary at the path of the running one, as SIGHUP does
+func (d *Downloader) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if d.upgrading.Load() {
+		http.Error(w, errUpgradeRunning.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	go func() {
+		if err := d.upgrade(); err != nil {
+			log.Errorf("upgrade: %v", err)
+		}
+	}()
+}
+
+// handleConfig lists the flags in effect, the values of credentials are redacted
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlag(f.Name) && value != "" {
+			value = "<redacted>"
+		}
+		config[f.Name] = value
+	})
+	writeJSON(w, config)
+}
+
+// secretFlag reports whether the flag holds a credential
+func secretFlag(name string) bool {
+	for _, s := range []string{"token", "password", "secret", "key", "wallet"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
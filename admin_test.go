@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testAdminDownloader is a downloader with a running download, a queued asset and a failed job
+func testAdminDownloader() (*Downloader, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Downloader{
+		concurrent:  2,
+		downloading: map[string]*runningJob{"running": {asset: &model.Asset{Cid: "running", TotalSize: 10}, startedAt: time.Now(), cancel: cancel}},
+		queued:      map[string]*model.Asset{"queued": {Cid: "queued", TotalSize: 20}},
+		recent:      map[string]*JobStatus{"failed": {Cid: "failed", State: jobFailed, Error: "boom", asset: &model.Asset{Cid: "failed"}}},
+	}
+	return d, ctx
+}
+
+// adminRequest serves a request with the admin routes, without the authorization in front of them
+func adminRequest(d *Downloader, method, target string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/jobs", d.handleJobs)
+	mux.HandleFunc("GET /v1/jobs/{cid}", d.handleJob)
+	mux.HandleFunc("POST /v1/jobs/{cid}/cancel", d.handleCancel)
+	mux.HandleFunc("POST /v1/jobs/{cid}/requeue", d.handleRequeue)
+	mux.HandleFunc("POST /v1/pause", d.handlePause)
+	mux.HandleFunc("POST /v1/resume", d.handleResume)
+	mux.HandleFunc("GET /v1/concurrency", d.handleConcurrency)
+	mux.HandleFunc("POST /v1/restore/{cid}", d.handleRestore)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func TestAdminJobs(t *testing.T) {
+	d, _ := testAdminDownloader()
+
+	var jobs []*JobStatus
+	if err := json.NewDecoder(adminRequest(d, http.MethodGet, "/v1/jobs").Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 3 {
+		t.Fatalf("listed %d jobs, want 3", len(jobs))
+	}
+
+	jobs = nil
+	if err := json.NewDecoder(adminRequest(d, http.MethodGet, "/v1/jobs?state=failed").Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Cid != "failed" || jobs[0].Error != "boom" {
+		t.Fatalf("failed jobs %+v", jobs)
+	}
+
+	var status JobStatus
+	if err := json.NewDecoder(adminRequest(d, http.MethodGet, "/v1/jobs/queued").Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.State != jobQueued || status.Size != 20 {
+		t.Fatalf("queued job %+v", status)
+	}
+
+	if code := adminRequest(d, http.MethodGet, "/v1/jobs/unknown").Code; code != http.StatusNotFound {
+		t.Fatalf("unknown job: status %d, want 404", code)
+	}
+}
+
+func TestAdminCancel(t *testing.T) {
+	d, ctx := testAdminDownloader()
+
+	if code := adminRequest(d, http.MethodPost, "/v1/jobs/running/cancel").Code; code != http.StatusAccepted {
+		t.Fatalf("cancel running: status %d, want 202", code)
+	}
+	if ctx.Err() == nil || !d.downloading["running"].cancelled {
+		t.Fatal("the running download wasn't cancelled")
+	}
+
+	if code := adminRequest(d, http.MethodPost, "/v1/jobs/queued/cancel").Code; code != http.StatusAccepted {
+		t.Fatalf("cancel queued: status %d, want 202", code)
+	}
+	if _, ok := d.queued["queued"]; ok {
+		t.Fatal("the cancelled asset is still queued")
+	}
+	if s := d.recent["queued"]; s == nil || s.State != jobCancelled {
+		t.Fatalf("cancelled job %+v", s)
+	}
+
+	if code := adminRequest(d, http.MethodPost, "/v1/jobs/unknown/cancel").Code; code != http.StatusNotFound {
+		t.Fatalf("cancel unknown: status %d, want 404", code)
+	}
+}
+
+func TestAdminRequeueActive(t *testing.T) {
+	d, _ := testAdminDownloader()
+
+	for _, cid := range []string{"running", "queued"} {
+		if code := adminRequest(d, http.MethodPost, "/v1/jobs/"+cid+"/requeue").Code; code != http.StatusConflict {
+			t.Errorf("requeue %s: status %d, want 409", cid, code)
+		}
+	}
+	if code := adminRequest(d, http.MethodPost, "/v1/jobs/unknown/requeue").Code; code != http.StatusNotFound {
+		t.Errorf("requeue unknown: status %d, want 404", code)
+	}
+	if _, ok := d.recent["failed"]; !ok {
+		t.Error("a rejected requeue dropped a recent job")
+	}
+}
+
+func TestAdminPause(t *testing.T) {
+	d, _ := testAdminDownloader()
+
+	if code := adminRequest(d, http.MethodPost, "/v1/pause").Code; code != http.StatusNoContent {
+		t.Fatalf("pause: status %d, want 204", code)
+	}
+	var c Concurrency
+	if err := json.NewDecoder(adminRequest(d, http.MethodGet, "/v1/concurrency").Body).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+	if c != (Concurrency{Concurrent: 2, Running: 1, Queued: 1, Paused: true}) {
+		t.Fatalf("concurrency %+v", c)
+	}
+
+	if code := adminRequest(d, http.MethodPost, "/v1/resume").Code; code != http.StatusNoContent {
+		t.Fatalf("resume: status %d, want 204", code)
+	}
+	if d.paused.Load() {
+		t.Fatal("still paused after resume")
+	}
+}
+
+func TestAdminRestoreWithoutUser(t *testing.T) {
+	d, _ := testAdminDownloader()
+
+	// the etcd user must not stand in for the Titan user
+	u := user
+	user = "etcd"
+	defer func() { user = u }()
+
+	if code := adminRequest(d, http.MethodPost, "/v1/restore/running").Code; code != http.StatusBadRequest {
+		t.Fatalf("restore without a user: status %d, want 400", code)
+	}
+}
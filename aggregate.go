@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	aggregateSuffix = ".agg"
+	// aggregateIndexSuffix is the offset index written next to an aggregate
+	aggregateIndexSuffix = ".idx"
+)
+
+var (
+	// compactMaxSize is the size up to which stored CARs are packed into aggregates
+	compactMaxSize int64 = 1 << 20
+	// aggregateSize is the size an aggregate is filled up to
+	aggregateSize int64 = 4 << 30
+	// compactInterval is the period the backup directories are compacted in, 0 disables the compactor
+	compactInterval time.Duration
+	// compactMinAge is the age of the backup directories compacted, the directories still written are left alone
+	compactMinAge = 48 * time.Hour
+)
+
+// AggregateEntry locates a CAR in an aggregate, the index of an aggregate is a json line per CAR
+type AggregateEntry struct {
+	Cid    string   `json:"cid"`
+	Offset int64    `json:"offset"`
+	Size   int64    `json:"size"`
+	SHA256 string   `json:"sha256"`
+	Meta   *DAGMeta `json:"meta,omitempty"`
+}
+
+// aggregated reports whether the CAR is packed into an aggregate rather than stored in its own file
+func (s *StoredCAR) aggregated() bool {
+	return s.Aggregate != ""
+}
+
+func (s *StoredCAR) aggregatePath() string {
+	return filepath.Join(s.Dir, s.Aggregate)
+}
+
+// openAggregated opens the section of the aggregate holding the CAR s, closing the file releases it
+func openAggregated(s *StoredCAR) (*os.File, *io.SectionReader, error) {
+	f, err := os.Open(s.aggregatePath())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if st.Size() < s.Offset+s.Size {
+		f.Close()
+		return nil, nil, errors.Errorf("aggregate %s of %d bytes can't hold %s at %d", s.aggregatePath(), st.Size(), s.Cid, s.Offset)
+	}
+	return f, io.NewSectionReader(f, s.Offset, s.Size), nil
+}
+
+// verifyAggregated checks the CAR packed into an aggregate against the checksum of its manifest entry
+func verifyAggregated(s *StoredCAR) error {
+	f, section, err := openAggregated(s)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, section); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != s.SHA256 {
+		return errors.Wrapf(ErrChecksumMismatch, "recorded %s, computed %s", s.SHA256, sum)
+	}
+	return nil
+}
+
+// extractAggregated copies the CAR packed into an aggregate to tmpDir and verifies it, cleanup removes the copy
+func extractAggregated(s *StoredCAR, tmpDir string) (*StoredCAR, func(), error) {
+	f, section, err := openAggregated(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	entry := *s.ManifestEntry
+	entry.Aggregate, entry.Offset = "", 0
+	out := &StoredCAR{Dir: tmpDir, ManifestEntry: &entry}
+	cleanup := func() { os.Remove(out.Path()) }
+
+	sum, err := copyFile(out.Path(), section)
+	if err == nil && sum != s.SHA256 {
+		err = errors.Wrapf(ErrChecksumMismatch, "recorded %s, computed %s", s.SHA256, sum)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return out, cleanup, nil
+}
+
+// readAggregateIndex reads the offset index of the aggregate at path
+func readAggregateIndex(path string) (map[string]*AggregateEntry, error) {
+	f, err := os.Open(path + aggregateIndexSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(map[string]*AggregateEntry)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var entry AggregateEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		out[entry.Cid] = &entry
+	}
+	return out, scanner.Err()
+}
+
+// readAggregatedMeta returns the descriptor of a packed CAR, kept in the aggregate index as its sidecar is gone
+func readAggregatedMeta(s *StoredCAR) (*DAGMeta, error) {
+	entries, err := readAggregateIndex(s.aggregatePath())
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := entries[s.Cid]; ok && e.Meta != nil {
+		return e.Meta, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// pruneAggregate removes the aggregate of dir once none of its CARs is left in the manifest, returning the bytes
+// reclaimed
+func pruneAggregate(dir, name string) (int64, error) {
+	entries, err := readManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if e.Aggregate == name {
+			return 0, nil
+		}
+	}
+
+	path := filepath.Join(dir, name)
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	os.Remove(path + aggregateIndexSuffix)
+	return st.Size(), os.Remove(path)
+}
+
+// compactReport sums up a compaction
+type compactReport struct {
+	CARs       int
+	Aggregates int
+	// Delta is the change of the size of every directory compacted
+	Delta map[string]int64
+}
+
+// compactable returns the CARs of dir to pack: verified, complete, small and no base of a delta CAR
+func compactable(dir string, bases map[string]struct{}) ([]*StoredCAR, error) {
+	entries, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*StoredCAR
+	for _, e := range entries {
+		s := &StoredCAR{Dir: dir, ManifestEntry: e}
+		if s.aggregated() || len(e.Base) > 0 || e.SHA256 == "" || e.Size > compactMaxSize {
+			continue
+		}
+		if _, ok := bases[e.Cid]; ok {
+			continue
+		}
+		if err := verifyStored(s); err != nil {
+			log.Warnf("compact: skip %s: %v", s.Path(), err)
+			continue
+		}
+		out = append(out, s)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Cid < out[j].Cid })
+	return out, nil
+}
+
+// writeAggregate packs the CARs into a new aggregate of dir, records them in the manifest as packed and removes
+// their files. It returns the change of the size of dir.
+func writeAggregate(dir string, cars []*StoredCAR) (int64, error) {
+	name := fmt.Sprintf("aggregate-%d%s", time.Now().UnixNano(), aggregateSuffix)
+	path := filepath.Join(dir, name)
+	partPath := stagingPath(path)
+
+	f, err := os.Create(partPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(partPath)
+
+	var index []*AggregateEntry
+	var offset int64
+	for _, s := range cars {
+		car, err := os.Open(s.Path())
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(f, h), car)
+		car.Close()
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+
+		// the CAR was verified, a mismatch now is a change under our feet
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != s.SHA256 || n != s.Size {
+			f.Close()
+			return 0, errors.Wrapf(ErrChecksumMismatch, "%s changed while packed", s.Path())
+		}
+
+		entry := &AggregateEntry{Cid: s.Cid, Offset: offset, Size: n, SHA256: s.SHA256}
+		entry.Meta, _ = readMeta(s.Path())
+		index = append(index, entry)
+		offset += n
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := writeAggregateIndex(path, index); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		return 0, err
+	}
+	if err := syncDir(dir); err != nil {
+		return 0, err
+	}
+
+	delta := offset
+	for i, s := range cars {
+		entry := *s.ManifestEntry
+		entry.Aggregate, entry.Offset = name, index[i].Offset
+		if err := appendManifest(dir, &entry); err != nil {
+			return delta, err
+		}
+
+		for _, suffix := range append([]string{""}, sidecarSuffixes...) {
+			if st, err := os.Stat(s.Path() + suffix); err == nil && os.Remove(s.Path()+suffix) == nil {
+				delta -= st.Size()
+			}
+		}
+	}
+	return delta, nil
+}
+
+func writeAggregateIndex(path string, index []*AggregateEntry) error {
+	idxPath := path + aggregateIndexSuffix
+	f, err := os.Create(stagingPath(idxPath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stagingPath(idxPath))
+
+	enc := json.NewEncoder(f)
+	for _, entry := range index {
+		if err := enc.Encode(entry); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(stagingPath(idxPath), idxPath)
+}
+
+// compact packs the small CARs of the backup directories older than minAge into aggregates of aggregateSize
+func compact(now time.Time, minAge time.Duration, dryRun bool) (*compactReport, error) {
+	report := &compactReport{Delta: make(map[string]int64)}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// delta CARs are materialized from the files of their bases
+	bases := make(map[string]struct{})
+	dirs := make(map[string]struct{})
+	for _, s := range stored {
+		for _, base := range s.Base {
+			bases[base] = struct{}{}
+		}
+		if date, err := dirDate(s.Dir); err == nil && now.Sub(date) >= minAge {
+			dirs[s.Dir] = struct{}{}
+		}
+	}
+
+	for dir := range dirs {
+		cars, err := compactable(dir, bases)
+		if err != nil {
+			return report, err
+		}
+		if len(cars) < 2 {
+			continue
+		}
+
+		for len(cars) > 0 {
+			var n int
+			var size int64
+			for n < len(cars) && (n == 0 || size+cars[n].Size <= aggregateSize) {
+				size += cars[n].Size
+				n++
+			}
+			group := cars[:n]
+			cars = cars[n:]
+
+			if len(group) < 2 {
+				continue
+			}
+			report.CARs += len(group)
+			report.Aggregates++
+			if dryRun {
+				continue
+			}
+
+			delta, err := writeAggregate(dir, group)
+			report.Delta[dir] += delta
+			if err != nil {
+				return report, errors.Wrapf(err, "compact %s", dir)
+			}
+			log.Infof("compact: packed %d CARs of %s into an aggregate of %s", len(group), dir, units.BytesSize(float64(size)))
+		}
+	}
+	return report, nil
+}
+
+// compactor compacts the backup directories every compactInterval
+func (d *Downloader) compactor() {
+	for {
+		time.Sleep(compactInterval)
+
+		report, err := compact(time.Now(), compactMinAge, false)
+		if err != nil {
+			log.Errorf("compact: %v", err)
+		}
+		if report == nil {
+			continue
+		}
+
+		for dir, delta := range report.Delta {
+			d.dirSize.add(dir, delta)
+		}
+		carsCompacted.Add(int64(report.CARs))
+	}
+}
+
+// compactCmd packs the small CARs into aggregates once
+func compactCmd(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report the CARs which would be packed without packing them")
+	minAge := fs.Duration("min-age", compactMinAge, "compact only backup directories of days older than this")
+	fs.Int64Var(&compactMaxSize, "max-car-size", compactMaxSize, "pack CARs up to this size")
+	fs.Int64Var(&aggregateSize, "aggregate-size", aggregateSize, "fill aggregates up to this size")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := compact(time.Now(), *minAge, *dryRun)
+	if report != nil {
+		fmt.Fprintf(os.Stderr, "%d CARs packed into %d aggregates\n", report.CARs, report.Aggregates)
+	}
+	return err
+}
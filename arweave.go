@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"github.com/pkg/errors"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// arweaveWallet enables archiving the assets selected by the policy permanently on Arweave, through irys
+	arweaveWallet string
+	// arweaveMaxSize is the size up to which assets are archived on Arweave
+	arweaveMaxSize int64 = 10 << 20
+	// arweaveTypes restricts the archived assets to the given asset types, comma separated, every type when empty
+	arweaveTypes string
+	irysBin      = "irys"
+	irysNetwork  = "mainnet"
+	// arweaveGateway serves the CARs uploaded to Arweave by transaction id
+	arweaveGateway = "https://arweave.net"
+)
+
+// UploadArweave is the target of the uploads to Arweave
+const UploadArweave = "arweave"
+
+var irysUploaded = regexp.MustCompile(`Uploaded to \S*/([A-Za-z0-9_-]{43})`)
+
+// arweavePolicy reports whether the asset is small and valuable enough to be archived permanently
+func arweavePolicy(asset *model.Asset) bool {
+	if arweaveWallet == "" || asset.TotalSize > arweaveMaxSize {
+		return false
+	}
+	return arweaveTypes == "" || strings.Contains(","+arweaveTypes+",", ","+asset.Type+",")
+}
+
+// uploadArweave uploads the stored CAR through the irys client and records the transaction id
+func uploadArweave(ctx context.Context, s *StoredCAR) error {
+	full, cleanup, err := completeCAR(s, os.TempDir())
+	if err != nil {
+		return errors.Wrap(err, "materialize delta CAR")
+	}
+	defer cleanup()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, irysBin, "upload", full.Path(),
+		"-n", irysNetwork,
+		"-t", "arweave",
+		"-w", arweaveWallet,
+		"--tags", "Content-Type", "application/vnd.ipld.car", "Root-CID", s.Cid,
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "irys upload: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	m := irysUploaded.FindSubmatch(stdout.Bytes())
+	if m == nil {
+		return errors.Errorf("irys upload: no transaction id in output %q", stdout.String())
+	}
+
+	return recordUpload(s, &Upload{Target: UploadArweave, IDs: []string{string(m[1])}, UploadedAt: time.Now()})
+}
+
+// arweaveUploadCmd archives the given CARs on Arweave regardless of the policy
+func arweaveUploadCmd(args []string) error {
+	fs := flag.NewFlagSet("arweave-upload", flag.ExitOnError)
+	force := fs.Bool("force", false, "upload CARs already uploaded again")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if arweaveWallet == "" || fs.NArg() == 0 {
+		return errors.New("usage: --arweave_wallet <wallet> arweave-upload [-force] <cid>...")
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return err
+	}
+
+	selected, err := selectStored(stored, "", fs.Args())
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var failed int
+	for i, s := range selected {
+		if s.uploaded(UploadArweave) && !*force {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "upload %d/%d: %s\n", i+1, len(selected), s.Cid)
+
+		result := &exportResult{Cid: s.Cid, Path: s.Path()}
+		if err := uploadArweave(context.Background(), s); err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		enc.Encode(result)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uploads failed", failed, len(selected))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+var awsClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchAWSSecret fetches the secret id from AWS Secrets Manager. With a field the secret string is a json object the
+// field is taken from. The credentials are read from the standard AWS_* environment variables.
+func fetchAWSSecret(id, field string) (string, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("no aws credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if awsRegion == "" {
+		return "", fmt.Errorf("no aws region, set AWS_REGION or aws_region")
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+
+	host := fmt.Sprintf("secretsmanager.%s.amazonaws.com", awsRegion)
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if session := os.Getenv("AWS_SESSION_TOKEN"); session != "" {
+		req.Header.Set("X-Amz-Security-Token", session)
+	}
+	signV4(req, body, host, "secretsmanager", accessKey, secretKey, time.Now())
+
+	resp, err := awsClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return "", fmt.Errorf("aws secret %s: status %d: %s", id, resp.StatusCode, msg)
+	}
+
+	var ret struct {
+		SecretString string
+		SecretBinary string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return "", err
+	}
+
+	value := ret.SecretString
+	if value == "" && ret.SecretBinary != "" {
+		data, err := base64.StdEncoding.DecodeString(ret.SecretBinary)
+		if err != nil {
+			return "", err
+		}
+		value = string(data)
+	}
+
+	if field == "" {
+		return value, nil
+	}
+
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("aws secret %s is not a json object: %w", id, err)
+	}
+	v, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("aws secret %s has no field %s", id, field)
+	}
+	return v, nil
+}
@@ -1,24 +1,28 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/Filecoin-Titan/titan/api"
 	"github.com/Filecoin-Titan/titan/api/types"
 	"github.com/docker/go-units"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
 	"github.com/gnasnik/titan-explorer/core/generated/model"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/pkg/errors"
-	"github.com/quic-go/quic-go/http3"
 	"go.etcd.io/etcd/client/pkg/v3/fileutil"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,28 +35,203 @@ const (
 
 	BackupResult = "/v1/storage/backup_result"
 	BackupAssets = "/v1/storage/backup_assets"
+
+	BackupVerification = "/v1/storage/backup_verification"
+	RestoreResult      = "/v1/storage/restore_result"
+)
+
+// SkippedEventID reports a job the node doesn't take, it's neither backed up nor failed
+const SkippedEventID = 98
+
+// partSuffix marks a CAR file still being downloaded or verified
+const partSuffix = ".part"
+
+// sidecarSuffixes mark the files stored next to a CAR, which move and go with it
+var sidecarSuffixes = []string{checksumSuffix, indexSuffix, paritySuffix, metaSuffix}
+
+var (
+	// replicationFriendly keeps partial files out of the backup tree, so rsync or zfs send never copy them
+	replicationFriendly bool
+	// stagingDir holds the partial files of a replication friendly tree, it must be on the filesystem of the tree
+	stagingDir = filepath.Join(filepath.Dir(BackupOutPath), ".titan-backup-staging")
 )
 
+// stagingPath is where the file at path is written before it's renamed into place
+func stagingPath(path string) string {
+	if !replicationFriendly {
+		return path + partSuffix
+	}
+	return filepath.Join(stagingDirOf(rootOf(filepath.Dir(path))), filepath.Base(filepath.Dir(path))+"-"+filepath.Base(path)+partSuffix)
+}
+
+// AllAreas is the area id that makes the downloader back up the assets of every discovered area.
+const AllAreas = "all"
+
 var log = logging.Logger("backup")
 
+var (
+	ErrCARFileNotFound  = errors.New("CARFile not found")
+	ErrSchedulerTimeout = errors.New("scheduler rpc timeout")
+	ErrTruncated        = errors.New("truncated transfer")
+)
+
 var backupInterval = time.Second * 60
 
+// durable fsyncs the CAR, its checksum, the manifest and their directory before success is reported, so a power loss
+// can't lose a backup which was already reported
+var durable bool
+
+// storeCAR moves the verified CAR at partPath into outPath with its sidecars and records the entry in the manifest
+func (d *Downloader) storeCAR(outPath, partPath string, entry *ManifestEntry) error {
+	carPath := filepath.Join(outPath, entry.Cid+".car")
+	if extraRoots != "" {
+		entry.Volume = rootOf(outPath)
+	}
+
+	if err := writeChecksum(carPath, entry.SHA256); err != nil {
+		os.Remove(partPath)
+		return errors.Wrap(err, "write checksum")
+	}
+
+	if err := os.Rename(partPath, carPath); err != nil {
+		return err
+	}
+
+	// the index can be regenerated from the CAR, don't fail the backup for it
+	if err := writeIndex(carPath); err != nil {
+		log.Errorf("write index of %s: %v", carPath, err)
+	}
+
+	if parityPercent > 0 {
+		if err := writeParity(carPath); err != nil {
+			log.Errorf("write parity of %s: %v", carPath, err)
+		}
+	}
+
+	// a delta CAR lacks the blocks of its bases, its descriptor would be partial
+	if len(entry.Base) == 0 {
+		if err := writeMeta(carPath, entry.Cid); err != nil {
+			log.Errorf("write descriptor of %s: %v", carPath, err)
+		}
+	}
+
+	// the sidecars take space too, a normalized or compressed CAR differs from the size of the job
+	d.dirSize.add(outPath, storedSize(carPath))
+
+	entry.BackupTime = time.Now()
+	if err := appendManifest(outPath, entry); err != nil {
+		return errors.Wrap(err, "append manifest")
+	}
+
+	// a delta CAR isn't a complete DAG the gateways could serve, the w3s-upload command materializes it
+	if w3sToken != "" && len(entry.Base) == 0 {
+		// the backup is complete without the upload, the w3s-upload command retries it
+		if err := uploadW3S(context.Background(), &StoredCAR{Dir: outPath, ManifestEntry: entry}); err != nil {
+			log.Errorf("upload %s to w3s: %v", entry.Cid, err)
+		}
+	}
+
+	// the gateway locates blocks through the index too
+	if incremental || gatewayListen != "" {
+		if err := d.blocks.add(&StoredCAR{Dir: outPath, ManifestEntry: entry}); err != nil {
+			log.Errorf("add %s to the block index: %v", carPath, err)
+		}
+	}
+
+	// the renamed CAR and a newly created manifest are only durable once the directory is synced
+	if durable {
+		if err := syncDir(outPath); err != nil {
+			return errors.Wrap(err, "sync directory")
+		}
+	}
+
+	if reportVerification {
+		report := &VerificationReport{
+			Cid:        entry.Cid,
+			SHA256:     entry.SHA256,
+			PieceCID:   entry.PieceCID,
+			PieceSize:  entry.PieceSize,
+			Verified:   true,
+			VerifiedAt: entry.BackupTime,
+		}
+		if err := pushVerification(d.token, []*VerificationReport{report}); err != nil {
+			log.Errorf("push verification of %s: %v", entry.Cid, err)
+		}
+	}
+
+	return nil
+}
+
+// storedSize sums the sizes of the CAR at path and its sidecars
+func storedSize(path string) int64 {
+	var size int64
+	for _, suffix := range append([]string{""}, sidecarSuffixes...) {
+		if st, err := os.Stat(path + suffix); err == nil {
+			size += st.Size()
+		}
+	}
+	return size
+}
+
+// reportVerification submits a VerificationReport for every verified download and scrubbed CAR
+var reportVerification bool
+
+// schedulerTimeout bounds every scheduler rpc call so a hung scheduler can't block a worker forever
+var schedulerTimeout = time.Second * 30
+
 type Downloader struct {
-	lk         sync.Mutex
+	lk sync.Mutex
+
+	slk        sync.RWMutex
 	schedulers []*Scheduler
 
 	JobQueue chan *model.Asset
-	dirSize  map[string]int64
-	token    string
-	areaId   string
-	running  bool
-
-	etcdClient *EtcdClient
-
+	// largeQueue feeds the large slots
+	largeQueue chan *model.Asset
+	dirSize    *dirSizes
+	token      string
+	areaId     string
+	running    bool
+
+	registry *SchedulerRegistry
+
+	rlk sync.Mutex
+	// round-robin offset of the schedulers of each area
+	roundRobin map[string]int
+	infoCache  *downloadInfoCache
+	// blocks locates archived blocks for incremental downloads
+	blocks *blockIndex
+
+	// concurrent is the size of the worker pool, guarded by dlk once running
 	concurrent      int
 	downWorkerQueue chan worker
-	dlk             sync.Mutex
-	downloading     map[string]struct{}
+	// retiring are the busy workers leaving the pool after their job, guarded by dlk
+	retiring   int
+	nextWorker int
+	dlk        sync.Mutex
+	// downloading are the running downloads, queued the assets admitted but not started yet, both guarded by dlk
+	downloading map[string]*runningJob
+	queued      map[string]*model.Asset
+	// recent are the last finished jobs by cid, guarded by dlk
+	recent map[string]*JobStatus
+	events jobEvents
+	// draining stops starting jobs for a handover to a new binary
+	draining atomic.Bool
+	// upgrading is set while a handover runs, so SIGHUP and the admin api don't start a second one
+	upgrading atomic.Bool
+	// paused stops polling for jobs and starting queued ones
+	paused atomic.Bool
+	// reserved is the space claimed by the running downloads, guarded by dlk
+	reserved int64
+	// writes counts the running downloads of every output root, guarded by dlk
+	writes map[string]int
+
+	// parent is the downloader of the flags for the downloader of a tenant, tenants the downloaders of the tenants
+	// for the parent
+	parent      *Downloader
+	tenants     []*Downloader
+	tenant      string
+	tenantQuota int64
 }
 
 type job func()
@@ -62,27 +241,37 @@ type worker struct {
 	jobQueue chan job
 }
 
-func newDownloader(token string, areaId string, client *EtcdClient, concurrent int) *Downloader {
-	schedulers, err := FetchSchedulersFromEtcd(client)
+func newDownloader(token string, areaId string, registry *SchedulerRegistry, concurrent int) *Downloader {
+	schedulers, err := FetchSchedulers(registry, areaId)
 	if err != nil {
-		log.Fatalf("fetch scheduler from etcd Failed: %v", err)
+		log.Fatalf("fetch scheduler Failed: %v", err)
 	}
 
 	if len(schedulers) == 0 {
+		available := registry.areaIds()
+		if !isAllAreas(areaId) && len(available) > 0 {
+			log.Fatalf("no scheduler found for area %s, available area ids: %s", areaId, strings.Join(available, ", "))
+		}
 		log.Fatal("no scheduler found")
 	}
 
 	return &Downloader{
 		JobQueue:   make(chan *model.Asset, 1),
-		dirSize:    make(map[string]int64),
+		largeQueue: make(chan *model.Asset, 1),
+		dirSize:    loadDirSizes(),
 		schedulers: schedulers,
 		areaId:     areaId,
 		token:      token,
-		etcdClient: client,
+		registry:   registry,
+		roundRobin: make(map[string]int),
+		infoCache:  newDownloadInfoCache(),
+		blocks:     newBlockIndex(),
 
-		downWorkerQueue: make(chan worker, concurrent),
+		downWorkerQueue: make(chan worker, max(concurrent, maxConcurrent)),
 		concurrent:      concurrent,
-		downloading:     make(map[string]struct{}),
+		downloading:     make(map[string]*runningJob),
+		queued:          make(map[string]*model.Asset),
+		recent:          make(map[string]*JobStatus),
 	}
 }
 
@@ -90,47 +279,222 @@ func (d *Downloader) Push(jobs []*model.Asset) {
 	//d.lk.Lock()
 	//defer d.lk.Unlock()
 
+	var admitted []*model.Asset
 	for _, j := range jobs {
-		d.JobQueue <- j
+		if d.admit(j) {
+			admitted = append(admitted, j)
+		}
 	}
+	d.dispatch(admitted)
 
 	d.running = false
 }
 
-func (d *Downloader) create(ctx context.Context, job *model.Asset) (*model.Asset, error) {
+func (d *Downloader) create(ctx context.Context, job *model.Asset) (*AssetResult, error) {
 	dir := job.EndTime.Format(dirDateTimeFormat)
 
-	outPath, err := d.getOutPath(dir)
+	root := d.pickRoot()
+	defer d.endWrite(root)
+
+	outPath, err := d.getOutPath(dir, root)
 	if err != nil {
 		return nil, err
 	}
 
-	var s *Scheduler
-
-	for _, sd := range d.schedulers {
-		if sd.AreaId == d.areaId {
-			s = sd
-			break
-		}
+	schedulers := d.pinScheduler(job.Cid, d.candidateSchedulers())
+	if len(schedulers) == 0 {
+		return nil, errors.New("no scheduler found")
 	}
 
-	if s == nil {
-		return nil, errors.New("no scheduler found")
+	var entry *ManifestEntry
+	for _, s := range schedulers {
+		entry, err = d.download(ctx, s, outPath, job)
+		// in all-areas mode the asset lives in exactly one area, try the next one
+		if errors.Is(err, ErrCARFileNotFound) {
+			continue
+		}
+		break
 	}
 
-	err = d.download(ctx, s, outPath, job.Cid, job.TotalSize)
 	if err != nil {
 		log.Errorf("download CARFile %s: %v", job.Cid, err)
 		job.Event = ErrorEventID
-		return job, err
+		return &AssetResult{Asset: job}, err
 	}
 
 	job.Path = outPath
-	return job, nil
+
+	if arweavePolicy(job) {
+		// permanent archiving is best effort, the backup is complete without it
+		if err := uploadArweave(ctx, &StoredCAR{Dir: outPath, ManifestEntry: entry}); err != nil {
+			log.Errorf("upload %s to arweave: %v", job.Cid, err)
+		}
+	}
+
+	result := &AssetResult{Asset: job, PieceCID: entry.PieceCID, PieceSize: entry.PieceSize}
+
+	// the CAR is kept, it matches the cid, but the metadata upstream has drifted
+	if err := checkAssetHash(job, &StoredCAR{Dir: outPath, ManifestEntry: entry}); errors.Is(err, ErrAssetHashMismatch) {
+		log.Warnf("asset %s: %v", job.Cid, err)
+		assetHashMismatches.Add(1)
+		result.Reason = ReasonHashMismatch
+	} else if err != nil {
+		log.Errorf("check hash of asset %s: %v", job.Cid, err)
+	}
+
+	return result, nil
 }
 
-func (d *Downloader) GetScheduler(areaId string) *Scheduler {
+// allAreas reports whether the downloader backs up the assets of every discovered area.
+func (d *Downloader) allAreas() bool {
+	return isAllAreas(d.areaId)
+}
+
+func isAllAreas(areaId string) bool {
+	return areaId == "" || areaId == AllAreas
+}
+
+// candidateSchedulers returns the schedulers an asset may be fetched from. In all-areas mode it returns one scheduler
+// of every discovered area, otherwise all schedulers of the configured area. The schedulers of an area are handed out
+// round-robin, so the rpc load is spread across them.
+func (d *Downloader) candidateSchedulers() []*Scheduler {
+	return d.schedulerCandidates(true)
+}
+
+// peekSchedulers returns the schedulers of candidateSchedulers without advancing the round-robin, the prefetch of the
+// sources doesn't take the turn of a worker
+func (d *Downloader) peekSchedulers() []*Scheduler {
+	return d.schedulerCandidates(false)
+}
+
+func (d *Downloader) schedulerCandidates(advance bool) []*Scheduler {
+	if !d.allAreas() {
+		return d.areaSchedulers(d.areaId, advance)
+	}
+
+	var out []*Scheduler
+	seen := make(map[string]struct{})
+	for _, s := range d.getSchedulers() {
+		if _, ok := seen[s.AreaId]; ok || !s.Usable() {
+			continue
+		}
+		seen[s.AreaId] = struct{}{}
+		if schedulers := d.areaSchedulers(s.AreaId, advance); len(schedulers) > 0 {
+			out = append(out, schedulers[0])
+		}
+	}
+	return out
+}
+
+// areaSchedulers returns the schedulers of the area, rotated by one on every call that advances the round-robin.
+func (d *Downloader) areaSchedulers(areaId string, advance bool) []*Scheduler {
+	var schedulers []*Scheduler
+	for _, s := range d.getSchedulers() {
+		if s.AreaId == areaId && s.Usable() {
+			schedulers = append(schedulers, s)
+		}
+	}
+
+	if len(schedulers) <= 1 {
+		return schedulers
+	}
+
+	d.rlk.Lock()
+	offset := d.roundRobin[areaId] % len(schedulers)
+	if advance {
+		d.roundRobin[areaId] = offset + 1
+	}
+	d.rlk.Unlock()
+
+	return append(schedulers[offset:], schedulers[:offset]...)
+}
+
+// pinScheduler moves the scheduler the sources of cid were prefetched from to the front of the schedulers, in place
+// of the scheduler of its area, so the worker finds the cached sources
+func (d *Downloader) pinScheduler(cid string, schedulers []*Scheduler) []*Scheduler {
+	uuid := d.infoCache.pinned(cid)
+	if uuid == "" {
+		return schedulers
+	}
+
+	var pinned *Scheduler
+	for _, s := range d.getSchedulers() {
+		if s.Uuid == uuid && s.Usable() {
+			pinned = s
+		}
+	}
+	if pinned == nil {
+		return schedulers
+	}
+
+	out := []*Scheduler{pinned}
+	for _, s := range schedulers {
+		if s.Uuid == uuid || (d.allAreas() && s.AreaId == pinned.AreaId) {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (d *Downloader) getSchedulers() []*Scheduler {
+	d.slk.RLock()
+	defer d.slk.RUnlock()
+	return d.schedulers
+}
+
+// refreshSchedulers reloads the schedulers from the discovery. Schedulers with an unchanged config keep their client,
+// the clients of removed or changed schedulers are closed.
+func (d *Downloader) refreshSchedulers() error {
+	schedulers, err := FetchSchedulers(d.registry, d.areaId)
+	if err != nil {
+		return err
+	}
+
+	d.slk.Lock()
+	defer d.slk.Unlock()
+
+	current := make(map[string]*Scheduler, len(d.schedulers))
 	for _, s := range d.schedulers {
+		current[s.Key] = s
+	}
+
+	for i, s := range schedulers {
+		old, ok := current[s.Key]
+		if !ok {
+			continue
+		}
+		delete(current, s.Key)
+
+		if old.sameConfig(s.cfg) {
+			schedulers[i] = old
+			continue
+		}
+		old.Close()
+	}
+
+	for _, s := range current {
+		log.Infof("scheduler %s removed, close client", s.Uuid)
+		s.Close()
+	}
+
+	d.schedulers = schedulers
+	return nil
+}
+
+// Close closes the clients of all schedulers
+func (d *Downloader) Close() {
+	for _, s := range d.getSchedulers() {
+		s.Close()
+	}
+
+	if err := d.dirSize.save(); err != nil {
+		log.Errorf("save %s: %v", dirSizeFile, err)
+	}
+}
+
+func (d *Downloader) GetScheduler(areaId string) *Scheduler {
+	for _, s := range d.getSchedulers() {
 		if s.AreaId == areaId {
 			return s
 		}
@@ -138,46 +502,288 @@ func (d *Downloader) GetScheduler(areaId string) *Scheduler {
 	return nil
 }
 
-func (d *Downloader) download(ctx context.Context, scheduler *Scheduler, outPath, cid string, size int64) error {
-	downloadInfos, err := scheduler.Api.GetAssetSourceDownloadInfo(ctx, cid)
+// getDownloadInfos returns the download sources of the cid, from the cache when a recent response exists.
+func (d *Downloader) getDownloadInfos(ctx context.Context, scheduler *Scheduler, cid string) (*types.AssetSourceDownloadInfoRsp, error) {
+	key := downloadInfoKey(scheduler, cid)
+	if downloadInfos := d.infoCache.get(key); downloadInfos != nil {
+		return downloadInfos, nil
+	}
+
+	schedulerApi, err := scheduler.client()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := schedulerLimits.wait(ctx, scheduler.Uuid); err != nil {
+		return nil, err
+	}
+
+	downloadInfos, err := getAssetSourceDownloadInfo(ctx, schedulerApi, cid)
+	if isAuthError(err) {
+		log.Warnf("scheduler %s rejected the access token, reload scheduler config: %v", scheduler.Uuid, err)
+		if rerr := scheduler.refreshAccessToken(d.registry); rerr != nil && scheduler.API() == schedulerApi {
+			log.Errorf("refresh access token: %v", rerr)
+			return nil, err
+		}
+		downloadInfos, err = getAssetSourceDownloadInfo(ctx, scheduler.API(), cid)
+	}
+	if isTransportError(err) {
+		if rerr := scheduler.reconnect(err); rerr != nil {
+			log.Errorf("reconnect scheduler: %v", rerr)
+			return nil, err
+		}
+		downloadInfos, err = getAssetSourceDownloadInfo(ctx, scheduler.API(), cid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scheduler.markHealthy()
+
+	if len(downloadInfos.SourceList) > 0 {
+		d.infoCache.put(key, downloadInfos)
+	}
+
+	return downloadInfos, nil
+}
+
+// download fetches the CAR of cid into outPath and records it in the manifest of outPath
+func (d *Downloader) download(ctx context.Context, scheduler *Scheduler, outPath string, job *model.Asset) (*ManifestEntry, error) {
+	cid, size := job.Cid, job.TotalSize
+
+	downloadInfos, err := d.getDownloadInfos(ctx, scheduler, cid)
 	if err != nil {
 		log.Errorf("GetAssetSourceDownloadInfo: %v", err)
-		return err
+		return nil, err
 	}
 
 	if len(downloadInfos.SourceList) == 0 {
-		return errors.New(fmt.Sprintf("CARFile %s not found", cid))
+		// the DAG may still be held by peers outside the area
+		if bitswapEnabled() {
+			entry, err := d.downloadBitswap(ctx, job, scheduler.AreaId, outPath, nil)
+			if err != nil || entry != nil {
+				return entry, err
+			}
+		}
+		return nil, errors.Wrapf(ErrCARFileNotFound, "area %s, cid %s", scheduler.AreaId, cid)
+	}
+
+	if incremental {
+		entry, err := d.downloadDelta(ctx, downloadInfos.SourceList, scheduler.AreaId, outPath, cid, size)
+		if err != nil || entry != nil {
+			return entry, err
+		}
 	}
 
 	start := time.Now()
 	hrs := units.BytesSize(float64(size))
 
+	carPath := filepath.Join(outPath, cid+".car")
+	partPath := stagingPath(carPath)
+
 	for _, downloadInfo := range downloadInfos.SourceList {
-		reader, err := request(downloadInfo.Address, cid, downloadInfo.Tk)
-		if err != nil {
-			log.Errorf("download requeset: %v", err)
+		var fetch func() (*fetchResult, error)
+		switch {
+		case isP2PAddr(downloadInfo.Address) && !graphsyncEnabled:
 			continue
+		case isP2PAddr(downloadInfo.Address):
+			fetch = func() (*fetchResult, error) {
+				return fetchGraphsync(ctx, downloadInfo.Address, cid, partPath, size)
+			}
+		default:
+			fetch = func() (*fetchResult, error) {
+				return fetchCAR(ctx, downloadInfo.Address, cid, downloadInfo.Tk, partPath, size)
+			}
 		}
 
-		file, err := os.Create(filepath.Join(outPath, cid+".car"))
+		fetched, err := fetch()
+		if errors.Is(err, ErrTruncated) {
+			// short transfers are mostly dropped connections, give the source another try over the same transport
+			log.Warnf("download from %s: %v, retry", downloadInfo.NodeID, err)
+			fetched, err = fetch()
+		}
 		if err != nil {
-			return err
+			log.Errorf("download from %s: %v", downloadInfo.NodeID, err)
+			os.Remove(partPath)
+			continue
 		}
 
-		_, err = io.Copy(file, reader)
+		entry, err := d.acceptCAR(job, scheduler.AreaId, outPath, partPath, downloadInfo.NodeID, fetched)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if entry == nil {
+			continue
 		}
 
-		d.lk.Lock()
-		d.dirSize[outPath] += size
-		d.lk.Unlock()
+		log.Infof("Successfully download CARFile %s, size: %s, piece: %s, cost: %v.\n", outPath, hrs, fetched.PieceCID, time.Since(start))
+		return entry, nil
+	}
 
-		log.Infof("Successfully download CARFile %s, size: %s, cost: %v.\n", outPath, hrs, time.Since(start))
-		return nil
+	// every source failed, the cached tokens may be stale
+	d.infoCache.remove(downloadInfoKey(scheduler, cid))
+
+	if bitswapEnabled() {
+		entry, err := d.downloadBitswap(ctx, job, scheduler.AreaId, outPath, downloadInfos.SourceList)
+		if err != nil || entry != nil {
+			return entry, err
+		}
 	}
 
-	return nil
+	return nil, errors.Errorf("download CARFile %s failed from all %d sources", cid, len(downloadInfos.SourceList))
+}
+
+// acceptCAR verifies the CAR of job downloaded from source into partPath and stores it into outPath. A CAR failing
+// verification returns a nil entry and no error, the caller moves on to the next source.
+func (d *Downloader) acceptCAR(job *model.Asset, areaId, outPath, partPath, source string, fetched *fetchResult) (*ManifestEntry, error) {
+	cid := job.Cid
+
+	downloadsUnverified.Add(1)
+	d.events.publish(&JobEvent{Cid: cid, State: jobVerifying, Size: fetched.Size})
+
+	if err := verifyCAR(partPath, cid); err != nil {
+		log.Errorf("verify CARFile %s from %s: %v", cid, source, err)
+		downloadsVerifyFailed.Add(1)
+		if qerr := quarantineDownload(partPath, cid, source, err); qerr != nil {
+			log.Errorf("quarantine CARFile %s: %v", cid, qerr)
+			os.Remove(partPath)
+		}
+		return nil, nil
+	}
+	downloadsVerified.Add(1)
+
+	normalized, err := normalizeCAR(partPath)
+	if err != nil {
+		log.Errorf("normalize CARFile %s from %s: %v", cid, source, err)
+		os.Remove(partPath)
+		return nil, nil
+	}
+	if normalized {
+		transport := fetched.Transport
+		if fetched, err = fileResult(partPath); err != nil {
+			os.Remove(partPath)
+			return nil, errors.Wrap(err, "digest normalized CAR")
+		}
+		fetched.Transport = transport
+	}
+
+	entry := &ManifestEntry{
+		Cid:        cid,
+		Size:       fetched.Size,
+		PieceCID:   fetched.PieceCID,
+		PieceSize:  fetched.PieceSize,
+		SHA256:     fetched.SHA256,
+		SourceNode: source,
+		Area:       areaId,
+		Transport:  fetched.Transport,
+	}
+	if err := d.storeCAR(outPath, partPath, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// fetchResult describes a CAR written by fetchCAR
+type fetchResult struct {
+	Size      int64
+	SHA256    string
+	PieceCID  string
+	PieceSize uint64
+	Transport string
+}
+
+// fetchCAR downloads the CAR of cid from the source node into path, computing its piece commitment on the way. A
+// transfer shorter than the response Content-Length or the asset size is reported as ErrTruncated.
+func fetchCAR(ctx context.Context, address, cid string, tk *types.Token, path string, size int64) (*fetchResult, error) {
+	resp, err := request(ctx, address, cid, tk)
+	if err != nil {
+		return nil, errors.Wrap(err, "download requeset")
+	}
+	defer resp.Body.Close()
+
+	result, err := writeCAR(path, size, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	n := result.Size
+
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return nil, errors.Wrapf(ErrTruncated, "wrote %d bytes, Content-Length %d", n, resp.ContentLength)
+	}
+
+	if size > 0 && n < size {
+		return nil, errors.Wrapf(ErrTruncated, "wrote %d bytes, asset size %d", n, size)
+	}
+
+	result.Transport = resp.Proto
+	return result, nil
+}
+
+// writeCAR writes the CAR read from r into path, computing its sha256 and piece commitment on the way
+func writeCAR(path string, size int64, r io.Reader) (*fetchResult, error) {
+	file, err := createCAR(path, size)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &commp.Calc{}
+	h := sha256.New()
+
+	var n int64
+	if writeBehindDepth > 0 {
+		n, err = writeBehind(io.MultiWriter(file, cp, h), r, writeBehindDepth)
+	} else {
+		buf, free := buffers.alloc(copyBufferSize)
+		n, err = io.CopyBuffer(io.MultiWriter(file, cp, h), r, buf)
+		free()
+	}
+	if err == nil && durable {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &fetchResult{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+
+	result.PieceCID, result.PieceSize, err = digestPiece(cp)
+	if err != nil {
+		// too small to form a piece, the CAR can only be dealt as part of an aggregate
+		log.Warnf("compute piece commitment of %s: %v", path, err)
+	}
+
+	return result, nil
+}
+
+// digestPiece returns the piece cid and padded piece size of the data written to cp
+func digestPiece(cp *commp.Calc) (string, uint64, error) {
+	rawCommP, paddedSize, err := cp.Digest()
+	if err != nil {
+		return "", 0, err
+	}
+
+	pieceCid, err := commcid.DataCommitmentV1ToCID(rawCommP)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return pieceCid.String(), paddedSize, nil
+}
+
+// getAssetSourceDownloadInfo calls the scheduler with schedulerTimeout applied, a deadline hit is reported as ErrSchedulerTimeout.
+func getAssetSourceDownloadInfo(ctx context.Context, schedulerApi api.Scheduler, cid string) (*types.AssetSourceDownloadInfoRsp, error) {
+	ctx, cancel := context.WithTimeout(ctx, schedulerTimeout)
+	defer cancel()
+
+	downloadInfos, err := schedulerApi.GetAssetSourceDownloadInfo(ctx, cid)
+	if err != nil && (errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded) {
+		return nil, errors.Wrapf(ErrSchedulerTimeout, "GetAssetSourceDownloadInfo %s exceeded %s", cid, schedulerTimeout)
+	}
+
+	return downloadInfos, err
 }
 
 func (d *Downloader) async() {
@@ -192,9 +798,22 @@ func (d *Downloader) async() {
 				continue
 			}
 
+			if d.draining.Load() || d.paused.Load() {
+				continue
+			}
+
 			d.running = true
 
-			assets, err := getJobs()
+			if lowDisk() {
+				d.running = false
+				continue
+			}
+
+			if err := d.refreshSchedulers(); err != nil {
+				log.Errorf("refresh schedulers: %v", err)
+			}
+
+			assets, err := getJobs(d.token, jobsFetchLimit)
 			if err != nil {
 				log.Errorf("get jobs: %v", err)
 				continue
@@ -216,6 +835,9 @@ func (d *Downloader) async() {
 
 func (d *Downloader) run() {
 	d.initDownWorker()
+	if largeSlots > 0 {
+		go d.runLarge()
+	}
 
 	for {
 
@@ -223,84 +845,155 @@ func (d *Downloader) run() {
 
 		// get asset to download
 		asset := <-d.JobQueue
+		d.waitResumed()
+		d.waitUndrained()
+
+		stop := func() {}
+		if len(d.downWorkerQueue) == 0 {
+			stop = d.prefetch(asset)
+		}
 
 		select {
 		case wrk := <-d.downWorkerQueue:
+			stop()
 			go func(a *model.Asset, w worker) {
-				// push job queue
-				jobFunc := d.jobProcess(a)
-				jobFunc()
-				// push back worker queue
-				d.downWorkerQueue <- w
+				runJob(d, a)
+				// push back worker queue, unless the pool was shrunk meanwhile
+				if !d.retireWorker() {
+					d.downWorkerQueue <- w
+				}
 			}(asset, wrk)
 		}
 	}
 }
 
+// runJob processes an asset taken by a worker
+var runJob = func(d *Downloader, asset *model.Asset) {
+	d.jobProcess(asset)()
+}
+
 func (d *Downloader) jobProcess(asset *model.Asset) job {
 	return func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
 		d.dlk.Lock()
+		// a job cancelled while queued is gone from the queue
+		_, admitted := d.queued[asset.Cid]
+		delete(d.queued, asset.Cid)
+		if !admitted {
+			log.Infof("cid %s is no longer queued", asset.Cid)
+			d.dlk.Unlock()
+			return
+		}
 		if _, existing := d.downloading[asset.Cid]; existing {
 			log.Infof("cid %s is downloading...", asset.Cid)
 			d.dlk.Unlock()
 			return
 		}
-		d.downloading[asset.Cid] = struct{}{}
+		running := &runningJob{asset: asset, startedAt: time.Now(), cancel: cancel}
+		d.downloading[asset.Cid] = running
 		d.dlk.Unlock()
+		d.events.publish(&JobEvent{Cid: asset.Cid, State: jobDownloading, Size: asset.TotalSize})
 
-		j, err := d.create(context.Background(), asset)
+		var err error
+		defer func() {
+			d.dlk.Lock()
+			delete(d.downloading, asset.Cid)
+			d.dlk.Unlock()
+			d.finished(running, err)
+		}()
+
+		// the job is handed out again once there is space, don't report it as failed. Smaller jobs which fit go on.
+		if d.overQuota(asset.TotalSize) || !d.reserveSpace(asset.TotalSize) {
+			err = errDeferred
+			jobsDeferred.Add(1)
+			deferred := *asset
+			deferred.Event = ErrorEventID
+			if err := pushResult(d.token, []*AssetResult{{Asset: &deferred, Reason: ReasonDeferred}}); err != nil {
+				log.Errorf("push result: %v", err)
+			}
+			return
+		}
+		defer d.releaseSpace(asset.TotalSize)
+
+		var result *AssetResult
+		result, err = d.create(ctx, asset)
 		if err != nil {
 			log.Errorf("download: %v", err)
 		}
 
-		if err == nil && j != nil {
-			log.Infof("process job: %s event: %d, path: %s", j.Cid, j.Event, j.Path)
+		if err == nil && result != nil {
+			log.Infof("process job: %s event: %d, path: %s, piece: %s", result.Cid, result.Event, result.Path, result.PieceCID)
 		}
 
-		err = pushResult(d.token, []*model.Asset{asset})
+		if result == nil {
+			result = &AssetResult{Asset: asset}
+		}
+
+		// anything short of a verified CAR must not be reported as success
 		if err != nil {
+			result.Event = ErrorEventID
+		}
+
+		if err := pushResult(d.token, []*AssetResult{result}); err != nil {
 			log.Errorf("push result: %v", err)
 		}
 
 		time.Sleep(time.Second)
-
-		d.dlk.Lock()
-		delete(d.downloading, asset.Cid)
-		d.dlk.Unlock()
 	}
 }
 
 func (d *Downloader) initDownWorker() {
-	for i := 0; i < d.concurrent; i++ {
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	for ; d.nextWorker < d.concurrent; d.nextWorker++ {
 		d.downWorkerQueue <- worker{
-			ID:       i,
+			ID:       d.nextWorker,
 			jobQueue: make(chan job, 1),
 		}
 	}
 }
 
-func (d *Downloader) createOrGetSize(dir string) (int64, error) {
-	if !fileutil.Exist(dir) {
-		return 0, os.Mkdir(dir, 0775)
+// syncDir fsyncs the directory, making the files created or renamed in it durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	d.lk.Lock()
-	defer d.lk.Unlock()
+	return f.Sync()
+}
 
-	if size, ok := d.dirSize[dir]; ok {
+// createOrGetSize returns the tracked size of dir, creating it on root when missing. A directory not tracked yet,
+// written before the sizes were persisted, is estimated from its manifest rather than walked.
+func (d *Downloader) createOrGetSize(dir, root string) (int64, error) {
+	if !fileutil.Exist(dir) {
+		d.dirSize.set(dir, 0)
+		return 0, mkBackupDir(dir, root)
+	}
+
+	if size, ok := d.dirSize.get(dir); ok {
 		return size, nil
 	}
 
-	size, err := getDirSize(dir)
+	size, err := manifestSize(dir)
 	if err != nil {
 		return 0, err
 	}
-	d.dirSize[dir] = size
+	d.dirSize.set(dir, size)
 
 	return size, nil
 }
 
 func getDirSize(path string) (int64, error) {
+	// backup directories on the extra roots are links
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
 	var size int64
 	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
 		if !info.IsDir() {
@@ -311,12 +1004,18 @@ func getDirSize(path string) (int64, error) {
 	return size, err
 }
 
-func (d *Downloader) getOutPath(dir string) (string, error) {
+// getOutPath returns the first backup directory of the day dir on root with room left. The directories of the day
+// on other roots are skipped, they take the assets placed there.
+func (d *Downloader) getOutPath(dir, root string) (string, error) {
 	var outPath string
 
 	for c := 'a'; c < 'z'; c++ {
-		outPath = filepath.Join(BackupOutPath, fmt.Sprintf("%s%c", dir, c))
-		size, err := d.createOrGetSize(outPath)
+		outPath = filepath.Join(BackupOutPath, fmt.Sprintf("%s%c%s", dir, c, d.namespace()))
+		if fileutil.Exist(outPath) && rootOf(outPath) != root {
+			continue
+		}
+
+		size, err := d.createOrGetSize(outPath, root)
 		if err != nil {
 			log.Errorf("createOrGetSize %s: %v", dir, err)
 			return "", err
@@ -330,17 +1029,26 @@ func (d *Downloader) getOutPath(dir string) (string, error) {
 	return outPath, nil
 }
 
-func request(url, cid string, token *types.Token) (io.ReadCloser, error) {
+func request(ctx context.Context, url, cid string, token *types.Token) (*http.Response, error) {
+	return requestFormat(ctx, url, cid, token, "car")
+}
+
+// requestFormat requests cid from the node at url in format, car or raw
+func requestFormat(ctx context.Context, url, cid string, token *types.Token, format string) (*http.Response, error) {
 	var scheme string
 	if !strings.HasPrefix(url, "http") {
 		scheme = "https://"
 	}
 
-	endpoint := fmt.Sprintf("%s%s/ipfs/%s?format=car", scheme, url, cid)
+	endpoint := fmt.Sprintf("%s%s/ipfs/%s?format=%s", scheme, url, cid, format)
+
+	if err := nodeLimits.wait(ctx, url); err != nil {
+		return nil, err
+	}
 
 	log.Infof("downloading from endpoint: %s", endpoint)
 
-	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -348,12 +1056,8 @@ func request(url, cid string, token *types.Token) (io.ReadCloser, error) {
 	//req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 
 	client := http.Client{
-		Timeout: 30 * time.Minute,
-		Transport: &http3.RoundTripper{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+		Timeout:   30 * time.Minute,
+		Transport: nodeTransport(),
 	}
 
 	resp, err := client.Do(req)
@@ -362,36 +1066,80 @@ func request(url, cid string, token *types.Token) (io.ReadCloser, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
 		return nil, errors.Errorf("http request: %d %v", resp.StatusCode, resp.Status)
 	}
 
-	return resp.Body, err
+	return resp, err
 }
 
-func pushResult(token string, jobs []*model.Asset) error {
-	data, err := json.Marshal(jobs)
-	if err != nil {
+// AssetResult is the asset reported to the storage api, with the piece commitment of the stored CAR
+type AssetResult struct {
+	*model.Asset
+	PieceCID  string `json:"piece_cid,omitempty"`
+	PieceSize uint64 `json:"piece_size,omitempty"`
+	// Reason qualifies the event, an ErrorEventID which isn't a failed download or a success with a caveat
+	Reason string `json:"reason,omitempty"`
+}
+
+// The reasons of an AssetResult. The storage api only knows the success event, ErrorEventID and SkippedEventID, the
+// reason tells the outcomes which aren't plain successes or failures apart.
+const (
+	// ReasonHashMismatch qualifies a backed up asset whose recorded hash doesn't match its content
+	ReasonHashMismatch = "hash_mismatch"
+	// ReasonSkipped qualifies a job outside the size range of the node, left to another backup node
+	ReasonSkipped = "skipped"
+	// ReasonDeferred qualifies a queued job put off for low disk space, it's not a failed backup
+	ReasonDeferred = "deferred"
+)
+
+func pushResult(token string, jobs []*AssetResult) error {
+	if err := postStorageAPI(token, BackupResult, jobs); err != nil {
 		return err
 	}
 
-	url := fmt.Sprintf("%s%s", StorageAPI, BackupResult)
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
-	if err != nil {
+	log.Infof("Successfully updated backup result")
+	return nil
+}
+
+// VerificationReport proves a stored CAR was verified intact at VerifiedAt
+type VerificationReport struct {
+	Cid        string    `json:"cid"`
+	SHA256     string    `json:"sha256"`
+	PieceCID   string    `json:"piece_cid,omitempty"`
+	PieceSize  uint64    `json:"piece_size,omitempty"`
+	Verified   bool      `json:"verified"`
+	Error      string    `json:"error,omitempty"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// pushVerification submits verification reports, so the explorer can show the backups are intact
+func pushVerification(token string, reports []*VerificationReport) error {
+	if len(reports) == 0 {
+		return nil
+	}
+
+	if err := postStorageAPI(token, BackupVerification, reports); err != nil {
 		return err
 	}
 
-	req.Header.Add("Authorization", "Bearer "+token)
-	resp, err := http.DefaultClient.Do(req)
+	log.Infof("Successfully submitted %d verification reports", len(reports))
+	return nil
+}
+
+// postStorageAPI posts v as json to the storage api path
+func postStorageAPI(token, path string, v interface{}) error {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("status: %d %v", resp.StatusCode, resp.Status)
+	resp, err := doStorageAPI(http.MethodPost, fmt.Sprintf("%s%s", StorageAPI, path), token, data)
+	if err != nil {
+		return err
 	}
+	resp.Body.Close()
 
-	log.Infof("Successfully updated backup result")
 	return nil
 }
 
@@ -400,38 +1148,82 @@ type getJobResp struct {
 	Data interface{}
 }
 
-func getJobs() ([]*model.Asset, error) {
-	url := fmt.Sprintf("%s%s", StorageAPI, BackupAssets)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
+// getJobs fetches the pending assets page by page until the last page or limit assets, 0 fetches every page
+func getJobs(token string, limit int) ([]*model.Asset, error) {
+	return pageJobs(limit, func(page int) ([]*model.Asset, int, error) {
+		return getJobsPage(token, page, jobsPageSize)
+	})
+}
+
+// pageJobs collects the jobs of the pages of jobsPageSize returned by fetch, with the total number of jobs
+func pageJobs(limit int, fetch func(page int) ([]*model.Asset, int, error)) ([]*model.Asset, error) {
+	var out []*model.Asset
+	seen := make(map[string]struct{})
+	for page := 1; ; page++ {
+		list, total, err := fetch(page)
+		if err != nil {
+			// the pages fetched so far are still worth processing
+			if len(out) > 0 {
+				log.Warnf("get jobs page %d: %v, continue with %d jobs", page, err, len(out))
+				return out, nil
+			}
+			return nil, err
+		}
+
+		added := 0
+		for _, asset := range list {
+			// the backlog shifts between pages as jobs are completed
+			if _, ok := seen[asset.Cid]; ok {
+				continue
+			}
+			seen[asset.Cid] = struct{}{}
+			out = append(out, asset)
+			added++
+		}
+
+		// a short page is the last one, a storage api without pagination returns everything on the first page. One
+		// ignoring the page returns the same full page again, which adds nothing.
+		if len(list) != jobsPageSize || (total > 0 && page*jobsPageSize >= total) || added == 0 {
+			break
+		}
+		if limit > 0 && len(out) >= limit {
+			break
+		}
 	}
 
-	req.Header.Add("Authorization", "Bearer "+token)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
 	}
-	defer resp.Body.Close()
+	return out, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status: %d %v", resp.StatusCode, resp.Status)
+// getJobsPage fetches page of the pending assets, with the total number of pending assets
+func getJobsPage(token string, page, size int) ([]*model.Asset, int, error) {
+	q := jobFilter.query()
+	q.Set("page", strconv.Itoa(page))
+	q.Set("size", strconv.Itoa(size))
+	url := fmt.Sprintf("%s%s?%s", StorageAPI, BackupAssets, q.Encode())
+
+	resp, err := doStorageAPI(http.MethodGet, url, token, nil)
+	if err != nil {
+		return nil, 0, err
 	}
+	defer resp.Body.Close()
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	var ret getJobResp
 	err = json.Unmarshal(data, &ret)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	data, err = json.Marshal(ret.Data)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	var out struct {
@@ -441,8 +1233,8 @@ func getJobs() ([]*model.Asset, error) {
 
 	err = json.Unmarshal(data, &out)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return out.List, nil
+	return out.List, out.Total, nil
 }
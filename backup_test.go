@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"testing"
+)
+
+// jobPages serves the pages of jobs, a page beyond them is empty
+func jobPages(pages [][]string, total int) (func(page int) ([]*model.Asset, int, error), *int) {
+	var fetched int
+	return func(page int) ([]*model.Asset, int, error) {
+		fetched++
+		if page > len(pages) {
+			return nil, total, nil
+		}
+		var list []*model.Asset
+		for _, c := range pages[page-1] {
+			list = append(list, &model.Asset{Cid: c})
+		}
+		return list, total, nil
+	}, &fetched
+}
+
+func cids(n int, prefix string) []string {
+	var out []string
+	for i := 0; i < n; i++ {
+		out = append(out, fmt.Sprintf("%s%d", prefix, i))
+	}
+	return out
+}
+
+func withPageSize(t *testing.T, size int) {
+	old := jobsPageSize
+	jobsPageSize = size
+	t.Cleanup(func() { jobsPageSize = old })
+}
+
+func TestPageJobs(t *testing.T) {
+	withPageSize(t, 3)
+
+	fetch, fetched := jobPages([][]string{cids(3, "a"), cids(3, "b"), cids(1, "c")}, 0)
+	jobs, err := pageJobs(0, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 7 || *fetched != 3 {
+		t.Errorf("got %d jobs in %d requests, want 7 in 3", len(jobs), *fetched)
+	}
+}
+
+func TestPageJobsTotal(t *testing.T) {
+	withPageSize(t, 3)
+
+	// a full last page ends the paging through the total
+	fetch, fetched := jobPages([][]string{cids(3, "a"), cids(3, "b")}, 6)
+	jobs, err := pageJobs(0, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 6 || *fetched != 2 {
+		t.Errorf("got %d jobs in %d requests, want 6 in 2", len(jobs), *fetched)
+	}
+}
+
+func TestPageJobsLimit(t *testing.T) {
+	withPageSize(t, 3)
+
+	fetch, fetched := jobPages([][]string{cids(3, "a"), cids(3, "b"), cids(3, "c")}, 9)
+	jobs, err := pageJobs(4, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 4 || *fetched != 2 {
+		t.Errorf("got %d jobs in %d requests, want 4 in 2", len(jobs), *fetched)
+	}
+}
+
+func TestPageJobsShiftedBacklog(t *testing.T) {
+	withPageSize(t, 3)
+
+	// jobs completed meanwhile shift a2 onto the second page
+	fetch, _ := jobPages([][]string{{"a0", "a1", "a2"}, {"a2", "b0", "b1"}, {"b2"}}, 0)
+	jobs, err := pageJobs(0, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 6 {
+		t.Errorf("got %d jobs, want 6 without duplicates", len(jobs))
+	}
+}
+
+func TestPageJobsIgnoredPage(t *testing.T) {
+	withPageSize(t, 3)
+
+	// a storage api ignoring the page parameter returns the first page again and again
+	var fetched int
+	jobs, err := pageJobs(0, func(page int) ([]*model.Asset, int, error) {
+		fetched++
+		if fetched > 10 {
+			t.Fatal("paging doesn't end")
+		}
+		return []*model.Asset{{Cid: "a0"}, {Cid: "a1"}, {Cid: "a2"}}, 0, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 3 || fetched != 2 {
+		t.Errorf("got %d jobs in %d requests, want 3 in 2", len(jobs), fetched)
+	}
+}
+
+func TestPageJobsError(t *testing.T) {
+	withPageSize(t, 3)
+
+	failure := errors.New("unavailable")
+	jobs, err := pageJobs(0, func(page int) ([]*model.Asset, int, error) {
+		if page == 2 {
+			return nil, 0, failure
+		}
+		return []*model.Asset{{Cid: "a0"}, {Cid: "a1"}, {Cid: "a2"}}, 0, nil
+	})
+	// the pages fetched before the failure are kept
+	if err != nil || len(jobs) != 3 {
+		t.Errorf("got %d jobs, %v, want the 3 of the first page", len(jobs), err)
+	}
+
+	if _, err := pageJobs(0, func(int) ([]*model.Asset, int, error) { return nil, 0, failure }); !errors.Is(err, failure) {
+		t.Errorf("failed first page returned %v", err)
+	}
+}
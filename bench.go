@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// benchResult is printed as a json line for every measured source and for the output volume
+type benchResult struct {
+	Kind      string  `json:"kind"`
+	Area      string  `json:"area,omitempty"`
+	Node      string  `json:"node,omitempty"`
+	Target    string  `json:"target"`
+	Bytes     int64   `json:"bytes"`
+	FirstByte string  `json:"first_byte,omitempty"`
+	Duration  string  `json:"duration"`
+	MBps      float64 `json:"mbps"`
+	Transport string  `json:"transport,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func (r *benchResult) finish(n int64, elapsed time.Duration) {
+	r.Bytes = n
+	r.Duration = elapsed.Round(time.Millisecond).String()
+	if elapsed > 0 {
+		r.MBps = float64(n) / elapsed.Seconds() / (1 << 20)
+	}
+}
+
+// benchSource downloads the CAR of cid from the node at address, discarding it
+func benchSource(ctx context.Context, address, cid string, result *benchResult, limit int64, token *types.Token) {
+	start := time.Now()
+	resp, err := request(ctx, address, cid, token)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+
+	result.FirstByte = time.Since(start).Round(time.Millisecond).String()
+	result.Transport = resp.Proto
+
+	var body io.Reader = resp.Body
+	if limit > 0 {
+		body = io.LimitReader(body, limit)
+	}
+
+	n, err := io.Copy(io.Discard, body)
+	result.finish(n, time.Since(start))
+	if err != nil {
+		result.Error = err.Error()
+	}
+}
+
+// benchWrite writes size bytes sequentially into dir through the CAR write path and syncs them
+func benchWrite(dir string, size int64, result *benchResult) {
+	path := filepath.Join(dir, fmt.Sprintf(".bench-%d%s", os.Getpid(), partSuffix))
+	defer os.Remove(path)
+
+	start := time.Now()
+	err := func() error {
+		f, err := createCAR(path, size)
+		if err != nil {
+			return err
+		}
+
+		buf, free := buffers.alloc(copyBufferSize)
+		defer free()
+		for i := range buf {
+			buf[i] = byte(i)
+		}
+
+		for written := int64(0); written < size; {
+			n := min(int64(len(buf)), size-written)
+			if _, err := f.Write(buf[:n]); err != nil {
+				f.Close()
+				return err
+			}
+			written += n
+		}
+
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}()
+
+	result.finish(size, time.Since(start))
+	if err != nil {
+		result.Error = err.Error()
+	}
+}
+
+// benchCmd measures the throughput of every source of a sample cid and the sequential write speed of the output
+// volume, to size --concurrent and the bandwidth limits
+func benchCmd(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	limit := fs.Int64("limit", 256<<20, "bytes downloaded from each source at most, 0 downloads the whole CAR")
+	writeSize := fs.Int64("write", 1<<30, "bytes written to the output volume, 0 skips the write test")
+	dir := fs.String("dir", BackupOutPath, "directory on the output volume the write test runs in")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+
+	if *writeSize > 0 {
+		result := &benchResult{Kind: "write", Target: *dir}
+		benchWrite(*dir, *writeSize, result)
+		enc.Encode(result)
+		fmt.Fprintf(os.Stderr, "write %s to %s: %.1f MiB/s\n", units.BytesSize(float64(*writeSize)), *dir, result.MBps)
+	}
+
+	if fs.NArg() == 0 {
+		return nil
+	}
+	cid := fs.Arg(0)
+
+	registry, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+
+	d := newDownloader(token, areaId, registry, concurrent)
+	defer d.Close()
+
+	var measured int
+	var total float64
+	for _, scheduler := range d.candidateSchedulers() {
+		infos, err := d.getDownloadInfos(context.Background(), scheduler, cid)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sources of %s in area %s: %v\n", cid, scheduler.AreaId, err)
+			continue
+		}
+
+		for _, source := range infos.SourceList {
+			result := &benchResult{Kind: "source", Area: scheduler.AreaId, Node: source.NodeID, Target: source.Address}
+			benchSource(context.Background(), source.Address, cid, result, *limit, source.Tk)
+			enc.Encode(result)
+
+			if result.Error == "" {
+				measured++
+				total += result.MBps
+			}
+		}
+	}
+
+	if measured == 0 {
+		return errors.Errorf("no source of %s could be measured", cid)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d sources, mean %.1f MiB/s per download\n", measured, total/float64(measured))
+	return nil
+}
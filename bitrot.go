@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// bitrotThreshold is the share of corrupted CARs per volume above which an alert is raised, 0 disables alerting
+	bitrotThreshold float64
+	// bitrotWindow is the period the scrub results are combined over
+	bitrotWindow = 7 * 24 * time.Hour
+	// bitrotWebhook receives a json post for every alert
+	bitrotWebhook string
+)
+
+const (
+	// bitrotMinChecked avoids alerting on a single corrupted CAR of a barely scrubbed volume
+	bitrotMinChecked = 20
+	// bitrotRealert repeats an alert while the rate stays above the threshold
+	bitrotRealert = 24 * time.Hour
+
+	bitrotWarning  = "warning"
+	bitrotCritical = "critical"
+)
+
+var (
+	bitrotFile = filepath.Join(BackupOutPath, ".bitrot.json")
+	bitrotLk   sync.Mutex
+
+	// bitrotRate is the corruption rate over the window, keyed by volume
+	bitrotRate   = expvar.NewMap("bitrot_rate")
+	bitrotAlerts = expvar.NewInt("bitrot_alerts")
+)
+
+type bitrotSample struct {
+	Time      time.Time `json:"time"`
+	Checked   int       `json:"checked"`
+	Corrupted int       `json:"corrupted"`
+}
+
+type bitrotVolume struct {
+	// Dir is a directory on the volume, for operators to locate the disk
+	Dir       string          `json:"dir"`
+	Samples   []*bitrotSample `json:"samples"`
+	Level     string          `json:"level,omitempty"`
+	AlertedAt time.Time       `json:"alerted_at,omitempty"`
+}
+
+// BitrotAlert is posted to the webhook
+type BitrotAlert struct {
+	Volume    string    `json:"volume"`
+	Dir       string    `json:"dir"`
+	Level     string    `json:"level"`
+	Rate      float64   `json:"rate"`
+	Checked   int       `json:"checked"`
+	Corrupted int       `json:"corrupted"`
+	Window    string    `json:"window"`
+	Time      time.Time `json:"time"`
+}
+
+// bitrotTally collects the results of one scrub round per volume
+type bitrotTally map[string]*bitrotVolume
+
+func (t bitrotTally) add(dir string, corrupted bool) {
+	volume := volumeOf(dir)
+	v, ok := t[volume]
+	if !ok {
+		v = &bitrotVolume{Dir: dir, Samples: []*bitrotSample{{Time: time.Now()}}}
+		t[volume] = v
+	}
+
+	v.Samples[0].Checked++
+	if corrupted {
+		v.Samples[0].Corrupted++
+	}
+}
+
+// recordBitrot merges the round into the persisted history, updates the rate metrics and escalates alerts
+func recordBitrot(tally bitrotTally) {
+	bitrotLk.Lock()
+	defer bitrotLk.Unlock()
+
+	volumes := make(map[string]*bitrotVolume)
+	if data, err := os.ReadFile(bitrotFile); err == nil {
+		if err := json.Unmarshal(data, &volumes); err != nil {
+			log.Errorf("bitrot: decode %s: %v", bitrotFile, err)
+		}
+	}
+
+	now := time.Now()
+	for volume, round := range tally {
+		v, ok := volumes[volume]
+		if !ok {
+			v = &bitrotVolume{}
+			volumes[volume] = v
+		}
+		v.Dir = round.Dir
+		v.Samples = append(v.Samples, round.Samples...)
+	}
+
+	for volume, v := range volumes {
+		var checked, corrupted int
+		samples := v.Samples[:0]
+		for _, s := range v.Samples {
+			if now.Sub(s.Time) > bitrotWindow {
+				continue
+			}
+			samples = append(samples, s)
+			checked += s.Checked
+			corrupted += s.Corrupted
+		}
+		v.Samples = samples
+
+		if len(samples) == 0 {
+			delete(volumes, volume)
+			bitrotRate.Delete(volume)
+			continue
+		}
+
+		rate := float64(corrupted) / float64(checked)
+		f := new(expvar.Float)
+		f.Set(rate)
+		bitrotRate.Set(volume, f)
+
+		if bitrotThreshold <= 0 || checked < bitrotMinChecked {
+			continue
+		}
+
+		var level string
+		switch {
+		case rate > 10*bitrotThreshold:
+			level = bitrotCritical
+		case rate > bitrotThreshold:
+			level = bitrotWarning
+		}
+
+		if level == "" {
+			if v.Level != "" {
+				log.Infof("bitrot: volume %s (%s) recovered, rate %.4f", volume, v.Dir, rate)
+			}
+			v.Level = ""
+			continue
+		}
+
+		// alert when the level is new or rises, and repeat daily while it persists
+		if level == v.Level && now.Sub(v.AlertedAt) < bitrotRealert {
+			continue
+		}
+		if level == bitrotWarning && v.Level == bitrotCritical && now.Sub(v.AlertedAt) < bitrotRealert {
+			continue
+		}
+
+		v.Level = level
+		v.AlertedAt = now
+		alertBitrot(&BitrotAlert{
+			Volume:    volume,
+			Dir:       v.Dir,
+			Level:     level,
+			Rate:      rate,
+			Checked:   checked,
+			Corrupted: corrupted,
+			Window:    bitrotWindow.String(),
+			Time:      now,
+		})
+	}
+
+	data, err := json.Marshal(volumes)
+	if err == nil {
+		err = os.WriteFile(bitrotFile, data, 0664)
+	}
+	if err != nil {
+		log.Errorf("bitrot: save %s: %v", bitrotFile, err)
+	}
+}
+
+func alertBitrot(alert *BitrotAlert) {
+	bitrotAlerts.Add(1)
+	log.Errorf("bitrot: %s: volume %s (%s) corrupted %d of %d CARs in %s, rate %.4f, the disk may be failing",
+		alert.Level, alert.Volume, alert.Dir, alert.Corrupted, alert.Checked, alert.Window, alert.Rate)
+
+	if bitrotWebhook == "" {
+		return
+	}
+
+	if err := postWebhook(bitrotWebhook, alert); err != nil {
+		log.Errorf("bitrot: post alert: %v", err)
+	}
+}
+
+// postWebhook posts v as json to url
+func postWebhook(url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// bitswapAPI is the rpc api of the Kubo node an asset is fetched over Bitswap through once every http source
+	// failed
+	bitswapAPI string
+	// bitswapEmbedded fetches over Bitswap with a libp2p host of the process instead of a Kubo node. It takes effect in
+	// builds with the libp2p tag.
+	bitswapEmbedded bool
+	// bitswapPeers are comma separated multiaddrs of peers holding the assets, dialed besides the sources of the
+	// scheduler advertising a /p2p multiaddr
+	bitswapPeers string
+	// bitswapTimeout bounds the Bitswap fetch of an asset
+	bitswapTimeout = time.Minute * 30
+)
+
+// bitswapSource is recorded as the source node and transport of the CARs fetched over Bitswap
+const bitswapSource = "bitswap"
+
+// bitswapEnabled reports whether an asset no node served is fetched over Bitswap
+func bitswapEnabled() bool {
+	return bitswapAPI != "" || bitswapEmbedded
+}
+
+// downloadBitswap fetches the DAG of job over Bitswap and stores it like a CAR from a node. A DAG that couldn't be
+// fetched or failing verification returns a nil entry and no error.
+func (d *Downloader) downloadBitswap(ctx context.Context, job *model.Asset, areaId, outPath string, sources []*types.SourceDownloadInfo) (*ManifestEntry, error) {
+	start := time.Now()
+	partPath := stagingPath(filepath.Join(outPath, job.Cid+".car"))
+	peers := bitswapPeerAddrs(sources)
+
+	fetch := func() (*fetchResult, error) {
+		if bitswapEmbedded {
+			return fetchEmbeddedBitswap(ctx, peers, job.Cid, partPath, job.TotalSize)
+		}
+		return fetchBitswap(ctx, bitswapAPI, peers, job.Cid, partPath, job.TotalSize)
+	}
+
+	fetched, err := fetch()
+	if errors.Is(err, ErrTruncated) {
+		log.Warnf("download %s over bitswap: %v, retry", job.Cid, err)
+		fetched, err = fetch()
+	}
+	if err != nil {
+		log.Errorf("download %s over bitswap: %v", job.Cid, err)
+		os.Remove(partPath)
+		return nil, nil
+	}
+
+	entry, err := d.acceptCAR(job, areaId, outPath, partPath, bitswapSource, fetched)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	log.Infof("Successfully download CARFile %s over bitswap, piece: %s, cost: %v", job.Cid, fetched.PieceCID, time.Since(start))
+	return entry, nil
+}
+
+// bitswapPeerAddrs returns the multiaddrs of bitswapPeers and the addresses of the sources which are /p2p multiaddrs,
+// the http addresses of the other sources are left out
+func bitswapPeerAddrs(sources []*types.SourceDownloadInfo) []string {
+	var out []string
+	for _, addr := range strings.Split(bitswapPeers, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			out = append(out, addr)
+		}
+	}
+	for _, source := range sources {
+		if isP2PAddr(source.Address) {
+			out = append(out, source.Address)
+		}
+	}
+	return out
+}
+
+// fetchBitswap has the Kubo node of api export the DAG of cid as a CAR into path. The node fetches the blocks it
+// lacks over Bitswap, from the peers and those it finds providing them.
+func fetchBitswap(ctx context.Context, api string, peers []string, cid, path string, size int64) (*fetchResult, error) {
+	api = strings.TrimSuffix(api, "/")
+
+	for _, addr := range peers {
+		// the blocks may still be found through the routing of the node
+		if err := kuboCall(ctx, api, "swarm/connect", url.Values{"arg": {addr}}); err != nil {
+			log.Warnf("connect bitswap peer %s: %v", addr, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bitswapTimeout)
+	defer cancel()
+
+	resp, err := kuboPost(ctx, api, "dag/export", url.Values{"arg": {cid}, "progress": {"false"}})
+	if err != nil {
+		return nil, errors.Wrap(err, "dag export")
+	}
+	defer resp.Body.Close()
+
+	result, err := writeCAR(path, size, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Kubo reports a failure after the response started in a trailer, the CAR is cut short then
+	if msg := resp.Trailer.Get("X-Stream-Error"); msg != "" {
+		return nil, errors.Wrapf(ErrTruncated, "dag export: %s", msg)
+	}
+
+	result.Transport = bitswapSource
+	return result, nil
+}
+
+// kuboCall calls the rpc api of a Kubo node and discards the response
+func kuboCall(ctx context.Context, api, cmd string, query url.Values) error {
+	resp, err := kuboPost(ctx, api, cmd, query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// kuboPost calls cmd on the rpc api of a Kubo node, a response other than 200 is returned as an error
+func kuboPost(ctx context.Context, api, cmd string, query url.Values) (*http.Response, error) {
+	endpoint := api + "/api/v0/" + cmd + "?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+		return nil, errors.Errorf("%s: status %d %s", cmd, resp.StatusCode, msg)
+	}
+	return resp, nil
+}
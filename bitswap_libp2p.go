@@ -0,0 +1,177 @@
+//go:build libp2p
+
+package main
+
+import (
+	"context"
+	"github.com/ipfs/boxo/bitswap"
+	bsnet "github.com/ipfs/boxo/bitswap/network"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/libp2p/go-libp2p"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+)
+
+// libp2pHost is the libp2p host of the process, started on first use. It only dials, the peers answer over the
+// connections it opened.
+var libp2pHost struct {
+	once sync.Once
+	host host.Host
+	err  error
+}
+
+func startHost() (host.Host, error) {
+	libp2pHost.once.Do(func() {
+		h, err := libp2p.New(libp2p.NoListenAddrs)
+		if err != nil {
+			libp2pHost.err = errors.Wrap(err, "start libp2p host")
+			return
+		}
+		libp2pHost.host = h
+		log.Infof("libp2p host %s started", h.ID())
+	})
+	return libp2pHost.host, libp2pHost.err
+}
+
+// connectPeer dials the peer of a /p2p multiaddr
+func connectPeer(ctx context.Context, h host.Host, addr string) (peer.ID, error) {
+	info, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return "", err
+	}
+	if err := h.Connect(ctx, *info); err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+// bitswapNode is the Bitswap client of the libp2p host, blocks are dropped from its blockstore once written to the CAR
+var bitswapNode struct {
+	once   sync.Once
+	client *bitswap.Bitswap
+	bstore blockstore.Blockstore
+	err    error
+}
+
+func startBitswap() error {
+	bitswapNode.once.Do(func() {
+		h, err := startHost()
+		if err != nil {
+			bitswapNode.err = err
+			return
+		}
+
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+		// the peers are dialed directly, there's no content routing to find others through
+		network := bsnet.NewFromIpfsHost(h, routinghelpers.Null{})
+
+		bitswapNode.bstore = bstore
+		bitswapNode.client = bitswap.New(context.Background(), network, bstore)
+	})
+	return bitswapNode.err
+}
+
+// fetchEmbeddedBitswap dials the peers with the libp2p host of the process and fetches the DAG of root from them over
+// Bitswap, writing it into path as CARv1 in depth first order
+func fetchEmbeddedBitswap(ctx context.Context, peers []string, root, path string, size int64) (*fetchResult, error) {
+	if err := startBitswap(); err != nil {
+		return nil, err
+	}
+
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode root cid %s", root)
+	}
+
+	var connected int
+	for _, addr := range peers {
+		if _, err := connectPeer(ctx, libp2pHost.host, addr); err != nil {
+			log.Warnf("connect bitswap peer %s: %v", addr, err)
+			continue
+		}
+		connected++
+	}
+	if connected == 0 {
+		return nil, errors.Errorf("none of %d bitswap peers reachable", len(peers))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bitswapTimeout)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	session := bitswapNode.client.NewSession(ctx)
+	go func() {
+		pw.CloseWithError(writeDAG(ctx, rootCid, pw, func(c cid.Cid) ([]byte, error) {
+			blk, err := session.GetBlock(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			if err := bitswapNode.bstore.DeleteBlock(ctx, c); err != nil {
+				log.Warnf("drop block %s: %v", c, err)
+			}
+			return blk.RawData(), nil
+		}))
+	}()
+
+	result, err := writeCAR(path, size, pr)
+	// a failed write leaves the walk blocked on the pipe otherwise
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	result.Transport = bitswapSource
+	return result, nil
+}
+
+// writeDAG writes the DAG of root as CARv1 to w depth first, reading every block through get
+func writeDAG(ctx context.Context, root cid.Cid, w io.Writer, get func(c cid.Cid) ([]byte, error)) error {
+	out, err := storage.NewWritable(w, []cid.Cid{root}, car.WriteAsCarV1(true))
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]struct{})
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if _, ok := seen[string(c.Hash())]; ok {
+			continue
+		}
+		seen[string(c.Hash())] = struct{}{}
+
+		// an identity cid carries its data, there's no block to fetch
+		if c.Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+
+		data, err := get(c)
+		if err != nil {
+			return errors.Wrapf(err, "fetch block %s", c)
+		}
+		if err := out.Put(ctx, c.KeyString(), data); err != nil {
+			return err
+		}
+
+		links, err := blockLinks(c, data)
+		if err != nil {
+			return err
+		}
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, links[i])
+		}
+	}
+	return out.Finalize()
+}
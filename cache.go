@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"sync"
+	"time"
+)
+
+// downloadInfoTTL is how long a GetAssetSourceDownloadInfo response is reused. The tokens in the response expire on the
+// scheduler side, so it must stay well below the scheduler token lifetime.
+var downloadInfoTTL = time.Minute
+
+type downloadInfoEntry struct {
+	info    *types.AssetSourceDownloadInfoRsp
+	expires time.Time
+}
+
+// downloadInfoCache keeps download info responses for a short time so retries of the same cid don't query the
+// scheduler again.
+type downloadInfoCache struct {
+	lk      sync.Mutex
+	entries map[string]*downloadInfoEntry
+	// pins are the schedulers the sources of the cids were prefetched from
+	pins map[string]string
+}
+
+func newDownloadInfoCache() *downloadInfoCache {
+	return &downloadInfoCache{
+		entries: make(map[string]*downloadInfoEntry),
+		pins:    make(map[string]string),
+	}
+}
+
+func downloadInfoKey(scheduler *Scheduler, cid string) string {
+	return scheduler.Uuid + "/" + cid
+}
+
+func (c *downloadInfoCache) get(key string) *types.AssetSourceDownloadInfoRsp {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+
+	return entry.info
+}
+
+func (c *downloadInfoCache) put(key string, info *types.AssetSourceDownloadInfoRsp) {
+	if downloadInfoTTL <= 0 {
+		return
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	for cid, uuid := range c.pins {
+		if _, ok := c.entries[uuid+"/"+cid]; !ok {
+			delete(c.pins, cid)
+		}
+	}
+
+	c.entries[key] = &downloadInfoEntry{info: info, expires: now.Add(downloadInfoTTL)}
+}
+
+func (c *downloadInfoCache) remove(key string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	delete(c.entries, key)
+}
+
+// pin records the scheduler the sources of cid were prefetched from
+func (c *downloadInfoCache) pin(scheduler *Scheduler, cid string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.pins[cid] = scheduler.Uuid
+}
+
+// pinned returns the scheduler the sources of cid were prefetched from, as long as they are cached
+func (c *downloadInfoCache) pinned(cid string) string {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	uuid, ok := c.pins[cid]
+	if !ok {
+		return ""
+	}
+	if entry, ok := c.entries[uuid+"/"+cid]; !ok || time.Now().After(entry.expires) {
+		delete(c.pins, cid)
+		return ""
+	}
+	return uuid
+}
+
+// prefetchSources resolves the sources of the asset next in line while every worker is busy
+var prefetchSources = true
+
+// prefetch resolves the sources of asset into the cache until the returned stop is called, so the worker taking it
+// doesn't wait on the scheduler. The worker is pinned to the scheduler the sources were resolved through. The sources are resolved again before the cached tokens are dropped.
+func (d *Downloader) prefetch(asset *model.Asset) (stop func()) {
+	if !prefetchSources || downloadInfoTTL <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for refresh := false; ; refresh = true {
+			for _, scheduler := range d.peekSchedulers() {
+				key := downloadInfoKey(scheduler, asset.Cid)
+				if refresh {
+					d.infoCache.remove(key)
+				}
+
+				infos, err := d.getDownloadInfos(ctx, scheduler, asset.Cid)
+				if err == nil && len(infos.SourceList) > 0 {
+					// the worker asks the same scheduler, whose turn it is or not
+					d.infoCache.pin(scheduler, asset.Cid)
+					break
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(downloadInfoTTL * 3 / 4):
+			}
+		}
+	}()
+	return cancel
+}
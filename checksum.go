@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checksumSuffix marks the sidecar sha256 checksum of a stored CAR, in the format of sha256sum
+const checksumSuffix = ".sha256"
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// writeChecksum writes the sidecar checksum of the CAR at carPath, replacing it rather than rewriting it in place
+func writeChecksum(carPath, sum string) error {
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(carPath))
+
+	path := carPath + checksumSuffix
+	f, err := os.Create(stagingPath(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(line)
+	if err == nil && durable {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(stagingPath(path))
+		return err
+	}
+	return os.Rename(stagingPath(path), path)
+}
+
+// readChecksum returns the sidecar checksum of the CAR at carPath
+func readChecksum(carPath string) (string, error) {
+	data, err := os.ReadFile(carPath + checksumSuffix)
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", errors.Errorf("empty checksum file of %s", carPath)
+	}
+	return fields[0], nil
+}
+
+// fileChecksum computes the sha256 of the file at path
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyChecksum compares the CAR at carPath with its sidecar checksum
+func verifyChecksum(carPath string) error {
+	expect, err := readChecksum(carPath)
+	if err != nil {
+		return err
+	}
+
+	sum, err := fileChecksum(carPath)
+	if err != nil {
+		return err
+	}
+
+	if sum != expect {
+		return errors.Wrapf(ErrChecksumMismatch, "recorded %s, computed %s", expect, sum)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"github.com/ipfs/go-cid"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// cidAllowlist is a file of cids always backed up, regardless of the job filter and the size range
+	cidAllowlist string
+	// cidDenylist is a file of cids never backed up, it takes precedence over the allowlist
+	cidDenylist string
+
+	allowlist *cidList
+	denylist  *cidList
+)
+
+// cidListReload is the period a cid list is checked for modifications in
+const cidListReload = 30 * time.Second
+
+// cidList is a file of cids, one per line, with # comments. The file is read again once it's modified, so
+// legal holds and exclusions apply without a restart.
+type cidList struct {
+	path string
+
+	lk      sync.Mutex
+	modTime time.Time
+	cids    map[string]struct{}
+}
+
+func newCidList(path string) (*cidList, error) {
+	l := &cidList{path: path}
+	if err := l.refresh(); err != nil {
+		return nil, err
+	}
+	go l.reload()
+	return l, nil
+}
+
+// reload reads the list again every cidListReload when it's modified. A list which can't be read again keeps its
+// last content.
+func (l *cidList) reload() {
+	for range time.Tick(cidListReload) {
+		l.lk.Lock()
+		if err := l.refresh(); err != nil {
+			log.Errorf("reload cid list %s: %v", l.path, err)
+		}
+		l.lk.Unlock()
+	}
+}
+
+// contains reports whether the cid is listed
+func (l *cidList) contains(c string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	_, ok := l.cids[canonicalCid(c)]
+	return ok
+}
+
+func (l *cidList) refresh() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+
+	if l.cids != nil && info.ModTime().Equal(l.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cids := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if _, err := cid.Decode(text); err != nil {
+			log.Warnf("cid list %s line %d: %v", l.path, line, err)
+			continue
+		}
+		cids[canonicalCid(text)] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	log.Infof("loaded %d cids from %s", len(cids), l.path)
+	l.cids = cids
+	l.modTime = info.ModTime()
+	return nil
+}
+
+// canonicalCid is the CIDv1 of the cid parsed, so a CIDv0 and the CIDv1 of the same content, or cids in other
+// multibases, match
+func canonicalCid(s string) string {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return s
+	}
+	return cid.NewCidV1(c.Type(), c.Hash()).String()
+}
+
+// loadCidLists reads the allowlist and the denylist given by the flags
+func loadCidLists() error {
+	var err error
+	if cidAllowlist != "" {
+		if allowlist, err = newCidList(cidAllowlist); err != nil {
+			return err
+		}
+	}
+
+	if cidDenylist != "" {
+		if denylist, err = newCidList(cidDenylist); err != nil {
+			return err
+		}
+	}
+	return nil
+}
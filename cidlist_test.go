@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"testing"
+)
+
+func TestCanonicalCid(t *testing.T) {
+	mh, err := multihash.Sum([]byte("titan"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v0 := cid.NewCidV0(mh)
+	v1 := cid.NewCidV1(cid.DagProtobuf, mh)
+	raw := cid.NewCidV1(cid.Raw, mh)
+
+	if got := canonicalCid(v0.String()); got != v1.String() {
+		t.Errorf("canonicalCid(%s) = %s, want %s", v0, got, v1)
+	}
+	if got := canonicalCid(v1.String()); got != v1.String() {
+		t.Errorf("canonicalCid(%s) = %s, want it unchanged", v1, got)
+	}
+	// the codec is part of the cid, the same multihash of another codec is another cid
+	if got := canonicalCid(raw.String()); got == v1.String() {
+		t.Errorf("canonicalCid(%s) = %s, the cid of another codec", raw, got)
+	}
+	if got := canonicalCid("not a cid"); got != "not a cid" {
+		t.Errorf("canonicalCid of an invalid cid = %s, want it unchanged", got)
+	}
+}
+
+func TestCidListMatchesVersions(t *testing.T) {
+	mh, err := multihash.Sum([]byte("titan"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v0 := cid.NewCidV0(mh)
+	v1 := cid.NewCidV1(cid.DagProtobuf, mh)
+
+	l := &cidList{cids: map[string]struct{}{canonicalCid(v0.String()): {}}}
+	if !l.contains(v1.String()) {
+		t.Errorf("list of %s doesn't contain %s", v0, v1)
+	}
+}
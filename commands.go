@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	usage  string
+	action func(args []string) error
+}
+
+var commands = map[string]*command{
+	"arweave-upload":  {usage: "arweave-upload [-force] <cid>...", action: arweaveUploadCmd},
+	"bench":           {usage: "bench [-limit bytes] [-write bytes] [-dir d] [cid]", action: benchCmd},
+	"compact":         {usage: "compact [-dry-run] [-min-age d] [-max-car-size n] [-aggregate-size n]", action: compactCmd},
+	"deal":            {usage: "deal -providers <sp,...> -url <gateway url> [-boost bin] [-duration epochs] [-price attofil] [-verified=false] [-piece-size bytes] [-tmp dir] <cid...|-date YYYYMMDD>", action: dealCmd},
+	"deal-status":     {usage: "deal-status [-boost bin] [-all]", action: dealStatusCmd},
+	"diff":            {usage: "diff <YYYYMMDD|manifest file> <YYYYMMDD|manifest file>", action: diffCmd},
+	"dirsize":         {usage: "dirsize [-rescan]", action: dirSizeCmd},
+	"export":          {usage: "export -to-ipfs <api> [-pin] | -tar <file> [-tar-size bytes] <cid...|-date YYYYMMDD|-area id>", action: exportCmd},
+	"find":            {usage: "find [-type unixfs type] [-codec codec] [-name substring] [-min-size n] [-max-size n] [-extract]", action: findCmd},
+	"gc":              {usage: "gc [-dry-run] [-min-age d]", action: gcCmd},
+	"index-export":    {usage: "index-export -out <dir> [-aggregate]", action: indexExportCmd},
+	"ingest-kubo":     {usage: "ingest-kubo -repo <kubo repo> [-network] <cid>...", action: ingestKuboCmd},
+	"login":           {usage: "login [-logout] [flag name, token by default]", action: loginCmd},
+	"manifest-key":    {usage: "manifest-key <private key file>", action: manifestKeyCmd},
+	"parity":          {usage: "parity verify|repair <car path>", action: parityCmd},
+	"quarantine":      {usage: "quarantine list | purge [-older-than d] [-max-size bytes] [-all] [cid...]", action: quarantineCmd},
+	"reconcile":       {usage: "reconcile [-checksum=false] [-api=false] [-kubo-repo repo] [-fix]", action: reconcileCmd},
+	"restore":         {usage: "restore [-user id] [-verify] [-tmp dir] [-remote url] [-workers n] [-replicas n [-wait d] [-report]] <cid...|-from YYYYMMDD [-to YYYYMMDD]|-manifest file>", action: restoreCmd},
+	"retention":       {usage: "retention [-dry-run]", action: retentionCmd},
+	"roundtrip":       {usage: "roundtrip [-tmp dir] <cid>...", action: roundTripCmd},
+	"verify-manifest": {usage: "verify-manifest -pubkey <hex public key> [dir...]", action: verifyManifestCmd},
+	"verify":          {usage: "verify [-workers n] [-cursor file] [-reset] [-quarantine]", action: verifyCmd},
+	"w3s-upload":      {usage: "w3s-upload [-force] <cid...|-date YYYYMMDD>", action: w3sUploadCmd},
+}
+
+// runCommand runs the subcommand named by args[0]
+func runCommand(args []string) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s, available commands:\n", args[0])
+		for _, c := range commands {
+			fmt.Fprintf(os.Stderr, "  %s\n", c.usage)
+		}
+		os.Exit(2)
+	}
+
+	if err := cmd.action(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "fmt"
+
+// maxConcurrent bounds the worker pool, the worker queue is allocated for it so the pool can grow at runtime
+const maxConcurrent = 1024
+
+// setConcurrency resizes the worker pool to n. New workers start taking jobs at once. Idle workers are dropped
+// at once, busy ones after finishing their download, so no job is interrupted.
+func (d *Downloader) setConcurrency(n int) error {
+	if n < 1 || n > maxConcurrent {
+		return fmt.Errorf("concurrency %d out of range 1-%d", n, maxConcurrent)
+	}
+
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	delta := n - d.concurrent
+	d.concurrent = n
+
+	// workers about to retire are kept instead of starting new ones
+	if delta > 0 {
+		kept := min(d.retiring, delta)
+		d.retiring -= kept
+		delta -= kept
+	}
+
+	for ; delta > 0; delta-- {
+		d.downWorkerQueue <- worker{ID: d.nextWorker, jobQueue: make(chan job, 1)}
+		d.nextWorker++
+	}
+
+	for ; delta < 0; delta++ {
+		select {
+		case <-d.downWorkerQueue:
+		default:
+			d.retiring++
+		}
+	}
+
+	log.Infof("worker concurrency set to %d", n)
+	return nil
+}
+
+// retireWorker reports whether a worker finishing its job leaves the pool after it was shrunk
+func (d *Downloader) retireWorker() bool {
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	if d.retiring == 0 {
+		return false
+	}
+	d.retiring--
+	return true
+}
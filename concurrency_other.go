@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// resizeOnSignal is not supported, there are no user signals on this platform
+func (d *Downloader) resizeOnSignal() {}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// resizeOnSignal grows the worker pool by one on SIGUSR1 and shrinks it by one on SIGUSR2
+func (d *Downloader) resizeOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for s := range sig {
+		d.dlk.Lock()
+		n := d.concurrent
+		d.dlk.Unlock()
+
+		if s == syscall.SIGUSR1 {
+			n++
+		} else {
+			n--
+		}
+
+		if err := d.setConcurrency(n); err != nil {
+			log.Errorf("resize worker pool: %v", err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/pkg/errors"
+	"os"
+)
+
+// Config is the optional config file given by --config
+type Config struct {
+	// Discovery selects where the schedulers are discovered, etcd (default), consul or kubernetes
+	Discovery  string
+	Consul     *ConsulConfig
+	Kubernetes *KubernetesConfig
+	// Schedulers are used when the discovery is unreachable, or instead of it when no etcd address is given
+	Schedulers []*StaticScheduler
+	// IncludeSchedulers restricts the discovered schedulers to the given keys or urls
+	IncludeSchedulers []string
+	// ExcludeSchedulers drops the discovered schedulers with the given keys or urls
+	ExcludeSchedulers []string
+	// Filter restricts the backed up assets to the given tenants
+	Filter *JobFilter
+	// Tenants are further Titan accounts backed up by the process, each polling with its own token
+	Tenants []*Tenant
+	// AdminCredentials grant observer or operator roles on the admin api and the control service
+	AdminCredentials []*AdminCredential
+}
+
+type StaticScheduler struct {
+	URL         string
+	AreaID      string
+	AccessToken string
+}
+
+func (s *StaticScheduler) toSchedulerCfg() *types.SchedulerCfg {
+	return &types.SchedulerCfg{
+		SchedulerURL: s.URL,
+		AreaID:       s.AreaID,
+		AccessToken:  s.AccessToken,
+	}
+}
+
+// staticKey is the key a static scheduler is stored under, in place of the etcd key
+func (s *StaticScheduler) staticKey() string {
+	return "static/" + s.AreaID + "/" + s.URL
+}
+
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := toml.Unmarshal(data, cfg); err != nil {
+		return nil, errors.Wrapf(err, "decode config %s", path)
+	}
+
+	switch cfg.Discovery {
+	case "", DiscoveryEtcd, DiscoveryConsul, DiscoveryKubernetes:
+	default:
+		return nil, errors.Errorf("config %s: unknown discovery %s", path, cfg.Discovery)
+	}
+
+	for i, s := range cfg.Schedulers {
+		if s.URL == "" || s.AreaID == "" {
+			return nil, errors.Errorf("config %s: scheduler %d requires URL and AreaID", path, i)
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ConsulConfig selects the consul KV prefix holding the scheduler configs, every key under the prefix stores one
+// types.SchedulerCfg encoded as json.
+type ConsulConfig struct {
+	Address string
+	Prefix  string
+	// Token is the consul ACL token, optional
+	Token string
+}
+
+type consulKV struct {
+	Key   string
+	Value string
+}
+
+// ConsulClient discovers the schedulers from a consul KV prefix
+type ConsulClient struct {
+	cfg    *ConsulConfig
+	client *http.Client
+}
+
+func NewConsulClient(cfg *ConsulConfig) (*ConsulClient, error) {
+	if cfg == nil || cfg.Address == "" {
+		return nil, errors.New("consul address not configured")
+	}
+
+	if cfg.Prefix == "" {
+		cfg.Prefix = "titan/scheduler"
+	}
+
+	return &ConsulClient{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// GetSchedulerConfigs returns the scheduler configs keyed by consul key
+func (cc *ConsulClient) GetSchedulerConfigs() (map[string]*types.SchedulerCfg, error) {
+	address := cc.cfg.Address
+	if !strings.HasPrefix(address, "http") {
+		address = "http://" + address
+	}
+
+	url := fmt.Sprintf("%s/v1/kv/%s?recurse=true", strings.TrimSuffix(address, "/"), strings.Trim(cc.cfg.Prefix, "/"))
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if cc.cfg.Token != "" {
+		req.Header.Add("X-Consul-Token", cc.cfg.Token)
+	}
+
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	configMap := make(map[string]*types.SchedulerCfg)
+
+	// no key under the prefix
+	if resp.StatusCode == http.StatusNotFound {
+		return configMap, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status: %d %v", resp.StatusCode, resp.Status)
+	}
+
+	var kvs []*consulKV
+	if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, err
+	}
+
+	for _, kv := range kvs {
+		// folder keys carry no value
+		if kv.Value == "" {
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode consul key %s", kv.Key)
+		}
+
+		var configScheduler *types.SchedulerCfg
+		if err := json.Unmarshal(value, &configScheduler); err != nil {
+			return nil, errors.Wrapf(err, "decode scheduler config %s", kv.Key)
+		}
+
+		configMap[kv.Key] = configScheduler
+	}
+
+	return configMap, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"slices"
+	"strings"
+)
+
+// grpcListen is the address of the gRPC control service, disabled when empty
+var grpcListen string
+
+// controlService is the full name of the gRPC control service
+const controlService = "backup.v1.Control"
+
+// jsonCodec encodes the messages of the control service as JSON, the same documents the admin api serves, so
+// clients need no generated code besides the method names
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+// JobRequest selects a job by cid, or the jobs of a state when listing
+type JobRequest struct {
+	Cid   string `json:"cid,omitempty"`
+	State string `json:"state,omitempty"`
+}
+
+// JobList is the response of ListJobs
+type JobList struct {
+	Jobs []*JobStatus `json:"jobs"`
+}
+
+// PruneRequest applies the retention policy, DryRun reports what would be deleted
+type PruneRequest struct {
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// RestoreRequest restores the archived CAR of Cid for User, titan_user when empty
+type RestoreRequest struct {
+	Cid  string `json:"cid"`
+	User string `json:"user,omitempty"`
+}
+
+// Empty is the request and response of the methods without arguments or results
+type Empty struct{}
+
+// control implements the control service on the downloader
+type control struct {
+	d *Downloader
+}
+
+func (c *control) ListJobs(ctx context.Context, req *JobRequest) (*JobList, error) {
+	jobs := c.d.jobs()
+	if req.State != "" {
+		jobs = slices.DeleteFunc(jobs, func(j *JobStatus) bool { return j.State != req.State })
+	}
+	return &JobList{Jobs: jobs}, nil
+}
+
+func (c *control) GetJob(ctx context.Context, req *JobRequest) (*JobStatus, error) {
+	s, err := c.d.job(req.Cid)
+	return s, grpcError(err)
+}
+
+func (c *control) CancelJob(ctx context.Context, req *JobRequest) (*Empty, error) {
+	return &Empty{}, grpcError(c.d.cancelJob(req.Cid))
+}
+
+func (c *control) RequeueJob(ctx context.Context, req *JobRequest) (*Empty, error) {
+	return &Empty{}, grpcError(c.d.requeue(req.Cid))
+}
+
+func (c *control) Pause(ctx context.Context, req *Empty) (*Empty, error) {
+	c.d.paused.Store(true)
+	log.Infof("control: paused")
+	return &Empty{}, nil
+}
+
+func (c *control) Resume(ctx context.Context, req *Empty) (*Empty, error) {
+	c.d.paused.Store(false)
+	log.Infof("control: resumed")
+	return &Empty{}, nil
+}
+
+func (c *control) GetConcurrency(ctx context.Context, req *Empty) (*Concurrency, error) {
+	return c.d.concurrency(), nil
+}
+
+func (c *control) SetConcurrency(ctx context.Context, req *Concurrency) (*Concurrency, error) {
+	if err := c.d.setConcurrency(req.Concurrent); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return c.d.concurrency(), nil
+}
+
+func (c *control) Prune(ctx context.Context, req *PruneRequest) (*retentionReport, error) {
+	report, err := c.d.prune(req.DryRun)
+	return report, grpcError(err)
+}
+
+func (c *control) Restore(ctx context.Context, req *RestoreRequest) (*restoreResult, error) {
+	userID, err := restoreUser(req.User)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	result, err := c.d.restoreOne(ctx, req.Cid, userID)
+	return result, grpcError(err)
+}
+
+// JobEvents streams the state changes of the jobs until the client goes away. A client too slow to keep up misses
+// events, ListJobs gives the current state again.
+func (c *control) JobEvents(req *JobRequest, stream grpc.ServerStream) error {
+	events, cancel := c.d.events.subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-events:
+			if req.Cid != "" && ev.Cid != req.Cid || req.State != "" && ev.State != req.State {
+				continue
+			}
+			if err := stream.SendMsg(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcError maps the errors of the job and archive operations to status codes
+func grpcError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errJobNotFound), errors.Is(err, errNotArchived):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errJobActive), errors.Is(err, errRetentionDisabled):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// unary adapts a method of the control service to a grpc method handler
+func unary[Req any, Resp any](name string, method func(*control, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+
+			handler := func(ctx context.Context, req any) (any, error) {
+				return method(srv.(*control), ctx, req.(*Req))
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + controlService + "/" + name}, handler)
+		},
+	}
+}
+
+var controlDesc = grpc.ServiceDesc{
+	ServiceName: controlService,
+	// the handlers assert the control themselves, any server type is accepted
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("ListJobs", (*control).ListJobs),
+		unary("GetJob", (*control).GetJob),
+		unary("CancelJob", (*control).CancelJob),
+		unary("RequeueJob", (*control).RequeueJob),
+		unary("Pause", (*control).Pause),
+		unary("Resume", (*control).Resume),
+		unary("GetConcurrency", (*control).GetConcurrency),
+		unary("SetConcurrency", (*control).SetConcurrency),
+		unary("Prune", (*control).Prune),
+		unary("Restore", (*control).Restore),
+	},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "JobEvents",
+		ServerStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			req := new(JobRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(*control).JobEvents(req, stream)
+		},
+	}},
+}
+
+// observerMethods are the methods of the control service open to observers, the others require operators
+var observerMethods = map[string]bool{
+	"ListJobs":       true,
+	"GetJob":         true,
+	"GetConcurrency": true,
+	"JobEvents":      true,
+}
+
+// grpcAuthorized checks that the client certificate or the bearer token in the authorization metadata of a call
+// grants the role the method requires
+func grpcAuthorized(ctx context.Context, fullMethod string) error {
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var authorization string
+	if v := md.Get("authorization"); len(v) > 0 {
+		authorization = v[0]
+	}
+
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	required := roleOperator
+	if observerMethods[method] {
+		required = roleObserver
+	}
+
+	got, name := authenticate(state, authorization)
+	switch {
+	case got == roleNone:
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	case got < required:
+		return status.Errorf(codes.PermissionDenied, "%s role required", required)
+	}
+
+	if required == roleOperator {
+		log.Infof("control: %s by %s", method, name)
+	}
+	return nil
+}
+
+// serveControl serves the control service on listen with the credentials of the admin api. The messages are JSON
+// encoded whatever the content subtype of the call.
+func serveControl(listen string, d *Downloader) {
+	lis, err := listenControl(listen)
+	if err != nil {
+		log.Errorf("serve control: %v", err)
+		return
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(jsonCodec{}),
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := grpcAuthorized(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := grpcAuthorized(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+	if controlTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(controlTLS)))
+	}
+
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&controlDesc, &control{d: d})
+
+	log.Infof("serve control on %s", listen)
+	if err := server.Serve(lis); err != nil {
+		log.Errorf("serve control: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+var (
+	// controlCert and controlKey serve the admin api, the control service and the metrics over TLS when set
+	controlCert string
+	controlKey  string
+	// controlClientCA authenticates the clients presenting a certificate signed by it, in place of a bearer token
+	controlClientCA string
+	// controlAllow are the comma separated addresses or CIDRs the control plane accepts connections from, any when empty
+	controlAllow string
+	// metricsToken is the bearer token the metrics require, they are open when empty
+	metricsToken string
+)
+
+var (
+	// controlTLS is loaded from the flags at startup, nil serves plain text
+	controlTLS *tls.Config
+	// controlAllowed is parsed from controlAllow at startup
+	controlAllowed []netip.Prefix
+)
+
+// loadControlTLS builds the TLS config of the control plane. With a client CA, certificates are verified when given,
+// so a client authenticates with either a certificate or the bearer token.
+func loadControlTLS() (*tls.Config, error) {
+	if controlCert == "" && controlKey == "" {
+		if controlClientCA != "" {
+			return nil, fmt.Errorf("control_client_ca requires control_cert and control_key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(controlCert, controlKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if controlClientCA != "" {
+		data, err := os.ReadFile(controlClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", controlClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// parseAllowlist parses comma separated addresses and CIDRs
+func parseAllowlist(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// allowed reports whether the remote address is in the allowlist, every address is without one
+func allowed(addr net.Addr) bool {
+	if len(controlAllowed) == 0 {
+		return true
+	}
+
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcp.IP)
+	if !ok {
+		return false
+	}
+
+	ip = ip.Unmap()
+	for _, p := range controlAllowed {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowListener drops the connections from addresses out of the allowlist before any byte is read
+type allowListener struct {
+	net.Listener
+}
+
+func (l allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Warnf("control plane: refused connection from %s", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// listenControl listens on listen for a control plane server, restricted to the allowlist
+func listenControl(listen string) (net.Listener, error) {
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	return allowListener{lis}, nil
+}
+
+// serveControlHTTP serves handler on listen over TLS when configured
+func serveControlHTTP(listen string, handler http.Handler) error {
+	lis, err := listenControl(listen)
+	if err != nil {
+		return err
+	}
+	if controlTLS != nil {
+		lis = tls.NewListener(lis, controlTLS)
+	}
+	return http.Serve(lis, handler)
+}
+
+// verifiedClient reports whether the peer presented a certificate signed by the client CA
+func verifiedClient(state *tls.ConnectionState) bool {
+	return state != nil && len(state.VerifiedChains) > 0
+}
+
+// bearerMatches compares the bearer token of an authorization header in constant time
+func bearerMatches(header, token string) bool {
+	got, ok := strings.CutPrefix(header, "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// controlAuth lets the requests with the bearer token or an admin credential of at least the observer role through, a
+// client certificate counts as the credential it maps to. Without a token and a client CA every request passes, as
+// the metrics did before.
+func controlAuth(token string, next http.Handler) http.Handler {
+	if token == "" && controlClientCA == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if role, _ := authenticate(r.TLS, authorization); role < roleObserver && !bearerMatches(authorization, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
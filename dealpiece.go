@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// dealPieceDir holds the deal pieces the storage providers fetch through the gateway. It's kept out of the backup
+// tree, a piece duplicates the CARs packed into it.
+var dealPieceDir = filepath.Join(filepath.Dir(BackupOutPath), "titan-pieces")
+
+// dealPiece is a CARv1 packing complete stored CARs for a storage deal. Its root is a dag-cbor list linking the roots
+// of the CARs, so the piece is a single DAG the provider can index.
+type dealPiece struct {
+	Root      string
+	PieceCID  string
+	PieceSize uint64
+	// Size is the size of the CAR file, the unpadded piece
+	Size int64
+	CARs []string
+}
+
+func dealPiecePath(root string) string {
+	return filepath.Join(dealPieceDir, root+".car")
+}
+
+// pieceRoot encodes the root block of a deal piece linking roots
+func pieceRoot(roots []cid.Cid) (cid.Cid, []byte, error) {
+	nb := basicnode.Prototype.List.NewBuilder()
+	la, err := nb.BeginList(int64(len(roots)))
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	for _, r := range roots {
+		if err := la.AssembleValue().AssignLink(cidlink.Link{Cid: r}); err != nil {
+			return cid.Undef, nil, err
+		}
+	}
+	if err := la.Finish(); err != nil {
+		return cid.Undef, nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(nb.Build(), &buf); err != nil {
+		return cid.Undef, nil, err
+	}
+	c, err := cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256).Sum(buf.Bytes())
+	return c, buf.Bytes(), err
+}
+
+// pieceOverhead is reserved in a deal piece for its header and root block. The headers of the packed CARs are not
+// copied, they make up for the links of the root block.
+const pieceOverhead = 1 << 10
+
+// planPieces groups the stored CARs into deal pieces of at most capacity bytes, in order. Delta and packed CARs are
+// sized as the complete CARs written into the piece. The CARs which can't be packed are reported through skip.
+func planPieces(cars []*StoredCAR, capacity int64, tmpDir string, skip func(s *StoredCAR, reason error)) [][]*StoredCAR {
+	capacity -= pieceOverhead
+
+	var (
+		groups [][]*StoredCAR
+		group  []*StoredCAR
+		size   int64
+	)
+	for _, s := range cars {
+		n := s.Size
+		if len(s.Base) > 0 {
+			complete, cleanup, err := completeCAR(s, tmpDir)
+			if err != nil {
+				skip(s, errors.Wrap(err, "materialize delta CAR"))
+				continue
+			}
+			n = complete.Size
+			cleanup()
+		}
+
+		if n > capacity {
+			skip(s, errors.Errorf("%d bytes exceed the piece capacity of %d", n, capacity))
+			continue
+		}
+		if size+n > capacity {
+			groups = append(groups, group)
+			group, size = nil, 0
+		}
+		group = append(group, s)
+		size += n
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// writeDealPiece packs the complete CARs of cars into a deal piece of dealPieceDir. A piece of the same CARs written
+// before is reused, its root only depends on theirs.
+func writeDealPiece(cars []*StoredCAR, tmpDir string) (*dealPiece, error) {
+	roots := make([]cid.Cid, 0, len(cars))
+	piece := &dealPiece{}
+	for _, s := range cars {
+		c, err := cid.Decode(s.Cid)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode root cid %s", s.Cid)
+		}
+		roots = append(roots, c)
+		piece.CARs = append(piece.CARs, s.Cid)
+	}
+
+	root, block, err := pieceRoot(roots)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode piece root")
+	}
+	piece.Root = root.String()
+	path := dealPiecePath(piece.Root)
+
+	if st, err := os.Stat(path); err == nil {
+		piece.Size = st.Size()
+		piece.PieceCID, piece.PieceSize, err = computePiece(path)
+		return piece, err
+	}
+
+	if err := os.MkdirAll(dealPieceDir, 0775); err != nil {
+		return nil, err
+	}
+
+	partPath := stagingPath(path)
+	file, err := os.Create(partPath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(partPath)
+	defer file.Close()
+
+	cp := &commp.Calc{}
+	w, err := storage.NewWritable(io.MultiWriter(file, cp), []cid.Cid{root}, car.WriteAsCarV1(true))
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Put(context.Background(), root.KeyString(), block); err != nil {
+		return nil, err
+	}
+
+	for _, s := range cars {
+		if err := copyBlocks(w, s, tmpDir); err != nil {
+			return nil, errors.Wrapf(err, "pack %s", s.Cid)
+		}
+	}
+
+	if err := w.Finalize(); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	piece.Size = st.Size()
+
+	if piece.PieceCID, piece.PieceSize, err = digestPiece(cp); err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return piece, os.Rename(partPath, path)
+}
+
+// copyBlocks writes the blocks of the complete CAR of s into w
+func copyBlocks(w storage.WritableCar, s *StoredCAR, tmpDir string) error {
+	complete, cleanup, err := completeCAR(s, tmpDir)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	f, err := os.Open(complete.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br, err := car.NewBlockReader(f)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidCAR, "read header: %v", err)
+	}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(ErrInvalidCAR, "read block: %v", err)
+		}
+		if err := w.Put(context.Background(), blk.Cid().KeyString(), blk.RawData()); err != nil {
+			return err
+		}
+	}
+}
+
+// serveDealPiece serves the deal piece with root c byte for byte, the providers check it against the piece cid
+func serveDealPiece(w http.ResponseWriter, r *http.Request, c cid.Cid) bool {
+	f, err := os.Open(dealPiecePath(c.String()))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	setTrustlessHeaders(w, c)
+	w.Header().Set("Content-Type", carContentType+"; version=1")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.car"`, c))
+	w.Header().Set("Etag", `"`+c.String()+`.car"`)
+	serveFileSection(w, r, f, 0, st.Size(), st.ModTime())
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWriteDealPiece(t *testing.T) {
+	dir := dealPieceDir
+	dealPieceDir = t.TempDir()
+	defer func() { dealPieceDir = dir }()
+
+	root, blocks := testDAG(t)
+	other := jsonBlock(t, "other")
+	first := storeTestCAR(t, root, nil, blocks...)
+	second := storeTestCAR(t, other, nil, other)
+
+	piece, err := writeDealPiece([]*StoredCAR{first, second}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(piece.CARs) != 2 || piece.PieceCID == "" || piece.PieceSize == 0 {
+		t.Fatalf("piece %+v, want both CARs and a piece cid", piece)
+	}
+	// the root of the piece links both CARs, so the whole piece is one DAG
+	if err := checkCAR(dealPiecePath(piece.Root), piece.Root, true); err != nil {
+		t.Fatalf("deal piece: %v", err)
+	}
+
+	again, err := writeDealPiece([]*StoredCAR{first, second}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Root != piece.Root || again.PieceCID != piece.PieceCID || again.Size != piece.Size {
+		t.Fatalf("piece written again %+v, want %+v", again, piece)
+	}
+}
+
+func TestPlanPieces(t *testing.T) {
+	cars := []*StoredCAR{
+		{ManifestEntry: &ManifestEntry{Cid: "a", Size: 600}},
+		{ManifestEntry: &ManifestEntry{Cid: "b", Size: 600}},
+		{ManifestEntry: &ManifestEntry{Cid: "c", Size: 4 << 10}},
+		{ManifestEntry: &ManifestEntry{Cid: "d", Size: 100}},
+	}
+
+	var skipped []string
+	groups := planPieces(cars, pieceOverhead+1<<10, os.TempDir(), func(s *StoredCAR, reason error) {
+		skipped = append(skipped, s.Cid)
+	})
+
+	if len(skipped) != 1 || skipped[0] != "c" {
+		t.Fatalf("skipped %v, want the CAR exceeding the capacity", skipped)
+	}
+	if len(groups) != 2 || len(groups[0]) != 1 || len(groups[1]) != 2 || groups[1][1].Cid != "d" {
+		t.Fatalf("%d pieces, want a, then b and d", len(groups))
+	}
+}
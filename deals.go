@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dealHistoryFile records the storage deals of the deal pieces, one json DealRecord per line. The last line of a deal
+// is its current state.
+var dealHistoryFile = filepath.Join(BackupOutPath, "deals.jsonl")
+
+const (
+	DealProposed = "proposed"
+	// DealActive is a deal whose sector is proven on chain, the proof of storage of the CAR
+	DealActive = "active"
+	DealFailed = "failed"
+)
+
+// DealRecord is a storage deal of a deal piece with a storage provider, made through the boost client
+type DealRecord struct {
+	// Cid is the root of the deal piece, CARs are the stored CARs packed into it
+	Cid       string   `json:"cid"`
+	CARs      []string `json:"cars,omitempty"`
+	PieceCID  string   `json:"piece_cid"`
+	PieceSize uint64   `json:"piece_size"`
+	Provider  string   `json:"provider"`
+	DealUUID  string   `json:"deal_uuid,omitempty"`
+	State     string   `json:"state"`
+	// Status is the last deal status reported by the provider
+	Status      string    `json:"status,omitempty"`
+	PublishCid  string    `json:"publish_cid,omitempty"`
+	ChainDealID uint64    `json:"chain_deal_id,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	ProposedAt  time.Time `json:"proposed_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (r *DealRecord) final() bool {
+	return r.State == DealActive || r.State == DealFailed
+}
+
+// appendDealHistory appends the record to the deal history
+func appendDealHistory(record *DealRecord) error {
+	return appendJSONL(dealHistoryFile, record)
+}
+
+// loadDeals returns the current state of every deal of the deal history
+func loadDeals() ([]*DealRecord, error) {
+	f, err := os.Open(dealHistoryFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*DealRecord
+	index := make(map[string]int)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record DealRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, errors.Wrapf(err, "decode %s", dealHistoryFile)
+		}
+
+		key := record.Cid + "/" + record.Provider + "/" + record.DealUUID
+		if i, ok := index[key]; ok {
+			out[i] = &record
+			continue
+		}
+		index[key] = len(out)
+		out = append(out, &record)
+	}
+	return out, scanner.Err()
+}
+
+// boostClient runs the deal commands of the boost client binary
+type boostClient struct {
+	bin string
+}
+
+// boostDealResult is the json output of boost deal
+type boostDealResult struct {
+	DealUUID string `json:"dealUuid"`
+}
+
+// boostDealStatus is the json output of boost deal-status
+type boostDealStatus struct {
+	DealUUID    string `json:"dealUuid"`
+	DealStatus  string `json:"dealStatus"`
+	PublishCid  string `json:"publishCid"`
+	ChainDealID uint64 `json:"chainDealId"`
+	Error       string `json:"error"`
+}
+
+func (b *boostClient) run(ctx context.Context, out interface{}, args ...string) error {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, b.bin, append([]string{"--json"}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "boost %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return errors.Wrapf(err, "decode boost %s output", args[0])
+	}
+	return nil
+}
+
+// propose makes an online deal of the deal piece with provider, which fetches the piece from url
+func (b *boostClient) propose(ctx context.Context, piece *dealPiece, provider, url string, duration int, price string, verified bool) (string, error) {
+	var result boostDealResult
+	err := b.run(ctx, &result, "deal",
+		"--provider="+provider,
+		"--http-url="+url,
+		"--commp="+piece.PieceCID,
+		fmt.Sprintf("--car-size=%d", piece.Size),
+		fmt.Sprintf("--piece-size=%d", piece.PieceSize),
+		"--payload-cid="+piece.Root,
+		fmt.Sprintf("--duration=%d", duration),
+		"--storage-price="+price,
+		fmt.Sprintf("--verified=%t", verified),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if result.DealUUID == "" {
+		return "", errors.New("boost deal returned no deal uuid")
+	}
+	return result.DealUUID, nil
+}
+
+func (b *boostClient) status(ctx context.Context, provider, dealUUID string) (*boostDealStatus, error) {
+	var status boostDealStatus
+	if err := b.run(ctx, &status, "deal-status", "--provider="+provider, "--deal-uuid="+dealUUID); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// dealState maps the status reported by the provider to the state of the record
+func dealState(status *boostDealStatus) string {
+	switch {
+	case status.Error != "":
+		return DealFailed
+	case strings.Contains(status.DealStatus, "Proving") || strings.Contains(status.DealStatus, "Active"):
+		return DealActive
+	}
+	return DealProposed
+}
+
+// dealCmd packs the selected CARs into deal pieces of piece-size and proposes a deal of every piece to every provider.
+// The providers fetch the pieces from the gateway at url, /ipfs/<root>?format=car.
+func dealCmd(args []string) error {
+	fs := flag.NewFlagSet("deal", flag.ExitOnError)
+	providers := fs.String("providers", "", "comma separated storage provider addresses, e.g. f01234,f05678")
+	gateway := fs.String("url", "", "public url of the gateway of this instance the providers fetch the deal pieces from")
+	bin := fs.String("boost", "boost", "path of the boost client binary, with a funded wallet configured")
+	duration := fs.Int("duration", 518400, "deal duration in epochs")
+	price := fs.String("price", "0", "storage price in attoFIL per epoch per GiB")
+	verified := fs.Bool("verified", true, "make verified deals using datacap")
+	pieceSize := fs.Int64("piece-size", 32<<30, "padded size of the deal pieces the CARs are packed into, a power of two up to the sector size")
+	tmpDir := fs.String("tmp", os.TempDir(), "directory the delta and packed CARs are materialized into")
+	date := fs.String("date", "", "propose every CAR backed up for the day, formatted as "+dirDateTimeFormat)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *providers == "" || *gateway == "" || (*date == "" && fs.NArg() == 0) {
+		return fmt.Errorf("usage: deal -providers <sp,...> -url <gateway url> [-piece-size bytes] <cid...|-date %s>", dirDateTimeFormat)
+	}
+	if *pieceSize <= 0 || *pieceSize&(*pieceSize-1) != 0 {
+		return errors.Errorf("piece size %d is no power of two", *pieceSize)
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return err
+	}
+
+	selected, err := selectStored(stored, *date, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	deals, err := loadDeals()
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]struct{})
+	for _, r := range deals {
+		if r.State == DealFailed {
+			continue
+		}
+		cars := r.CARs
+		if len(cars) == 0 {
+			cars = []string{r.Cid}
+		}
+		for _, c := range cars {
+			existing[c+"/"+r.Provider] = struct{}{}
+		}
+	}
+
+	providerList := strings.Split(*providers, ",")
+	dealt := func(cid, provider string) bool {
+		_, ok := existing[cid+"/"+provider]
+		return ok
+	}
+
+	// a CAR dealt with every provider already isn't packed again
+	var pending []*StoredCAR
+	for _, s := range selected {
+		for _, provider := range providerList {
+			if !dealt(s.Cid, provider) {
+				pending = append(pending, s)
+				break
+			}
+		}
+	}
+
+	// the unpadded capacity of a piece, the padding of commP takes 1/128
+	capacity := *pieceSize / 128 * 127
+	groups := planPieces(pending, capacity, *tmpDir, func(s *StoredCAR, reason error) {
+		fmt.Fprintf(os.Stderr, "deal: %s skipped: %v\n", s.Cid, reason)
+	})
+
+	boost := &boostClient{bin: *bin}
+	enc := json.NewEncoder(os.Stdout)
+	var failed int
+	for i, group := range groups {
+		piece, err := writeDealPiece(group, *tmpDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "deal %d/%d: pack %d CARs: %v\n", i+1, len(groups), len(group), err)
+			failed++
+			continue
+		}
+
+		url := fmt.Sprintf("%s/ipfs/%s?format=car", strings.TrimSuffix(*gateway, "/"), piece.Root)
+		for _, provider := range providerList {
+			done := true
+			for _, c := range piece.CARs {
+				done = done && dealt(c, provider)
+			}
+			if done {
+				continue
+			}
+
+			fmt.Fprintf(os.Stderr, "deal %d/%d: piece %s of %d CARs with %s\n", i+1, len(groups), piece.PieceCID, len(piece.CARs), provider)
+
+			now := time.Now()
+			record := &DealRecord{
+				Cid:        piece.Root,
+				CARs:       piece.CARs,
+				PieceCID:   piece.PieceCID,
+				PieceSize:  piece.PieceSize,
+				Provider:   provider,
+				State:      DealProposed,
+				ProposedAt: now,
+				UpdatedAt:  now,
+			}
+
+			record.DealUUID, err = boost.propose(context.Background(), piece, provider, url, *duration, *price, *verified)
+			if err != nil {
+				record.State = DealFailed
+				record.Error = err.Error()
+				failed++
+			}
+
+			if err := appendDealHistory(record); err != nil {
+				return errors.Wrap(err, "record deal")
+			}
+			enc.Encode(record)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d deal proposals failed", failed)
+	}
+	return nil
+}
+
+// dealStatusCmd polls the providers for the state of every deal not active or failed yet, recording the chain deal
+// ids of the proven ones
+func dealStatusCmd(args []string) error {
+	fs := flag.NewFlagSet("deal-status", flag.ExitOnError)
+	bin := fs.String("boost", "boost", "path of the boost client binary")
+	all := fs.Bool("all", false, "print the active and failed deals too")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	deals, err := loadDeals()
+	if err != nil {
+		return err
+	}
+
+	boost := &boostClient{bin: *bin}
+	enc := json.NewEncoder(os.Stdout)
+	var active, pending, failed int
+	for _, r := range deals {
+		changed := false
+		if !r.final() {
+			status, err := boost.status(context.Background(), r.Provider, r.DealUUID)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "deal %s of %s with %s: %v\n", r.DealUUID, r.Cid, r.Provider, err)
+			} else if state := dealState(status); state != r.State || status.DealStatus != r.Status {
+				r.State = state
+				r.Status = status.DealStatus
+				r.PublishCid = status.PublishCid
+				r.ChainDealID = status.ChainDealID
+				r.Error = status.Error
+				r.UpdatedAt = time.Now()
+
+				if err := appendDealHistory(r); err != nil {
+					return errors.Wrap(err, "record deal")
+				}
+				changed = true
+			}
+		}
+
+		switch r.State {
+		case DealActive:
+			active++
+		case DealFailed:
+			failed++
+		default:
+			pending++
+		}
+
+		if *all || changed || !r.final() {
+			enc.Encode(r)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%d active, %d pending, %d failed deals\n", active, pending, failed)
+	return nil
+}
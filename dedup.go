@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/Filecoin-Titan/titan/api/types"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// incremental fetches only the blocks missing from the archive of an asset sharing blocks with archived ones, and
+// stores them as a delta CAR referencing the CARs holding the rest
+var incremental bool
+
+// maxBlockSize bounds the raw blocks fetched by an incremental backup
+const maxBlockSize = 4 << 20
+
+var errNothingShared = errors.New("no block shared with the archive")
+
+// blockIndex maps the multihash of every archived block to the root cid of a CAR holding it
+type blockIndex struct {
+	once   sync.Once
+	lk     sync.RWMutex
+	blocks map[string]string
+}
+
+func newBlockIndex() *blockIndex {
+	return &blockIndex{blocks: make(map[string]string)}
+}
+
+// ensureLoaded reads the indexes of the whole archive on first use
+func (b *blockIndex) ensureLoaded() {
+	b.once.Do(func() {
+		stored, err := loadInventory(BackupOutPath)
+		if err != nil {
+			log.Errorf("block index: load inventory: %v", err)
+			return
+		}
+
+		for _, s := range stored {
+			if err := b.add(s); err != nil {
+				log.Errorf("block index: %s: %v", s.Path(), err)
+			}
+		}
+		log.Infof("block index: loaded %d blocks of %d CARs", len(b.blocks), len(stored))
+	})
+}
+
+func (b *blockIndex) add(s *StoredCAR) error {
+	// packed CARs have no file of their own to serve as the base of a delta
+	if s.aggregated() {
+		return nil
+	}
+
+	idx, err := standardIndex(s.Path())
+	if err != nil {
+		return err
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	return idx.ForEach(func(mh multihash.Multihash, _ uint64) error {
+		if _, ok := b.blocks[string(mh)]; !ok {
+			b.blocks[string(mh)] = s.Cid
+		}
+		return nil
+	})
+}
+
+// remove drops the blocks of the CARs of roots, which were deleted from the archive
+func (b *blockIndex) remove(roots []string) {
+	removed := make(map[string]struct{}, len(roots))
+	for _, root := range roots {
+		removed[root] = struct{}{}
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	for mh, root := range b.blocks {
+		if _, ok := removed[root]; ok {
+			delete(b.blocks, mh)
+		}
+	}
+}
+
+// lookup returns the root cid of an archived CAR holding c
+func (b *blockIndex) lookup(c cid.Cid) (string, bool) {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+
+	root, ok := b.blocks[string(c.Hash())]
+	return root, ok
+}
+
+// deltaProbeDepth is how many levels of the DAG an incremental backup fetches block by block looking for archived
+// sub-DAGs, the missing sub-DAGs below them are fetched as CARs
+const deltaProbeDepth = 2
+
+// fetchDelta writes the blocks of the DAG of root missing from the archive as CARv1 into path. The first
+// deltaProbeDepth levels are fetched block by block, skipping the sub-DAGs of archived blocks, the missing links below
+// are fetched as CAR sub-DAGs. It returns the root cids of the archived CARs the delta references, and
+// errNothingShared when no block linked from the probed levels is archived, a full download is cheaper then.
+func fetchDelta(ctx context.Context, address, root string, tk *types.Token, path string, blocks *blockIndex) (*fetchResult, []string, error) {
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "decode root cid %s", root)
+	}
+
+	// the whole DAG is archived already, a delta would be empty
+	if _, ok := blocks.lookup(rootCid); ok {
+		return nil, nil, errNothingShared
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	cp := &commp.Calc{}
+	h := sha256.New()
+	w, err := storage.NewWritable(io.MultiWriter(file, cp, h), []cid.Cid{rootCid}, car.WriteAsCarV1(true))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f := &deltaFetch{
+		ctx:     ctx,
+		address: address,
+		tk:      tk,
+		blocks:  blocks,
+		w:       w,
+		bases:   make(map[string]struct{}),
+		written: make(map[string]struct{}),
+	}
+
+	// probed is a node fetched block by block and its missing links left to fetch as CARs
+	type probed struct {
+		c       cid.Cid
+		missing []cid.Cid
+		whole   bool
+	}
+
+	var nodes []probed
+	scheduled := map[string]struct{}{string(rootCid.Hash()): {}}
+	level := []cid.Cid{rootCid}
+	for depth := 0; depth < deltaProbeDepth && len(level) > 0; depth++ {
+		var next []cid.Cid
+		for _, c := range level {
+			links, err := f.block(c)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			node := probed{c: c, whole: len(links) > 0}
+			for _, l := range links {
+				if f.archived(l) {
+					node.whole = false
+					continue
+				}
+				if _, ok := scheduled[string(l.Hash())]; ok {
+					node.whole = false
+					continue
+				}
+				scheduled[string(l.Hash())] = struct{}{}
+
+				// raw leaves have no links to look into
+				if depth+1 < deltaProbeDepth && l.Prefix().Codec != cid.Raw {
+					node.whole = false
+					next = append(next, l)
+					continue
+				}
+				node.missing = append(node.missing, l)
+			}
+			nodes = append(nodes, node)
+		}
+		level = next
+	}
+
+	if len(f.bases) == 0 {
+		return nil, nil, errNothingShared
+	}
+
+	for _, node := range nodes {
+		if node.whole {
+			if err := f.subDAG(node.c); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		for _, l := range node.missing {
+			if err := f.subDAG(l); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if err := w.Finalize(); err != nil {
+		return nil, nil, err
+	}
+	if durable {
+		if err := file.Sync(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	st, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &fetchResult{Size: st.Size(), SHA256: hex.EncodeToString(h.Sum(nil)), Transport: f.transport}
+	result.PieceCID, result.PieceSize, err = digestPiece(cp)
+	if err != nil {
+		log.Warnf("compute piece commitment of %s: %v", root, err)
+	}
+
+	var refs []string
+	for base := range f.bases {
+		refs = append(refs, base)
+	}
+	return result, refs, nil
+}
+
+// deltaFetch writes the missing blocks of a DAG into the delta CAR and collects the archived CARs it references
+type deltaFetch struct {
+	ctx       context.Context
+	address   string
+	tk        *types.Token
+	blocks    *blockIndex
+	w         storage.WritableCar
+	transport string
+	bases     map[string]struct{}
+	written   map[string]struct{}
+}
+
+// archived reports whether c is archived, recording the CAR holding it as a base of the delta
+func (f *deltaFetch) archived(c cid.Cid) bool {
+	base, ok := f.blocks.lookup(c)
+	if ok {
+		f.bases[base] = struct{}{}
+	}
+	return ok
+}
+
+func (f *deltaFetch) put(c cid.Cid, data []byte) error {
+	if _, ok := f.written[string(c.Hash())]; ok {
+		return nil
+	}
+	f.written[string(c.Hash())] = struct{}{}
+	return f.w.Put(context.Background(), c.KeyString(), data)
+}
+
+// block fetches the single block c, writes it and returns its links
+func (f *deltaFetch) block(c cid.Cid) ([]cid.Cid, error) {
+	data, proto, err := fetchBlock(f.ctx, f.address, c, f.tk)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetch block %s", c)
+	}
+	f.transport = proto
+
+	if err := f.put(c, data); err != nil {
+		return nil, err
+	}
+	return blockLinks(c, data)
+}
+
+// subDAG fetches the sub-DAG of c as a CAR and writes its blocks, but the archived ones
+func (f *deltaFetch) subDAG(c cid.Cid) error {
+	resp, err := requestFormat(f.ctx, f.address, c.String(), f.tk, "car")
+	if err != nil {
+		return errors.Wrapf(err, "fetch sub-DAG %s", c)
+	}
+	defer resp.Body.Close()
+	f.transport = resp.Proto
+
+	br, err := car.NewBlockReader(resp.Body)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidCAR, "sub-DAG %s: read header: %v", c, err)
+	}
+	if !containsCid(br.Roots, c) {
+		return errors.Wrapf(ErrRootMismatch, "sub-DAG %s: got %v", c, br.Roots)
+	}
+
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(ErrInvalidCAR, "sub-DAG %s: %v", c, err)
+		}
+
+		if err := verifyBlockHash(blk.Cid(), blk.RawData()); err != nil {
+			return err
+		}
+		if f.archived(blk.Cid()) {
+			continue
+		}
+		if err := f.put(blk.Cid(), blk.RawData()); err != nil {
+			return err
+		}
+	}
+}
+
+// fetchBlock fetches a single raw block from the node and verifies its hash, it returns the protocol of the response
+func fetchBlock(ctx context.Context, address string, c cid.Cid, tk *types.Token) ([]byte, string, error) {
+	resp, err := requestFormat(ctx, address, c.String(), tk, "raw")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBlockSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxBlockSize {
+		return nil, "", errors.Errorf("block exceeds %d bytes", maxBlockSize)
+	}
+
+	if err := verifyBlockHash(c, data); err != nil {
+		return nil, "", err
+	}
+	return data, resp.Proto, nil
+}
+
+// completeCAR returns a complete CAR of the stored asset. A delta CAR is materialized into tmpDir from its own blocks
+// and those of the CARs it references, a packed CAR is copied out of its aggregate. cleanup removes the copy.
+func completeCAR(s *StoredCAR, tmpDir string) (*StoredCAR, func(), error) {
+	if s.aggregated() {
+		return extractAggregated(s, tmpDir)
+	}
+	if len(s.Base) == 0 {
+		return s, func() {}, nil
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byCid := make(map[string]*StoredCAR)
+	for _, st := range stored {
+		byCid[st.Cid] = st
+	}
+
+	chain, err := baseChain(s, byCid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry := *s.ManifestEntry
+	entry.Base = nil
+	out := &StoredCAR{Dir: tmpDir, ManifestEntry: &entry}
+
+	if err := materialize(s.Cid, chain, out.Path()); err != nil {
+		os.Remove(out.Path())
+		return nil, nil, err
+	}
+
+	st, err := os.Stat(out.Path())
+	if err == nil {
+		entry.Size = st.Size()
+		entry.SHA256, err = fileChecksum(out.Path())
+	}
+	if err != nil {
+		os.Remove(out.Path())
+		return nil, nil, err
+	}
+
+	return out, func() { os.Remove(out.Path()) }, nil
+}
+
+// baseChain returns the paths of the delta CAR s and of the CARs it references, the bases may be deltas themselves
+func baseChain(s *StoredCAR, byCid map[string]*StoredCAR) ([]string, error) {
+	var chain []string
+	seen := make(map[string]struct{})
+	queue := []*StoredCAR{s}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[c.Cid]; ok {
+			continue
+		}
+		seen[c.Cid] = struct{}{}
+		chain = append(chain, c.Path())
+
+		for _, base := range c.Base {
+			b, ok := byCid[base]
+			if !ok {
+				return nil, errors.Wrapf(ErrIncompleteDAG, "base %s of %s is not in the archive", base, s.Cid)
+			}
+			queue = append(queue, b)
+		}
+	}
+	return chain, nil
+}
+
+// materialize writes the DAG of root as CARv1 to path, reading every block from the first CAR of chain holding it
+func materialize(root string, chain []string, path string) error {
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return errors.Wrapf(err, "decode root cid %s", root)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w, err := storage.NewWritable(file, []cid.Cid{rootCid}, car.WriteAsCarV1(true))
+	if err != nil {
+		return err
+	}
+
+	err = walkChain(rootCid, chain, func(c cid.Cid, data []byte) error {
+		return w.Put(context.Background(), c.KeyString(), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := w.Finalize(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// walkChain walks the DAG of root depth first, reading every block from the first CAR of chain holding it
+func walkChain(root cid.Cid, chain []string, visit func(c cid.Cid, data []byte) error) error {
+	seen := make(map[string]struct{})
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if _, ok := seen[string(c.Hash())]; ok {
+			continue
+		}
+		seen[string(c.Hash())] = struct{}{}
+
+		data, err := readChainBlock(chain, c)
+		if err != nil {
+			return err
+		}
+
+		if err := visit(c, data); err != nil {
+			return err
+		}
+
+		links, err := blockLinks(c, data)
+		if err != nil {
+			return err
+		}
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, links[i])
+		}
+	}
+	return nil
+}
+
+func readChainBlock(chain []string, c cid.Cid) ([]byte, error) {
+	for _, path := range chain {
+		data, err := readBlock(path, c)
+		if errors.Is(err, ErrBlockNotFound) {
+			continue
+		}
+		return data, err
+	}
+	return nil, errors.Wrapf(ErrIncompleteDAG, "block %s not found", c)
+}
+
+// downloadDelta backs up the asset incrementally from the first source able to serve its blocks. It returns a nil
+// entry when the asset shares nothing with the archive or no source serves single blocks.
+func (d *Downloader) downloadDelta(ctx context.Context, sources []*types.SourceDownloadInfo, area, outPath string, cid string, size int64) (*ManifestEntry, error) {
+	d.blocks.ensureLoaded()
+
+	partPath := stagingPath(filepath.Join(outPath, cid+".car"))
+	for _, source := range sources {
+		fetched, bases, err := fetchDelta(ctx, source.Address, cid, source.Tk, partPath, d.blocks)
+		if errors.Is(err, errNothingShared) {
+			os.Remove(partPath)
+			return nil, nil
+		}
+		if err != nil {
+			log.Warnf("incremental download of %s from %s: %v", cid, source.NodeID, err)
+			os.Remove(partPath)
+			continue
+		}
+
+		// the blocks were hashed as fetched, the framing and the root of the written CAR are checked still
+		downloadsUnverified.Add(1)
+		if err := verifyPartialCAR(partPath, cid); err != nil {
+			log.Errorf("verify delta CARFile %s from %s: %v", cid, source.NodeID, err)
+			downloadsVerifyFailed.Add(1)
+			if qerr := quarantineDownload(partPath, cid, source.NodeID, err); qerr != nil {
+				log.Errorf("quarantine CARFile %s: %v", cid, qerr)
+				os.Remove(partPath)
+			}
+			continue
+		}
+		downloadsVerified.Add(1)
+
+		entry := &ManifestEntry{
+			Cid:        cid,
+			Size:       fetched.Size,
+			PieceCID:   fetched.PieceCID,
+			PieceSize:  fetched.PieceSize,
+			SHA256:     fetched.SHA256,
+			SourceNode: source.NodeID,
+			Area:       area,
+			Transport:  fetched.Transport,
+			Base:       bases,
+		}
+		if err := d.storeCAR(outPath, partPath, entry); err != nil {
+			return nil, err
+		}
+
+		log.Infof("Successfully download CARFile %s incrementally, %d bytes referencing %d archived CARs", cid, fetched.Size, len(bases))
+		return entry, nil
+	}
+
+	return nil, nil
+}
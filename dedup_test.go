@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// storeTestCAR writes the blocks as the indexed CAR of root, referencing the bases
+func storeTestCAR(t *testing.T, root testBlock, bases []string, blocks ...testBlock) *StoredCAR {
+	path := writeTestCAR(t, root.cid, blocks...)
+	if err := writeIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	return &StoredCAR{Dir: filepath.Dir(path), ManifestEntry: &ManifestEntry{Cid: root.cid.String(), Base: bases}}
+}
+
+// blockServer serves the blocks as a node does, single ones with format=raw and sub-DAGs with format=car. It records
+// the cids requested, those of the sub-DAGs with a .car suffix. The nodes are requested over plain http meanwhile.
+func blockServer(t *testing.T, blocks ...testBlock) (*httptest.Server, func() []string) {
+	transport := nodeTransport
+	nodeTransport = func() http.RoundTripper { return http.DefaultTransport }
+	t.Cleanup(func() { nodeTransport = transport })
+
+	var (
+		lk        sync.Mutex
+		requested []string
+	)
+	byCid := make(map[string][]byte)
+	for _, b := range blocks {
+		byCid[b.cid.String()] = b.data
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := strings.TrimPrefix(r.URL.Path, "/ipfs/")
+		format := r.URL.Query().Get("format")
+		lk.Lock()
+		if format == "car" {
+			requested = append(requested, c+".car")
+		} else {
+			requested = append(requested, c)
+		}
+		lk.Unlock()
+
+		data, ok := byCid[c]
+		switch {
+		case !ok:
+			http.NotFound(w, r)
+		case format == "raw":
+			w.Write(data)
+		case format == "car":
+			writeSubDAG(t, w, c, byCid)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []string {
+		lk.Lock()
+		defer lk.Unlock()
+		return append([]string(nil), requested...)
+	}
+}
+
+// writeSubDAG writes the DAG of root as CARv1 to w
+func writeSubDAG(t *testing.T, w io.Writer, root string, byCid map[string][]byte) {
+	rootCid := cid.MustParse(root)
+	cw, err := storage.NewWritable(w, []cid.Cid{rootCid}, car.WriteAsCarV1(true))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	stack := []cid.Cid{rootCid}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		data := byCid[c.String()]
+		if err := cw.Put(context.Background(), c.KeyString(), data); err != nil {
+			t.Error(err)
+			return
+		}
+		links, err := blockLinks(c, data)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		stack = append(stack, links...)
+	}
+}
+
+func TestFetchDeltaChain(t *testing.T) {
+	root, blocks := testDAG(t)
+	left, right := blocks[1], blocks[2]
+
+	// the left leaf is archived as a CAR of its own
+	base := storeTestCAR(t, left, nil, left)
+	index := newBlockIndex()
+	if err := index.add(base); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, requested := blockServer(t, blocks...)
+	delta := &StoredCAR{Dir: t.TempDir(), ManifestEntry: &ManifestEntry{Cid: root.cid.String()}}
+	fetched, bases, err := fetchDelta(context.Background(), srv.URL, delta.Cid, nil, delta.Path(), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bases) != 1 || bases[0] != left.cid.String() {
+		t.Fatalf("bases %v, want the CAR of the left leaf", bases)
+	}
+	fetchedRight := false
+	for _, c := range requested() {
+		if strings.TrimSuffix(c, ".car") == left.cid.String() {
+			t.Error("the archived leaf was fetched again")
+		}
+		fetchedRight = fetchedRight || c == right.cid.String()
+	}
+	if !fetchedRight {
+		t.Error("the missing leaf wasn't fetched")
+	}
+	if fetched.Size == 0 || fetched.SHA256 == "" {
+		t.Errorf("fetch result %+v", fetched)
+	}
+
+	// the delta lacks the left leaf by design
+	if err := verifyPartialCAR(delta.Path(), delta.Cid); err != nil {
+		t.Fatalf("delta CAR: %v", err)
+	}
+	if err := checkCAR(delta.Path(), delta.Cid, true); !errors.Is(err, ErrIncompleteDAG) {
+		t.Fatalf("delta CAR walked alone: %v, want ErrIncompleteDAG", err)
+	}
+
+	// materialized from its chain it's the complete DAG
+	delta.Base = bases
+	if err := writeIndex(delta.Path()); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := baseChain(delta, map[string]*StoredCAR{base.Cid: base, delta.Cid: delta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "complete.car")
+	if err := materialize(delta.Cid, chain, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCAR(out, delta.Cid, true); err != nil {
+		t.Fatalf("materialized CAR: %v", err)
+	}
+}
+
+func TestFetchDeltaNothingShared(t *testing.T) {
+	root, blocks := testDAG(t)
+	srv, _ := blockServer(t, blocks...)
+
+	path := filepath.Join(t.TempDir(), "delta.car")
+	_, _, err := fetchDelta(context.Background(), srv.URL, root.cid.String(), nil, path, newBlockIndex())
+	if !errors.Is(err, errNothingShared) {
+		t.Fatalf("nothing archived: %v, want errNothingShared", err)
+	}
+}
+
+func TestFetchDeltaSubDAGs(t *testing.T) {
+	shared, other := jsonBlock(t, "shared"), jsonBlock(t, "other")
+	first, second := jsonBlock(t, "first"), jsonBlock(t, "second")
+	mixed := jsonBlock(t, "mixed", shared.cid, other.cid)
+	missing := jsonBlock(t, "missing", first.cid, second.cid)
+	root := jsonBlock(t, "root", mixed.cid, missing.cid)
+	blocks := []testBlock{root, mixed, missing, shared, other, first, second}
+
+	// only a grandchild of the root is archived
+	base := storeTestCAR(t, shared, nil, shared)
+	index := newBlockIndex()
+	if err := index.add(base); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, requested := blockServer(t, blocks...)
+	delta := &StoredCAR{Dir: t.TempDir(), ManifestEntry: &ManifestEntry{Cid: root.cid.String()}}
+	_, bases, err := fetchDelta(context.Background(), srv.URL, delta.Cid, nil, delta.Path(), index)
+	if err != nil {
+		t.Fatalf("archived grandchild: %v", err)
+	}
+	if len(bases) != 1 || bases[0] != shared.cid.String() {
+		t.Fatalf("bases %v, want the CAR of the shared block", bases)
+	}
+
+	got := make(map[string]bool)
+	for _, c := range requested() {
+		got[c] = true
+	}
+	for _, want := range []string{missing.cid.String() + ".car", other.cid.String() + ".car"} {
+		if !got[want] {
+			t.Errorf("%s wasn't requested, got %v", want, requested())
+		}
+	}
+	for _, b := range []testBlock{shared, first, second} {
+		if got[b.cid.String()] || got[b.cid.String()+".car"] {
+			t.Errorf("%s was requested on its own", b.cid)
+		}
+	}
+
+	delta.Base = bases
+	if err := writeIndex(delta.Path()); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := baseChain(delta, map[string]*StoredCAR{base.Cid: base, delta.Cid: delta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "complete.car")
+	if err := materialize(delta.Cid, chain, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCAR(out, delta.Cid, true); err != nil {
+		t.Fatalf("materialized CAR: %v", err)
+	}
+}
+
+func TestMaterializeDeltaOfDelta(t *testing.T) {
+	shared := jsonBlock(t, "shared")
+	middle := jsonBlock(t, "middle", shared.cid)
+	extra := jsonBlock(t, "extra")
+	top := jsonBlock(t, "top", middle.cid, extra.cid)
+
+	// top references the delta of middle, which references the full CAR of shared
+	full := storeTestCAR(t, shared, nil, shared)
+	mid := storeTestCAR(t, middle, []string{full.Cid}, middle)
+	delta := storeTestCAR(t, top, []string{mid.Cid}, top, extra)
+	byCid := map[string]*StoredCAR{full.Cid: full, mid.Cid: mid, delta.Cid: delta}
+
+	chain, err := baseChain(delta, byCid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 {
+		t.Fatalf("chain %v, want the delta and both bases", chain)
+	}
+
+	out := filepath.Join(t.TempDir(), "complete.car")
+	if err := materialize(delta.Cid, chain, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCAR(out, delta.Cid, true); err != nil {
+		t.Fatalf("materialized CAR: %v", err)
+	}
+
+	// the full CAR at the end of the chain was removed from the archive
+	delete(byCid, full.Cid)
+	if _, err := baseChain(delta, byCid); !errors.Is(err, ErrIncompleteDAG) {
+		t.Fatalf("missing base: %v, want ErrIncompleteDAG", err)
+	}
+}
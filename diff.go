@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// diffEntry is printed as a json line for every asset which differs between the two sides
+type diffEntry struct {
+	Change string `json:"change"`
+	Cid    string `json:"cid"`
+	// Delta is the change of the stored bytes
+	Delta  int64  `json:"delta"`
+	OldSHA string `json:"old_sha256,omitempty"`
+	NewSHA string `json:"new_sha256,omitempty"`
+}
+
+// diffSide loads the manifest entries of a backup day, formatted as dirDateTimeFormat, or of a manifest file
+func diffSide(arg string) (map[string]*ManifestEntry, error) {
+	var dirs []string
+	if filepath.Base(arg) == manifestFile {
+		dirs = []string{filepath.Dir(arg)}
+	} else {
+		entries, err := os.ReadDir(BackupOutPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if isBackupDir(BackupOutPath, e) && strings.HasPrefix(e.Name(), arg) {
+				dirs = append(dirs, filepath.Join(BackupOutPath, e.Name()))
+			}
+		}
+		if len(dirs) == 0 {
+			return nil, fmt.Errorf("no backup directory of %s", arg)
+		}
+	}
+
+	out := make(map[string]*ManifestEntry)
+	for _, dir := range dirs {
+		entries, err := readManifest(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			out[entry.Cid] = entry
+		}
+	}
+	return out, nil
+}
+
+func diffCmd(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: diff <%s|manifest file> <%s|manifest file>", dirDateTimeFormat, dirDateTimeFormat)
+	}
+
+	before, err := diffSide(args[0])
+	if err != nil {
+		return err
+	}
+	after, err := diffSide(args[1])
+	if err != nil {
+		return err
+	}
+
+	var changes []*diffEntry
+	for cid, a := range after {
+		b, ok := before[cid]
+		switch {
+		case !ok:
+			changes = append(changes, &diffEntry{Change: "added", Cid: cid, Delta: a.Size, NewSHA: a.SHA256})
+		case a.Size != b.Size || a.SHA256 != b.SHA256:
+			changes = append(changes, &diffEntry{Change: "changed", Cid: cid, Delta: a.Size - b.Size, OldSHA: b.SHA256, NewSHA: a.SHA256})
+		}
+	}
+	for cid, b := range before {
+		if _, ok := after[cid]; !ok {
+			changes = append(changes, &diffEntry{Change: "removed", Cid: cid, Delta: -b.Size, OldSHA: b.SHA256})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Change != changes[j].Change {
+			return changes[i].Change < changes[j].Change
+		}
+		return changes[i].Cid < changes[j].Cid
+	})
+
+	enc := json.NewEncoder(os.Stdout)
+	counts := make(map[string]int)
+	var delta int64
+	for _, c := range changes {
+		counts[c.Change]++
+		delta += c.Delta
+		enc.Encode(c)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d added, %d removed, %d changed, %+d bytes\n", counts["added"], counts["removed"], counts["changed"], delta)
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+// directIOThreshold is the asset size from which CARs are written with O_DIRECT, bypassing the page cache so
+// multi-GB downloads don't evict the cache of the other workloads of the host. 0 disables direct I/O.
+var directIOThreshold int64
+
+// ioUring writes CARs through an io_uring, overlapping network reads with disk writes. It takes effect in builds
+// with the iouring tag on Linux.
+var ioUring bool
+
+const (
+	// directIOAlign is the alignment of the buffer, offsets and lengths of direct writes
+	directIOAlign = 4096
+	// directIOBuffer is the size of the writes issued to the disk
+	directIOBuffer = 1 << 20
+)
+
+// carFile is the file a downloaded CAR is written to
+type carFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// createCAR creates the file of a CAR of size, written with direct I/O when the size reaches directIOThreshold and
+// the platform supports it
+func createCAR(path string, size int64) (carFile, error) {
+	direct := directIOThreshold > 0 && size >= directIOThreshold
+
+	var f *os.File
+	var err error
+	if direct {
+		if f, err = openDirect(path); err != nil {
+			log.Warnf("open %s for direct I/O: %v, fall back to buffered I/O", path, err)
+			direct = false
+		}
+	}
+	if f == nil {
+		if f, err = os.Create(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if ioUring {
+		w, err := newUringWriter(f, direct)
+		if err == nil {
+			return w, nil
+		}
+		log.Warnf("io_uring writer of %s: %v, fall back to synchronous writes", path, err)
+	}
+
+	if direct {
+		return newDirectWriter(f), nil
+	}
+	return f, nil
+}
+
+// directWriter collects the written bytes in an aligned buffer and writes them in aligned blocks. The tail is
+// written padded to the alignment and the file truncated back to the written length.
+type directWriter struct {
+	f       *os.File
+	buf     []byte
+	free    func()
+	n       int
+	written int64
+	flushed bool
+}
+
+func newDirectWriter(f *os.File) *directWriter {
+	buffers.acquire(directIOBuffer)
+	return &directWriter{f: f, buf: alignedBuffer(directIOBuffer), free: func() { buffers.release(directIOBuffer) }}
+}
+
+// alignedBuffer returns a buffer of size starting at a directIOAlign boundary
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlign)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlign - 1)); rem != 0 {
+		offset = directIOAlign - rem
+	}
+	return buf[offset : offset+size]
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	var total int
+	for len(p) > 0 {
+		c := copy(w.buf[w.n:], p)
+		w.n += c
+		total += c
+		p = p[c:]
+
+		if w.n == len(w.buf) {
+			if _, err := w.f.Write(w.buf); err != nil {
+				return total, err
+			}
+			w.written += int64(w.n)
+			w.n = 0
+		}
+	}
+	return total, nil
+}
+
+// flush writes the buffered tail, no write may follow
+func (w *directWriter) flush() error {
+	if w.flushed {
+		return nil
+	}
+	w.flushed = true
+
+	if w.n == 0 {
+		return nil
+	}
+
+	padded := (w.n + directIOAlign - 1) &^ (directIOAlign - 1)
+	clear(w.buf[w.n:padded])
+	if _, err := w.f.Write(w.buf[:padded]); err != nil {
+		return err
+	}
+
+	w.written += int64(w.n)
+	w.n = 0
+	return w.f.Truncate(w.written)
+}
+
+func (w *directWriter) Sync() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+func (w *directWriter) Close() error {
+	err := w.flush()
+	w.free()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// openDirect is not supported, CARs are written through the page cache
+func openDirect(path string) (*os.File, error) {
+	return nil, errors.New("direct I/O not supported on this platform")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/docker/go-units"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dirSizeFile persists the tracked sizes of the backup directories, so a restart doesn't walk the archive
+var dirSizeFile = filepath.Join(BackupOutPath, ".dirsize.json")
+
+// dirSizeSaveInterval bounds how stale the persisted sizes get
+const dirSizeSaveInterval = time.Minute
+
+// dirSizes tracks the size of every backup directory as files are stored and deleted
+type dirSizes struct {
+	lk    sync.Mutex
+	sizes map[string]int64
+	dirty bool
+}
+
+// loadDirSizes reads the persisted sizes, a missing or broken file starts empty
+func loadDirSizes() *dirSizes {
+	s := &dirSizes{sizes: make(map[string]int64)}
+
+	data, err := os.ReadFile(dirSizeFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("read %s: %v", dirSizeFile, err)
+		}
+		return s
+	}
+
+	if err := json.Unmarshal(data, &s.sizes); err != nil {
+		log.Warnf("decode %s: %v", dirSizeFile, err)
+		s.sizes = make(map[string]int64)
+	}
+	return s
+}
+
+func (s *dirSizes) get(dir string) (int64, bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	size, ok := s.sizes[dir]
+	return size, ok
+}
+
+func (s *dirSizes) set(dir string, size int64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.sizes[dir] = size
+	s.dirty = true
+}
+
+// add adjusts the size of a tracked dir by delta, negative for deleted files. Directories which no longer exist are
+// forgotten.
+func (s *dirSizes) add(dir string, delta int64) {
+	_, err := os.Stat(dir)
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	size, ok := s.sizes[dir]
+	if !ok {
+		return
+	}
+
+	if os.IsNotExist(err) {
+		delete(s.sizes, dir)
+	} else {
+		s.sizes[dir] = max(size+delta, 0)
+	}
+	s.dirty = true
+}
+
+// sum is the total size of the tracked dirs matching match
+func (s *dirSizes) sum(match func(dir string) bool) int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	var total int64
+	for dir, size := range s.sizes {
+		if match(dir) {
+			total += size
+		}
+	}
+	return total
+}
+
+// free applies the bytes freed per directory
+func (s *dirSizes) free(freed map[string]int64) {
+	for dir, size := range freed {
+		s.add(dir, -size)
+	}
+}
+
+func (s *dirSizes) save() error {
+	s.lk.Lock()
+	if !s.dirty {
+		s.lk.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.sizes)
+	s.dirty = false
+	s.lk.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(dirSizeFile+partSuffix, data, 0664); err != nil {
+		return err
+	}
+	return os.Rename(dirSizeFile+partSuffix, dirSizeFile)
+}
+
+// persist saves the sizes every dirSizeSaveInterval
+func (s *dirSizes) persist() {
+	for {
+		time.Sleep(dirSizeSaveInterval)
+		if err := s.save(); err != nil {
+			log.Errorf("save %s: %v", dirSizeFile, err)
+		}
+	}
+}
+
+// manifestSize sums the CARs recorded in the manifest of dir, a cheap estimate of a directory not tracked yet
+func manifestSize(dir string) (int64, error) {
+	entries, err := readManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+	return size, nil
+}
+
+// dirSizeCmd prints the tracked sizes, -rescan walks every backup directory and replaces them
+func dirSizeCmd(args []string) error {
+	fs := flag.NewFlagSet("dirsize", flag.ExitOnError)
+	rescan := fs.Bool("rescan", false, "walk every backup directory and persist the sizes, run it while the backup is stopped")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	s := loadDirSizes()
+	if *rescan {
+		dirs, err := os.ReadDir(BackupOutPath)
+		if err != nil {
+			return err
+		}
+
+		s = &dirSizes{sizes: make(map[string]int64), dirty: true}
+		for _, d := range dirs {
+			if _, err := dirDate(d.Name()); err != nil || !isBackupDir(BackupOutPath, d) {
+				continue
+			}
+
+			dir := filepath.Join(BackupOutPath, d.Name())
+			size, err := getDirSize(dir)
+			if err != nil {
+				return err
+			}
+			s.set(dir, size)
+		}
+
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+
+	dirs := make([]string, 0, len(s.sizes))
+	for dir := range s.sizes {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		fmt.Printf("%s\t%s\n", dir, units.BytesSize(float64(s.sizes[dir])))
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DiscoveryEtcd   = "etcd"
+	DiscoveryConsul = "consul"
+	// DiscoveryKubernetes reads the schedulers from a Secret or ConfigMap of the cluster
+	DiscoveryKubernetes = "kubernetes"
+)
+
+// Discovery finds the schedulers of the titan network
+type Discovery interface {
+	// GetSchedulerConfigs returns the scheduler configs keyed by a key unique to each scheduler
+	GetSchedulerConfigs() (map[string]*types.SchedulerCfg, error)
+}
+
+// SchedulerRegistry keeps the latest scheduler configs from the discovery, falling back to the static schedulers of
+// the config file when the discovery is unreachable.
+type SchedulerRegistry struct {
+	// discovery is nil when only the static schedulers are configured
+	discovery Discovery
+	// static schedulers from the config file
+	static []*StaticScheduler
+	// include and exclude are the scheduler keys or urls from the config file
+	include map[string]struct{}
+	exclude map[string]struct{}
+
+	lk sync.Mutex
+	// key is discovery key, value is types.SchedulerCfg pointer
+	configMap map[string]*types.SchedulerCfg
+}
+
+func NewSchedulerRegistry(discovery Discovery, cfg *Config) (*SchedulerRegistry, error) {
+	if discovery == nil && len(cfg.Schedulers) == 0 {
+		return nil, errors.New("neither scheduler discovery nor static schedulers configured")
+	}
+
+	return &SchedulerRegistry{
+		discovery: discovery,
+		static:    cfg.Schedulers,
+		include:   toSet(cfg.IncludeSchedulers),
+		exclude:   toSet(cfg.ExcludeSchedulers),
+		configMap: make(map[string]*types.SchedulerCfg),
+	}, nil
+}
+
+func toSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[strings.TrimSuffix(v, "/")] = struct{}{}
+	}
+	return set
+}
+
+// filter drops the schedulers excluded by the config file, or not in the include list when one is given.
+func (r *SchedulerRegistry) filter(configMap map[string]*types.SchedulerCfg) map[string]*types.SchedulerCfg {
+	if len(r.include) == 0 && len(r.exclude) == 0 {
+		return configMap
+	}
+
+	matches := func(set map[string]struct{}, key string, cfg *types.SchedulerCfg) bool {
+		url := strings.TrimSuffix(cfg.SchedulerURL, "/")
+		for _, v := range []string{key, url, strings.Replace(url, "https", "http", 1)} {
+			if _, ok := set[v]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	out := make(map[string]*types.SchedulerCfg)
+	for key, cfg := range configMap {
+		if len(r.include) > 0 && !matches(r.include, key, cfg) {
+			log.Debugf("scheduler %s not in include list, skip", key)
+			continue
+		}
+		if matches(r.exclude, key, cfg) {
+			log.Infof("scheduler %s excluded by config", key)
+			continue
+		}
+		out[key] = cfg
+	}
+	return out
+}
+
+func (r *SchedulerRegistry) loadSchedulerConfigs() (map[string][]*types.SchedulerCfg, error) {
+	if r.discovery == nil {
+		return r.loadStaticSchedulerConfigs(), nil
+	}
+
+	configMap, err := r.discovery.GetSchedulerConfigs()
+	if err != nil {
+		if len(r.static) == 0 {
+			return nil, err
+		}
+		log.Warnf("discover schedulers: %v, fallback to %d static schedulers", err, len(r.static))
+		return r.loadStaticSchedulerConfigs(), nil
+	}
+
+	configMap = r.filter(configMap)
+
+	r.lk.Lock()
+	r.configMap = configMap
+	r.lk.Unlock()
+
+	return groupByArea(configMap), nil
+}
+
+func (r *SchedulerRegistry) loadStaticSchedulerConfigs() map[string][]*types.SchedulerCfg {
+	configMap := make(map[string]*types.SchedulerCfg)
+	for _, s := range r.static {
+		configMap[s.staticKey()] = s.toSchedulerCfg()
+	}
+	configMap = r.filter(configMap)
+
+	r.lk.Lock()
+	r.configMap = configMap
+	r.lk.Unlock()
+
+	return groupByArea(configMap)
+}
+
+// reloadSchedulerConfig reads the scheduler configs again and returns the latest config stored under key.
+func (r *SchedulerRegistry) reloadSchedulerConfig(key string) (*types.SchedulerCfg, error) {
+	if _, err := r.loadSchedulerConfigs(); err != nil {
+		return nil, err
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	cfg, ok := r.configMap[key]
+	if !ok {
+		return nil, errors.Errorf("scheduler config %s not found", key)
+	}
+	return cfg, nil
+}
+
+// areaIds returns the sorted area ids of the loaded scheduler configs
+func (r *SchedulerRegistry) areaIds() []string {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	var out []string
+	for areaId := range groupByArea(r.configMap) {
+		out = append(out, areaId)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func groupByArea(configMap map[string]*types.SchedulerCfg) map[string][]*types.SchedulerCfg {
+	schedulerConfigs := make(map[string][]*types.SchedulerCfg)
+	for _, cfg := range configMap {
+		schedulerConfigs[cfg.AreaID] = append(schedulerConfigs[cfg.AreaID], cfg)
+	}
+	return schedulerConfigs
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/docker/go-units"
+	"sync"
+	"time"
+)
+
+var (
+	// minFreeSpace pauses the intake of new jobs while the backup volume has less free bytes, 0 disables the safeguard
+	minFreeSpace int64
+	// diskWebhook receives a json post when the intake is paused for low disk space
+	diskWebhook string
+)
+
+// LowDiskAlert is posted to the webhook when the intake is paused
+type LowDiskAlert struct {
+	Dir      string    `json:"dir"`
+	Free     int64     `json:"free"`
+	MinFree  int64     `json:"min_free"`
+	Deferred bool      `json:"deferred"`
+	Time     time.Time `json:"time"`
+}
+
+var (
+	lowDiskLk sync.Mutex
+	// lowDiskSince is when the intake was paused, zero while there is enough space
+	lowDiskSince time.Time
+)
+
+// footprint estimates the bytes an asset takes in the archive, with its parity
+func footprint(size int64) int64 {
+	return size + size*int64(parityPercent)/100
+}
+
+// reserveSpace claims the space of an asset of size for a download. It fails when the free space left by the running
+// downloads can't take the asset above minFreeSpace, so the asset is deferred rather than the queue blocked behind it.
+func (d *Downloader) reserveSpace(size int64) bool {
+	// the tenants write to the same volumes, their claims add up
+	if d.parent != nil {
+		return d.parent.reserveSpace(size)
+	}
+
+	need := footprint(size)
+
+	// an unknown free space doesn't hold back the download
+	free, err := outputFreeSpace()
+
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	if err == nil && free-d.reserved-need < minFreeSpace {
+		log.Warnf("deferred: %s needs %s, %s free with %s claimed by running downloads", units.BytesSize(float64(size)),
+			units.BytesSize(float64(need)), units.BytesSize(float64(free)), units.BytesSize(float64(d.reserved)))
+		return false
+	}
+
+	d.reserved += need
+	return true
+}
+
+// releaseSpace returns the space claimed by reserveSpace, the written CAR is counted by the free space now
+func (d *Downloader) releaseSpace(size int64) {
+	if d.parent != nil {
+		d.parent.releaseSpace(size)
+		return
+	}
+
+	d.dlk.Lock()
+	d.reserved -= footprint(size)
+	d.dlk.Unlock()
+}
+
+// lowDisk reports whether the free space of the backup volume is below minFreeSpace. The transitions are logged and
+// posted to diskWebhook, so operators get one alert per episode rather than an error per download.
+func lowDisk() bool {
+	if minFreeSpace <= 0 {
+		return false
+	}
+
+	free, err := outputFreeSpace()
+	if err != nil {
+		log.Errorf("%v", err)
+		return false
+	}
+
+	low := free < minFreeSpace
+
+	lowDiskLk.Lock()
+	defer lowDiskLk.Unlock()
+
+	if low == !lowDiskSince.IsZero() {
+		return low
+	}
+
+	if low {
+		lowDiskSince = time.Now()
+		intakeDeferred.Set(1)
+		log.Errorf("deferred: low disk, %s free on %s, below %s, new jobs are not pulled", units.BytesSize(float64(free)), BackupOutPath, units.BytesSize(float64(minFreeSpace)))
+	} else {
+		log.Infof("%s free on %s again after %s, resume pulling jobs", units.BytesSize(float64(free)), BackupOutPath, time.Since(lowDiskSince).Round(time.Second))
+		lowDiskSince = time.Time{}
+		intakeDeferred.Set(0)
+	}
+
+	if diskWebhook != "" {
+		alert := &LowDiskAlert{Dir: BackupOutPath, Free: free, MinFree: minFreeSpace, Deferred: low, Time: time.Now()}
+		if err := postWebhook(diskWebhook, alert); err != nil {
+			log.Errorf("post low disk alert: %v", err)
+		}
+	}
+	return low
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"cmp"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"slices"
+	"sync"
+)
+
+var (
+	// smallestFirst hands out the small assets of a long batch first, so more assets are protected per hour
+	smallestFirst bool
+	// smallestFirstMinJobs is the batch length from which the assets are reordered
+	smallestFirstMinJobs = 20
+	// largeAssetSize is the size from which an asset is downloaded in a large slot, when there are any
+	largeAssetSize int64 = 8 << 30
+	// largeSlots are workers dedicated to the large assets besides the concurrent ones, 0 downloads them in order
+	largeSlots int
+)
+
+// dispatch hands the admitted jobs to the workers. Large assets go to the dedicated slots, so they transfer without
+// holding back the small ones. It returns once every job is taken by a worker.
+func (d *Downloader) dispatch(jobs []*model.Asset) {
+	// the jobs not handed out yet are checkpointed by a handover
+	d.dlk.Lock()
+	for _, j := range jobs {
+		d.queued[j.Cid] = j
+	}
+	d.dlk.Unlock()
+
+	for _, j := range jobs {
+		d.events.publish(&JobEvent{Cid: j.Cid, State: jobQueued, Size: j.TotalSize})
+	}
+
+	if smallestFirst && len(jobs) >= smallestFirstMinJobs {
+		slices.SortStableFunc(jobs, func(a, b *model.Asset) int {
+			return cmp.Compare(a.TotalSize, b.TotalSize)
+		})
+	}
+
+	var wg sync.WaitGroup
+	if largeSlots > 0 {
+		var large []*model.Asset
+		jobs = slices.DeleteFunc(jobs, func(j *model.Asset) bool {
+			if j.TotalSize >= largeAssetSize {
+				large = append(large, j)
+				return true
+			}
+			return false
+		})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, j := range large {
+				d.waitUndrained()
+				d.largeQueue <- j
+			}
+		}()
+	}
+
+	for _, j := range jobs {
+		d.waitUndrained()
+		d.JobQueue <- j
+	}
+	wg.Wait()
+}
+
+// runLarge downloads the large assets in the dedicated slots
+func (d *Downloader) runLarge() {
+	slots := make(chan struct{}, largeSlots)
+	for asset := range d.largeQueue {
+		d.waitResumed()
+		d.waitUndrained()
+
+		stop := func() {}
+		if len(slots) == largeSlots {
+			stop = d.prefetch(asset)
+		}
+		slots <- struct{}{}
+		stop()
+		go func(a *model.Asset) {
+			runJob(d, a)
+			<-slots
+		}(asset)
+	}
+}
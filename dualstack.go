@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/quic-go/quic-go"
+	"net"
+	"time"
+)
+
+var (
+	// ipFamily restricts the connections to the nodes and services to ipv4 or ipv6, any uses both
+	ipFamily = "any"
+	// fallbackDelay is how long an address is given before the next one is raced against it
+	fallbackDelay = 300 * time.Millisecond
+)
+
+// familyNetwork restricts network, tcp, udp or ip, to the configured family
+func familyNetwork(network string) string {
+	switch ipFamily {
+	case "4", "6":
+		return network + ipFamily
+	}
+	return network
+}
+
+// dialTCP dials over the configured family, both families are raced by the dialer otherwise
+func dialTCP(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer.FallbackDelay = fallbackDelay
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" {
+			network = familyNetwork(network)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// interleave orders the addresses ipv6 first alternating with ipv4, as in rfc 8305
+func interleave(ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < max(len(v6), len(v4)); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// dialQUIC connects to a node over every address of its host, the next address is tried when the previous one fails
+// or hasn't answered within fallbackDelay and the first handshake to complete wins. Nodes reachable over one family
+// only, or with a broken ipv6 route, are connected without waiting for a timeout.
+func dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, familyNetwork("ip"), host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no ipv%s address of %s", ipFamily, host)
+	}
+	ips = interleave(ips)
+
+	if tlsCfg.ServerName == "" {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ServerName = host
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn quic.EarlyConnection
+		err  error
+	}
+	results := make(chan attempt, len(ips))
+
+	var next, pending int
+	launch := func() {
+		target := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := quic.DialAddrEarly(ctx, target, tlsCfg, cfg)
+			results <- attempt{conn, err}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(ips) {
+				launch()
+				timer.Reset(fallbackDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the handshakes completing after the winner
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.err == nil {
+							late.conn.CloseWithError(0, "")
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+
+			lastErr = r.err
+			if next < len(ips) {
+				launch()
+				timer.Reset(fallbackDelay)
+			}
+		}
+	}
+	return nil, lastErr
+}
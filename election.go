@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"os"
+	"time"
+)
+
+// campaignLeader blocks until this instance is elected leader on key. Only the leader polls and downloads jobs, a
+// standby instance takes over within ttl seconds after the leader's lease expires.
+func campaignLeader(ctx context.Context, addresses []string, key string, ttl int) (*concurrency.Session, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   addresses,
+		DialTimeout: 5 * time.Second,
+		Username:    user,
+		Password:    secret("password"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := concurrency.NewSession(cli, concurrency.WithTTL(ttl))
+	if err != nil {
+		cli.Close()
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	candidate := hostname + "/" + time.Now().Format(time.RFC3339Nano)
+
+	election := concurrency.NewElection(session, key)
+
+	log.Infof("campaign for leadership on %s as %s", key, candidate)
+	if err := election.Campaign(ctx, candidate); err != nil {
+		session.Close()
+		cli.Close()
+		return nil, err
+	}
+
+	log.Infof("elected leader on %s", key)
+	return session, nil
+}
+
+// watchLeadership exits the process once the leader lease is lost, so a standby can't end up downloading alongside
+// a leader which regained its connection.
+func watchLeadership(session *concurrency.Session) {
+	<-session.Done()
+	log.Fatal("leader lease lost, exit to let the standby take over")
+}
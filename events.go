@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// jobEventBuffer is how many events a subscriber may lag behind before it misses some
+const jobEventBuffer = 256
+
+// JobEvent is a state change of a job, queued, downloading or one of the finished states
+type JobEvent struct {
+	Cid   string    `json:"cid"`
+	State string    `json:"state"`
+	Size  int64     `json:"size"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// jobEvents fans the job events out to the subscribers, the zero value is ready to use
+type jobEvents struct {
+	lk   sync.Mutex
+	subs map[chan *JobEvent]struct{}
+}
+
+// subscribe returns the events published from now on, cancel must be called once the channel isn't read anymore
+func (e *jobEvents) subscribe() (<-chan *JobEvent, func()) {
+	ch := make(chan *JobEvent, jobEventBuffer)
+
+	e.lk.Lock()
+	if e.subs == nil {
+		e.subs = make(map[chan *JobEvent]struct{})
+	}
+	e.subs[ch] = struct{}{}
+	e.lk.Unlock()
+
+	return ch, func() {
+		e.lk.Lock()
+		delete(e.subs, ch)
+		e.lk.Unlock()
+	}
+}
+
+// publish hands ev to every subscriber, a subscriber with a full buffer misses it rather than holding up the jobs
+func (e *jobEvents) publish(ev *JobEvent) {
+	ev.Time = time.Now()
+
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// kuboImportResult is a line of the response of the dag/import api of Kubo
+type kuboImportResult struct {
+	Root *struct {
+		Cid struct {
+			Path string `json:"/"`
+		}
+		PinErrorMsg string
+	}
+}
+
+// exportToIPFS imports the stored CAR into the Kubo node of api through dag/import, pinning its root when pin is set
+func exportToIPFS(ctx context.Context, api string, s *StoredCAR, pin bool) error {
+	s, cleanup, err := completeCAR(s, os.TempDir())
+	if err != nil {
+		return errors.Wrap(err, "materialize delta CAR")
+	}
+	defer cleanup()
+
+	f, err := os.Open(s.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	query := url.Values{"pin-roots": {fmt.Sprint(pin)}}
+	endpoint := strings.TrimSuffix(api, "/") + "/api/v0/dag/import?" + query.Encode()
+
+	body, contentType := multipartFile(filepath.Base(s.Path()), f)
+	defer body.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "dag import")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return errors.Errorf("dag import: status %d %s", resp.StatusCode, msg)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var result kuboImportResult
+		if err := dec.Decode(&result); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "decode dag import response")
+		}
+
+		if result.Root != nil && result.Root.PinErrorMsg != "" {
+			return errors.Errorf("pin %s: %s", result.Root.Cid.Path, result.Root.PinErrorMsg)
+		}
+	}
+}
+
+// exportResult is printed as a json line for every exported CAR
+type exportResult struct {
+	Cid   string `json:"cid"`
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+}
+
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	toIPFS := fs.String("to-ipfs", "", "rpc api address of the Kubo node, e.g. http://127.0.0.1:5001")
+	toTar := fs.String("tar", "", "tar archive the CARs and their manifest are packed into")
+	tarSize := fs.Int64("tar-size", 0, "split the tar archive into archives of at most this many bytes of CARs, 0 writes one archive")
+	date := fs.String("date", "", "export every CAR backed up for the day, formatted as "+dirDateTimeFormat)
+	area := fs.String("area", "", "export only the CARs found in the area")
+	pin := fs.Bool("pin", false, "pin the roots of the imported CARs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if (*toIPFS == "") == (*toTar == "") || (*date == "" && *area == "" && fs.NArg() == 0) {
+		return fmt.Errorf("usage: export -to-ipfs <api> [-pin] | -tar <file> [-tar-size bytes] <cid...|-date %s|-area id>", dirDateTimeFormat)
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return err
+	}
+
+	selected := stored
+	if *date != "" || fs.NArg() > 0 {
+		if selected, err = selectStored(stored, *date, fs.Args()); err != nil {
+			return err
+		}
+	}
+
+	if *area != "" {
+		selected = selectArea(selected, *area)
+	}
+
+	if *toTar != "" {
+		paths, err := exportTar(*toTar, selected, *tarSize)
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var failed int
+	for i, s := range selected {
+		fmt.Fprintf(os.Stderr, "export %d/%d: %s\n", i+1, len(selected), s.Cid)
+
+		result := &exportResult{Cid: s.Cid, Path: s.Path()}
+		if err := exportToIPFS(context.Background(), *toIPFS, s, *pin); err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		enc.Encode(result)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d exports failed", failed, len(selected))
+	}
+	return nil
+}
+
+// selectStored picks the stored CARs of the cids and of the backup directories of date
+// selectArea returns the CARs found in the area, CARs backed up before the area was recorded don't match
+func selectArea(stored []*StoredCAR, area string) []*StoredCAR {
+	var out []*StoredCAR
+	for _, s := range stored {
+		if s.Area == area {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func selectStored(stored []*StoredCAR, date string, cids []string) ([]*StoredCAR, error) {
+	byCid := make(map[string]*StoredCAR)
+	for _, s := range stored {
+		byCid[s.Cid] = s
+	}
+
+	var out []*StoredCAR
+	for _, cid := range cids {
+		s, ok := byCid[cid]
+		if !ok {
+			return nil, errors.Errorf("%s is not in the archive", cid)
+		}
+		out = append(out, s)
+	}
+
+	if date != "" {
+		for _, s := range stored {
+			if strings.HasPrefix(filepath.Base(s.Dir), date) {
+				out = append(out, s)
+			}
+		}
+	}
+	return out, nil
+}
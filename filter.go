@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// JobFilter restricts the backups to the assets of the tenants an operator is contracted for
+type JobFilter struct {
+	// Users are the owners whose assets are backed up, every owner when empty
+	Users []string
+	// Projects are the asset groups backed up, every group when empty
+	Projects []int64
+}
+
+// jobFilter is loaded from the Filter section of the config file
+var jobFilter = &JobFilter{}
+
+var (
+	// jobsPageSize is the number of jobs fetched from the storage api per request
+	jobsPageSize = 100
+	// jobsFetchLimit caps the jobs fetched per poll, 0 fetches the whole backlog
+	jobsFetchLimit = 1000
+
+	// minSize skips the assets smaller than it, 0 disables the lower bound
+	minSize int64
+	// maxSize skips the assets larger than it, 0 disables the upper bound
+	maxSize int64
+)
+
+func (f *JobFilter) empty() bool {
+	return len(f.Users) == 0 && len(f.Projects) == 0
+}
+
+// query passes the filter to the storage api, so the jobs of other tenants aren't handed out in the first place
+func (f *JobFilter) query() url.Values {
+	q := url.Values{}
+	for _, u := range f.Users {
+		q.Add("user_id", u)
+	}
+	for _, p := range f.Projects {
+		q.Add("project_id", strconv.FormatInt(p, 10))
+	}
+	return q
+}
+
+// match reports whether the asset belongs to a tenant of the filter. The storage api may ignore the query
+// parameters, so fetched jobs are matched again.
+func (f *JobFilter) match(asset *model.Asset) bool {
+	if len(f.Users) > 0 && !slices.Contains(f.Users, asset.UserId) {
+		return false
+	}
+	if len(f.Projects) > 0 && !slices.Contains(f.Projects, asset.ProjectId) {
+		return false
+	}
+	return true
+}
+
+// inSizeRange reports whether the asset size is within min_size and max_size
+func inSizeRange(size int64) bool {
+	if minSize > 0 && size < minSize {
+		return false
+	}
+	if maxSize > 0 && size > maxSize {
+		return false
+	}
+	return true
+}
+
+// admit reports whether a job is handed to the workers. Jobs out of the size range are reported once with
+// SkippedEventID, so they can be handed to a node which accepts them. Denylisted cids are never backed up,
+// allowlisted ones always.
+func (d *Downloader) admit(asset *model.Asset) bool {
+	// another member of the fleet downloads it
+	if !ownsShard(asset.Cid) {
+		jobsSharded.Add(1)
+		return false
+	}
+
+	if denylist.contains(asset.Cid) {
+		log.Infof("skip asset %s, denylisted", asset.Cid)
+		jobsDenied.Add(1)
+		return false
+	}
+
+	if allowlist.contains(asset.Cid) {
+		return true
+	}
+
+	if !jobFilter.match(asset) {
+		log.Infof("skip asset %s of user %s project %d, filtered out", asset.Cid, asset.UserId, asset.ProjectId)
+		jobsFiltered.Add(1)
+		return false
+	}
+
+	if !inSizeRange(asset.TotalSize) {
+		if !d.skipOnce(asset) {
+			return false
+		}
+		log.Infof("skip asset %s of %d bytes, out of the size range", asset.Cid, asset.TotalSize)
+		jobsSkipped.Add(1)
+
+		asset.Event = SkippedEventID
+		if err := pushResult(d.token, []*AssetResult{{Asset: asset, Reason: ReasonSkipped}}); err != nil {
+			log.Errorf("push result: %v", err)
+		}
+		return false
+	}
+	return true
+}
+
+// skipOnce records the asset as skipped in the recent jobs, it reports false when it was skipped already
+func (d *Downloader) skipOnce(asset *model.Asset) bool {
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	if s, ok := d.recent[asset.Cid]; ok && s.State == jobSkipped {
+		return false
+	}
+	d.remember(&JobStatus{Cid: asset.Cid, State: jobSkipped, Size: asset.TotalSize, FinishedAt: time.Now(), asset: asset})
+	return true
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gatewayListen is the address of the gateway serving stored CARs and blocks, disabled when empty
+var gatewayListen string
+
+const (
+	carContentType = "application/vnd.ipld.car"
+	rawContentType = "application/vnd.ipld.raw"
+
+	// immutableCacheControl is what the trustless gateway spec sends for content addressed responses
+	immutableCacheControl = "public, max-age=29030400, immutable"
+)
+
+var ErrBlockNotFound = errors.New("block not found")
+
+// inventoryTTL is how long the gateway serves from a loaded inventory, CARs stored meanwhile are found after it
+const inventoryTTL = time.Minute
+
+// inventoryCache keeps the stored CARs by the multihash of their root, so requests don't read every manifest
+type inventoryCache struct {
+	lk       sync.Mutex
+	loadedAt time.Time
+	byRoot   map[string]*StoredCAR
+}
+
+var gatewayInventory inventoryCache
+
+// lookup returns the stored CAR with root c, CIDv0 and CIDv1 roots match. The inventory is loaded again once it's
+// older than inventoryTTL.
+func (i *inventoryCache) lookup(c cid.Cid) (*StoredCAR, error) {
+	i.lk.Lock()
+	defer i.lk.Unlock()
+
+	if time.Since(i.loadedAt) > inventoryTTL {
+		stored, err := loadInventory(BackupOutPath)
+		if err != nil {
+			return nil, err
+		}
+
+		byRoot := make(map[string]*StoredCAR, len(stored))
+		for _, s := range stored {
+			if root, err := cid.Decode(s.Cid); err == nil {
+				byRoot[string(root.Hash())] = s
+			}
+		}
+		i.byRoot, i.loadedAt = byRoot, time.Now()
+	}
+	return i.byRoot[string(c.Hash())], nil
+}
+
+// serveGateway serves /ipfs/<cid>?format=car with the stored CAR of an asset and /ipfs/<cid>?format=raw with a
+// single block, located through the block index of d. The responses follow the trustless gateway spec, so clients
+// can retrieve from the archive and verify what they get.
+func serveGateway(listen string, d *Downloader) {
+	go d.blocks.ensureLoaded()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ipfs/{cid}", d.handleGateway)
+
+	log.Infof("serve gateway on %s", listen)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		log.Errorf("serve gateway: %v", err)
+	}
+}
+
+func (d *Downloader) handleGateway(w http.ResponseWriter, r *http.Request) {
+	c, err := cid.Decode(r.PathValue("cid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s, err := gatewayInventory.lookup(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch gatewayFormat(r) {
+	case "car":
+		// the deal pieces are fetched by the storage providers
+		if s == nil && serveDealPiece(w, r, c) {
+			return
+		}
+		serveStoredCAR(w, r, c, s)
+	case "raw":
+		d.serveBlock(w, c, s)
+	default:
+		http.Error(w, "format must be car or raw", http.StatusBadRequest)
+	}
+}
+
+// gatewayFormat takes the format from the query, falling back to the Accept header as the IPFS gateways do
+func gatewayFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, carContentType):
+		return "car"
+	case strings.Contains(accept, rawContentType):
+		return "raw"
+	}
+	return ""
+}
+
+// serveStoredCAR serves s, the stored CAR with root c
+func serveStoredCAR(w http.ResponseWriter, r *http.Request, c cid.Cid, s *StoredCAR) {
+	if s == nil {
+		http.Error(w, "not in the archive", http.StatusNotFound)
+		return
+	}
+
+	// a packed CAR is served from its aggregate
+	path, base, size := s.Path(), int64(0), s.Size
+	if s.aggregated() {
+		path, base = s.aggregatePath(), s.Offset
+	} else {
+		complete, cleanup, err := completeCAR(s, os.TempDir())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer cleanup()
+		path = complete.Path()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if !s.aggregated() {
+		st, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		size = st.Size()
+	}
+
+	// trustless clients expect CARv1, the payload of a CARv2 is one
+	offset, size, err := carPayload(io.NewSectionReader(f, base, size), size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	offset += base
+
+	setTrustlessHeaders(w, c)
+	w.Header().Set("Content-Type", carContentType+"; version=1")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+c.String()+`.car"`)
+	w.Header().Set("Etag", `"`+c.String()+`.car"`)
+	serveFileSection(w, r, f, offset, size, s.BackupTime)
+}
+
+// carPayload locates the CARv1 payload in the CAR r of size, the whole CAR unless it's a CARv2
+func carPayload(r io.ReaderAt, size int64) (offset, payload int64, err error) {
+	reader, err := car.NewReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if reader.Version == 2 {
+		return int64(reader.Header.DataOffset), int64(reader.Header.DataSize), nil
+	}
+	return 0, size, nil
+}
+
+// serveFileSection serves size bytes of f from offset. The bytes are copied from the file to the socket with
+// sendfile, so restores of large CARs don't pass through user space. Multi-range and conditional requests are left
+// to http.ServeContent.
+func serveFileSection(w http.ResponseWriter, r *http.Request, f *os.File, offset, size int64, modtime time.Time) {
+	if st, err := f.Stat(); err == nil && offset == 0 && st.Size() == size {
+		// ServeContent copies a whole *os.File with sendfile too
+		http.ServeContent(w, r, "", modtime, f)
+		return
+	}
+
+	start, length, ok := singleRange(r)
+	if ok && length < 0 {
+		length = size - start
+	}
+	// unsatisfiable and clipped ranges are answered by ServeContent
+	if !ok || length < 0 || start+length > size || (length == 0 && size > 0) {
+		http.ServeContent(w, r, "", modtime, io.NewSectionReader(f, offset, size))
+		return
+	}
+
+	if _, err := f.Seek(offset+start, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if r.Header.Get("Range") != "" {
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if r.Method != http.MethodHead {
+		io.CopyN(w, f, length)
+	}
+}
+
+// singleRange parses an unconditional request for the whole content or a single byte range, the length is -1 up to
+// the end. Suffix ranges are not handled.
+func singleRange(r *http.Request) (start, length int64, ok bool) {
+	for _, h := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"} {
+		if r.Header.Get(h) != "" {
+			return 0, 0, false
+		}
+	}
+
+	spec := r.Header.Get("Range")
+	if spec == "" {
+		return 0, -1, true
+	}
+
+	spec, found := strings.CutPrefix(spec, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found || first == "" {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end - start + 1, true
+}
+
+func setTrustlessHeaders(w http.ResponseWriter, c cid.Cid) {
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Ipfs-Path", "/ipfs/"+c.String())
+	w.Header().Set("X-Ipfs-Roots", c.String())
+	w.Header().Set("Vary", "Accept")
+}
+
+// serveBlock serves the block c, from root when c is the root of a stored CAR or from the CAR the block index
+// locates it in
+func (d *Downloader) serveBlock(w http.ResponseWriter, c cid.Cid, root *StoredCAR) {
+	s := root
+	if s == nil {
+		if r, ok := d.blocks.lookup(c); ok {
+			rootCid, err := cid.Decode(r)
+			if err == nil {
+				s, err = gatewayInventory.lookup(rootCid)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if s == nil {
+		http.Error(w, "not in the archive", http.StatusNotFound)
+		return
+	}
+
+	block, err := readStoredBlock(s, c)
+	if errors.Is(err, ErrBlockNotFound) || errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "not in the archive", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("gateway: read %s from %s: %v", c, s.Path(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setTrustlessHeaders(w, c)
+	w.Header().Set("Content-Type", rawContentType)
+	w.Header().Set("Etag", `"`+c.String()+`.raw"`)
+	w.Write(block)
+}
+
+// readStoredBlock reads the block c of the stored CAR, a packed CAR is copied out of its aggregate first
+func readStoredBlock(s *StoredCAR, c cid.Cid) ([]byte, error) {
+	if !s.aggregated() {
+		return readBlock(s.Path(), c)
+	}
+
+	full, cleanup, err := completeCAR(s, os.TempDir())
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	defer os.Remove(full.Path() + indexSuffix)
+
+	return readBlock(full.Path(), c)
+}
+
+// readBlock reads the block c of the CAR at path through its index and verifies its hash
+func readBlock(path string, c cid.Cid) ([]byte, error) {
+	idx, err := readIndex(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read index")
+	}
+
+	var offset uint64
+	var found bool
+	err = idx.GetAll(c, func(o uint64) bool {
+		offset, found = o, true
+		return false
+	})
+	if errors.Is(err, index.ErrNotFound) || (err == nil && !found) {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := car.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := reader.DataReader()
+	if err != nil {
+		return nil, err
+	}
+
+	blockCid, block, err := readSection(data, offset)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidCAR, "read block at %d: %v", offset, err)
+	}
+
+	if err := verifyBlockHash(blockCid, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
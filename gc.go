@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/docker/go-units"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	gcInterval = 6 * time.Hour
+	// gcMinAge spares the files of running downloads, which are modified more recently
+	gcMinAge = 24 * time.Hour
+)
+
+type gcReport struct {
+	Files     int
+	Dirs      int
+	Reclaimed int64
+	// Freed are the bytes deleted per backup directory
+	Freed map[string]int64
+}
+
+// isTempFile reports whether name is a partial file, of a download or of a sidecar or archive being written
+func isTempFile(name string) bool {
+	return strings.Contains(name, partSuffix) || strings.HasSuffix(name, ".tmp")
+}
+
+// orphanSidecar reports whether path is the sidecar of a CAR which no longer exists
+func orphanSidecar(path string) bool {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			_, err := os.Stat(strings.TrimSuffix(path, suffix))
+			return os.IsNotExist(err)
+		}
+	}
+	return false
+}
+
+// collectGarbage removes the partial files left by crashed downloads, the sidecars of removed CARs and the backup
+// directories holding neither a CAR nor a manifest entry. Only files not modified for minAge are touched.
+func collectGarbage(minAge time.Duration, dryRun bool) (*gcReport, error) {
+	report := &gcReport{Freed: make(map[string]int64)}
+	cutoff := time.Now().Add(-minAge)
+
+	remove := func(path string, size int64) {
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				log.Errorf("gc: %v", err)
+				return
+			}
+		}
+		log.Infof("gc: removed %s", path)
+		report.Freed[filepath.Dir(path)] += size
+		report.Files++
+		report.Reclaimed += size
+	}
+
+	for _, root := range outputRoots() {
+		staging := stagingDirOf(root)
+		if staged, err := os.ReadDir(staging); err == nil {
+			for _, f := range staged {
+				if info, err := f.Info(); err == nil && !f.IsDir() && info.ModTime().Before(cutoff) {
+					remove(filepath.Join(staging, f.Name()), info.Size())
+				}
+			}
+		}
+	}
+
+	dirs, err := os.ReadDir(BackupOutPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range dirs {
+		if _, err := dirDate(d.Name()); err != nil || !isBackupDir(BackupOutPath, d) {
+			continue
+		}
+		dir := filepath.Join(BackupOutPath, d.Name())
+
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return report, err
+		}
+
+		var cars int
+		for _, f := range files {
+			info, err := f.Info()
+			if err != nil || f.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+
+			switch {
+			case info.ModTime().After(cutoff):
+			case isTempFile(f.Name()), orphanSidecar(path):
+				remove(path, info.Size())
+				continue
+			}
+
+			if strings.HasSuffix(f.Name(), ".car") {
+				cars++
+			}
+		}
+
+		if cars > 0 {
+			continue
+		}
+
+		// untracked CARs are left to reconcile, only directories without any CAR are dropped
+		entries, err := readManifest(dir)
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		size, _ := getDirSize(dir)
+		if !dryRun {
+			if err := removeBackupDir(dir); err != nil {
+				log.Errorf("gc: %v", err)
+				continue
+			}
+		}
+		log.Infof("gc: removed directory %s without CARs", dir)
+		report.Dirs++
+		report.Reclaimed += size
+		report.Freed[dir] += size
+	}
+	return report, nil
+}
+
+// gc collects the garbage every gcInterval
+func (d *Downloader) gc() {
+	for {
+		time.Sleep(gcInterval)
+
+		report, err := collectGarbage(gcMinAge, false)
+		if err != nil {
+			log.Errorf("gc: %v", err)
+			continue
+		}
+
+		if report.Files > 0 || report.Dirs > 0 {
+			d.dirSize.free(report.Freed)
+
+			log.Infof("gc: removed %d files and %d directories, reclaimed %s", report.Files, report.Dirs, units.BytesSize(float64(report.Reclaimed)))
+		}
+	}
+}
+
+func gcCmd(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report the garbage without removing it")
+	minAge := fs.Duration("min-age", gcMinAge, "remove only files not modified for this long, 0 when no download is running")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := collectGarbage(*minAge, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%d files and %d directories, %s reclaimed\n", report.Files, report.Dirs, units.BytesSize(float64(report.Reclaimed)))
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+var (
+	// graphsyncEnabled fetches from the sources advertising a /p2p multiaddr over graphsync, the native data transfer
+	// of the nodes, instead of skipping them. It takes effect in builds with the libp2p tag.
+	graphsyncEnabled bool
+	// graphsyncTimeout bounds the graphsync fetch of an asset
+	graphsyncTimeout = time.Minute * 30
+)
+
+// graphsyncTransport is recorded as the transport of the CARs fetched over graphsync
+const graphsyncTransport = "graphsync"
+
+// isP2PAddr reports whether the address of a source is a libp2p multiaddr rather than an http address
+func isP2PAddr(addr string) bool {
+	return strings.HasPrefix(addr, "/") && strings.Contains(addr, "/p2p/")
+}
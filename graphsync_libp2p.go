@@ -0,0 +1,139 @@
+//go:build libp2p
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	gsimpl "github.com/ipfs/go-graphsync/impl"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pkg/errors"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// graphsyncNode is the graphsync exchange of the libp2p host. Every request persists its blocks through a link system
+// of its own, writing them straight into the CAR of the request.
+var graphsyncNode struct {
+	once     sync.Once
+	exchange graphsync.GraphExchange
+	// options maps the peer and root of an outgoing request to the persistence option of its CAR
+	options sync.Map
+	seq     atomic.Int64
+	err     error
+}
+
+func startGraphsync() error {
+	graphsyncNode.once.Do(func() {
+		h, err := startHost()
+		if err != nil {
+			graphsyncNode.err = err
+			return
+		}
+
+		// the default link system has no storage, the host only requests and serves nothing
+		exchange := gsimpl.New(context.Background(), gsnet.NewFromLibp2pHost(h), cidlink.DefaultLinkSystem())
+		exchange.RegisterOutgoingRequestHook(func(p peer.ID, request graphsync.RequestData, actions graphsync.OutgoingRequestHookActions) {
+			if name, ok := graphsyncNode.options.Load(requestKey(p, request.Root().String())); ok {
+				actions.UsePersistenceOption(name.(string))
+			}
+		})
+		graphsyncNode.exchange = exchange
+	})
+	return graphsyncNode.err
+}
+
+// requestKey identifies the outgoing request of root to peer p
+func requestKey(p peer.ID, root string) string {
+	return p.String() + "/" + root
+}
+
+// fetchGraphsync requests the whole DAG of root over graphsync from the node of a /p2p multiaddr, the native data
+// transfer of the nodes without a reachable http listener. The blocks are verified by graphsync as they arrive and
+// written into path as CARv1 in the order of the traversal, only their offsets are held in memory.
+func fetchGraphsync(ctx context.Context, addr, root, path string, size int64) (*fetchResult, error) {
+	if err := startGraphsync(); err != nil {
+		return nil, err
+	}
+
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode root cid %s", root)
+	}
+
+	id, err := connectPeer(ctx, libp2pHost.host, addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "connect")
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	out, err := storage.NewReadableWritable(file, []cid.Cid{rootCid}, car.WriteAsCarV1(true))
+	if err != nil {
+		return nil, err
+	}
+
+	// blocks graphsync already holds in the request are read back from the CAR
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(out)
+	lsys.SetWriteStorage(out)
+
+	name := fmt.Sprintf("car-%d", graphsyncNode.seq.Add(1))
+	if err := graphsyncNode.exchange.RegisterPersistenceOption(name, lsys); err != nil {
+		return nil, err
+	}
+	defer graphsyncNode.exchange.UnregisterPersistenceOption(name)
+
+	key := requestKey(id, cidlink.Link{Cid: rootCid}.String())
+	if _, loaded := graphsyncNode.options.LoadOrStore(key, name); loaded {
+		return nil, errors.Errorf("%s is already being fetched from %s", root, id)
+	}
+	defer graphsyncNode.options.Delete(key)
+
+	ctx, cancel := context.WithTimeout(ctx, graphsyncTimeout)
+	defer cancel()
+
+	progress, errs := graphsyncNode.exchange.Request(ctx, id, cidlink.Link{Cid: rootCid}, selectorparse.CommonSelector_ExploreAllRecursively)
+	go func() {
+		for range progress {
+		}
+	}()
+	for err := range errs {
+		// a missing block is reported here too, the request ends with the channel
+		if err != nil {
+			return nil, errors.Wrap(err, "graphsync request")
+		}
+	}
+
+	if err := out.Finalize(); err != nil {
+		return nil, err
+	}
+	if durable {
+		if err := file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	result, err := fileResult(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Transport = graphsyncTransport
+	return result, nil
+}
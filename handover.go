@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// handoverTimeout is how long the running downloads are given to finish before the new binary takes over
+var handoverTimeout = 10 * time.Minute
+
+// handoverFile holds the queue the new binary resumes with
+var handoverFile = filepath.Join(BackupOutPath, ".handover.json")
+
+// errUpgradeRunning rejects an upgrade while another one hands over
+var errUpgradeRunning = errors.New("upgrade already running")
+
+// Handover is the checkpoint of the queue written for the new binary
+type Handover struct {
+	// Jobs are the admitted jobs not started yet and the downloads interrupted by the handover
+	Jobs []*model.Asset `json:"jobs"`
+	// Tenants are the jobs of every tenant by name, like Jobs
+	Tenants map[string][]*model.Asset `json:"tenants,omitempty"`
+	// Interrupted are the cids of the downloads which didn't finish within the timeout
+	Interrupted []string  `json:"interrupted,omitempty"`
+	WrittenAt   time.Time `json:"written_at"`
+}
+
+// checkpoint stops starting jobs of the downloader and its tenants, waits up to timeout for the running downloads to
+// finish and writes the jobs left to handoverFile
+func (d *Downloader) checkpoint(timeout time.Duration) (*Handover, error) {
+	accounts := append([]*Downloader{d}, d.tenants...)
+	for _, a := range accounts {
+		a.draining.Store(true)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var running int
+		for _, a := range accounts {
+			a.dlk.Lock()
+			running += len(a.downloading)
+			a.dlk.Unlock()
+		}
+
+		if running == 0 || time.Now().After(deadline) {
+			break
+		}
+		log.Infof("handover: waiting for %d downloads", running)
+		time.Sleep(time.Second)
+	}
+
+	h := &Handover{WrittenAt: time.Now()}
+
+	var interrupted []string
+	h.Jobs, interrupted = d.jobsLeft()
+	h.Interrupted = append(h.Interrupted, interrupted...)
+	if len(d.tenants) > 0 {
+		h.Tenants = make(map[string][]*model.Asset, len(d.tenants))
+	}
+	for _, t := range d.tenants {
+		h.Tenants[t.tenant], interrupted = t.jobsLeft()
+		h.Interrupted = append(h.Interrupted, interrupted...)
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(stagingPath(handoverFile), data, 0664); err != nil {
+		return nil, err
+	}
+	return h, os.Rename(stagingPath(handoverFile), handoverFile)
+}
+
+// waitUndrained blocks while a handover drains the downloader. The jobs held meanwhile stay queued, they are
+// checkpointed for the new binary and start here when it fails to take over.
+func (d *Downloader) waitUndrained() {
+	for d.draining.Load() {
+		time.Sleep(time.Second)
+	}
+}
+
+// undrain lets the downloader and its tenants start jobs again after a failed handover
+func (d *Downloader) undrain() {
+	d.draining.Store(false)
+	for _, t := range d.tenants {
+		t.draining.Store(false)
+	}
+}
+
+// jobsLeft returns the admitted jobs not started yet and the running downloads, and the cids of the latter
+func (d *Downloader) jobsLeft() ([]*model.Asset, []string) {
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	var jobs []*model.Asset
+	var interrupted []string
+	for cid, running := range d.downloading {
+		jobs = append(jobs, running.asset)
+		interrupted = append(interrupted, cid)
+	}
+	for _, asset := range d.queued {
+		jobs = append(jobs, asset)
+	}
+	return jobs, interrupted
+}
+
+// takeHandover reads the queue checkpointed by the previous binary and removes the checkpoint, so it's resumed once
+func takeHandover() *Handover {
+	data, err := os.ReadFile(handoverFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("read handover: %v", err)
+		}
+		return nil
+	}
+	os.Remove(handoverFile)
+
+	var h Handover
+	if err := json.Unmarshal(data, &h); err != nil {
+		log.Errorf("decode handover: %v", err)
+		return nil
+	}
+
+	log.Infof("resume %d jobs handed over at %s, %d interrupted downloads start over", h.count(), h.WrittenAt.Format(time.RFC3339), len(h.Interrupted))
+	return &h
+}
+
+// count returns the number of jobs handed over, those of the tenants included
+func (h *Handover) count() int {
+	count := len(h.Jobs)
+	for _, jobs := range h.Tenants {
+		count += len(jobs)
+	}
+	return count
+}
+
+// jobs returns the jobs handed over to the tenant, to the account of the flags for "". A nil handover has none.
+func (h *Handover) jobs(tenant string) []*model.Asset {
+	if h == nil {
+		return nil
+	}
+	if tenant == "" {
+		return h.Jobs
+	}
+	return h.Tenants[tenant]
+}
+
+// resume queues the jobs handed over by the previous binary ahead of the first poll
+func (d *Downloader) resume(jobs []*model.Asset) {
+	if len(jobs) == 0 {
+		return
+	}
+
+	d.running = true
+	go d.Push(jobs)
+}
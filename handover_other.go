@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// upgradeOnSignal is not supported, there is no SIGHUP on this platform
+func (d *Downloader) upgradeOnSignal() {}
+
+// upgrade is not supported, a process can't be replaced in place on this platform
+func (d *Downloader) upgrade() error {
+	return errors.New("upgrade not supported on this platform")
+}
@@ -0,0 +1,57 @@
+//go:build unix
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// execBinary replaces the process with the binary, it only returns on failure
+var execBinary = syscall.Exec
+
+// upgradeOnSignal hands over to the binary at the path of the running one on SIGHUP. The queue is checkpointed and
+// the new binary is executed in place of this process with the same arguments, keeping its pid for the supervisor.
+// A failed upgrade leaves this process running and waiting for the next SIGHUP.
+func (d *Downloader) upgradeOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := d.upgrade(); err != nil {
+			log.Errorf("upgrade: %v", err)
+		}
+	}
+}
+
+// upgrade checkpoints the queue and executes the new binary. When the binary can't be executed the checkpoint is
+// dropped and the downloader starts jobs again, its scheduler clients reconnect on the next call.
+func (d *Downloader) upgrade() error {
+	if !d.upgrading.CompareAndSwap(false, true) {
+		return errUpgradeRunning
+	}
+	defer d.upgrading.Store(false)
+
+	bin, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	h, err := d.checkpoint(handoverTimeout)
+	if err != nil {
+		d.undrain()
+		return err
+	}
+	d.Close()
+
+	log.Infof("upgrade: handing %d jobs over to %s", h.count(), bin)
+	err = execBinary(bin, os.Args, os.Environ())
+
+	// still running, a later restart must not resume the jobs a second time
+	if rerr := os.Remove(handoverFile); rerr != nil && !os.IsNotExist(rerr) {
+		log.Errorf("upgrade: remove handover: %v", rerr)
+	}
+	d.undrain()
+	return errors.Wrapf(err, "exec %s", bin)
+}
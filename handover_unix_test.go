@@ -0,0 +1,118 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// withFailingExec makes the exec of the new binary fail, it returns the number of attempts
+func withFailingExec(t *testing.T) *atomic.Int32 {
+	var attempts atomic.Int32
+	oldExec, oldFile := execBinary, handoverFile
+	execBinary = func(string, []string, []string) error {
+		attempts.Add(1)
+		return syscall.ENOEXEC
+	}
+	handoverFile = filepath.Join(t.TempDir(), ".handover.json")
+	t.Cleanup(func() { execBinary, handoverFile = oldExec, oldFile })
+	return &attempts
+}
+
+func TestUpgradeExecFailure(t *testing.T) {
+	withFailingExec(t)
+	d := &Downloader{dirSize: &dirSizes{sizes: make(map[string]int64)}}
+
+	if err := d.upgrade(); !errors.Is(err, syscall.ENOEXEC) {
+		t.Fatalf("upgrade: %v, want the exec error", err)
+	}
+	if d.draining.Load() {
+		t.Error("the downloader still drains after the failed upgrade")
+	}
+	if _, err := os.Stat(handoverFile); !os.IsNotExist(err) {
+		t.Errorf("the handover is left for a later restart: %v", err)
+	}
+}
+
+func TestUpgradeOnSignalRetries(t *testing.T) {
+	attempts := withFailingExec(t)
+	d := &Downloader{dirSize: &dirSizes{sizes: make(map[string]int64)}}
+
+	// a SIGHUP before the handler is registered must not end the test process
+	ignored := make(chan os.Signal, 16)
+	signal.Notify(ignored, syscall.SIGHUP)
+	defer signal.Stop(ignored)
+
+	go d.upgradeOnSignal()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for attempts.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d upgrades attempted, want another one after the failed exec", attempts.Load())
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestUpgradeExecFailureRunsQueued(t *testing.T) {
+	withFailingExec(t)
+	started := make(chan string, 1)
+	oldRun := runJob
+	runJob = func(d *Downloader, a *model.Asset) { started <- a.Cid }
+	t.Cleanup(func() { runJob = oldRun })
+
+	d := &Downloader{
+		concurrent:      1,
+		JobQueue:        make(chan *model.Asset, 1),
+		downWorkerQueue: make(chan worker, 1),
+		dirSize:         &dirSizes{sizes: make(map[string]int64)},
+		downloading:     make(map[string]*runningJob),
+		queued:          make(map[string]*model.Asset),
+		recent:          make(map[string]*JobStatus),
+	}
+	go d.run()
+
+	// the job is admitted while the handover drains the downloader
+	d.draining.Store(true)
+	go d.dispatch([]*model.Asset{{Cid: "queued"}})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.dlk.Lock()
+		_, ok := d.queued["queued"]
+		d.dlk.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the job is not queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	d.upgrading.Store(true)
+	if err := d.upgrade(); !errors.Is(err, errUpgradeRunning) {
+		t.Fatalf("upgrade: %v, want it refused while another one runs", err)
+	}
+	d.upgrading.Store(false)
+
+	if err := d.upgrade(); !errors.Is(err, syscall.ENOEXEC) {
+		t.Fatalf("upgrade: %v, want the exec error", err)
+	}
+	select {
+	case cid := <-started:
+		if cid != "queued" {
+			t.Errorf("started %s, want the queued job", cid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued job didn't start after the failed upgrade")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// restoreHistoryFile records every restore, one json RestoreRecord per line
+var restoreHistoryFile = filepath.Join(BackupOutPath, "restores.jsonl")
+
+// jsonlLk serializes the appends to the history files
+var jsonlLk sync.Mutex
+
+const (
+	RestoreComplete = "complete"
+	// RestorePending is a restore submitted to the network which didn't reach its replica target in time
+	RestorePending = "pending"
+	RestoreFailed  = "failed"
+)
+
+type RestoreRecord struct {
+	Cid         string    `json:"cid"`
+	Scheduler   string    `json:"scheduler,omitempty"`
+	State       string    `json:"state"`
+	Replicas    int       `json:"replicas"`
+	Target      int       `json:"target,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	SubmittedAt time.Time `json:"submitted_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+}
+
+// appendRestoreHistory appends the record to the restore history
+func appendRestoreHistory(record *RestoreRecord) error {
+	return appendJSONL(restoreHistoryFile, record)
+}
+
+// appendJSONL appends v as a json line to the file at path
+func appendJSONL(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	jsonlLk.Lock()
+	defer jsonlLk.Unlock()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(data, '\n'))
+	if err == nil && durable {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"io"
+	"math"
+	"os"
+)
+
+// indexSuffix marks the sidecar CARv2 index of a stored CAR, it lets single blocks be located without scanning the CAR
+const indexSuffix = ".idx"
+
+// multihashIndexSorted is the codec of the standard CARv2 index keyed by multihash, which external tooling consumes
+const multihashIndexSorted = 0x0401
+
+// writeIndex writes the CARv2 index of the CAR at carPath into its sidecar file. The index embedded in a CARv2 is
+// reused when it's keyed by multihash, otherwise the CAR is indexed by scanning it. Offsets are relative to the CAR
+// data payload.
+func writeIndex(carPath string) error {
+	f, err := os.Open(carPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	idx, err := car.ReadOrGenerateIndex(f, car.StoreIdentityCIDs(true))
+	if err != nil {
+		return err
+	}
+
+	if idx.Codec() != multihashIndexSorted {
+		if idx, err = generateMultihashIndex(f); err != nil {
+			return err
+		}
+	}
+
+	idxPath := carPath + indexSuffix
+	out, err := os.Create(stagingPath(idxPath))
+	if err != nil {
+		return err
+	}
+
+	_, err = index.WriteTo(idx, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(stagingPath(idxPath))
+		return err
+	}
+
+	return os.Rename(stagingPath(idxPath), idxPath)
+}
+
+// generateMultihashIndex indexes the data payload of the CAR by multihash
+func generateMultihashIndex(f io.ReaderAt) (index.Index, error) {
+	reader, err := car.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := reader.DataReader()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := index.NewMultihashSorted()
+	if err := car.LoadIndex(idx, data, car.StoreIdentityCIDs(true)); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// readIndex reads the sidecar index of the CAR at carPath, a missing sidecar is generated first
+func readIndex(carPath string) (index.Index, error) {
+	f, err := os.Open(carPath + indexSuffix)
+	if os.IsNotExist(err) {
+		if err := writeIndex(carPath); err != nil {
+			return nil, err
+		}
+		f, err = os.Open(carPath + indexSuffix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return index.ReadFrom(f)
+}
+
+// readSection reads the block of the CAR data section starting at offset
+func readSection(data io.ReaderAt, offset uint64) (cid.Cid, []byte, error) {
+	br := bufio.NewReader(io.NewSectionReader(data, int64(offset), math.MaxInt64-int64(offset)))
+
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	section := make([]byte, length)
+	if _, err := io.ReadFull(br, section); err != nil {
+		return cid.Undef, nil, err
+	}
+
+	n, c, err := cid.CidFromBytes(section)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	return c, section[n:], nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// aggregateIndexFile maps every multihash of the archive to the ordinal of its CAR in aggregateCarsFile
+	aggregateIndexFile = "aggregate.idx"
+	// aggregateCarsFile lists the CARs of the aggregate index, one "<ordinal>\t<cid>\t<path>" per line
+	aggregateCarsFile = "aggregate.cars"
+)
+
+// standardIndex reads the sidecar index of the CAR, rewriting sidecars written in another codec
+func standardIndex(carPath string) (index.IterableIndex, error) {
+	idx, err := readIndex(carPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if idx.Codec() != multihashIndexSorted {
+		if err := writeIndex(carPath); err != nil {
+			return nil, err
+		}
+		if idx, err = readIndex(carPath); err != nil {
+			return nil, err
+		}
+	}
+
+	iterable, ok := idx.(index.IterableIndex)
+	if !ok {
+		return nil, errors.Errorf("index codec %x not iterable", idx.Codec())
+	}
+	return iterable, nil
+}
+
+// storedIndex returns the index of the stored CAR, a packed CAR is indexed from a copy out of its aggregate
+func storedIndex(s *StoredCAR) (index.IterableIndex, error) {
+	if !s.aggregated() {
+		return standardIndex(s.Path())
+	}
+
+	full, cleanup, err := completeCAR(s, os.TempDir())
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	defer os.Remove(full.Path() + indexSuffix)
+
+	return standardIndex(full.Path())
+}
+
+func writeIndexFile(path string, idx index.Index) error {
+	out, err := os.Create(path + partSuffix)
+	if err != nil {
+		return err
+	}
+
+	_, err = index.WriteTo(idx, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + partSuffix)
+		return err
+	}
+	return os.Rename(path+partSuffix, path)
+}
+
+func indexExportCmd(args []string) error {
+	fs := flag.NewFlagSet("index-export", flag.ExitOnError)
+	outDir := fs.String("out", "", "directory the indexes are written to")
+	aggregate := fs.Bool("aggregate", false, "also write an index over the whole archive")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *outDir == "" {
+		return fmt.Errorf("usage: index-export -out <dir> [-aggregate]")
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return err
+	}
+
+	var records []index.Record
+	var cars *bufio.Writer
+	if *aggregate {
+		f, err := os.Create(filepath.Join(*outDir, aggregateCarsFile))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cars = bufio.NewWriter(f)
+	}
+
+	for i, s := range stored {
+		idx, err := storedIndex(s)
+		if err != nil {
+			return errors.Wrapf(err, "index of %s", s.Path())
+		}
+
+		if err := writeIndexFile(filepath.Join(*outDir, s.Cid+".car"+indexSuffix), idx); err != nil {
+			return err
+		}
+
+		if !*aggregate {
+			continue
+		}
+
+		ordinal := uint64(i)
+		err = idx.ForEach(func(mh multihash.Multihash, _ uint64) error {
+			// the multihash sorted index only keeps the multihash of the cid
+			records = append(records, index.Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: ordinal})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cars, "%d\t%s\t%s\n", ordinal, s.Cid, s.Path())
+	}
+
+	if *aggregate {
+		if err := cars.Flush(); err != nil {
+			return err
+		}
+
+		idx := index.NewMultihashSorted()
+		if err := idx.Load(records); err != nil {
+			return err
+		}
+		if err := writeIndexFile(filepath.Join(*outDir, aggregateIndexFile), idx); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "exported the indexes of %d CARs to %s\n", len(stored), *outDir)
+	return nil
+}
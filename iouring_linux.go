@@ -0,0 +1,332 @@
+//go:build linux && iouring
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysIOUringSetup = 425
+	sysIOUringEnter = 426
+
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+
+	ioringOpWrite         = 23
+	ioringEnterGetEvents  = 1
+	ioringEntries         = 8
+	ioringWriteBuffers    = 4
+	ioringWriteBufferSize = 1 << 20
+)
+
+type ioSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioUringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioSQRingOffsets
+	cqOff                                                                  ioCQRingOffsets
+}
+
+type ioUringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type ioUringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is a minimal io_uring submitting writes and reaping their completions
+type uring struct {
+	fd     int
+	params ioUringParams
+	sqRing []byte
+	cqRing []byte
+	sqes   []byte
+}
+
+func newURing(entries uint32) (*uring, error) {
+	r := &uring{}
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&r.params)), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "io_uring_setup")
+	}
+	r.fd = int(fd)
+
+	var err error
+	p := &r.params
+	if r.sqRing, err = syscall.Mmap(r.fd, ioringOffSQRing, int(p.sqOff.array+p.sqEntries*4),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, errors.Wrap(err, "mmap sq ring")
+	}
+	if r.cqRing, err = syscall.Mmap(r.fd, ioringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(ioUringCQE{}))),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, errors.Wrap(err, "mmap cq ring")
+	}
+	if r.sqes, err = syscall.Mmap(r.fd, ioringOffSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(ioUringSQE{}))),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, errors.Wrap(err, "mmap sqes")
+	}
+	return r, nil
+}
+
+func (r *uring) u32(ring []byte, off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&ring[off]))
+}
+
+// submitWrite queues a write of buf at off of fd and submits it
+func (r *uring) submitWrite(fd int, buf []byte, off int64, userData uint64) error {
+	p := &r.params
+	tail := atomic.LoadUint32(r.u32(r.sqRing, p.sqOff.tail))
+	index := tail & *r.u32(r.sqRing, p.sqOff.ringMask)
+
+	sqe := (*ioUringSQE)(unsafe.Pointer(&r.sqes[uintptr(index)*unsafe.Sizeof(ioUringSQE{})]))
+	*sqe = ioUringSQE{
+		opcode:   ioringOpWrite,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		len:      uint32(len(buf)),
+		userData: userData,
+	}
+	*r.u32(r.sqRing, p.sqOff.array+index*4) = index
+	atomic.StoreUint32(r.u32(r.sqRing, p.sqOff.tail), tail+1)
+
+	return r.enter(1, 0)
+}
+
+func (r *uring) enter(toSubmit, minComplete uint32) error {
+	for {
+		var flags uintptr
+		if minComplete > 0 {
+			flags = ioringEnterGetEvents
+		}
+		_, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), flags, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errors.Wrap(errno, "io_uring_enter")
+		}
+		return nil
+	}
+}
+
+// reap waits for a completion and returns it
+func (r *uring) reap() (ioUringCQE, error) {
+	p := &r.params
+	for {
+		head := atomic.LoadUint32(r.u32(r.cqRing, p.cqOff.head))
+		if head != atomic.LoadUint32(r.u32(r.cqRing, p.cqOff.tail)) {
+			index := head & *r.u32(r.cqRing, p.cqOff.ringMask)
+			cqe := *(*ioUringCQE)(unsafe.Pointer(&r.cqRing[uintptr(p.cqOff.cqes)+uintptr(index)*unsafe.Sizeof(ioUringCQE{})]))
+			atomic.StoreUint32(r.u32(r.cqRing, p.cqOff.head), head+1)
+			return cqe, nil
+		}
+
+		if err := r.enter(0, 1); err != nil {
+			return ioUringCQE{}, err
+		}
+	}
+}
+
+func (r *uring) close() {
+	for _, m := range [][]byte{r.sqRing, r.cqRing, r.sqes} {
+		if m != nil {
+			syscall.Munmap(m)
+		}
+	}
+	syscall.Close(r.fd)
+}
+
+// uringWriter writes through a ring, so the next buffer is filled from the network while the disk writes the
+// previous ones
+type uringWriter struct {
+	f      *os.File
+	ring   *uring
+	direct bool
+
+	bufs     [][]byte
+	offsets  []int64
+	lengths  []int
+	free     []int
+	inflight int
+
+	cur     int
+	n       int
+	written int64
+	err     error
+	flushed bool
+}
+
+func newUringWriter(f *os.File, direct bool) (carFile, error) {
+	ring, err := newURing(ioringEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	buffers.acquire(ioringWriteBuffers * ioringWriteBufferSize)
+
+	w := &uringWriter{f: f, ring: ring, direct: direct}
+	for i := 0; i < ioringWriteBuffers; i++ {
+		w.bufs = append(w.bufs, alignedBuffer(ioringWriteBufferSize))
+		w.free = append(w.free, i)
+	}
+	w.offsets = make([]int64, ioringWriteBuffers)
+	w.lengths = make([]int, ioringWriteBuffers)
+	w.cur = w.take()
+	return w, nil
+}
+
+func (w *uringWriter) take() int {
+	i := w.free[len(w.free)-1]
+	w.free = w.free[:len(w.free)-1]
+	return i
+}
+
+// reapWrite waits for the completion of a write of the ring
+var reapWrite = (*uring).reap
+
+// complete reaps one write, a short write is finished synchronously
+func (w *uringWriter) complete() error {
+	cqe, err := reapWrite(w.ring)
+	if err != nil {
+		return err
+	}
+	w.inflight--
+
+	i := int(cqe.userData)
+	w.free = append(w.free, i)
+
+	if cqe.res < 0 {
+		return errors.Wrap(syscall.Errno(-cqe.res), "io_uring write")
+	}
+	if done := int(cqe.res); done < w.lengths[i] {
+		// direct writes need an aligned offset and length, the rest is written again from the block holding done
+		if w.direct {
+			done &^= directIOAlign - 1
+		}
+		if _, err := w.f.WriteAt(w.bufs[i][done:w.lengths[i]], w.offsets[i]+int64(done)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *uringWriter) submit(length int) error {
+	i := w.cur
+	w.offsets[i], w.lengths[i] = w.written, length
+	if err := w.ring.submitWrite(int(w.f.Fd()), w.bufs[i][:length], w.written, uint64(i)); err != nil {
+		return err
+	}
+	w.inflight++
+
+	if len(w.free) == 0 {
+		if err := w.complete(); err != nil {
+			return err
+		}
+	}
+	w.cur = w.take()
+	return nil
+}
+
+func (w *uringWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	var total int
+	for len(p) > 0 {
+		c := copy(w.bufs[w.cur][w.n:], p)
+		w.n += c
+		total += c
+		p = p[c:]
+
+		if w.n == ioringWriteBufferSize {
+			if w.err = w.submit(w.n); w.err != nil {
+				return total, w.err
+			}
+			w.written += int64(w.n)
+			w.n = 0
+		}
+	}
+	return total, nil
+}
+
+// flush writes the tail, padded for direct I/O, and waits for every write
+func (w *uringWriter) flush() error {
+	if w.flushed {
+		return w.err
+	}
+	w.flushed = true
+
+	if w.err == nil && w.n > 0 {
+		length := w.n
+		if w.direct {
+			length = (w.n + directIOAlign - 1) &^ (directIOAlign - 1)
+			clear(w.bufs[w.cur][w.n:length])
+		}
+		w.err = w.submit(length)
+		w.written += int64(w.n)
+	}
+
+	for w.inflight > 0 {
+		if err := w.complete(); err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+
+	if w.err == nil && w.direct {
+		w.err = w.f.Truncate(w.written)
+	}
+	return w.err
+}
+
+func (w *uringWriter) Sync() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+func (w *uringWriter) Close() error {
+	err := w.flush()
+	w.ring.close()
+	buffers.release(ioringWriteBuffers * ioringWriteBufferSize)
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
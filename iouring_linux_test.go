@@ -0,0 +1,86 @@
+//go:build linux && iouring
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testShortWrite writes data through an io_uring writer whose first write completes short, the bytes past the short
+// count are overwritten with garbage as if they never reached the disk
+func testShortWrite(t *testing.T, direct bool) {
+	data := bytes.Repeat([]byte("titan"), (3*directIOAlign+17)/5)
+	short := directIOAlign + 100
+
+	path := filepath.Join(t.TempDir(), "uring.car")
+	var f *os.File
+	var err error
+	if direct {
+		if f, err = openDirect(path); err != nil {
+			t.Skipf("no direct I/O on the temp dir: %v", err)
+		}
+	} else if f, err = os.Create(path); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newUringWriter(f, direct)
+	if err != nil {
+		f.Close()
+		t.Skipf("no io_uring: %v", err)
+	}
+
+	reap := reapWrite
+	defer func() { reapWrite = reap }()
+	shortened := false
+	reapWrite = func(r *uring) (ioUringCQE, error) {
+		cqe, err := reap(r)
+		if err != nil || shortened {
+			return cqe, err
+		}
+		shortened = true
+
+		garbage, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer garbage.Close()
+		st, err := garbage.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := garbage.WriteAt(bytes.Repeat([]byte{0xff}, int(st.Size())-short), int64(short)); err != nil {
+			t.Fatal(err)
+		}
+		cqe.res = int32(short)
+		return cqe, nil
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close after a short write: %v", err)
+	}
+	if !shortened {
+		t.Fatal("no write completed")
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("wrote %d bytes, read back %d differing bytes", len(data), len(got))
+	}
+}
+
+func TestUringShortWrite(t *testing.T) {
+	testShortWrite(t, false)
+}
+
+func TestUringShortWriteDirect(t *testing.T) {
+	testShortWrite(t, true)
+}
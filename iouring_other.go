@@ -0,0 +1,13 @@
+//go:build !linux || !iouring
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// newUringWriter is not available, io_uring requires Linux and the iouring build tag
+func newUringWriter(f *os.File, direct bool) (carFile, error) {
+	return nil, errors.New("built without io_uring support, build on linux with -tags iouring")
+}
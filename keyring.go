@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// keyringService is the service the credentials are stored under in the OS keyring
+	keyringService = "titan-storage-backup"
+	keyringScheme  = "keyring:"
+)
+
+var errKeyringNotFound = errors.New("not found in keyring")
+
+// keyringFlags are taken from the keyring when not given, so a single host install runs without credentials in its
+// arguments once logged in
+var keyringFlags = []string{"token", "password", "w3s_token"}
+
+// keyringDefaults sets the keyringFlags left empty from the keyring
+func keyringDefaults() {
+	for _, name := range keyringFlags {
+		f := flag.Lookup(name)
+		if f == nil || f.Value.String() != "" {
+			continue
+		}
+		if name == "token" && (tokenFile != "" || tokenRefreshURL != "") {
+			continue
+		}
+
+		value, err := keyringGet(name)
+		if err != nil {
+			if !errors.Is(err, errKeyringNotFound) {
+				log.Debugf("keyring lookup of %s: %v", name, err)
+			}
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			log.Errorf("set %s: %v", name, err)
+			continue
+		}
+		log.Infof("%s taken from the keyring", name)
+	}
+}
+
+// loginCmd stores a credential in the OS keyring, the token unless another flag is named
+func loginCmd(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	logout := fs.Bool("logout", false, "remove the credential from the keyring")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	name := "token"
+	if fs.NArg() > 0 {
+		name = fs.Arg(0)
+	}
+	if flag.Lookup(name) == nil {
+		return fmt.Errorf("no flag %s", name)
+	}
+
+	if *logout {
+		if err := keyringDelete(name); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s removed from the keyring\n", name)
+		return nil
+	}
+
+	value, err := readSecret(fmt.Sprintf("%s: ", name))
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return errors.New("empty value")
+	}
+
+	if err := keyringSet(name, value); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s stored in the keyring of %s, pass --%s=%s%s or leave it empty to use it\n", name, keyringService, name, keyringScheme, name)
+	return nil
+}
+
+// readSecret reads a line from stdin, without echo when it's a terminal
+func readSecret(prompt string) (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, prompt)
+		if stty("-echo") == nil {
+			defer func() {
+				stty("echo")
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func stty(mode string) error {
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,48 @@
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// the login keychain is reached through security(1)
+
+// errSecItemNotFound is the exit status of security when no item matches
+const errSecItemNotFound = 44
+
+func keyringGet(name string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", keyringService, "-a", name, "-w").Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() == errSecItemNotFound {
+			return "", errKeyringNotFound
+		}
+		return "", fmt.Errorf("security find-generic-password: %w", err)
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// keyringSet passes the value through the interactive mode of security, so it doesn't show in the arguments
+func keyringSet(name, value string) error {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s \"%s\" -a \"%s\" -w \"%s\"\n", keyringService, quote.Replace(name), quote.Replace(value)))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil || stderr.Len() > 0 {
+		return fmt.Errorf("security add-generic-password: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func keyringDelete(name string) error {
+	if err := exec.Command("security", "delete-generic-password", "-s", keyringService, "-a", name).Run(); err != nil {
+		return fmt.Errorf("security delete-generic-password: %w", err)
+	}
+	return nil
+}
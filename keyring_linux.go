@@ -0,0 +1,43 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// the Secret Service is reached through secret-tool of libsecret
+
+func keyringGet(name string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", keyringService, "account", name).Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && len(out) == 0 && len(exit.Stderr) == 0 {
+			return "", errKeyringNotFound
+		}
+		return "", fmt.Errorf("secret-tool lookup: %w", err)
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func keyringSet(name, value string) error {
+	cmd := exec.Command("secret-tool", "store", "--label", keyringService+" "+name, "service", keyringService, "account", name)
+	cmd.Stdin = strings.NewReader(value)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("secret-tool store: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func keyringDelete(name string) error {
+	if err := exec.Command("secret-tool", "clear", "service", keyringService, "account", name).Run(); err != nil {
+		return fmt.Errorf("secret-tool clear: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "errors"
+
+var errKeyringUnsupported = errors.New("no OS keyring on this platform")
+
+func keyringGet(name string) (string, error) { return "", errKeyringUnsupported }
+
+func keyringSet(name, value string) error { return errKeyringUnsupported }
+
+func keyringDelete(name string) error { return errKeyringUnsupported }
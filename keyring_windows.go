@@ -0,0 +1,103 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+// the Windows Credential Manager is reached through the Cred* functions of advapi32
+
+var (
+	advapi32       = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead   = advapi32.NewProc("CredReadW")
+	procCredWrite  = advapi32.NewProc("CredWriteW")
+	procCredDelete = advapi32.NewProc("CredDeleteW")
+	procCredFree   = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+	errorNotFound           = syscall.Errno(1168)
+)
+
+// credential is CREDENTIALW
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+func credTarget(name string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(keyringService + ":" + name)
+}
+
+func keyringGet(name string) (string, error) {
+	target, err := credTarget(name)
+	if err != nil {
+		return "", err
+	}
+
+	var cred *credential
+	r, _, err := procCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if errors.Is(err, errorNotFound) {
+			return "", errKeyringNotFound
+		}
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	return string(unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)), nil
+}
+
+func keyringSet(name, value string) error {
+	target, err := credTarget(name)
+	if err != nil {
+		return err
+	}
+	user, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return errors.New("empty value")
+	}
+
+	blob := []byte(value)
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(blob)),
+		CredentialBlob:     &blob[0],
+		Persist:            credPersistLocalMachine,
+		UserName:           user,
+	}
+	if r, _, err := procCredWrite.Call(uintptr(unsafe.Pointer(&cred)), 0); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func keyringDelete(name string) error {
+	target, err := credTarget(name)
+	if err != nil {
+		return err
+	}
+	if r, _, err := procCredDelete.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0); r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesConfig selects the Secret or ConfigMap holding the scheduler configs, every data key stores one
+// types.SchedulerCfg encoded as json. The in-cluster service account is used to read it.
+type KubernetesConfig struct {
+	// Namespace defaults to the namespace of the pod
+	Namespace string
+	// Secret is preferred since the configs carry access tokens
+	Secret    string
+	ConfigMap string
+}
+
+// KubernetesClient discovers the schedulers from a Secret or ConfigMap of the cluster the backup pod runs in
+type KubernetesClient struct {
+	cfg    *KubernetesConfig
+	host   string
+	client *http.Client
+}
+
+func NewKubernetesClient(cfg *KubernetesConfig) (*KubernetesClient, error) {
+	if cfg == nil || (cfg.Secret == "" && cfg.ConfigMap == "") {
+		return nil, errors.New("kubernetes secret or configmap not configured")
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a kubernetes cluster")
+	}
+
+	if cfg.Namespace == "" {
+		namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, errors.Wrap(err, "read pod namespace")
+		}
+		cfg.Namespace = strings.TrimSpace(string(namespace))
+	}
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, errors.Wrap(err, "read cluster ca")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid cluster ca")
+	}
+
+	return &KubernetesClient{
+		cfg:  cfg,
+		host: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// GetSchedulerConfigs returns the scheduler configs keyed by namespace/name/data key
+func (kc *KubernetesClient) GetSchedulerConfigs() (map[string]*types.SchedulerCfg, error) {
+	kind, name := "secrets", kc.cfg.Secret
+	if name == "" {
+		kind, name = "configmaps", kc.cfg.ConfigMap
+	}
+
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/%s/%s", kc.host, kc.cfg.Namespace, kind, name)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// bound service account tokens are rotated by the kubelet, read it on every request
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, errors.Wrap(err, "read service account token")
+	}
+	req.Header.Add("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status: %d %v", resp.StatusCode, resp.Status)
+	}
+
+	var object struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return nil, err
+	}
+
+	configMap := make(map[string]*types.SchedulerCfg)
+
+	for key, value := range object.Data {
+		data := []byte(value)
+		// secret data is base64 encoded, configmap data is plain
+		if kind == "secrets" {
+			data, err = base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "decode secret key %s", key)
+			}
+		}
+
+		var configScheduler *types.SchedulerCfg
+		if err := json.Unmarshal(data, &configScheduler); err != nil {
+			return nil, errors.Wrapf(err, "decode scheduler config %s", key)
+		}
+
+		configMap[fmt.Sprintf("%s/%s/%s", kc.cfg.Namespace, name, key)] = configScheduler
+	}
+
+	return configMap, nil
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kuboShardingFile holds the shard function of a Kubo flatfs blockstore, e.g. /repo/flatfs/shard/v1/next-to-last/2
+const kuboShardingFile = "SHARDING"
+
+// flatfs reads and writes blocks of the flatfs blockstore of a Kubo repo, keyed like Kubo by the base32 of the block
+// multihash. Blocks are only written while the repo is offline.
+type flatfs struct {
+	dir   string
+	shard func(key string) string
+}
+
+func openFlatfs(repo string) (*flatfs, error) {
+	if _, err := os.Stat(filepath.Join(repo, "api")); err == nil {
+		return nil, errors.Errorf("the Kubo daemon of %s seems to be running, stop it first", repo)
+	}
+	return readFlatfs(repo)
+}
+
+// readFlatfs opens the flatfs blockstore of a Kubo repo without checking for a running daemon, reading blocks is safe
+// while it runs
+func readFlatfs(repo string) (*flatfs, error) {
+	dir := filepath.Join(repo, "blocks")
+	data, err := os.ReadFile(filepath.Join(dir, kuboShardingFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "only flatfs blockstores are supported, read shard function")
+	}
+
+	shard, err := parseShardFunc(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	return &flatfs{dir: dir, shard: shard}, nil
+}
+
+// parseShardFunc implements the shard functions of go-ds-flatfs
+func parseShardFunc(spec string) (func(string) string, error) {
+	parts := strings.Split(strings.TrimPrefix(spec, "/repo/flatfs/shard/"), "/")
+	if len(parts) != 3 || parts[0] != "v1" {
+		return nil, errors.Errorf("unsupported shard function %s", spec)
+	}
+
+	n, err := strconv.Atoi(parts[2])
+	if err != nil || n <= 0 {
+		return nil, errors.Errorf("invalid shard function parameter %s", spec)
+	}
+	padding := strings.Repeat("_", n+1)
+
+	switch parts[1] {
+	case "prefix":
+		return func(key string) string { return (key + padding)[:n] }, nil
+	case "suffix":
+		return func(key string) string { s := padding + key; return s[len(s)-n:] }, nil
+	case "next-to-last":
+		return func(key string) string { s := padding + key; return s[len(s)-n-1 : len(s)-1] }, nil
+	default:
+		return nil, errors.Errorf("unsupported shard function %s", spec)
+	}
+}
+
+// put writes the block unless the blockstore has it, it returns whether the block was written
+func (b *flatfs) put(c cid.Cid, data []byte) (bool, error) {
+	path := b.path(c)
+	dir := filepath.Dir(path)
+
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+
+	f, err := os.CreateTemp(dir, "put-")
+	if err != nil {
+		return false, err
+	}
+
+	_, err = f.Write(data)
+	if err == nil && durable {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// path is the file of the block c
+func (b *flatfs) path(c cid.Cid) string {
+	key := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(c.Hash())
+	return filepath.Join(b.dir, b.shard(key), key+".data")
+}
+
+// get reads the block c and verifies its hash
+func (b *flatfs) get(c cid.Cid) ([]byte, error) {
+	data, err := os.ReadFile(b.path(c))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyBlockHash(c, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// resolve walks the DAG of root through the blockstore and reports the first block missing or corrupted, left by a
+// garbage collection of the unpinned blocks or a partial ingest
+func (b *flatfs) resolve(root string) error {
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return errors.Wrapf(err, "decode root cid %s", root)
+	}
+
+	seen := make(map[string]struct{})
+	stack := []cid.Cid{rootCid}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		// identity cids carry their data inline
+		if c.Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+
+		if _, ok := seen[string(c.Hash())]; ok {
+			continue
+		}
+		seen[string(c.Hash())] = struct{}{}
+
+		data, err := b.get(c)
+		if os.IsNotExist(err) {
+			return errors.Wrapf(ErrIncompleteDAG, "block %s missing", c)
+		}
+		if err != nil {
+			return err
+		}
+
+		links, err := blockLinks(c, data)
+		if err != nil {
+			return err
+		}
+		stack = append(stack, links...)
+	}
+	return nil
+}
+
+// unresolvedRoots resolves the root of every stored asset in the blockstore and returns a finding for each which
+// doesn't resolve
+func (b *flatfs) unresolvedRoots(stored []*StoredCAR) []*reconcileFinding {
+	var out []*reconcileFinding
+	seen := make(map[string]struct{})
+	for _, s := range stored {
+		// the same asset may be stored in several directories
+		if _, ok := seen[s.Cid]; ok {
+			continue
+		}
+		seen[s.Cid] = struct{}{}
+
+		if err := b.resolve(s.Cid); err != nil {
+			out = append(out, &reconcileFinding{Kind: reconcileUnresolvable, Cid: s.Cid, Path: s.Path(), Detail: err.Error()})
+		}
+	}
+	return out
+}
+
+var (
+	// kuboRepo is the Kubo repo the archive is ingested into with ingest-kubo, its blockstore is reconciled with the
+	// inventory every kuboReconcileInterval when set
+	kuboRepo              string
+	kuboReconcileInterval = 24 * time.Hour
+)
+
+// reconcileKubo confirms every kuboReconcileInterval that the root of every stored asset still resolves in the
+// blockstore of kuboRepo. It only reports, ingest-kubo repairs the assets.
+func (d *Downloader) reconcileKubo() {
+	for {
+		time.Sleep(kuboReconcileInterval)
+
+		store, err := readFlatfs(kuboRepo)
+		if err != nil {
+			log.Errorf("reconcile kubo: %v", err)
+			continue
+		}
+
+		stored, err := loadInventory(BackupOutPath)
+		if err != nil {
+			log.Errorf("reconcile kubo: load inventory: %v", err)
+			continue
+		}
+
+		findings := store.unresolvedRoots(stored)
+		for _, f := range findings {
+			log.Warnf("reconcile kubo: %s doesn't resolve in %s: %s", f.Cid, kuboRepo, f.Detail)
+		}
+		kuboUnresolvable.Set(int64(len(findings)))
+		log.Infof("reconcile kubo: %d of %d assets don't resolve in %s", len(findings), len(stored), kuboRepo)
+	}
+}
+
+// ingestCAR streams the blocks of a CAR with root into the blockstore, verifying every block hash on the way
+func (b *flatfs) ingestCAR(r io.Reader, root string) (int, error) {
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return 0, errors.Wrapf(err, "decode root cid %s", root)
+	}
+
+	br, err := car.NewBlockReader(r, car.WithTrustedCAR(true))
+	if err != nil {
+		return 0, errors.Wrapf(ErrInvalidCAR, "read header: %v", err)
+	}
+
+	if !containsCid(br.Roots, rootCid) {
+		return 0, errors.Wrapf(ErrRootMismatch, "want %s, got %v", rootCid, br.Roots)
+	}
+
+	var written int
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, errors.Wrapf(ErrInvalidCAR, "read block: %v", err)
+		}
+
+		if err := verifyBlockHash(blk.Cid(), blk.RawData()); err != nil {
+			return written, err
+		}
+
+		ok, err := b.put(blk.Cid(), blk.RawData())
+		if err != nil {
+			return written, err
+		}
+		if ok {
+			written++
+		}
+	}
+}
+
+// ingestFromNetwork streams the asset from its source nodes into the blockstore without staging a CAR file
+func (b *flatfs) ingestFromNetwork(ctx context.Context, d *Downloader, root string) (int, error) {
+	var lastErr error
+	for _, scheduler := range d.candidateSchedulers() {
+		downloadInfos, err := d.getDownloadInfos(ctx, scheduler, root)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, downloadInfo := range downloadInfos.SourceList {
+			resp, err := request(ctx, downloadInfo.Address, root, downloadInfo.Tk)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			// blocks written before a failure stay, they are verified and the next source skips them
+			n, err := b.ingestCAR(resp.Body, root)
+			resp.Body.Close()
+			if err == nil {
+				return n, nil
+			}
+			log.Warnf("ingest %s from %s: %v", root, downloadInfo.NodeID, err)
+			lastErr = err
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = ErrCARFileNotFound
+	}
+	return 0, lastErr
+}
+
+// ingestResult is printed as a json line for every ingested asset
+type ingestResult struct {
+	Cid    string `json:"cid"`
+	Source string `json:"source"`
+	Blocks int    `json:"blocks"`
+	Error  string `json:"error,omitempty"`
+}
+
+func ingestKuboCmd(args []string) error {
+	fs := flag.NewFlagSet("ingest-kubo", flag.ExitOnError)
+	repo := fs.String("repo", "", "path of the offline Kubo repo")
+	network := fs.Bool("network", false, "fetch assets missing from the archive from the network")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *repo == "" || fs.NArg() == 0 {
+		return fmt.Errorf("usage: ingest-kubo -repo <kubo repo> [-network] <cid>...")
+	}
+
+	store, err := openFlatfs(*repo)
+	if err != nil {
+		return err
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return err
+	}
+
+	byCid := make(map[string]*StoredCAR)
+	for _, s := range stored {
+		byCid[s.Cid] = s
+	}
+
+	var d *Downloader
+	if *network {
+		registry, err := loadRegistry()
+		if err != nil {
+			return err
+		}
+		d = newDownloader(token, areaId, registry, concurrent)
+		defer d.Close()
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var failed int
+	for _, cid := range fs.Args() {
+		result := &ingestResult{Cid: cid}
+
+		if s, ok := byCid[cid]; ok {
+			result.Source = s.Path()
+			result.Blocks, err = ingestStored(store, s)
+		} else if d != nil {
+			result.Source = "network"
+			result.Blocks, err = store.ingestFromNetwork(context.Background(), d, cid)
+		} else {
+			err = errors.Errorf("%s is not in the archive", cid)
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		enc.Encode(result)
+	}
+
+	// the blocks are unpinned, the garbage collector of Kubo would remove them
+	fmt.Fprintln(os.Stderr, "pin the roots with ipfs pin add before the next garbage collection")
+	if failed > 0 {
+		return fmt.Errorf("%d of %d ingests failed", failed, fs.NArg())
+	}
+	return nil
+}
+
+func ingestStored(store *flatfs, s *StoredCAR) (int, error) {
+	if s.aggregated() {
+		full, cleanup, err := completeCAR(s, os.TempDir())
+		if err != nil {
+			return 0, err
+		}
+		defer cleanup()
+		s = full
+	}
+
+	f, err := os.Open(s.Path())
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return store.ingestCAR(f, s.Cid)
+}
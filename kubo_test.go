@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testFlatfs creates the flatfs blockstore of a Kubo repo holding the blocks
+func testFlatfs(t *testing.T, blocks ...testBlock) *flatfs {
+	repo := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repo, "blocks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "blocks", kuboShardingFile), []byte("/repo/flatfs/shard/v1/next-to-last/2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openFlatfs(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blocks {
+		if _, err := store.put(b.cid, b.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestFlatfsResolve(t *testing.T) {
+	root, blocks := testDAG(t)
+	store := testFlatfs(t, blocks...)
+
+	if err := store.resolve(root.cid.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a garbage collection of the unpinned blocks took a leaf
+	if err := os.Remove(store.path(blocks[2].cid)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.resolve(root.cid.String()); !errors.Is(err, ErrIncompleteDAG) {
+		t.Fatalf("missing leaf: %v, want ErrIncompleteDAG", err)
+	}
+}
+
+func TestFlatfsUnresolvedRoots(t *testing.T) {
+	root, blocks := testDAG(t)
+	other := jsonBlock(t, "other")
+	store := testFlatfs(t, blocks...)
+
+	stored := []*StoredCAR{
+		{Dir: "20240101", ManifestEntry: &ManifestEntry{Cid: root.cid.String()}},
+		{Dir: "20240102", ManifestEntry: &ManifestEntry{Cid: other.cid.String()}},
+		// stored twice, reported once
+		{Dir: "20240103", ManifestEntry: &ManifestEntry{Cid: other.cid.String()}},
+	}
+
+	findings := store.unresolvedRoots(stored)
+	if len(findings) != 1 || findings[0].Cid != other.cid.String() || findings[0].Kind != reconcileUnresolvable {
+		t.Fatalf("got %+v, want other unresolvable", findings)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !libp2p
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errNoLibp2p = errors.New("built without the libp2p host, build with -tags libp2p")
+
+// fetchEmbeddedBitswap is not available, the libp2p host requires the libp2p build tag
+func fetchEmbeddedBitswap(ctx context.Context, peers []string, root, path string, size int64) (*fetchResult, error) {
+	return nil, errNoLibp2p
+}
+
+// fetchGraphsync is not available, the libp2p host requires the libp2p build tag
+func fetchGraphsync(ctx context.Context, addr, root, path string, size int64) (*fetchResult, error) {
+	return nil, errNoLibp2p
+}
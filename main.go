@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	logging "github.com/ipfs/go-log/v2"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
@@ -13,31 +19,512 @@ var (
 	token      string
 	areaId     string
 	concurrent int
+	configPath string
+
+	electionKey string
+	electionTTL int
+
+	metricsListen string
 )
 
 func init() {
+	flag.StringVar(&configPath, "config", "", "path of the toml config file")
 	flag.StringVar(&etcd, "etcd", "", "etcd address")
 	flag.StringVar(&user, "user", "", "etcd user")
 	flag.StringVar(&password, "password", "", "etcd password")
 	flag.StringVar(&token, "token", "", "storage api authenticate token")
-	flag.StringVar(&areaId, "area_id", "", "scheduler area id")
+	flag.StringVar(&titanUser, "titan_user", "", "Titan user id the restored and re-seeded assets are created for, required by restore and reseed_replicas")
+	flag.DurationVar(&secretsRefresh, "secrets_refresh", secretsRefresh, "period the flags given as vault:<path>#<field> or awssm:<secret id>[#<field>] are fetched again in, 0 fetches them at startup only")
+	flag.StringVar(&vaultAddr, "vault_addr", vaultAddr, "address of the HashiCorp Vault server, VAULT_ADDR by default")
+	flag.StringVar(&vaultTokenFile, "vault_token_file", "", "file of the vault token, VAULT_TOKEN is used when empty")
+	flag.StringVar(&awsRegion, "aws_region", awsRegion, "region of AWS Secrets Manager and of the restore -remote s3:// urls, AWS_REGION by default")
+	flag.StringVar(&storageAPICert, "storage_api_cert", "", "client certificate file presented to the storage api for mTLS, reloaded when it changes")
+	flag.StringVar(&storageAPIKey, "storage_api_key", "", "key file of storage_api_cert")
+	flag.StringVar(&storageAPICA, "storage_api_ca", "", "CA file the storage api certificate is verified with in place of the system roots")
+	flag.StringVar(&tokenFile, "token_file", "", "file of the storage api token, read again when it changes, in place of token")
+	flag.StringVar(&tokenRefreshURL, "token_refresh_url", "", "OAuth token endpoint the storage api token is renewed at with the refresh token of refresh_token_file")
+	flag.StringVar(&refreshTokenFile, "refresh_token_file", "", "file of the refresh token, rewritten when token_refresh_url rotates it")
+	flag.StringVar(&tokenClientID, "token_client_id", "", "client id sent to token_refresh_url")
+	flag.DurationVar(&tokenRenewBefore, "token_renew_before", tokenRenewBefore, "how long before its expiry the storage api token is renewed")
+	flag.StringVar(&areaId, "area_id", "", "scheduler area id, empty or 'all' to back up every area")
 	flag.IntVar(&concurrent, "concurrent", 5, "scheduler area id")
+	flag.DurationVar(&schedulerTimeout, "scheduler_timeout", schedulerTimeout, "timeout of each scheduler rpc call")
+	flag.StringVar(&electionKey, "election_key", "", "etcd key of the leader election, enables HA mode where only the leader downloads")
+	flag.IntVar(&electionTTL, "election_ttl", 5, "leader lease ttl in seconds, how fast a standby takes over")
+	flag.IntVar(&shardIndex, "shard_index", 0, "index of this instance among shard_count instances splitting the jobs of an area")
+	flag.IntVar(&shardCount, "shard_count", 0, "number of instances splitting the jobs of an area by cid hash, 0 takes every job")
+	flag.StringVar(&shardPrefix, "shard_prefix", "", "etcd prefix the instances register under to split the jobs between the live members, in place of shard_count")
+	flag.StringVar(&shardID, "shard_id", defaultShardID(), "id of this instance under shard_prefix, unique in the fleet")
+	flag.StringVar(&metricsListen, "metrics_listen", "", "address to serve metrics on /debug/vars, disabled when empty")
+	flag.StringVar(&replicateFrom, "replicate_from", "", "admin api url of a primary instance to mirror the archive of instead of backing up from the Titan network")
+	flag.DurationVar(&replicateInterval, "replicate_interval", replicateInterval, "period the archive of the primary is synced in")
+	flag.StringVar(&replicateToken, "replicate_token", "", "bearer token of an admin credential of the primary, its /inventory and /archive require one")
+	flag.StringVar(&gatewayListen, "gateway_listen", "", "address to serve stored CARs and blocks on /ipfs/<cid>, disabled when empty")
+	flag.BoolVar(&verifyDAG, "verify_dag", false, "require every block linked from the root to be present in downloaded CARs")
+	flag.BoolVar(&incremental, "incremental", false, "fetch only the blocks of an asset missing from the archive and store them as a delta CAR referencing the archived ones")
+	flag.IntVar(&carVersion, "car_version", 0, "CAR version (1 or 2) stored files are normalized to, 0 keeps the version a node sent")
+	flag.IntVar(&parityPercent, "parity_percent", 0, "Reed-Solomon parity overhead in percent written next to stored CARs, 0 disables parity")
+	flag.StringVar(&manifestKeyPath, "manifest_key", "", "file of the hex encoded ed25519 key manifests are signed with, signing is disabled when empty")
+	flag.BoolVar(&replicationFriendly, "replication_friendly", false, "write partial files to staging_dir instead of the backup tree and never rewrite stored files in place, for rsync or zfs send replication")
+	flag.StringVar(&stagingDir, "staging_dir", stagingDir, "directory of the partial files with replication_friendly, on the filesystem of the backup tree")
+	flag.StringVar(&w3sToken, "w3s_token", "", "web3.storage/Storacha api token, every verified CAR is uploaded when set")
+	flag.StringVar(&w3sEndpoint, "w3s_endpoint", w3sEndpoint, "web3.storage/Storacha api url")
+	flag.Int64Var(&w3sShardSize, "w3s_shard_size", w3sShardSize, "largest CAR uploaded in one request, larger CARs are split into shards")
+	flag.StringVar(&w3sGateway, "w3s_gateway", w3sGateway, "gateway the CARs migrated to w3s are restored from")
+	flag.StringVar(&arweaveWallet, "arweave_wallet", "", "arweave wallet file of the irys client, small assets are archived permanently on Arweave when set")
+	flag.Int64Var(&arweaveMaxSize, "arweave_max_size", arweaveMaxSize, "largest asset in bytes archived on Arweave")
+	flag.StringVar(&arweaveTypes, "arweave_types", "", "comma separated asset types archived on Arweave, every type when empty")
+	flag.StringVar(&irysBin, "irys", irysBin, "path of the irys client binary")
+	flag.StringVar(&irysNetwork, "irys_network", irysNetwork, "irys network, mainnet or devnet")
+	flag.StringVar(&arweaveGateway, "arweave_gateway", arweaveGateway, "gateway the CARs migrated to Arweave are restored from")
+	flag.Int64Var(&directIOThreshold, "direct_io_threshold", 0, "asset size in bytes from which CARs are written with O_DIRECT, bypassing the page cache, 0 disables direct I/O")
+	flag.BoolVar(&ioUring, "io_uring", false, "write CARs through io_uring, overlapping network reads with disk writes, requires a linux build with -tags iouring")
+	flag.Int64Var(&maxBufferedBytes, "max_buffered_bytes", 0, "cap of the bytes buffered by all downloads and uploads together, 0 disables the cap")
+	flag.BoolVar(&durable, "durable", false, "fsync stored CARs, their sidecars and manifests before reporting success")
+	flag.BoolVar(&reportVerification, "report_verification", false, "submit verification reports of downloaded and scrubbed CARs to the storage api")
+	flag.Float64Var(&scrubFraction, "scrub_fraction", 0, "fraction of the stored CARs re-verified per day, 0 disables the scrubber")
+	flag.Float64Var(&bitrotThreshold, "bitrot_threshold", 0, "alert when the share of corrupted CARs found by the scrubber on a volume exceeds it, 0 disables alerting")
+	flag.DurationVar(&bitrotWindow, "bitrot_window", bitrotWindow, "period the scrub results are combined over for the corruption rate")
+	flag.StringVar(&bitrotWebhook, "bitrot_webhook", "", "url receiving a json post for every bit rot alert")
+	flag.BoolVar(&scrubRepair, "scrub_repair", false, "download corrupted CARs found by the scrubber again")
+	flag.IntVar(&spotCheckCARs, "spot_check_cars", 0, "number of stored CARs spot checked every hour, 0 disables the spot check")
+	flag.IntVar(&spotCheckBlocks, "spot_check_blocks", spotCheckBlocks, "number of random blocks verified in every spot checked CAR")
+	flag.IntVar(&jobsPageSize, "jobs_page_size", jobsPageSize, "number of jobs fetched from the storage api per request")
+	flag.IntVar(&jobsFetchLimit, "jobs_fetch_limit", jobsFetchLimit, "jobs fetched per poll at most, pages are fetched until it's reached, 0 fetches the whole backlog")
+	flag.BoolVar(&smallestFirst, "smallest_first", false, "hand out the smallest assets of a long batch of jobs first")
+	flag.IntVar(&smallestFirstMinJobs, "smallest_first_min_jobs", smallestFirstMinJobs, "batch length from which smallest_first reorders the jobs")
+	flag.Int64Var(&largeAssetSize, "large_asset_size", largeAssetSize, "size in bytes from which an asset is downloaded in a large slot")
+	flag.IntVar(&largeSlots, "large_slots", 0, "workers dedicated to large assets besides the concurrent ones, 0 downloads them with the others")
+	flag.Int64Var(&minSize, "min_size", 0, "skip assets smaller than it in bytes, 0 disables the lower bound")
+	flag.Int64Var(&maxSize, "max_size", 0, "skip assets larger than it in bytes, 0 disables the upper bound")
+	flag.StringVar(&cidAllowlist, "cid_allowlist", "", "file of cids always backed up regardless of the job filter and size range, read again when modified")
+	flag.StringVar(&cidDenylist, "cid_denylist", "", "file of cids never backed up, read again when modified")
+	flag.BoolVar(&mirror, "mirror", false, "back up every asset the schedulers know of, not only the backup_assets feed")
+	flag.DurationVar(&mirrorInterval, "mirror_interval", mirrorInterval, "period the asset lists of the schedulers are compared with the archive in")
+	flag.IntVar(&retainDays, "retain_days", 0, "delete backup directories older than this many days, 0 keeps them forever")
+	flag.StringVar(&retainArchiveDir, "retain_archive_dir", "", "directory expired backup directories are archived to as tar before they're deleted")
+	flag.StringVar(&retainMigrate, "retain_migrate", "", "cold target, w3s or arweave, expired CARs are uploaded to before they're deleted")
+	flag.StringVar(&legalHoldPath, "legal_hold", "", "file of cids exempt from retention, read again when modified")
+	flag.Int64Var(&archiveQuota, "archive_quota", 0, "byte budget of the archive, beyond it the oldest CARs with a cold tier copy are evicted, 0 disables the quota")
+	flag.DurationVar(&quotaInterval, "quota_interval", quotaInterval, "period the archive size is checked against archive_quota in")
+	flag.Int64Var(&minFreeSpace, "min_free_space", 0, "pause pulling jobs while the backup volume has less free bytes, 0 disables the safeguard")
+	flag.StringVar(&diskWebhook, "disk_webhook", "", "url receiving a json post when pulling jobs is paused or resumed for disk space")
+	flag.DurationVar(&gcInterval, "gc_interval", gcInterval, "period partial and orphaned files are removed in")
+	flag.DurationVar(&gcMinAge, "gc_min_age", gcMinAge, "age of the partial files removed on schedule, files of running downloads are younger")
+	flag.DurationVar(&compactInterval, "compact_interval", 0, "period small CARs are packed into aggregates in, 0 disables the compactor")
+	flag.DurationVar(&compactMinAge, "compact_min_age", compactMinAge, "age of the backup directories compacted")
+	flag.Int64Var(&compactMaxSize, "compact_max_size", compactMaxSize, "size in bytes up to which CARs are packed into aggregates")
+	flag.Int64Var(&aggregateSize, "aggregate_size", aggregateSize, "size in bytes aggregates are filled up to")
+	flag.IntVar(&reseedReplicas, "reseed_replicas", 0, "upload stored assets again whose network replica count falls below it, 0 disables re-seeding")
+	flag.DurationVar(&reseedInterval, "reseed_interval", reseedInterval, "period the replica count of every stored asset is checked in")
+	flag.StringVar(&quarantineDir, "quarantine_dir", quarantineDir, "directory of the stored and downloaded CARs which failed verification, keep it out of the backup tree")
+	flag.DurationVar(&quarantineMaxAge, "quarantine_max_age", 0, "remove quarantined CARs older than it, 0 keeps them until purged")
+	flag.Int64Var(&quarantineMaxSize, "quarantine_max_size", 0, "bytes the quarantine may hold, the oldest CARs are removed beyond it, 0 disables the cap")
+	flag.StringVar(&bitswapAPI, "bitswap_api", "", "rpc api address of a Kubo node assets are fetched over Bitswap through once every node failed or none holds them, e.g. http://127.0.0.1:5001, disabled when empty")
+	flag.BoolVar(&bitswapEmbedded, "bitswap_embedded", false, "fetch over Bitswap with a libp2p host of the process instead of the Kubo node of bitswap_api, requires a build with -tags libp2p")
+	flag.StringVar(&bitswapPeers, "bitswap_peers", "", "comma separated multiaddrs of peers holding the assets, dialed over Bitswap besides the sources advertising a /p2p multiaddr")
+	flag.DurationVar(&bitswapTimeout, "bitswap_timeout", bitswapTimeout, "timeout of fetching an asset over Bitswap")
+	flag.BoolVar(&graphsyncEnabled, "graphsync", false, "fetch from the sources advertising a /p2p multiaddr over graphsync instead of skipping them, requires a build with -tags libp2p")
+	flag.DurationVar(&graphsyncTimeout, "graphsync_timeout", graphsyncTimeout, "timeout of fetching an asset over graphsync")
+	flag.StringVar(&kuboRepo, "kubo_repo", "", "Kubo repo the archive is ingested into, the assets are confirmed to resolve in its blockstore every kubo_reconcile_interval, disabled when empty")
+	flag.DurationVar(&kuboReconcileInterval, "kubo_reconcile_interval", kuboReconcileInterval, "period the assets are resolved in the blockstore of kubo_repo in")
+	flag.StringVar(&s3Endpoint, "s3_endpoint", "", "url of an S3 compatible store the restore -remote s3:// urls are read from path-style, AWS S3 when empty")
+	flag.StringVar(&ageIdentity, "age_identity", "", "age identity file the encrypted CARs of a restore -remote copy are decrypted with")
+	flag.DurationVar(&downloadInfoTTL, "download_info_ttl", downloadInfoTTL, "how long download info from the scheduler is reused, 0 disables the cache")
+	flag.Float64Var(&schedulerRate, "scheduler_rate", 0, "rpc calls per second to every scheduler at most, 0 disables the limit")
+	flag.IntVar(&schedulerBurst, "scheduler_burst", schedulerBurst, "rpc calls to a scheduler allowed at once above scheduler_rate")
+	flag.Float64Var(&nodeRate, "node_rate", 0, "download attempts per second from every node at most, 0 disables the limit")
+	flag.IntVar(&nodeBurst, "node_burst", nodeBurst, "download attempts from a node allowed at once above node_rate")
+	flag.IntVar(&writeBehindDepth, "write_behind_depth", writeBehindDepth, "256KiB chunks of a download queued between the network and the disk, 0 writes each before reading the next")
+	flag.BoolVar(&prefetchSources, "prefetch_sources", prefetchSources, "resolve the sources of the next asset while every worker is busy, needs download_info_ttl")
+	flag.StringVar(&ioniceClass, "ionice_class", "", "I/O scheduling class of the downloads and verification, none, realtime, best-effort or idle, empty leaves it unchanged")
+	flag.IntVar(&ioniceLevel, "ionice_level", ioniceLevel, "priority 0-7 within the realtime and best-effort ionice classes, 0 is the highest")
+	flag.DurationVar(&storageAPITimeout, "storage_api_timeout", storageAPITimeout, "timeout of a single storage api request")
+	flag.IntVar(&storageAPIRetries, "storage_api_retries", storageAPIRetries, "times a storage api request is retried after a network error, 429 or 5xx response")
+	flag.Uint64Var(&quicStreamWindow, "quic_stream_window", 0, "max receive window of a QUIC stream in bytes, raise it on high bandwidth-delay links, 0 keeps the quic-go default")
+	flag.Uint64Var(&quicConnWindow, "quic_conn_window", 0, "max receive window of a QUIC connection in bytes, 0 keeps the quic-go default")
+	flag.DurationVar(&quicKeepAlive, "quic_keep_alive", 0, "period QUIC keep-alive packets are sent to the nodes in, 0 disables them")
+	flag.DurationVar(&quicHandshakeTimeout, "quic_handshake_timeout", 0, "timeout of the QUIC handshake with a node, 0 keeps the quic-go default")
+	flag.DurationVar(&quicIdleTimeout, "quic_idle_timeout", 0, "idle QUIC connections to the nodes are closed after it, 0 keeps the quic-go default")
+	flag.StringVar(&extraRoots, "output_roots", "", "comma separated directories on further volumes new backup directories are placed on besides the backup path")
+	flag.StringVar(&placement, "placement", placement, "volume a new asset is placed on with output_roots, free for the most free space or load for the fewest running downloads")
+	flag.StringVar(&ipFamily, "ip_family", ipFamily, "address family of the connections to the nodes and the storage api, 4, 6 or any to race both")
+	flag.DurationVar(&fallbackDelay, "fallback_delay", fallbackDelay, "time an address of a node is given before the next one is tried in parallel")
+	flag.StringVar(&adminListen, "admin_listen", "", "address of the admin api managing the queue and the worker pool at runtime, disabled when empty")
+	flag.StringVar(&adminToken, "admin_token", "", "bearer token required by the admin api and the gRPC control service")
+	flag.StringVar(&controlCert, "control_cert", "", "certificate file the admin api, the gRPC control service and the metrics are served with over TLS")
+	flag.StringVar(&controlKey, "control_key", "", "key file of control_cert")
+	flag.StringVar(&controlClientCA, "control_client_ca", "", "CA file of the client certificates accepted by the control plane in place of a bearer token")
+	flag.StringVar(&controlAllow, "control_allow", "", "comma separated addresses or CIDRs the control plane accepts connections from, any when empty")
+	flag.StringVar(&metricsToken, "metrics_token", "", "bearer token required by the metrics, open when empty")
+	flag.StringVar(&grpcListen, "grpc_listen", "", "address of the gRPC control service with streaming job events, disabled when empty")
+	flag.DurationVar(&handoverTimeout, "handover_timeout", handoverTimeout, "time the running downloads are given to finish when upgrading on SIGHUP, unfinished ones start over in the new binary")
+	flag.IntVar(&niceness, "nice", 0, "increment of the cpu niceness of the downloads and verification, 0 leaves it unchanged")
 }
 
 func main() {
 	flag.Parse()
 
+	if err := resolveSecretFlags(); err != nil {
+		log.Fatalf("resolve secrets: %v", err)
+	}
+	keyringDefaults()
+
+	if err := applyPriority(); err != nil {
+		log.Fatalf("apply priority: %v", err)
+	}
+
+	if replicationFriendly {
+		for _, root := range outputRoots() {
+			if err := os.MkdirAll(stagingDirOf(root), 0755); err != nil {
+				log.Fatalf("create staging dir: %v", err)
+			}
+		}
+	}
+
+	// subcommands append to manifests too, they must keep them signed
+	if secretFlagged("manifest_key") {
+		key, err := parseManifestKey(manifestKeyPath, "manifest_key")
+		if err != nil {
+			log.Fatalf("load manifest key: %v", err)
+		}
+		manifestKey = key
+	} else if manifestKeyPath != "" {
+		key, err := loadManifestKey(manifestKeyPath)
+		if err != nil {
+			log.Fatalf("load manifest key: %v", err)
+		}
+		manifestKey = key
+	}
+
+	apiTLS, err := loadStorageTLS()
+	if err != nil {
+		log.Fatalf("load storage api tls: %v", err)
+	}
+	storageTLS = apiTLS
+
+	if tokenRefreshURL != "" && refreshTokenFile == "" {
+		log.Fatalf("token_refresh_url requires refresh_token_file")
+	}
+
+	if tokenFile != "" || tokenRefreshURL != "" {
+		tokens, err := newTokenSource(token)
+		if err != nil {
+			log.Fatalf("load storage api token: %v", err)
+		}
+		storageTokens = tokens
+		go storageTokens.renew()
+	} else if secretFlagged("token") {
+		// the token is kept current by rotateSecrets
+		storageTokens = &tokenSource{token: token, expiry: jwtExpiry(token)}
+	}
+
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		return
+	}
+
 	logging.SetDebugLogging()
 
-	addresses := strings.Split(etcd, ",")
-	client, err := NewEtcdClient(addresses)
+	// checked before the first worker starts, a retention pass must not delete what it can't migrate
+	switch {
+	case retainMigrate == UploadW3S && w3sToken == "":
+		log.Fatal("retain_migrate w3s requires w3s_token")
+	case retainMigrate == UploadArweave && arweaveWallet == "":
+		log.Fatal("retain_migrate arweave requires arweave_wallet")
+	case retainMigrate != "" && retainMigrate != UploadW3S && retainMigrate != UploadArweave:
+		log.Fatalf("unknown retain_migrate target %s", retainMigrate)
+	}
+
+	if secretsRefresh > 0 {
+		go rotateSecrets()
+	}
+
+	if carVersion != 0 && carVersion != 1 && carVersion != 2 {
+		log.Fatalf("unsupported car_version %d", carVersion)
+	}
+
+	if ipFamily != "any" && ipFamily != "4" && ipFamily != "6" {
+		log.Fatalf("unknown ip_family %s, want 4, 6 or any", ipFamily)
+	}
+
+	if jobsPageSize <= 0 {
+		log.Fatalf("jobs_page_size must be positive")
+	}
+
+	if placement != "free" && placement != "load" {
+		log.Fatalf("unknown placement %s, want free or load", placement)
+	}
+
+	if reseedReplicas > 0 && titanUser == "" {
+		log.Fatal("reseed_replicas requires titan_user")
+	}
+
+	if err := loadAdminCredentials(); err != nil {
+		log.Fatal(err)
+	}
+
+	if (adminListen != "" || grpcListen != "") && len(adminCredentials) == 0 && controlClientCA == "" {
+		log.Fatalf("admin_listen and grpc_listen require admin_token, AdminCredentials or control_client_ca")
+	}
+
+	tlsConfig, err := loadControlTLS()
+	if err != nil {
+		log.Fatalf("load control plane tls: %v", err)
+	}
+	controlTLS = tlsConfig
+
+	allow, err := parseAllowlist(controlAllow)
+	if err != nil {
+		log.Fatalf("parse control_allow: %v", err)
+	}
+	controlAllowed = allow
+
+	if maxSize > 0 && minSize > maxSize {
+		log.Fatalf("min_size %d exceeds max_size %d", minSize, maxSize)
+	}
+
+	if kuboRepo != "" {
+		if _, err := readFlatfs(kuboRepo); err != nil {
+			log.Fatalf("open kubo_repo: %v", err)
+		}
+	}
+
+	if metricsListen != "" {
+		go serveMetrics(metricsListen)
+	}
+
+	// a secondary instance only mirrors the primary, the Titan network is left alone
+	if replicateFrom != "" {
+		replica := newReplica(token)
+		if gatewayListen != "" {
+			go serveGateway(gatewayListen, replica)
+		}
+
+		log.Infof("Started, replicating from %s", replicateFrom)
+		go replica.replicate()
+		waitSignal()
+		return
+	}
+
+	registry, err := loadRegistry()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	addresses := etcdAddresses()
+
+	if electionKey != "" {
+		if len(addresses) == 0 {
+			log.Fatal("leader election requires etcd")
+		}
+
+		session, err := campaignLeader(context.Background(), addresses, electionKey, electionTTL)
+		if err != nil {
+			log.Fatalf("campaign leader: %v", err)
+		}
+		defer session.Close()
+
+		go watchLeadership(session)
+	}
+
+	switch {
+	case shardCount > 0 && shardPrefix != "":
+		log.Fatal("shard_count and shard_prefix are exclusive")
+	case shardCount > 0:
+		ring, err := staticShards(shardIndex, shardCount)
+		if err != nil {
+			log.Fatal(err)
+		}
+		shards.Store(ring)
+		log.Infof("taking shard %d of %d", shardIndex, shardCount)
+	case shardPrefix != "":
+		if len(addresses) == 0 {
+			log.Fatal("shard_prefix requires etcd")
+		}
+		if err := joinShards(context.Background(), addresses, shardPrefix, shardID, electionTTL); err != nil {
+			log.Fatalf("join shards: %v", err)
+		}
+	}
+
+	if err := loadJobFilter(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadCidLists(); err != nil {
+		log.Fatalf("load cid lists: %v", err)
+	}
+
+	// no download of this instance runs yet, but a standby may share the archive with a leader
+	startupAge := time.Duration(0)
+	if electionKey != "" {
+		startupAge = gcMinAge
+	}
+	if report, err := collectGarbage(startupAge, false); err != nil {
+		log.Errorf("gc: %v", err)
+	} else if report.Files > 0 || report.Dirs > 0 {
+		log.Infof("gc: removed %d files and %d directories left by earlier runs", report.Files, report.Dirs)
+	}
+
+	downloader := newDownloader(token, areaId, registry, concurrent)
+
+	// the tenants are known before the maintenance starts, it routes their CARs to them
+	tenants, err := loadTenants()
 	if err != nil {
-		log.Fatal("New etcdClient Failed: %v", err)
+		log.Fatal(err)
+	}
+	for _, t := range tenants {
+		newTenantDownloader(downloader, t)
 	}
 
-	downloader := newDownloader(token, areaId, client, concurrent)
+	handover := takeHandover()
+	downloader.resume(handover.jobs(""))
 	go downloader.async()
+	go downloader.resizeOnSignal()
+	go downloader.upgradeOnSignal()
+	go downloader.gc()
+	go downloader.dirSize.persist()
+
+	if gatewayListen != "" {
+		go serveGateway(gatewayListen, downloader)
+	}
+
+	if adminListen != "" {
+		go serveAdmin(adminListen, downloader)
+	}
+
+	if grpcListen != "" {
+		go serveControl(grpcListen, downloader)
+	}
+
+	if scrubFraction > 0 {
+		go downloader.scrub()
+	}
+
+	if spotCheckCARs > 0 {
+		go downloader.spotCheck()
+	}
+
+	if reseedReplicas > 0 {
+		go downloader.reseed()
+	}
+
+	if mirror {
+		go downloader.mirrorAssets()
+	}
+
+	if compactInterval > 0 {
+		go downloader.compactor()
+	}
+
+	if retainDays > 0 || archiveQuota > 0 {
+		if err := loadLegalHold(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if retainDays > 0 {
+		go downloader.retain()
+	}
+
+	if archiveQuota > 0 {
+		go downloader.quota()
+	}
+
+	for _, td := range downloader.tenants {
+		td.resume(handover.jobs(td.tenant))
+		go td.async()
+		go td.run()
+		log.Infof("backing up tenant %s of area %s", td.tenant, td.areaId)
+	}
+
+	if kuboRepo != "" {
+		go downloader.reconcileKubo()
+	}
 
 	log.Infof("Started")
-	downloader.run()
+	go downloader.run()
+
+	waitSignal()
+	downloader.Close()
+}
+
+func waitSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	log.Infof("Shutting down")
+}
+
+func etcdAddresses() []string {
+	if etcd == "" {
+		return nil
+	}
+	return strings.Split(etcd, ",")
+}
+
+// loadRegistry builds the scheduler registry from the config file and the discovery flags
+func loadRegistry() (*SchedulerRegistry, error) {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+
+	discovery, err := newDiscovery(cfg, etcdAddresses())
+	if err != nil {
+		if len(cfg.Schedulers) == 0 {
+			return nil, fmt.Errorf("New discovery Failed: %w", err)
+		}
+		log.Warnf("new discovery: %v, fallback to %d static schedulers", err, len(cfg.Schedulers))
+	}
+
+	return NewSchedulerRegistry(discovery, cfg)
+}
+
+// loadJobFilter sets the job filter from the Filter section of the config file
+func loadJobFilter() error {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+
+	if cfg.Filter == nil || cfg.Filter.empty() {
+		return nil
+	}
+	jobFilter = cfg.Filter
+
+	// asset records of the schedulers carry no owner, mirrored assets can't be matched
+	if mirror {
+		log.Warnf("mirror with a job filter, only the assets of the backup_assets feed are backed up")
+	}
+	log.Infof("backing up the assets of users %v projects %v only", jobFilter.Users, jobFilter.Projects)
+	return nil
+}
+
+func newDiscovery(cfg *Config, addresses []string) (Discovery, error) {
+	switch cfg.Discovery {
+	case DiscoveryConsul:
+		consul, err := NewConsulClient(cfg.Consul)
+		if err != nil {
+			return nil, err
+		}
+		return consul, nil
+	case DiscoveryKubernetes:
+		kubernetes, err := NewKubernetesClient(cfg.Kubernetes)
+		if err != nil {
+			return nil, err
+		}
+		return kubernetes, nil
+	default:
+		if len(addresses) == 0 {
+			return nil, nil
+		}
+
+		etcdClient, err := NewEtcdClient(addresses)
+		if err != nil {
+			return nil, err
+		}
+		return etcdClient, nil
+	}
 }
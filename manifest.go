@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// manifestFile is the per-directory manifest, one json ManifestEntry per line appended for every stored CAR
+const manifestFile = "manifest.jsonl"
+
+var manifestLk sync.Mutex
+
+type ManifestEntry struct {
+	Cid        string    `json:"cid"`
+	Size       int64     `json:"size"`
+	PieceCID   string    `json:"piece_cid,omitempty"`
+	PieceSize  uint64    `json:"piece_size,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"`
+	SourceNode string    `json:"source_node,omitempty"` // node the CAR was downloaded from
+	Area       string    `json:"area,omitempty"`        // area of the scheduler the CAR was found in
+	Transport  string    `json:"transport,omitempty"`   // protocol the CAR was downloaded with
+	Base       []string  `json:"base,omitempty"`        // root cids of the CARs holding the blocks missing from a delta CAR
+	Uploads    []*Upload `json:"uploads,omitempty"`     // copies of the CAR on remote targets
+	Volume     string    `json:"volume,omitempty"`      // output root the CAR is stored on, when output_roots are set
+	Aggregate  string    `json:"aggregate,omitempty"`   // aggregate file of the directory the CAR is packed into
+	Offset     int64     `json:"offset,omitempty"`      // offset of the CAR in its aggregate
+	BackupTime time.Time `json:"backup_time"`
+	// Deleted marks the CAR of the cid as removed from the directory
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// appendManifest appends the entry to the manifest of dir
+func appendManifest(dir string, entry *ManifestEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	manifestLk.Lock()
+	defer manifestLk.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(dir, manifestFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+
+	line := append(data, '\n')
+	_, err = f.Write(line)
+	if err == nil && durable {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || manifestKey == nil {
+		return err
+	}
+
+	return signManifest(dir, line)
+}
+
+// removeFromManifest records the CAR of cid as removed from dir
+func removeFromManifest(dir, cid string) error {
+	return appendManifest(dir, &ManifestEntry{Cid: cid, BackupTime: time.Now(), Deleted: true})
+}
+
+// readManifest returns the entries of the manifest of dir, the last entry of a cid wins and deleted cids are dropped
+func readManifest(dir string) ([]*ManifestEntry, error) {
+	f, err := os.Open(filepath.Join(dir, manifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*ManifestEntry
+	index := make(map[string]int)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var entry ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a torn last line of a crashed append
+			log.Warnf("skip invalid manifest line in %s: %v", dir, err)
+			continue
+		}
+
+		if i, ok := index[entry.Cid]; ok {
+			out[i] = &entry
+			continue
+		}
+		index[entry.Cid] = len(out)
+		out = append(out, &entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := out[:0]
+	for _, entry := range out {
+		if !entry.Deleted {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// StoredCAR is a CAR recorded in the manifest of Dir
+type StoredCAR struct {
+	Dir string
+	*ManifestEntry
+}
+
+func (s *StoredCAR) Path() string {
+	return filepath.Join(s.Dir, s.Cid+".car")
+}
+
+// loadInventory reads the manifests of every backup directory under root
+func loadInventory(root string) ([]*StoredCAR, error) {
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*StoredCAR
+	for _, d := range dirs {
+		if !isBackupDir(root, d) {
+			continue
+		}
+
+		dir := filepath.Join(root, d.Name())
+		entries, err := readManifest(dir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read manifest of %s", dir)
+		}
+
+		for _, entry := range entries {
+			out = append(out, &StoredCAR{Dir: dir, ManifestEntry: entry})
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+)
+
+// maxBufferedBytes caps the bytes buffered by all downloads and uploads together, 0 disables the cap
+var maxBufferedBytes int64
+
+// copyBufferSize is the buffer a download is copied from the network with
+const copyBufferSize = 256 << 10
+
+// bufferLimiter blocks buffer allocations while the buffered bytes would exceed the cap
+type bufferLimiter struct {
+	lk   sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+var buffers = newBufferLimiter()
+
+func newBufferLimiter() *bufferLimiter {
+	l := &bufferLimiter{}
+	l.cond = sync.NewCond(&l.lk)
+	return l
+}
+
+// acquire waits until n bytes fit the cap and claims them. A claim larger than the cap waits for every other claim to
+// be released, so it can't block forever.
+func (l *bufferLimiter) acquire(n int64) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	for maxBufferedBytes > 0 && l.used > 0 && l.used+n > maxBufferedBytes {
+		l.cond.Wait()
+	}
+	l.used += n
+	bufferedBytes.Set(l.used)
+}
+
+func (l *bufferLimiter) release(n int64) {
+	l.lk.Lock()
+	l.used -= n
+	bufferedBytes.Set(l.used)
+	l.lk.Unlock()
+
+	l.cond.Broadcast()
+}
+
+// alloc returns a buffer of size claimed from the limiter, free releases it
+func (l *bufferLimiter) alloc(size int) (buf []byte, free func()) {
+	l.acquire(int64(size))
+	return make([]byte, size), func() { l.release(int64(size)) }
+}
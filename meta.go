@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// metaSuffix marks the sidecar DAGMeta descriptor of a stored CAR
+const metaSuffix = ".meta"
+
+// DAGMeta describes the content of a stored CAR, so the archive can be searched by more than cids
+type DAGMeta struct {
+	Cid   string `json:"cid"`
+	Codec string `json:"codec"`
+	// UnixFSType is the type of the root of a UnixFS DAG: file, directory, hamt-directory, symlink, raw or metadata
+	UnixFSType string `json:"unixfs_type,omitempty"`
+	// Name is the name of the only entry of a wrapping directory
+	Name     string `json:"name,omitempty"`
+	FileSize uint64 `json:"file_size,omitempty"`
+	Entries  int    `json:"entries,omitempty"`
+	Blocks   int    `json:"blocks"`
+	// Depth is the number of levels of the DAG below the root
+	Depth int `json:"depth"`
+}
+
+var codecNames = map[uint64]string{
+	cid.Raw:         "raw",
+	cid.DagProtobuf: "dag-pb",
+	cid.DagCBOR:     "dag-cbor",
+	0x0129:          "dag-json",
+}
+
+var unixfsTypes = []string{"raw", "directory", "file", "metadata", "symlink", "hamt-directory"}
+
+// extractMeta scans the CAR at path once, counting its blocks and the depth of the DAG of root, and describes the
+// root block
+func extractMeta(path, root string) (*DAGMeta, error) {
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode root cid %s", root)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br, err := car.NewBlockReader(f, car.WithTrustedCAR(true))
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidCAR, "read header: %v", err)
+	}
+
+	meta := &DAGMeta{Cid: root, Codec: codecName(rootCid.Prefix().Codec)}
+	dag := make(dagLinks)
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidCAR, "read block %d: %v", meta.Blocks, err)
+		}
+		meta.Blocks++
+
+		links, err := blockLinks(blk.Cid(), blk.RawData())
+		if err != nil {
+			return nil, err
+		}
+		dag[string(blk.Cid().Hash())] = links
+
+		if bytes.Equal(blk.Cid().Hash(), rootCid.Hash()) && rootCid.Prefix().Codec == cid.DagProtobuf {
+			if err := describeUnixFS(meta, blk.RawData()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	meta.Depth = dag.depth(rootCid)
+	return meta, nil
+}
+
+// depth returns the number of levels below c reachable in the CAR
+func (d dagLinks) depth(c cid.Cid) int {
+	seen := map[string]struct{}{string(c.Hash()): {}}
+	level := []cid.Cid{c}
+	depth := -1
+	for len(level) > 0 {
+		depth++
+
+		var next []cid.Cid
+		for _, c := range level {
+			for _, l := range d[string(c.Hash())] {
+				if _, ok := seen[string(l.Hash())]; ok {
+					continue
+				}
+				seen[string(l.Hash())] = struct{}{}
+				if _, ok := d[string(l.Hash())]; ok {
+					next = append(next, l)
+				}
+			}
+		}
+		level = next
+	}
+	return depth
+}
+
+func codecName(codec uint64) string {
+	if name, ok := codecNames[codec]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", codec)
+}
+
+// describeUnixFS fills the UnixFS type, file size and entries of the dag-pb root block into meta
+func describeUnixFS(meta *DAGMeta, data []byte) error {
+	decoder, err := multicodec.LookupDecoder(cid.DagProtobuf)
+	if err != nil {
+		return err
+	}
+
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := decoder(nb, bytes.NewReader(data)); err != nil {
+		return errors.Wrapf(ErrInvalidCAR, "decode root block: %v", err)
+	}
+	node := nb.Build()
+
+	var names []string
+	if links, err := node.LookupByString("Links"); err == nil {
+		for it := links.ListIterator(); it != nil && !it.Done(); {
+			_, link, err := it.Next()
+			if err != nil {
+				return err
+			}
+
+			var name string
+			if n, err := link.LookupByString("Name"); err == nil {
+				name, _ = n.AsString()
+			}
+			names = append(names, name)
+		}
+	}
+
+	dataNode, err := node.LookupByString("Data")
+	if err != nil {
+		// a dag-pb node without UnixFS data
+		return nil
+	}
+	unixfs, err := dataNode.AsBytes()
+	if err != nil {
+		return nil
+	}
+
+	typ, fileSize, err := parseUnixFSData(unixfs)
+	if err != nil {
+		return errors.Wrap(err, "parse unixfs data")
+	}
+
+	if typ < uint64(len(unixfsTypes)) {
+		meta.UnixFSType = unixfsTypes[typ]
+	}
+	meta.FileSize = fileSize
+
+	if strings.HasSuffix(meta.UnixFSType, "directory") {
+		meta.Entries = len(names)
+		if len(names) == 1 {
+			meta.Name = names[0]
+		}
+	}
+	return nil
+}
+
+// parseUnixFSData reads the Type (1) and filesize (3) fields of the UnixFS Data protobuf message
+func parseUnixFSData(data []byte) (typ uint64, fileSize uint64, err error) {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, 0, errors.New("invalid field key")
+		}
+		data = data[n:]
+
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return 0, 0, errors.Errorf("invalid varint of field %d", field)
+			}
+			data = data[n:]
+
+			switch field {
+			case 1:
+				typ = v
+			case 3:
+				fileSize = v
+			}
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return 0, 0, errors.Errorf("truncated field %d", field)
+			}
+			data = data[size:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return 0, 0, errors.Errorf("truncated field %d", field)
+			}
+			data = data[n+int(l):]
+		default:
+			return 0, 0, errors.Errorf("unsupported wire type %d of field %d", wireType, field)
+		}
+	}
+	return typ, fileSize, nil
+}
+
+// writeMeta extracts the descriptor of the CAR at carPath into its sidecar file
+func writeMeta(carPath, root string) error {
+	meta, err := extractMeta(carPath, root)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	path := carPath + metaSuffix
+	if err := os.WriteFile(stagingPath(path), data, 0664); err != nil {
+		os.Remove(stagingPath(path))
+		return err
+	}
+	return os.Rename(stagingPath(path), path)
+}
+
+func readMeta(carPath string) (*DAGMeta, error) {
+	data, err := os.ReadFile(carPath + metaSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta DAGMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, errors.Wrapf(err, "decode %s", carPath+metaSuffix)
+	}
+	return &meta, nil
+}
+
+// findCmd searches the descriptors of the stored CARs, printing the matching ones
+func findCmd(args []string) error {
+	fs := flag.NewFlagSet("find", flag.ExitOnError)
+	typ := fs.String("type", "", "unixfs type of the root, e.g. file or directory")
+	codec := fs.String("codec", "", "codec of the root, e.g. dag-pb or raw")
+	name := fs.String("name", "", "substring of the name of the wrapped entry")
+	minSize := fs.Uint64("min-size", 0, "smallest unixfs file size")
+	maxSize := fs.Uint64("max-size", 0, "largest unixfs file size, 0 for no limit")
+	extract := fs.Bool("extract", false, "extract the missing descriptors of CARs stored before descriptors were written")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var missing int
+	for _, s := range stored {
+		var meta *DAGMeta
+		if s.aggregated() {
+			meta, err = readAggregatedMeta(s)
+		} else {
+			meta, err = readMeta(s.Path())
+		}
+		if os.IsNotExist(err) && !s.aggregated() && *extract && len(s.Base) == 0 {
+			if err = writeMeta(s.Path(), s.Cid); err == nil {
+				meta, err = readMeta(s.Path())
+			}
+		}
+		if err != nil {
+			missing++
+			continue
+		}
+
+		if (*typ != "" && meta.UnixFSType != *typ) ||
+			(*codec != "" && meta.Codec != *codec) ||
+			(*name != "" && !strings.Contains(meta.Name, *name)) ||
+			meta.FileSize < *minSize ||
+			(*maxSize > 0 && meta.FileSize > *maxSize) {
+			continue
+		}
+
+		enc.Encode(struct {
+			Dir string `json:"dir"`
+			*DAGMeta
+		}{s.Dir, meta})
+	}
+
+	if missing > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d CARs have no descriptor\n", missing, len(stored))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+)
+
+var (
+	// schedulerReconnects counts the rebuilt rpc clients, keyed by scheduler
+	schedulerReconnects = expvar.NewMap("scheduler_reconnects")
+	// schedulerReconnectFailures counts the failed rebuilds, keyed by scheduler
+	schedulerReconnectFailures = expvar.NewMap("scheduler_reconnect_failures")
+
+	downloadsUnverified   = expvar.NewInt("downloads_unverified")
+	downloadsVerified     = expvar.NewInt("downloads_verified")
+	downloadsVerifyFailed = expvar.NewInt("downloads_verify_failed")
+	assetHashMismatches   = expvar.NewInt("asset_hash_mismatches")
+
+	scrubChecked   = expvar.NewInt("scrub_checked")
+	scrubCorrupted = expvar.NewInt("scrub_corrupted")
+
+	spotCheckedBlocks = expvar.NewInt("spot_checked_blocks")
+	spotCheckFailures = expvar.NewInt("spot_check_failures")
+
+	reseedChecked  = expvar.NewInt("reseed_checked")
+	reseedRestored = expvar.NewInt("reseed_restored")
+
+	// retentionReclaimed counts the bytes deleted by the retention policy
+	retentionReclaimed = expvar.NewInt("retention_reclaimed_bytes")
+	// quotaEvicted counts the CARs evicted to keep the archive within its quota
+	quotaEvicted   = expvar.NewInt("quota_evicted")
+	quotaReclaimed = expvar.NewInt("quota_reclaimed_bytes")
+
+	// intakeDeferred is 1 while no jobs are pulled for low disk space
+	intakeDeferred = expvar.NewInt("intake_deferred")
+	// deferredLarge counts the jobs put off as they don't fit the free space
+	jobsDeferred = expvar.NewInt("jobs_deferred")
+
+	// jobsFiltered counts the jobs dropped by the job filter
+	jobsFiltered = expvar.NewInt("jobs_filtered")
+	// jobsSkipped counts the jobs out of the size range of the node
+	jobsSkipped = expvar.NewInt("jobs_skipped")
+	// jobsDenied counts the jobs of denylisted cids
+	jobsDenied = expvar.NewInt("jobs_denied")
+	// jobsSharded counts the jobs left to the other members of the fleet
+	jobsSharded = expvar.NewInt("jobs_sharded")
+
+	// bufferedBytes are the bytes claimed by the buffers of the running downloads and uploads
+	bufferedBytes = expvar.NewInt("buffered_bytes")
+	// carsCompacted counts the CARs packed into aggregates
+	carsCompacted = expvar.NewInt("cars_compacted")
+	// storageAPIRetried counts storage api requests sent again after a network error, 429 or 5xx
+	storageAPIRetried = expvar.NewInt("storage_api_retried")
+
+	// kuboUnresolvable are the stored assets which didn't resolve in the Kubo blockstore at the last reconciliation
+	kuboUnresolvable = expvar.NewInt("kubo_unresolvable")
+)
+
+// serveMetrics exposes the expvar metrics on /debug/vars of listen, behind metricsToken when set
+func serveMetrics(listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	log.Infof("serve metrics on %s", listen)
+	if err := serveControlHTTP(listen, controlAuth(metricsToken, mux)); err != nil {
+		log.Errorf("serve metrics: %v", err)
+	}
+}
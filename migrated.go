@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readMigrations returns the migration records of every cid deleted by the retention policy, in the order written
+func readMigrations() (map[string][]*MigrationRecord, error) {
+	f, err := os.Open(migrationFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(map[string][]*MigrationRecord)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var r MigrationRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Warnf("skip invalid migration line: %v", err)
+			continue
+		}
+		out[r.Cid] = append(out[r.Cid], &r)
+	}
+	return out, scanner.Err()
+}
+
+// fetchMigrated copies the CAR the retention policy migrated into tmpDir from the first of its records it can be
+// fetched from, the local tar archive before the remote targets. The copy is a complete CAR, it's verified with its
+// DAG against the cid.
+func fetchMigrated(records []*MigrationRecord, tmpDir string) (*StoredCAR, error) {
+	var lastErr error
+	for _, r := range records {
+		path := filepath.Join(tmpDir, r.Cid+".car")
+
+		var err error
+		switch {
+		case len(r.IDs) == 0:
+			err = errors.Errorf("no location recorded")
+		case r.Target == "tar":
+			err = extractTar(r.IDs[0], filepath.Join(r.Dir, r.Cid+".car"), path)
+		case r.Target == UploadW3S:
+			_, err = fetchFile(context.Background(), fmt.Sprintf("%s/ipfs/%s?format=car", strings.TrimSuffix(w3sGateway, "/"), r.Cid), "", path)
+		case r.Target == UploadArweave:
+			_, err = fetchFile(context.Background(), strings.TrimSuffix(arweaveGateway, "/")+"/"+r.IDs[0], "", path)
+		default:
+			err = errors.Errorf("unknown migration target %s", r.Target)
+		}
+		if err == nil {
+			err = checkCAR(path, r.Cid, true)
+		}
+		if err != nil {
+			log.Warnf("fetch %s from %s: %v", r.Cid, r.Target, err)
+			os.Remove(path)
+			lastErr = err
+			continue
+		}
+
+		fetched, err := fileResult(path)
+		if err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+		return &StoredCAR{Dir: tmpDir, ManifestEntry: &ManifestEntry{
+			Cid:        r.Cid,
+			Size:       fetched.Size,
+			PieceCID:   fetched.PieceCID,
+			PieceSize:  fetched.PieceSize,
+			SHA256:     fetched.SHA256,
+			BackupTime: r.MigratedAt,
+		}}, nil
+	}
+	return nil, errors.Wrap(lastErr, "fetch migrated CAR")
+}
+
+// extractTar copies the file name of the tar archive to path
+func extractTar(archive, name, path string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errors.Errorf("%s is not in %s", name, archive)
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Name == name {
+			_, err := copyFile(path, tr)
+			return err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"time"
+)
+
+var (
+	// mirror backs up every asset the schedulers know of, not only the ones of the backup_assets feed
+	mirror bool
+	// mirrorInterval is the period the asset lists of the schedulers are diffed against the inventory in
+	mirrorInterval = 6 * time.Hour
+)
+
+const (
+	mirrorPageSize = 500
+	// mirrorState is the state of the assets fully replicated on the network
+	mirrorState = "Servicing"
+)
+
+// mirrorAssets periodically pages through the asset records of every scheduler and queues the assets missing from
+// the archive
+func (d *Downloader) mirrorAssets() {
+	for {
+		if lowDisk() {
+			time.Sleep(mirrorInterval)
+			continue
+		}
+
+		queued, err := d.mirrorOnce()
+		if err != nil {
+			log.Errorf("mirror: %v", err)
+		}
+		log.Infof("mirror: queued %d missing assets", queued)
+
+		time.Sleep(mirrorInterval)
+	}
+}
+
+func (d *Downloader) mirrorOnce() (int, error) {
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return 0, err
+	}
+
+	have := make(map[string]struct{}, len(stored))
+	for _, s := range stored {
+		have[s.Cid] = struct{}{}
+	}
+
+	var queued int
+	for _, scheduler := range d.getSchedulers() {
+		schedulerApi, err := scheduler.client()
+		if err != nil {
+			log.Errorf("mirror: scheduler %s: %v", scheduler.Uuid, err)
+			continue
+		}
+
+		for offset := 0; ; offset += mirrorPageSize {
+			if err := schedulerLimits.wait(context.Background(), scheduler.Uuid); err != nil {
+				log.Errorf("mirror: %v", err)
+				break
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), schedulerTimeout)
+			records, err := schedulerApi.GetAssetRecords(ctx, mirrorPageSize, offset, []string{mirrorState}, "")
+			cancel()
+			if err != nil {
+				log.Errorf("mirror: list assets of scheduler %s at %d: %v", scheduler.Uuid, offset, err)
+				break
+			}
+
+			for _, record := range records {
+				if _, ok := have[record.CID]; ok {
+					continue
+				}
+				have[record.CID] = struct{}{}
+
+				asset := &model.Asset{Cid: record.CID, Hash: record.Hash, TotalSize: record.TotalSize, EndTime: time.Now()}
+				if !d.admit(asset) {
+					continue
+				}
+
+				if d.draining.Load() {
+					return queued, nil
+				}
+
+				// blocks while the workers are busy, so the listing is paced by the downloads
+				d.dispatch([]*model.Asset{asset})
+				queued++
+			}
+
+			if len(records) < mirrorPageSize {
+				break
+			}
+		}
+	}
+	return queued, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/ipld/go-car/v2"
+	"github.com/pkg/errors"
+	"os"
+)
+
+// carVersion is the CAR version stored files are normalized to, 0 keeps the version a node sent
+var carVersion int
+
+// normalizeCAR rewrites the verified CAR at path to carVersion, a CARv2 is written with its index. It returns whether
+// the file was rewritten.
+func normalizeCAR(path string) (bool, error) {
+	if carVersion == 0 {
+		return false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	version, err := car.ReadVersion(f)
+	f.Close()
+	if err != nil {
+		return false, errors.Wrapf(ErrInvalidCAR, "read version: %v", err)
+	}
+
+	if int(version) == carVersion {
+		return false, nil
+	}
+
+	tmp := path + ".normalize"
+	switch carVersion {
+	case 1:
+		err = car.ExtractV1File(path, tmp)
+	case 2:
+		err = car.WrapV1File(path, tmp)
+	default:
+		return false, errors.Errorf("unsupported CAR version %d", carVersion)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, errors.Wrapf(err, "convert CARv%d to CARv%d", version, carVersion)
+	}
+
+	return true, os.Rename(tmp, path)
+}
+
+// fileResult recomputes the size, checksum and piece of a CAR rewritten after it was fetched
+func fileResult(path string) (*fetchResult, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pieceCid, pieceSize, err := computePiece(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fetchResult{Size: st.Size(), SHA256: sum, PieceCID: pieceCid, PieceSize: pieceSize}, nil
+}
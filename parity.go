@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"github.com/pkg/errors"
+	"hash"
+	"io"
+	"os"
+)
+
+const (
+	// paritySuffix marks the Reed-Solomon parity sidecar of a stored CAR
+	paritySuffix = ".par"
+	// parityDataShards is the number of shards a CAR is split into, a corruption is repaired shard-wise
+	parityDataShards = 16
+)
+
+// parityPercent is the parity overhead of the sidecar in percent of the CAR size, 0 disables the sidecar
+var parityPercent int
+
+// parityHeader trails the parity shards in the sidecar, followed by its own length as uint32
+type parityHeader struct {
+	DataShards   int      `json:"data_shards"`
+	ParityShards int      `json:"parity_shards"`
+	ShardSize    int64    `json:"shard_size"`
+	FileSize     int64    `json:"file_size"`
+	DataHashes   []string `json:"data_hashes"`
+	ParityHashes []string `json:"parity_hashes"`
+}
+
+// writeParity writes the parity sidecar of the CAR at carPath
+func writeParity(carPath string) error {
+	f, err := os.Open(carPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &parityHeader{
+		DataShards:   parityDataShards,
+		ParityShards: max(1, (parityDataShards*parityPercent+99)/100),
+		ShardSize:    max(1, (st.Size()+parityDataShards-1)/parityDataShards),
+		FileSize:     st.Size(),
+	}
+
+	enc, err := reedsolomon.NewStream(header.DataShards, header.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	parPath := carPath + paritySuffix
+	out, err := os.Create(stagingPath(parPath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stagingPath(parPath))
+
+	dataReaders, dataHashes := header.dataShards(f)
+	parityWriters := make([]io.Writer, header.ParityShards)
+	parityHashes := make([]hash.Hash, header.ParityShards)
+	for i := range parityWriters {
+		parityHashes[i] = sha256.New()
+		parityWriters[i] = io.MultiWriter(io.NewOffsetWriter(out, int64(i)*header.ShardSize), parityHashes[i])
+	}
+
+	if err := enc.Encode(dataReaders, parityWriters); err != nil {
+		out.Close()
+		return err
+	}
+
+	header.DataHashes = hexSums(dataHashes)
+	header.ParityHashes = hexSums(parityHashes)
+
+	data, err := json.Marshal(header)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	trailer := binary.BigEndian.AppendUint32(data, uint32(len(data)))
+	_, err = out.WriteAt(trailer, int64(header.ParityShards)*header.ShardSize)
+	if err == nil && durable {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(stagingPath(parPath), parPath)
+}
+
+// dataShards returns readers of the data shards of f, the last one padded with zeros, and the hashes fed by them
+func (h *parityHeader) dataShards(f io.ReaderAt) ([]io.Reader, []hash.Hash) {
+	readers := make([]io.Reader, h.DataShards)
+	hashes := make([]hash.Hash, h.DataShards)
+	for i := range readers {
+		offset := int64(i) * h.ShardSize
+		length := max(0, min(h.ShardSize, h.FileSize-offset))
+		padding := io.LimitReader(zeroReader{}, h.ShardSize-length)
+
+		hashes[i] = sha256.New()
+		readers[i] = io.TeeReader(io.MultiReader(io.NewSectionReader(f, offset, length), padding), hashes[i])
+	}
+	return readers, hashes
+}
+
+func readParityHeader(par *os.File) (*parityHeader, error) {
+	st, err := par.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := par.ReadAt(size[:], st.Size()-4); err != nil {
+		return nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(size[:]))
+	data := make([]byte, length)
+	if _, err := par.ReadAt(data, st.Size()-4-length); err != nil {
+		return nil, err
+	}
+
+	var header parityHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, errors.Wrap(err, "decode parity header")
+	}
+	return &header, nil
+}
+
+// checkParity returns the indexes of the corrupted data and parity shards of the CAR at carPath
+func checkParity(carPath string) (*parityHeader, []int, []int, error) {
+	f, err := os.Open(carPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+
+	par, err := os.Open(carPath + paritySuffix)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer par.Close()
+
+	header, err := readParityHeader(par)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var badData, badParity []int
+
+	readers, hashes := header.dataShards(f)
+	for i, r := range readers {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, nil, nil, err
+		}
+		if hex.EncodeToString(hashes[i].Sum(nil)) != header.DataHashes[i] {
+			badData = append(badData, i)
+		}
+	}
+
+	for i := 0; i < header.ParityShards; i++ {
+		h := sha256.New()
+		if _, err := io.Copy(h, io.NewSectionReader(par, int64(i)*header.ShardSize, header.ShardSize)); err != nil {
+			return nil, nil, nil, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != header.ParityHashes[i] {
+			badParity = append(badParity, i)
+		}
+	}
+
+	return header, badData, badParity, nil
+}
+
+// repairParity reconstructs the corrupted shards of the CAR at carPath and of its parity sidecar in place. It returns
+// the number of repaired shards.
+func repairParity(carPath string) (int, error) {
+	header, badData, badParity, err := checkParity(carPath)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(badData)+len(badParity) == 0 {
+		return 0, nil
+	}
+
+	if len(badData)+len(badParity) > header.ParityShards {
+		return 0, errors.Errorf("%d corrupted shards, only %d can be repaired", len(badData)+len(badParity), header.ParityShards)
+	}
+
+	f, err := os.OpenFile(carPath, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	par, err := os.OpenFile(carPath+paritySuffix, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer par.Close()
+
+	enc, err := reedsolomon.NewStream(header.DataShards, header.ParityShards)
+	if err != nil {
+		return 0, err
+	}
+
+	total := header.DataShards + header.ParityShards
+	valid := make([]io.Reader, total)
+	fill := make([]io.Writer, total)
+
+	dataReaders, _ := header.dataShards(f)
+	for i, r := range dataReaders {
+		valid[i] = r
+	}
+	for i := 0; i < header.ParityShards; i++ {
+		valid[header.DataShards+i] = io.NewSectionReader(par, int64(i)*header.ShardSize, header.ShardSize)
+	}
+
+	for _, i := range badData {
+		valid[i] = nil
+		offset := int64(i) * header.ShardSize
+		// the padding of the last shard must not extend the CAR
+		fill[i] = &limitedWriter{w: io.NewOffsetWriter(f, offset), n: max(0, min(header.ShardSize, header.FileSize-offset))}
+	}
+	for _, i := range badParity {
+		valid[header.DataShards+i] = nil
+		fill[header.DataShards+i] = io.NewOffsetWriter(par, int64(i)*header.ShardSize)
+	}
+
+	if err := enc.Reconstruct(valid, fill); err != nil {
+		return 0, err
+	}
+
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := par.Sync(); err != nil {
+		return 0, err
+	}
+
+	return len(badData) + len(badParity), nil
+}
+
+func parityCmd(args []string) error {
+	if len(args) != 2 || (args[0] != "verify" && args[0] != "repair") {
+		return fmt.Errorf("usage: parity verify|repair <car path>")
+	}
+
+	if args[0] == "repair" {
+		n, err := repairParity(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("repaired %d shards of %s\n", n, args[1])
+		return nil
+	}
+
+	_, badData, badParity, err := checkParity(args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("corrupted data shards: %v, corrupted parity shards: %v\n", badData, badParity)
+	return nil
+}
+
+func hexSums(hashes []hash.Hash) []string {
+	out := make([]string, len(hashes))
+	for i, h := range hashes {
+		out[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return out
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// limitedWriter writes the first n bytes to w and discards the rest
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n <= 0 {
+		return len(p), nil
+	}
+
+	keep := p[:min(int64(len(p)), l.n)]
+	if _, err := l.w.Write(keep); err != nil {
+		return 0, err
+	}
+	l.n -= int64(len(keep))
+	return len(p), nil
+}
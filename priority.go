@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// ioniceClass is the I/O scheduling class of the daemon, empty leaves it unchanged
+	ioniceClass string
+	// ioniceLevel is the priority within the best-effort and realtime classes, 0 is the highest
+	ioniceLevel = 4
+	// niceness is added to the CPU niceness of the daemon, 0 leaves it unchanged
+	niceness int
+)
+
+// I/O scheduling classes of ioprio_set
+const (
+	ioprioClassNone = iota
+	ioprioClassRealtime
+	ioprioClassBestEffort
+	ioprioClassIdle
+)
+
+// parseIOClass maps the ionice_class names to the ioprio classes
+func parseIOClass(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return ioprioClassNone, nil
+	case "realtime", "rt":
+		return ioprioClassRealtime, nil
+	case "best-effort", "be":
+		return ioprioClassBestEffort, nil
+	case "idle":
+		return ioprioClassIdle, nil
+	}
+	return 0, fmt.Errorf("unknown ionice class %s, want none, realtime, best-effort or idle", name)
+}
+
+// applyPriority lowers the I/O and CPU priority of every worker of the process as configured
+func applyPriority() error {
+	if niceness != 0 {
+		if err := setNiceness(niceness); err != nil {
+			return fmt.Errorf("set niceness %d: %w", niceness, err)
+		}
+		log.Infof("cpu niceness set to %d", niceness)
+	}
+
+	if ioniceClass == "" {
+		return nil
+	}
+
+	class, err := parseIOClass(ioniceClass)
+	if err != nil {
+		return err
+	}
+	if ioniceLevel < 0 || ioniceLevel > 7 {
+		return fmt.Errorf("ionice level %d out of range 0-7", ioniceLevel)
+	}
+
+	if err := setIOPriority(class, ioniceLevel); err != nil {
+		return fmt.Errorf("set ionice class %s: %w", ioniceClass, err)
+	}
+	log.Infof("ionice class set to %s, level %d", ioniceClass, ioniceLevel)
+	return nil
+}
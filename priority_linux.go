@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const ioprioWhoProcess = 1
+
+// threads lists the ids of the os threads of the process, linux keeps the I/O and CPU priority per thread and
+// threads started later inherit them from the thread creating them
+func threads() ([]int, error) {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, err
+	}
+
+	tids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if tid, err := strconv.Atoi(entry.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids, nil
+}
+
+// setIOPriority sets the ioprio class and level of every thread
+func setIOPriority(class, level int) error {
+	tids, err := threads()
+	if err != nil {
+		return err
+	}
+
+	prio := uintptr(class<<13 | level)
+	for _, tid := range tids {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), prio); errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+// setNiceness adds inc to the niceness of every thread
+func setNiceness(inc int) error {
+	tids, err := threads()
+	if err != nil {
+		return err
+	}
+
+	for _, tid := range tids {
+		prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, tid)
+		if err != nil {
+			return err
+		}
+		// the raw syscall returns 20 - nice
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, 20-prio+inc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
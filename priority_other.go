@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// setIOPriority is not supported, I/O keeps the default priority
+func setIOPriority(class, level int) error {
+	return errors.New("ionice not supported on this platform")
+}
+
+// setNiceness is not supported, the process keeps its niceness
+func setNiceness(inc int) error {
+	return errors.New("niceness not supported on this platform")
+}
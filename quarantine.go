@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// quarantineDir holds the stored and downloaded CARs which failed verification, each with a reason file. It's kept
+// out of the backup tree, so the inventory, gc and the size accounting leave it alone.
+var quarantineDir = filepath.Join(filepath.Dir(BackupOutPath), "titan-quarantine")
+
+const reasonSuffix = ".reason"
+
+var (
+	// quarantineMaxAge removes quarantined CARs older than it, 0 keeps them until they're purged
+	quarantineMaxAge time.Duration
+	// quarantineMaxSize bounds the bytes held by the quarantine, the oldest CARs are removed beyond it, 0 disables it
+	quarantineMaxSize int64
+)
+
+// QuarantineReason is written next to a quarantined CAR
+type QuarantineReason struct {
+	Cid          string `json:"cid"`
+	OriginalPath string `json:"original_path,omitempty"`
+	// Source is the node a downloaded CAR failing verification came from
+	Source        string    `json:"source,omitempty"`
+	Reason        string    `json:"reason"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+
+	// name is the file name of the quarantined CAR without its extension
+	name string
+}
+
+// quarantine moves the stored CAR and its sidecars into quarantineDir and removes it from the manifest, so it's no
+// longer treated as a good backup.
+func quarantine(s *StoredCAR, reason error) error {
+	_, err := quarantineStored(s, reason)
+	return err
+}
+
+// quarantine quarantines the stored CAR and takes the bytes freed off the tracked size of its directory
+func (d *Downloader) quarantine(s *StoredCAR, reason error) error {
+	freed, err := quarantineStored(s, reason)
+	d.dirSize.add(s.Dir, -freed)
+	return err
+}
+
+// quarantineStored quarantines the stored CAR, it returns the bytes freed in its directory
+func quarantineStored(s *StoredCAR, reason error) (int64, error) {
+	if err := os.MkdirAll(quarantineDir, 0775); err != nil {
+		return 0, err
+	}
+
+	// the same cid may be quarantined from several directories
+	name := fmt.Sprintf("%s.%s", s.Cid, filepath.Base(s.Dir))
+	target := filepath.Join(quarantineDir, name+".car")
+
+	var freed int64
+
+	if s.aggregated() {
+		// the aggregate holds other CARs, the packed one is copied out
+		f, section, err := openAggregated(s)
+		if err != nil {
+			return 0, err
+		}
+		_, err = copyFile(target, section)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		freed = storedSize(s.Path())
+		if err := moveFile(s.Path(), target); err != nil {
+			return 0, err
+		}
+		for _, suffix := range sidecarSuffixes {
+			moveFile(s.Path()+suffix, target+suffix)
+		}
+	}
+
+	if err := writeReason(name, &QuarantineReason{Cid: s.Cid, OriginalPath: s.Path(), Reason: reason.Error()}); err != nil {
+		return freed, err
+	}
+	limitQuarantine()
+
+	log.Warnf("quarantined %s: %v", s.Path(), reason)
+	if err := removeFromManifest(s.Dir, s.Cid); err != nil {
+		return freed, err
+	}
+
+	if s.aggregated() {
+		return pruneAggregate(s.Dir, s.Aggregate)
+	}
+	return freed, nil
+}
+
+// quarantineDownload moves a downloaded CAR of cid which failed verification from partPath into quarantineDir, as
+// evidence against the node it came from
+func quarantineDownload(partPath, cid, node string, reason error) error {
+	if err := os.MkdirAll(quarantineDir, 0775); err != nil {
+		return err
+	}
+
+	// a node may send a bad CAR of the cid more than once
+	name := fmt.Sprintf("%s.%s.%d", cid, filepath.Base(node), time.Now().Unix())
+	if err := moveFile(partPath, filepath.Join(quarantineDir, name+".car")); err != nil {
+		return err
+	}
+
+	log.Warnf("quarantined %s from %s: %v", cid, node, reason)
+	if err := writeReason(name, &QuarantineReason{Cid: cid, Source: node, Reason: reason.Error()}); err != nil {
+		return err
+	}
+
+	// a source sending bad CARs again and again would fill the disk otherwise
+	limitQuarantine()
+	return nil
+}
+
+// limitQuarantine applies quarantineMaxAge and quarantineMaxSize after a CAR was quarantined
+func limitQuarantine() {
+	if quarantineMaxAge <= 0 && quarantineMaxSize <= 0 {
+		return
+	}
+
+	removed, freed, err := pruneQuarantine(quarantineMaxAge, quarantineMaxSize)
+	if err != nil {
+		log.Errorf("prune quarantine: %v", err)
+		return
+	}
+	if removed > 0 {
+		log.Infof("removed %d quarantined CARs, reclaimed %s", removed, units.BytesSize(float64(freed)))
+	}
+}
+
+// pruneQuarantine removes the quarantined CARs older than maxAge, then the oldest ones until the quarantine holds at
+// most maxSize bytes, 0 disables either bound. It returns the number of CARs removed and the bytes freed.
+func pruneQuarantine(maxAge time.Duration, maxSize int64) (int, int64, error) {
+	reasons, err := listQuarantine()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sort.Slice(reasons, func(i, j int) bool { return reasons[i].QuarantinedAt.Before(reasons[j].QuarantinedAt) })
+
+	sizes := make([]int64, len(reasons))
+	var total int64
+	for i, r := range reasons {
+		sizes[i] = quarantinedSize(r.name)
+		total += sizes[i]
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	var removed int
+	var freed int64
+	for i, r := range reasons {
+		expired := maxAge > 0 && r.QuarantinedAt.Before(cutoff)
+		if !expired && (maxSize <= 0 || total <= maxSize) {
+			// the rest is younger and fits
+			break
+		}
+
+		if err := removeQuarantined(r.name); err != nil {
+			return removed, freed, err
+		}
+		total -= sizes[i]
+		freed += sizes[i]
+		removed++
+	}
+	return removed, freed, nil
+}
+
+// quarantineFiles are the CAR, the sidecars and last the reason file of the quarantined CAR name
+func quarantineFiles(name string) []string {
+	carPath := filepath.Join(quarantineDir, name+".car")
+	files := []string{carPath}
+	for _, suffix := range sidecarSuffixes {
+		files = append(files, carPath+suffix)
+	}
+	return append(files, filepath.Join(quarantineDir, name+reasonSuffix))
+}
+
+// quarantinedSize returns the bytes of the files of the quarantined CAR name
+func quarantinedSize(name string) int64 {
+	var size int64
+	for _, path := range quarantineFiles(name) {
+		if st, err := os.Stat(path); err == nil {
+			size += st.Size()
+		}
+	}
+	return size
+}
+
+// removeQuarantined deletes the quarantined CAR name, its reason file goes last so a failed removal is retried
+func removeQuarantined(name string) error {
+	for _, path := range quarantineFiles(name) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReason writes the reason file of the quarantined CAR name
+func writeReason(name string, reason *QuarantineReason) error {
+	reason.QuarantinedAt = time.Now()
+	data, err := json.MarshalIndent(reason, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(quarantineDir, name+reasonSuffix), data, 0664)
+}
+
+// moveFile renames src to dst, copying it when the quarantine is on another filesystem
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	_, err = copyFile(dst, f)
+	f.Close()
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// listQuarantine returns the reasons of the quarantined CARs
+func listQuarantine() ([]*QuarantineReason, error) {
+	files, err := os.ReadDir(quarantineDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var out []*QuarantineReason
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), reasonSuffix) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(quarantineDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var reason QuarantineReason
+		if err := json.Unmarshal(data, &reason); err != nil {
+			return nil, err
+		}
+		reason.name = strings.TrimSuffix(f.Name(), reasonSuffix)
+		out = append(out, &reason)
+	}
+
+	return out, nil
+}
+
+func quarantineCmd(args []string) error {
+	if len(args) > 0 && args[0] == "purge" {
+		return quarantinePurgeCmd(args[1:])
+	}
+	if len(args) == 0 || args[0] != "list" {
+		return fmt.Errorf("usage: quarantine list | purge [-older-than d] [-max-size bytes] [-all] [cid...]")
+	}
+
+	reasons, err := listQuarantine()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CID\tQUARANTINED AT\tORIGINAL PATH\tREASON")
+	for _, r := range reasons {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Cid, r.QuarantinedAt.Format(time.RFC3339), r.OriginalPath, r.Reason)
+	}
+	return w.Flush()
+}
+
+// quarantinePurgeCmd removes quarantined CARs by cid, by age or size, or all of them
+func quarantinePurgeCmd(args []string) error {
+	fs := flag.NewFlagSet("quarantine purge", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", 0, "remove the CARs quarantined longer ago")
+	maxSize := fs.Int64("max-size", 0, "remove the oldest CARs until the quarantine holds at most this many bytes")
+	all := fs.Bool("all", false, "remove every quarantined CAR")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if !*all && *olderThan <= 0 && *maxSize <= 0 && fs.NArg() == 0 {
+		return fmt.Errorf("usage: quarantine purge [-older-than d] [-max-size bytes] [-all] [cid...]")
+	}
+
+	var removed int
+	var freed int64
+	if *all || fs.NArg() > 0 {
+		reasons, err := listQuarantine()
+		if err != nil {
+			return err
+		}
+
+		selected := make(map[string]struct{})
+		for _, c := range fs.Args() {
+			selected[c] = struct{}{}
+		}
+
+		for _, r := range reasons {
+			if _, ok := selected[r.Cid]; !*all && !ok {
+				continue
+			}
+			size := quarantinedSize(r.name)
+			if err := removeQuarantined(r.name); err != nil {
+				return err
+			}
+			removed++
+			freed += size
+		}
+	}
+
+	if *olderThan > 0 || *maxSize > 0 {
+		n, size, err := pruneQuarantine(*olderThan, *maxSize)
+		removed += n
+		freed += size
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%d quarantined CARs removed, %s reclaimed\n", removed, units.BytesSize(float64(freed)))
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withQuarantineDir(t *testing.T) {
+	old := quarantineDir
+	quarantineDir = t.TempDir()
+	t.Cleanup(func() { quarantineDir = old })
+}
+
+// quarantineTestCAR quarantines a download of size bytes, backdated by age
+func quarantineTestCAR(t *testing.T, cid string, size int, age time.Duration) {
+	partPath := filepath.Join(t.TempDir(), cid+".car"+partSuffix)
+	if err := os.WriteFile(partPath, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := quarantineDownload(partPath, cid, "node", errors.New("bad")); err != nil {
+		t.Fatal(err)
+	}
+
+	reasons, err := listQuarantine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reasons {
+		if r.Cid != cid {
+			continue
+		}
+		// writeReason stamps the current time
+		r.QuarantinedAt = time.Now().Add(-age)
+		data, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(quarantineDir, r.name+reasonSuffix), data, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func quarantinedCids(t *testing.T) map[string]bool {
+	reasons, err := listQuarantine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]bool)
+	for _, r := range reasons {
+		out[r.Cid] = true
+	}
+	return out
+}
+
+func TestPruneQuarantineAge(t *testing.T) {
+	withQuarantineDir(t)
+	quarantineTestCAR(t, "old", 10, 48*time.Hour)
+	quarantineTestCAR(t, "new", 10, time.Hour)
+
+	removed, _, err := pruneQuarantine(24*time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left := quarantinedCids(t); removed != 1 || left["old"] || !left["new"] {
+		t.Errorf("removed %d, left %v, want only old removed", removed, left)
+	}
+	if files, _ := filepath.Glob(filepath.Join(quarantineDir, "old.*")); len(files) > 0 {
+		t.Errorf("files of old left behind: %v", files)
+	}
+}
+
+func TestPruneQuarantineSize(t *testing.T) {
+	withQuarantineDir(t)
+	quarantineTestCAR(t, "first", 1000, 3*time.Hour)
+	quarantineTestCAR(t, "second", 1000, 2*time.Hour)
+	quarantineTestCAR(t, "third", 1000, time.Hour)
+
+	// the reason files count too
+	removed, freed, err := pruneQuarantine(0, 2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := quarantinedCids(t)
+	if removed != 1 || freed < 1000 || left["first"] || !left["second"] || !left["third"] {
+		t.Errorf("removed %d freeing %d, left %v, want the oldest removed", removed, freed, left)
+	}
+}
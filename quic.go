@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// quicStreamWindow is the max receive window of a QUIC stream, 0 keeps the quic-go default of 6MiB
+	quicStreamWindow uint64
+	// quicConnWindow is the max receive window of a QUIC connection, 0 keeps the quic-go default of 15MiB
+	quicConnWindow uint64
+	// quicKeepAlive is the period keep-alive packets are sent in, 0 disables them
+	quicKeepAlive time.Duration
+	// quicHandshakeTimeout bounds the QUIC handshake with a node, 0 keeps the quic-go default
+	quicHandshakeTimeout time.Duration
+	// quicIdleTimeout closes QUIC connections idle for longer, 0 keeps the quic-go default
+	quicIdleTimeout time.Duration
+)
+
+// quicConfig tunes the QUIC connections to the nodes from the flags. The default windows cap a download at
+// window / rtt, far below the link speed between regions
+func quicConfig() *quic.Config {
+	config := &quic.Config{
+		MaxStreamReceiveWindow:     quicStreamWindow,
+		MaxConnectionReceiveWindow: quicConnWindow,
+		KeepAlivePeriod:            quicKeepAlive,
+		HandshakeIdleTimeout:       quicHandshakeTimeout,
+		MaxIdleTimeout:             quicIdleTimeout,
+	}
+
+	// start the windows at a quarter of their max, quic-go grows them with the measured rtt from there
+	if quicStreamWindow > 0 {
+		config.InitialStreamReceiveWindow = quicStreamWindow / 4
+	}
+	if quicConnWindow > 0 {
+		config.InitialConnectionReceiveWindow = quicConnWindow / 4
+	}
+	return config
+}
+
+// nodeTransport is the http3 round tripper shared by the downloads from the nodes, so connections to a node are
+// reused. It's created on first use, after the flags are parsed
+var nodeTransport = sync.OnceValue(func() http.RoundTripper {
+	return &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		QuicConfig: quicConfig(),
+		Dial:       dialQUIC,
+	}
+})
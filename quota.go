@@ -0,0 +1,130 @@
+package main
+
+import (
+	"github.com/docker/go-units"
+	"sort"
+	"time"
+)
+
+var (
+	// archiveQuota is the byte budget of the archive, the oldest CARs copied to a cold tier are evicted beyond it
+	archiveQuota  int64
+	quotaInterval = time.Hour
+)
+
+// coldCopies returns the cids with a copy on a cold tier: an upload recorded in the manifest or an active deal
+func coldCopies(stored []*StoredCAR) (map[string]struct{}, error) {
+	cold := make(map[string]struct{})
+	for _, s := range stored {
+		if len(s.Uploads) > 0 {
+			cold[s.Cid] = struct{}{}
+		}
+	}
+
+	deals, err := loadDeals()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range deals {
+		if r.State != DealActive {
+			continue
+		}
+		cars := r.CARs
+		if len(cars) == 0 {
+			cars = []string{r.Cid}
+		}
+		for _, c := range cars {
+			cold[c] = struct{}{}
+		}
+	}
+	return cold, nil
+}
+
+// enforceQuota evicts the oldest CARs with a cold copy until the archive fits archiveQuota. CARs on legal hold and
+// bases of delta CARs are never evicted.
+func enforceQuota() (*retentionReport, error) {
+	report := &retentionReport{Freed: make(map[string]int64)}
+
+	var used int64
+	for _, root := range outputRoots() {
+		size, err := getDirSize(root)
+		if err != nil {
+			return nil, err
+		}
+		used += size
+	}
+	if used <= archiveQuota {
+		return report, nil
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cold, err := coldCopies(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	bases := make(map[string]struct{})
+	for _, s := range stored {
+		for _, base := range s.Base {
+			bases[base] = struct{}{}
+		}
+	}
+
+	sort.SliceStable(stored, func(i, j int) bool {
+		return stored[i].BackupTime.Before(stored[j].BackupTime)
+	})
+
+	for _, s := range stored {
+		if used <= archiveQuota {
+			break
+		}
+
+		if _, ok := cold[s.Cid]; !ok {
+			continue
+		}
+		if _, ok := bases[s.Cid]; ok || legalHold.contains(s.Cid) {
+			report.Held++
+			continue
+		}
+
+		size, err := removeStored(s, false)
+		if err != nil {
+			return report, err
+		}
+
+		log.Infof("quota: evicted %s, copied to a cold tier, reclaimed %s", s.Path(), units.BytesSize(float64(size)))
+		used -= size
+		report.CARs++
+		report.Reclaimed += size
+		report.Freed[s.Dir] += size
+		report.Removed = append(report.Removed, s.Cid)
+	}
+
+	if used > archiveQuota {
+		log.Warnf("quota: archive uses %s of %s, no more CARs with a cold copy to evict", units.BytesSize(float64(used)), units.BytesSize(float64(archiveQuota)))
+	}
+	return report, nil
+}
+
+// quota enforces archiveQuota every quotaInterval
+func (d *Downloader) quota() {
+	for {
+		report, err := enforceQuota()
+		if err != nil {
+			log.Errorf("quota: %v", err)
+		}
+
+		if report != nil && report.CARs > 0 {
+			d.blocks.remove(report.Removed)
+			d.dirSize.free(report.Freed)
+			quotaEvicted.Add(int64(report.CARs))
+			quotaReclaimed.Add(report.Reclaimed)
+		}
+
+		time.Sleep(quotaInterval)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"sync"
+)
+
+var (
+	// schedulerRate caps the rpc calls per second to every scheduler, 0 disables the limit
+	schedulerRate float64
+	// schedulerBurst is the number of scheduler rpc calls allowed at once above schedulerRate
+	schedulerBurst = 5
+	// nodeRate caps the download attempts per second from every node, 0 disables the limit
+	nodeRate float64
+	// nodeBurst is the number of download attempts allowed at once above nodeRate
+	nodeBurst = 2
+)
+
+// keyedLimiter rate limits every key, a scheduler or a node, on its own
+type keyedLimiter struct {
+	lk       sync.Mutex
+	limiters map[string]*rate.Limiter
+	rate     *float64
+	burst    *int
+}
+
+// wait blocks until key may make another request or ctx is done
+func (l *keyedLimiter) wait(ctx context.Context, key string) error {
+	if *l.rate <= 0 {
+		return nil
+	}
+
+	l.lk.Lock()
+	if l.limiters == nil {
+		l.limiters = make(map[string]*rate.Limiter)
+	}
+	limiter, ok := l.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(*l.rate), max(*l.burst, 1))
+		l.limiters[key] = limiter
+	}
+	l.lk.Unlock()
+
+	return limiter.Wait(ctx)
+}
+
+var (
+	// schedulerLimits limits the rpc calls to the schedulers by their url
+	schedulerLimits = &keyedLimiter{rate: &schedulerRate, burst: &schedulerBurst}
+	// nodeLimits limits the downloads from the nodes by their address
+	nodeLimits = &keyedLimiter{rate: &nodeRate, burst: &nodeBurst}
+)
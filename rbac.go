@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role is what a control plane client may do
+type Role int
+
+const (
+	roleNone Role = iota
+	// roleObserver reads the status, the listings, the config and the metrics
+	roleObserver
+	// roleOperator also changes the queue and the worker pool, prunes and restores the archive and upgrades the binary
+	roleOperator
+)
+
+func (r Role) String() string {
+	switch r {
+	case roleObserver:
+		return "observer"
+	case roleOperator:
+		return "operator"
+	}
+	return "none"
+}
+
+// AdminCredential grants a role on the admin api and the control service to a bearer token or to the client
+// certificates of a common name
+type AdminCredential struct {
+	// Name identifies the client in the logs of the operations
+	Name string
+	// Token is a bearer token, a secret reference is resolved at startup
+	Token string
+	// CommonName matches the subject of client certificates signed by control_client_ca
+	CommonName string
+	// Role is observer or operator
+	Role string
+
+	role Role
+}
+
+// adminCredentials are loaded at startup from the flags and the AdminCredentials section of the config file
+var adminCredentials []*AdminCredential
+
+// loadAdminCredentials reads the credentials of the config file, admin_token is an operator credential
+func loadAdminCredentials() error {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+
+	creds := cfg.AdminCredentials
+	if adminToken != "" {
+		creds = append(creds, &AdminCredential{Name: "admin_token", Token: adminToken, Role: "operator"})
+	}
+
+	for _, c := range creds {
+		switch c.Role {
+		case "observer":
+			c.role = roleObserver
+		case "operator":
+			c.role = roleOperator
+		default:
+			return fmt.Errorf("credential %s: unknown role %q, want observer or operator", c.Name, c.Role)
+		}
+
+		if isSecretRef(c.Token) {
+			value, err := fetchSecret(c.Token)
+			if err != nil {
+				return fmt.Errorf("fetch token of credential %s: %w", c.Name, err)
+			}
+			c.Token = value
+		}
+		if c.Token == "" && c.CommonName == "" {
+			return fmt.Errorf("credential %s has neither token nor common name", c.Name)
+		}
+	}
+
+	adminCredentials = creds
+	return nil
+}
+
+// certificatesMapped reports whether any credential names a certificate subject. Without one, every verified client
+// certificate is an operator, as before roles existed.
+func certificatesMapped() bool {
+	for _, c := range adminCredentials {
+		if c.CommonName != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the role and name of a client from its verified certificate or the bearer token of its
+// authorization header
+func authenticate(state *tls.ConnectionState, authorization string) (Role, string) {
+	if verifiedClient(state) {
+		cn := state.VerifiedChains[0][0].Subject.CommonName
+		if !certificatesMapped() {
+			return roleOperator, cn
+		}
+		for _, c := range adminCredentials {
+			if c.CommonName != "" && c.CommonName == cn {
+				return c.role, c.Name
+			}
+		}
+	}
+
+	got, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return roleNone, ""
+	}
+	for _, c := range adminCredentials {
+		if c.Token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(c.Token)) == 1 {
+			return c.role, c.Name
+		}
+	}
+	return roleNone, ""
+}
+
+// authorize serves h to the clients with role or a higher one, the operations of operators are logged
+func authorize(role Role, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, name := authenticate(r.TLS, r.Header.Get("Authorization"))
+		switch {
+		case got == roleNone:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		case got < role:
+			http.Error(w, fmt.Sprintf("%s role required", role), http.StatusForbidden)
+			return
+		}
+
+		if role == roleOperator {
+			log.Infof("admin: %s %s by %s", r.Method, r.URL.Path, name)
+		}
+		h(w, r)
+	})
+}
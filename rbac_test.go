@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withAdminConfig loads the credentials of the config file and admin_token, restoring the previous ones afterwards
+func withAdminConfig(t *testing.T, config, token string) error {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath, oldToken, oldCreds := configPath, adminToken, adminCredentials
+	configPath, adminToken = path, token
+	t.Cleanup(func() { configPath, adminToken, adminCredentials = oldPath, oldToken, oldCreds })
+	return loadAdminCredentials()
+}
+
+const testCredentials = `
+[[AdminCredentials]]
+Name = "dashboard"
+Token = "observer-token"
+Role = "observer"
+
+[[AdminCredentials]]
+Name = "oncall"
+Token = "operator-token"
+Role = "operator"
+`
+
+func TestAuthenticate(t *testing.T) {
+	if err := withAdminConfig(t, testCredentials, "admin-token"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		authorization string
+		role          Role
+		name          string
+	}{
+		{"Bearer observer-token", roleObserver, "dashboard"},
+		{"Bearer operator-token", roleOperator, "oncall"},
+		{"Bearer admin-token", roleOperator, "admin_token"},
+		{"Bearer unknown", roleNone, ""},
+		{"observer-token", roleNone, ""},
+		{"", roleNone, ""},
+	} {
+		role, name := authenticate(nil, tc.authorization)
+		if role != tc.role || name != tc.name {
+			t.Errorf("%q: %s %q, want %s %q", tc.authorization, role, name, tc.role, tc.name)
+		}
+	}
+}
+
+func TestLoadAdminCredentialsRole(t *testing.T) {
+	err := withAdminConfig(t, `
+[[AdminCredentials]]
+Name = "dashboard"
+Token = "token"
+Role = "admin"
+`, "")
+	if err == nil {
+		t.Fatal("unknown role loaded")
+	}
+
+	err = withAdminConfig(t, `
+[[AdminCredentials]]
+Name = "dashboard"
+Role = "observer"
+`, "")
+	if err == nil {
+		t.Fatal("credential without token or common name loaded")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	if err := withAdminConfig(t, testCredentials, ""); err != nil {
+		t.Fatal(err)
+	}
+	h := authorize(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, tc := range []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"unknown", http.StatusUnauthorized},
+		{"observer-token", http.StatusForbidden},
+		{"operator-token", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/pause", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("token %q: status %d, want %d", tc.token, w.Code, tc.code)
+		}
+	}
+}
+
+func TestControlAuth(t *testing.T) {
+	if err := withAdminConfig(t, testCredentials, ""); err != nil {
+		t.Fatal(err)
+	}
+	h := controlAuth("metrics-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, tc := range []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"unknown", http.StatusUnauthorized},
+		{"metrics-token", http.StatusNoContent},
+		{"observer-token", http.StatusNoContent},
+		{"operator-token", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("token %q: status %d, want %d", tc.token, w.Code, tc.code)
+		}
+	}
+}
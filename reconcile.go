@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// reconcileMissing is a manifest entry whose CAR is gone
+	reconcileMissing = "missing"
+	// reconcileSize is a CAR whose size differs from its manifest entry
+	reconcileSize = "size_mismatch"
+	// reconcileChecksum is a CAR which doesn't match its sidecar checksum
+	reconcileChecksum = "checksum_mismatch"
+	// reconcileUntracked is a CAR on disk without a manifest entry
+	reconcileUntracked = "untracked"
+	// reconcileUnreported is a stored CAR the storage api still asks to back up
+	reconcileUnreported = "unreported"
+	// reconcileUnresolvable is an asset whose DAG no longer resolves in the shared Kubo blockstore
+	reconcileUnresolvable = "unresolvable"
+)
+
+// reconcileFinding is printed as a json line for every difference
+type reconcileFinding struct {
+	Kind   string `json:"kind"`
+	Cid    string `json:"cid"`
+	Path   string `json:"path"`
+	Detail string `json:"detail,omitempty"`
+	Fixed  bool   `json:"fixed,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func reconcileCmd(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	checksum := fs.Bool("checksum", true, "compare every CAR with its sidecar checksum, reads the whole archive")
+	api := fs.Bool("api", true, "compare with the assets the storage api still asks to back up, requires --token or tenants")
+	kubo := fs.String("kubo-repo", kuboRepo, "Kubo repo the archive is ingested into, the DAG of every asset is walked through its blockstore")
+	fix := fs.Bool("fix", false, "tombstone missing CARs, quarantine mismatching ones, record verified untracked ones and report unreported ones")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var findings int
+	report := func(f *reconcileFinding, fixErr error) {
+		if *fix {
+			f.Fixed = fixErr == nil
+			if fixErr != nil {
+				f.Error = fixErr.Error()
+			}
+		}
+		findings++
+		enc.Encode(f)
+	}
+
+	tracked := make(map[string]*StoredCAR)
+	for _, s := range stored {
+		tracked[s.Path()] = s
+
+		if s.aggregated() {
+			f, _, err := openAggregated(s)
+			if err != nil {
+				f := &reconcileFinding{Kind: reconcileMissing, Cid: s.Cid, Path: s.aggregatePath(), Detail: err.Error()}
+				report(f, fixIf(*fix, func() error { return removeFromManifest(s.Dir, s.Cid) }))
+				continue
+			}
+			f.Close()
+
+			if *checksum {
+				if err := verifyAggregated(s); err != nil {
+					f := &reconcileFinding{Kind: reconcileChecksum, Cid: s.Cid, Path: s.aggregatePath(), Detail: err.Error()}
+					report(f, fixIf(*fix, func() error { return quarantine(s, err) }))
+				}
+			}
+			continue
+		}
+
+		st, err := os.Stat(s.Path())
+		if os.IsNotExist(err) {
+			f := &reconcileFinding{Kind: reconcileMissing, Cid: s.Cid, Path: s.Path()}
+			report(f, fixIf(*fix, func() error { return removeFromManifest(s.Dir, s.Cid) }))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if st.Size() != s.Size {
+			f := &reconcileFinding{Kind: reconcileSize, Cid: s.Cid, Path: s.Path(), Detail: fmt.Sprintf("recorded %d, found %d", s.Size, st.Size())}
+			report(f, fixIf(*fix, func() error { return quarantine(s, fmt.Errorf("reconcile: %s", f.Detail)) }))
+			continue
+		}
+
+		if !*checksum {
+			continue
+		}
+
+		if err := verifyChecksum(s.Path()); err != nil && !os.IsNotExist(err) {
+			f := &reconcileFinding{Kind: reconcileChecksum, Cid: s.Cid, Path: s.Path(), Detail: err.Error()}
+			report(f, fixIf(*fix, func() error { return quarantine(s, err) }))
+		}
+	}
+
+	if *kubo != "" {
+		store, err := readFlatfs(*kubo)
+		if err != nil {
+			return err
+		}
+
+		// only ingest-kubo restores the blocks, the finding is reported without a fix
+		for _, f := range store.unresolvedRoots(stored) {
+			findings++
+			enc.Encode(f)
+		}
+	}
+
+	untracked, err := untrackedCARs(tracked)
+	if err != nil {
+		return err
+	}
+	for _, path := range untracked {
+		cid := strings.TrimSuffix(filepath.Base(path), ".car")
+		f := &reconcileFinding{Kind: reconcileUntracked, Cid: cid, Path: path}
+		report(f, fixIf(*fix, func() error { return trackCAR(path, cid) }))
+	}
+
+	if *api {
+		tokens, err := accountTokens()
+		if err != nil {
+			return err
+		}
+		if tokens[""] == "" {
+			fmt.Fprintln(os.Stderr, "no --token, skip comparing the CARs of the flags account with the storage api")
+		}
+
+		// every account is compared with the CARs of its own backup directories
+		byCid := make(map[string]map[string]*StoredCAR)
+		for _, s := range stored {
+			if _, err := os.Stat(s.Path()); err == nil {
+				tenant := dirTenant(s.Dir)
+				if byCid[tenant] == nil {
+					byCid[tenant] = make(map[string]*StoredCAR)
+				}
+				byCid[tenant][s.Cid] = s
+			}
+		}
+
+		for tenant, token := range tokens {
+			if token == "" {
+				continue
+			}
+
+			pending, err := getJobs(token, 0)
+			if err != nil {
+				return fmt.Errorf("get backup assets: %w", err)
+			}
+
+			for _, asset := range pending {
+				s, ok := byCid[tenant][asset.Cid]
+				if !ok {
+					continue
+				}
+				f := &reconcileFinding{Kind: reconcileUnreported, Cid: s.Cid, Path: s.Path()}
+				report(f, fixIf(*fix, func() error { return reportStored(token, asset, s) }))
+			}
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "reconciled %d CARs, %d differences\n", len(stored), findings)
+	return nil
+}
+
+func fixIf(fix bool, action func() error) error {
+	if !fix {
+		return nil
+	}
+	return action()
+}
+
+// untrackedCARs lists the CARs of the backup directories which are not in their manifest
+func untrackedCARs(tracked map[string]*StoredCAR) ([]string, error) {
+	dirs, err := os.ReadDir(BackupOutPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, d := range dirs {
+		dir := filepath.Join(BackupOutPath, d.Name())
+		if !isBackupDir(BackupOutPath, d) || dir == quarantineDir {
+			continue
+		}
+
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			path := filepath.Join(dir, f.Name())
+			if f.IsDir() || !strings.HasSuffix(f.Name(), ".car") || tracked[path] != nil {
+				continue
+			}
+			out = append(out, path)
+		}
+	}
+	return out, nil
+}
+
+// trackCAR verifies an untracked CAR and records it in the manifest of its directory
+func trackCAR(path, cid string) error {
+	if err := verifyCAR(path, cid); err != nil {
+		return err
+	}
+
+	fetched, err := fileResult(path)
+	if err != nil {
+		return err
+	}
+
+	if err := writeChecksum(path, fetched.SHA256); err != nil {
+		return err
+	}
+
+	return appendManifest(filepath.Dir(path), &ManifestEntry{
+		Cid:        cid,
+		Size:       fetched.Size,
+		PieceCID:   fetched.PieceCID,
+		PieceSize:  fetched.PieceSize,
+		SHA256:     fetched.SHA256,
+		BackupTime: time.Now(),
+	})
+}
+
+// accountTokens returns the token of the flags, keyed "", and of every tenant by name
+func accountTokens() (map[string]string, error) {
+	tenants, err := loadTenants()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := map[string]string{"": token}
+	for _, t := range tenants {
+		tokens[t.Name] = t.Token
+	}
+	return tokens, nil
+}
+
+// reportStored pushes the result of a stored CAR the storage api missed with the token of its account
+func reportStored(token string, asset *model.Asset, s *StoredCAR) error {
+	asset.Path = s.Dir
+	return pushResult(token, []*AssetResult{{Asset: asset, PieceCID: s.PieceCID, PieceSize: s.PieceSize}})
+}
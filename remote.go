@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// s3Endpoint is the url of an S3 compatible store addressed path-style in place of AWS S3
+	s3Endpoint string
+	// ageIdentity is the age identity file the encrypted objects of a remote copy are decrypted with
+	ageIdentity string
+	// ageBin, zstdBin and sftpBin are the clients the decryption, the zstd decompression and the sftp fetch shell out to
+	ageBin  = "age"
+	zstdBin = "zstd"
+	sftpBin = "sftp"
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+// remoteSuffixes are the names a CAR copied to an object store may carry besides <cid>.car, the layers are told apart
+// by their magic bytes though
+var remoteSuffixes = []string{"", ".gz", ".zst", ".age", ".gz.age", ".zst.age"}
+
+var remoteClient = &http.Client{Timeout: 30 * time.Minute}
+
+var (
+	ageMagic      = []byte("age-encryption.org/v1\n")
+	ageArmorMagic = []byte("-----BEGIN AGE ENCRYPTED FILE-----")
+	gzipMagic     = []byte{0x1f, 0x8b}
+	zstdMagic     = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// fetchRemoteCAR copies the CAR of cid from the copy of the archive at base, an s3://bucket/prefix,
+// gs://bucket/prefix or sftp://[user@]host[:port]/path url, into tmpDir. The CAR is looked up as <dir>/<cid>.car
+// before <cid>.car, compressed or encrypted under any of remoteSuffixes. The decoded copy is verified with its DAG
+// against the cid and against sha, the checksum of the archived CAR, when known.
+func fetchRemoteCAR(ctx context.Context, base, dir, cid, sha, tmpDir string) (*StoredCAR, error) {
+	var names []string
+	if dir != "" {
+		names = append(names, path.Join(dir, cid+".car"))
+	}
+	names = append(names, cid+".car")
+
+	carPath := filepath.Join(tmpDir, cid+".car")
+	var lastErr error = errObjectNotFound
+	for _, name := range names {
+		for _, suffix := range remoteSuffixes {
+			object := strings.TrimSuffix(base, "/") + "/" + name + suffix
+			err := fetchRemote(ctx, object, carPath)
+			if errors.Is(err, errObjectNotFound) {
+				continue
+			}
+			if err == nil {
+				err = decodeObject(ctx, carPath)
+			}
+			if err == nil {
+				err = checkCAR(carPath, cid, true)
+			}
+
+			var fetched *fetchResult
+			if err == nil {
+				fetched, err = fileResult(carPath)
+			}
+			if err == nil && sha != "" && fetched.SHA256 != sha {
+				err = errors.Wrapf(ErrChecksumMismatch, "sha256 %s, archived %s", fetched.SHA256, sha)
+			}
+			if err != nil {
+				log.Warnf("fetch %s from %s: %v", cid, object, err)
+				os.Remove(carPath)
+				lastErr = err
+				continue
+			}
+
+			return &StoredCAR{Dir: tmpDir, ManifestEntry: &ManifestEntry{
+				Cid:        cid,
+				Size:       fetched.Size,
+				PieceCID:   fetched.PieceCID,
+				PieceSize:  fetched.PieceSize,
+				SHA256:     fetched.SHA256,
+				BackupTime: time.Now(),
+			}}, nil
+		}
+	}
+	return nil, errors.Wrapf(lastErr, "fetch %s from %s", cid, base)
+}
+
+// fetchRemote downloads the object of an s3, gs or sftp url into path, a missing object returns errObjectNotFound
+func fetchRemote(ctx context.Context, rawURL, path string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	key := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "s3":
+		return fetchS3(ctx, u.Host, key, path)
+	case "gs":
+		return fetchGCS(ctx, u.Host, key, path)
+	case "sftp":
+		return fetchSFTP(ctx, u, path)
+	default:
+		return errors.Errorf("unsupported remote %s, want s3, gs or sftp", rawURL)
+	}
+}
+
+// fetchS3 downloads an object of AWS S3 or the store of s3Endpoint, signed with the credentials of the standard
+// AWS_* environment variables. Public buckets are read anonymously without them.
+func fetchS3(ctx context.Context, bucket, key, path string) error {
+	host := fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, awsRegion)
+	endpoint := "https://" + host + "/" + escapeKey(key)
+	if s3Endpoint != "" {
+		u, err := url.Parse(s3Endpoint)
+		if err != nil {
+			return errors.Wrap(err, "s3_endpoint")
+		}
+		host = u.Host
+		endpoint = strings.TrimSuffix(s3Endpoint, "/") + "/" + bucket + "/" + escapeKey(key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	if accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); accessKey != "" && secretKey != "" {
+		if awsRegion == "" {
+			return errors.New("no aws region, set AWS_REGION or aws_region")
+		}
+		req.Header.Set("X-Amz-Content-Sha256", sha256Hex(nil))
+		if session := os.Getenv("AWS_SESSION_TOKEN"); session != "" {
+			req.Header.Set("X-Amz-Security-Token", session)
+		}
+		signV4(req, nil, host, "s3", accessKey, secretKey, time.Now())
+	}
+	return downloadObject(req, path)
+}
+
+// fetchGCS downloads an object of Google Cloud Storage, authorized with the oauth token of
+// GOOGLE_OAUTH_ACCESS_TOKEN when set
+func fetchGCS(ctx context.Context, bucket, key, path string) error {
+	endpoint := "https://storage.googleapis.com/" + bucket + "/" + escapeKey(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return downloadObject(req, path)
+}
+
+// downloadObject copies the body of the object request into path
+func downloadObject(req *http.Request, path string) error {
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errObjectNotFound
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return errors.Errorf("get %s: status %d %s", req.URL.Redacted(), resp.StatusCode, msg)
+	}
+
+	_, err = copyFile(path, resp.Body)
+	return err
+}
+
+// fetchSFTP downloads a file over sftp with the sftp client in batch mode, authenticated by the ssh agent or the keys
+// of the user running the daemon
+func fetchSFTP(ctx context.Context, u *url.URL, path string) error {
+	args := []string{"-q", "-b", "-", "-o", "BatchMode=yes"}
+	if port := u.Port(); port != "" {
+		args = append(args, "-P", port)
+	}
+	dest := u.Hostname()
+	if name := u.User.Username(); name != "" {
+		dest = name + "@" + dest
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, sftpBin, append(args, dest)...)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("get %s %s\n", sftpQuote(u.Path), sftpQuote(path)))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "not found") {
+			return errObjectNotFound
+		}
+		return errors.Wrapf(err, "sftp get %s: %s", u.Path, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// decodeObject strips the encryption and compression layers of the object at path in place
+func decodeObject(ctx context.Context, path string) error {
+	// an encrypted compressed CAR has two layers
+	for i := 0; i < 3; i++ {
+		magic, err := readMagic(path, len(ageArmorMagic))
+		if err != nil {
+			return err
+		}
+
+		var decode func(ctx context.Context, src, dst string) error
+		switch {
+		case bytes.HasPrefix(magic, ageMagic), bytes.HasPrefix(magic, ageArmorMagic):
+			decode = ageDecrypt
+		case bytes.HasPrefix(magic, gzipMagic):
+			decode = gunzipFile
+		case bytes.HasPrefix(magic, zstdMagic):
+			decode = unzstdFile
+		default:
+			return nil
+		}
+
+		decoded := path + ".decoded"
+		if err := decode(ctx, path, decoded); err != nil {
+			os.Remove(decoded)
+			return err
+		}
+		if err := os.Rename(decoded, path); err != nil {
+			return err
+		}
+	}
+	return errors.New("too many encryption and compression layers")
+}
+
+// readMagic reads the first n bytes of the file, fewer when it's shorter
+func readMagic(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic, err := bufio.NewReader(f).Peek(n)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return magic, nil
+}
+
+func ageDecrypt(ctx context.Context, src, dst string) error {
+	if ageIdentity == "" {
+		return errors.New("the object is encrypted, set age_identity")
+	}
+	out, err := exec.CommandContext(ctx, ageBin, "-d", "-i", ageIdentity, "-o", dst, src).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "age decrypt: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func gunzipFile(_ context.Context, src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.Wrap(err, "gunzip")
+	}
+	defer zr.Close()
+
+	if _, err := copyFile(dst, zr); err != nil {
+		return errors.Wrap(err, "gunzip")
+	}
+	return nil
+}
+
+func unzstdFile(ctx context.Context, src, dst string) error {
+	out, err := exec.CommandContext(ctx, zstdBin, "-d", "-q", "-f", "-o", dst, src).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "zstd decompress: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// escapeKey escapes the segments of an object key for the request path
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sftpQuote quotes a path for an sftp batch command
+func sftpQuote(path string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(path) + `"`
+}
+
+// copyFile writes r into a new file at path and returns its sha256
+func copyFile(path string, r io.Reader) (string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
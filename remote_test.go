@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// withS3Server serves objects, keyed by the request path, as the store of s3Endpoint
+func withS3Server(t *testing.T, objects map[string][]byte) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	old := s3Endpoint
+	s3Endpoint = srv.URL
+	t.Cleanup(func() { s3Endpoint = old })
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchRemoteCARCompressed(t *testing.T) {
+	root, blocks := testDAG(t)
+	data, err := os.ReadFile(writeTestCAR(t, root.cid, blocks...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid := root.cid.String()
+	withS3Server(t, map[string][]byte{"/bucket/backup/20240101/" + cid + ".car.gz": gzipData(t, data)})
+
+	s, err := fetchRemoteCAR(context.Background(), "s3://bucket/backup", "20240101", cid, sha256Hex(data), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := os.ReadFile(s.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched, data) || s.Cid != cid {
+		t.Fatal("the decompressed CAR differs from the archived one")
+	}
+}
+
+func TestFetchRemoteCARChecksum(t *testing.T) {
+	root, blocks := testDAG(t)
+	data, err := os.ReadFile(writeTestCAR(t, root.cid, blocks...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid := root.cid.String()
+	withS3Server(t, map[string][]byte{"/bucket/" + cid + ".car": data})
+
+	// a valid CAR, not the one archived
+	_, err = fetchRemoteCAR(context.Background(), "s3://bucket", "20240101", cid, sha256Hex([]byte("other")), t.TempDir())
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("checksum mismatch: %v, want ErrChecksumMismatch", err)
+	}
+
+	_, err = fetchRemoteCAR(context.Background(), "s3://bucket", "", jsonBlock(t, "missing").cid.String(), "", t.TempDir())
+	if !errors.Is(err, errObjectNotFound) {
+		t.Fatalf("missing object: %v, want errObjectNotFound", err)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// replicateFrom is the admin api of the primary backup instance this instance mirrors, instead of backing up from
+	// the Titan network
+	replicateFrom string
+	// replicateInterval is the period the inventory of the primary is synced in
+	replicateInterval = 10 * time.Minute
+	// replicateToken is the bearer token sent to the primary, an admin credential of it
+	replicateToken string
+)
+
+// inventoryTimeout bounds the listing of the primary, fileClient the copy of a whole CAR
+const inventoryTimeout = 5 * time.Minute
+
+var fileClient = &http.Client{Timeout: 30 * time.Minute}
+
+// InventoryEntry is a stored CAR listed by the admin api
+type InventoryEntry struct {
+	Dir string `json:"dir"`
+	*ManifestEntry
+}
+
+// handleInventory lists the stored CARs, backup directories are relative to the backup tree. Like handleArchive it's
+// served to admin credentials only, replicateToken of the secondary instances.
+func handleInventory(w http.ResponseWriter, r *http.Request) {
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]*InventoryEntry, 0, len(stored))
+	for _, s := range stored {
+		out = append(out, &InventoryEntry{Dir: filepath.Base(s.Dir), ManifestEntry: s.ManifestEntry})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleArchive serves a stored CAR byte for byte, unlike /ipfs/<cid> which may convert or materialize it
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	dir, file := r.PathValue("dir"), r.PathValue("file")
+	if strings.ContainsAny(dir+file, `/\`) || strings.HasPrefix(dir, ".") || !strings.HasSuffix(file, ".car") {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	path := filepath.Join(BackupOutPath, dir, file)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		serveAggregated(w, r, filepath.Dir(path), strings.TrimSuffix(file, ".car"))
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// serveAggregated serves the CAR of cid packed into an aggregate of dir byte for byte
+func serveAggregated(w http.ResponseWriter, r *http.Request, dir, cid string) {
+	entries, err := readManifest(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, e := range entries {
+		if e.Cid != cid || e.Aggregate == "" {
+			continue
+		}
+
+		s := &StoredCAR{Dir: dir, ManifestEntry: e}
+		f, err := os.Open(s.aggregatePath())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		serveFileSection(w, r, f, s.Offset, s.Size, s.BackupTime)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// newReplica returns a downloader which only stores the CARs replicated from the primary
+func newReplica(token string) *Downloader {
+	return &Downloader{
+		dirSize: loadDirSizes(),
+		token:   token,
+		blocks:  newBlockIndex(),
+	}
+}
+
+// replicate periodically copies the CARs of the primary missing from the local archive
+func (d *Downloader) replicate() {
+	for {
+		copied, err := d.replicateOnce()
+		if err != nil {
+			log.Errorf("replicate from %s: %v", replicateFrom, err)
+		} else {
+			log.Infof("replicated %d CARs from %s", copied, replicateFrom)
+		}
+
+		time.Sleep(replicateInterval)
+	}
+}
+
+func (d *Downloader) replicateOnce() (int, error) {
+	remote, err := fetchInventory(replicateFrom)
+	if err != nil {
+		return 0, err
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	local := make(map[string]struct{})
+	for _, s := range stored {
+		local[filepath.Base(s.Dir)+"/"+s.Cid] = struct{}{}
+	}
+
+	var copied int
+	for _, e := range remote {
+		if _, ok := local[e.Dir+"/"+e.Cid]; ok {
+			continue
+		}
+
+		if err := d.replicateCAR(e); err != nil {
+			log.Errorf("replicate %s/%s: %v", e.Dir, e.Cid, err)
+			continue
+		}
+		copied++
+	}
+	return copied, nil
+}
+
+func fetchInventory(primary string) ([]*InventoryEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), inventoryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(primary, "/")+"/inventory", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := secret("replicate_token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := fileClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("inventory: status %d", resp.StatusCode)
+	}
+
+	var out []*InventoryEntry
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, errors.Wrap(err, "decode inventory")
+	}
+	return out, nil
+}
+
+// replicateCAR copies the CAR from the primary and verifies it against the checksum of the primary manifest
+func (d *Downloader) replicateCAR(e *InventoryEntry) error {
+	if strings.ContainsAny(e.Dir, `/\`) || strings.HasPrefix(e.Dir, ".") {
+		return errors.Errorf("invalid directory %s", e.Dir)
+	}
+	// a base64 cid may hold a slash
+	if _, err := cid.Decode(e.Cid); err != nil || strings.ContainsAny(e.Cid, `/\`) {
+		return errors.Errorf("invalid cid %s", e.Cid)
+	}
+
+	outPath := filepath.Join(BackupOutPath, e.Dir)
+	if err := os.MkdirAll(outPath, 0755); err != nil {
+		return err
+	}
+
+	partPath := stagingPath(filepath.Join(outPath, e.Cid+".car"))
+	url := fmt.Sprintf("%s/archive/%s/%s.car", strings.TrimSuffix(replicateFrom, "/"), e.Dir, e.Cid)
+
+	sum, err := fetchFile(context.Background(), url, secret("replicate_token"), partPath)
+	if err != nil {
+		os.Remove(partPath)
+		return err
+	}
+
+	switch {
+	case e.SHA256 != "" && sum != e.SHA256:
+		err = errors.Wrapf(ErrChecksumMismatch, "recorded %s, computed %s", e.SHA256, sum)
+	case e.SHA256 == "" && len(e.Base) == 0:
+		// manifests of old backups carry no checksum
+		err = verifyCAR(partPath, e.Cid)
+	case e.SHA256 == "":
+		// a delta CAR lacks the blocks of its bases
+		err = verifyPartialCAR(partPath, e.Cid)
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return err
+	}
+
+	entry := *e.ManifestEntry
+	entry.SHA256 = sum
+	// packed CARs of the primary are stored in their own file
+	entry.Aggregate, entry.Offset = "", 0
+	return d.storeCAR(outPath, partPath, &entry)
+}
+
+// fetchFile writes the response of url into path and returns its sha256, token is sent as bearer token when set
+func fetchFile(ctx context.Context, url, token, path string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := fileClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("get %s: status %d", url, resp.StatusCode)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if err == nil && durable {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+var (
+	// reseedReplicas is the network replica count below which a stored asset is uploaded again, 0 disables re-seeding
+	reseedReplicas int
+	// reseedInterval is the period every stored asset is checked in
+	reseedInterval = 6 * time.Hour
+)
+
+// reseed periodically compares the replica count of every stored asset with reseedReplicas and restores the
+// under-replicated ones from the archive.
+func (d *Downloader) reseed() {
+	ticker := time.NewTicker(reseedInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stored, err := loadInventory(BackupOutPath)
+		if err != nil {
+			log.Errorf("reseed: load inventory: %v", err)
+			continue
+		}
+
+		var reseeded int
+		for _, s := range stored {
+			scheduler, replicas, err := d.replicas(s.Cid)
+			if err != nil {
+				log.Errorf("reseed: replicas of %s: %v", s.Cid, err)
+				continue
+			}
+			reseedChecked.Add(1)
+
+			if replicas >= reseedReplicas {
+				continue
+			}
+
+			if err := verifyStored(s); err != nil {
+				log.Errorf("reseed: %s has %d replicas but the archived copy is corrupted: %v", s.Cid, replicas, err)
+				continue
+			}
+
+			log.Infof("reseed: %s has %d replicas, restore through scheduler %s", s.Cid, replicas, scheduler.Uuid)
+			if _, err := restoreCAR(context.Background(), scheduler, s, titanUser); err != nil {
+				log.Errorf("reseed: restore %s: %v", s.Cid, err)
+				continue
+			}
+			reseeded++
+			reseedRestored.Add(1)
+		}
+
+		log.Infof("reseed: checked %d assets, re-seeded %d", len(stored), reseeded)
+	}
+}
+
+// replicas returns the scheduler holding the record of the asset and its count of succeeded replicas. An asset unknown
+// to every scheduler has no replica and is restored through the first scheduler.
+func (d *Downloader) replicas(cid string) (*Scheduler, int, error) {
+	schedulers := d.candidateSchedulers()
+
+	var lastErr error
+	for _, scheduler := range schedulers {
+		schedulerApi, err := scheduler.client()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if err := schedulerLimits.wait(context.Background(), scheduler.Uuid); err != nil {
+			lastErr = err
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), schedulerTimeout)
+		record, err := schedulerApi.GetAssetRecord(ctx, cid)
+		cancel()
+		if err != nil {
+			if !strings.Contains(err.Error(), "not found") {
+				lastErr = err
+			}
+			continue
+		}
+
+		var replicas int
+		for _, r := range record.ReplicaInfos {
+			if r.Status == types.ReplicaStatusSucceeded {
+				replicas++
+			}
+		}
+		return scheduler, replicas, nil
+	}
+
+	if lastErr != nil {
+		return nil, 0, lastErr
+	}
+	if len(schedulers) == 0 {
+		return nil, 0, errors.New("no scheduler found")
+	}
+	return schedulers[0], 0, nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const restoreProgressInterval = 10 * time.Second
+
+var errNotArchived = errors.New("not in the archive")
+
+// titanUser is the Titan user id the restored and re-seeded assets are created for, the etcd user has nothing to do with it
+var titanUser string
+
+var errNoTitanUser = errors.New("no Titan user id given and titan_user isn't set")
+
+// restoreUser returns the user a restore requested for userID is made for, titanUser when empty
+func restoreUser(userID string) (string, error) {
+	if userID == "" {
+		userID = titanUser
+	}
+	if userID == "" {
+		return "", errNoTitanUser
+	}
+	return userID, nil
+}
+
+// restoreCAR re-publishes the stored CAR through the scheduler, which hands out the upload url of a node the CAR is
+// posted to. It returns true without uploading when the network already holds the asset.
+func restoreCAR(ctx context.Context, scheduler *Scheduler, s *StoredCAR, userID string) (bool, error) {
+	s, cleanup, err := completeCAR(s, os.TempDir())
+	if err != nil {
+		return false, errors.Wrap(err, "materialize delta CAR")
+	}
+	defer cleanup()
+
+	schedulerApi, err := scheduler.client()
+	if err != nil {
+		return false, err
+	}
+
+	rsp, err := schedulerApi.CreateAsset(ctx, &types.CreateAssetReq{
+		UserID: userID,
+		AssetProperty: types.AssetProperty{
+			AssetCID:  s.Cid,
+			AssetName: filepath.Base(s.Path()),
+			AssetSize: s.Size,
+			AssetType: "file",
+		},
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "create asset")
+	}
+
+	if rsp.AlreadyExists {
+		return true, nil
+	}
+
+	return false, uploadCAR(ctx, rsp.UploadURL, rsp.Token, s)
+}
+
+// uploadCAR streams the CAR as multipart form to the upload url of a node, logging the progress
+func uploadCAR(ctx context.Context, url, token string, s *StoredCAR) error {
+	f, err := os.Open(s.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	progress := &progressReader{r: f}
+	stop := progress.report(s.Cid, s.Size)
+	defer stop()
+
+	body, contentType := multipartFile(filepath.Base(s.Path()), progress)
+	defer body.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "upload")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return errors.Errorf("upload: status %d %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// multipartFile streams r as the file field of a multipart form without buffering it
+func multipartFile(name string, r io.Reader) (io.ReadCloser, string) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, mw.FormDataContentType()
+}
+
+// progressReader counts the bytes read through it
+type progressReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n.Add(int64(n))
+	return n, err
+}
+
+// report prints the progress to stderr until the returned function is called
+func (p *progressReader) report(cid string, size int64) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(restoreProgressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				n := p.n.Load()
+				fmt.Fprintf(os.Stderr, "restore %s: %s of %s (%.1f%%)\n", cid, units.BytesSize(float64(n)), units.BytesSize(float64(size)), 100*float64(n)/float64(max(size, 1)))
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// restoreResult is printed as a json line for every restored CAR
+type restoreResult struct {
+	Cid           string `json:"cid"`
+	Path          string `json:"path,omitempty"`
+	Scheduler     string `json:"scheduler,omitempty"`
+	AlreadyExists bool   `json:"already_exists,omitempty"`
+	Verified      bool   `json:"verified,omitempty"`
+	Replicas      int    `json:"replicas,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+func restoreCmd(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	userID := fs.String("user", titanUser, "Titan user id the restored assets are created for, titan_user by default")
+	verify := fs.Bool("verify", false, "fetch every restored asset back from the network and compare it with the archive")
+	tmpDir := fs.String("tmp", os.TempDir(), "directory the CARs migrated by the retention policy or fetched from -remote and the network copies of -verify are fetched into")
+	from := fs.String("from", "", "restore every CAR backed up from the day, formatted as "+dirDateTimeFormat)
+	to := fs.String("to", "", "last day restored with -from, defaults to -from")
+	manifest := fs.String("manifest", "", "restore every CAR of the manifest file")
+	workers := fs.Int("workers", 1, "number of CARs restored in parallel")
+	replicas := fs.Int("replicas", 0, "wait until the restored assets have that many succeeded replicas before marking them complete, 0 doesn't wait")
+	wait := fs.Duration("wait", time.Hour, "how long -replicas waits for the replication of an asset")
+	report := fs.Bool("report", false, "submit the completed restores to the storage api")
+	remote := fs.String("remote", "", "copy of the archive the CARs missing locally are fetched from, s3://bucket/prefix, gs://bucket/prefix or sftp://[user@]host[:port]/path, the objects may be gzip or zstd compressed and age encrypted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 && *from == "" && *manifest == "" {
+		return fmt.Errorf("usage: restore [-user id] [-verify] [-tmp dir] [-remote url] [-workers n] <cid...|-from %s [-to %s]|-manifest file>", dirDateTimeFormat, dirDateTimeFormat)
+	}
+
+	if *userID == "" {
+		return errors.New("restore: no Titan user id, set -user or titan_user")
+	}
+
+	targets, err := restoreTargets(fs.Args(), *from, *to, *manifest)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		t.remote = *remote
+	}
+
+	registry, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+
+	d := newDownloader(token, areaId, registry, concurrent)
+	defer d.Close()
+
+	var (
+		ctx     = context.Background()
+		enc     = json.NewEncoder(os.Stdout)
+		lk      sync.Mutex
+		done    int
+		failed  []string
+		wg      sync.WaitGroup
+		targetC = make(chan *restoreTarget)
+	)
+
+	for i := 0; i < max(*workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range targetC {
+				result := &restoreResult{Cid: t.cid}
+				record := &RestoreRecord{Cid: t.cid, Target: *replicas, SubmittedAt: time.Now()}
+
+				s, cleanup, err := t.car(*tmpDir)
+				if err == nil {
+					err = restore(ctx, d, s, *userID, result)
+				}
+				if err == nil && *verify {
+					err = d.verifyRoundTrip(ctx, s, *tmpDir)
+					result.Verified = err == nil
+				}
+				cleanup()
+				if err == nil && *replicas > 0 {
+					result.Replicas, err = d.waitReplicated(ctx, t.cid, *replicas, *wait)
+				}
+				if err != nil {
+					result.Error = err.Error()
+				}
+
+				record.Scheduler, record.Replicas = result.Scheduler, result.Replicas
+				switch {
+				case errors.Is(err, ErrReplicationTimeout):
+					record.State, record.Error = RestorePending, err.Error()
+				case err != nil:
+					record.State, record.Error = RestoreFailed, err.Error()
+				default:
+					record.State, record.CompletedAt = RestoreComplete, time.Now()
+				}
+				if herr := appendRestoreHistory(record); herr != nil {
+					log.Errorf("append restore history of %s: %v", t.cid, herr)
+				}
+				if *report && record.State == RestoreComplete {
+					if rerr := postStorageAPI(token, RestoreResult, []*RestoreRecord{record}); rerr != nil {
+						log.Errorf("report restore of %s: %v", t.cid, rerr)
+					}
+				}
+
+				lk.Lock()
+				done++
+				if err != nil {
+					failed = append(failed, t.cid)
+				}
+				fmt.Fprintf(os.Stderr, "restored %d/%d, %d failed\n", done, len(targets), len(failed))
+				enc.Encode(result)
+				lk.Unlock()
+			}
+		}()
+	}
+
+	for _, t := range targets {
+		targetC <- t
+	}
+	close(targetC)
+	wg.Wait()
+
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "failed restores:\n  %s\n", strings.Join(failed, "\n  "))
+		return fmt.Errorf("%d of %d restores failed", len(failed), len(targets))
+	}
+	fmt.Fprintf(os.Stderr, "restored %d CARs\n", len(targets))
+	return nil
+}
+
+var ErrReplicationTimeout = errors.New("replication target not reached")
+
+const replicationPollInterval = 30 * time.Second
+
+// waitReplicated polls the replica count of the asset until it reaches target, giving up after timeout
+func (d *Downloader) waitReplicated(ctx context.Context, cid string, target int, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, replicas, err := d.replicas(cid)
+		if err != nil {
+			log.Warnf("replicas of %s: %v", cid, err)
+		}
+		if replicas >= target {
+			return replicas, nil
+		}
+
+		if time.Now().Add(replicationPollInterval).After(deadline) {
+			return replicas, errors.Wrapf(ErrReplicationTimeout, "%d of %d replicas after %s", replicas, target, timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return replicas, ctx.Err()
+		case <-time.After(replicationPollInterval):
+		}
+	}
+}
+
+// restoreTarget is a cid to restore with its stored CAR, nil when the archive doesn't have it. migrated are the
+// locations the retention policy moved the CAR to, remote the copy of the archive in an object store.
+type restoreTarget struct {
+	cid      string
+	stored   *StoredCAR
+	migrated []*MigrationRecord
+	remote   string
+}
+
+// car returns the stored CAR of the target, fetched into tmpDir from where the retention policy migrated it or from
+// the remote copy of the archive when the archive no longer has it. cleanup removes the fetched copy.
+func (t *restoreTarget) car(tmpDir string) (*StoredCAR, func(), error) {
+	if t.stored != nil {
+		if _, err := os.Stat(t.stored.Path()); t.remote == "" || err == nil {
+			return t.stored, func() {}, nil
+		}
+	}
+
+	var err error
+	if t.stored == nil && len(t.migrated) > 0 {
+		var s *StoredCAR
+		if s, err = fetchMigrated(t.migrated, tmpDir); err == nil {
+			return s, func() { os.Remove(s.Path()) }, nil
+		}
+	}
+	if t.remote == "" {
+		return nil, func() {}, err
+	}
+
+	var dir, sha string
+	switch {
+	case t.stored != nil:
+		dir, sha = filepath.Base(t.stored.Dir), t.stored.SHA256
+	case len(t.migrated) > 0:
+		dir, sha = filepath.Base(t.migrated[0].Dir), t.migrated[0].SHA256
+	}
+	s, err := fetchRemoteCAR(context.Background(), t.remote, dir, t.cid, sha, tmpDir)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	return s, func() { os.Remove(s.Path()) }, nil
+}
+
+// restoreTargets collects the cids, the CARs of the backup directories between from and to, those migrated away
+// included, and the entries of the manifest file
+func restoreTargets(cids []string, from, to, manifest string) ([]*restoreTarget, error) {
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := readMigrations()
+	if err != nil {
+		return nil, errors.Wrap(err, "read migrations")
+	}
+
+	byCid := make(map[string]*StoredCAR)
+	for _, s := range stored {
+		byCid[s.Cid] = s
+	}
+
+	var out []*restoreTarget
+	for _, cid := range cids {
+		out = append(out, &restoreTarget{cid: cid, stored: byCid[cid], migrated: migrations[cid]})
+	}
+
+	if from != "" {
+		if to == "" {
+			to = from
+		}
+		inRange := func(dir string) bool {
+			day := filepath.Base(dir)[:min(len(dirDateTimeFormat), len(filepath.Base(dir)))]
+			return day >= from && day <= to
+		}
+
+		for _, s := range stored {
+			if inRange(s.Dir) {
+				out = append(out, &restoreTarget{cid: s.Cid, stored: s})
+			}
+		}
+		for cid, records := range migrations {
+			if _, ok := byCid[cid]; !ok && inRange(records[0].Dir) {
+				out = append(out, &restoreTarget{cid: cid, migrated: records})
+			}
+		}
+	}
+
+	if manifest != "" {
+		dir := filepath.Dir(manifest)
+		if filepath.Base(manifest) != manifestFile {
+			return nil, errors.Errorf("%s is not a %s", manifest, manifestFile)
+		}
+
+		entries, err := readManifest(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			out = append(out, &restoreTarget{cid: entry.Cid, stored: &StoredCAR{Dir: dir, ManifestEntry: entry}})
+		}
+	}
+
+	return out, nil
+}
+
+// restoreOne restores the CAR of cid for userID, from where the retention policy migrated it when the archive no
+// longer has it, and records it in the restore history
+func (d *Downloader) restoreOne(ctx context.Context, cid, userID string) (*restoreResult, error) {
+	targets, err := restoreTargets([]string{cid}, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	if targets[0].stored == nil && len(targets[0].migrated) == 0 {
+		return nil, errors.Wrap(errNotArchived, cid)
+	}
+
+	result := &restoreResult{Cid: cid}
+	record := &RestoreRecord{Cid: cid, SubmittedAt: time.Now()}
+
+	s, cleanup, err := targets[0].car(os.TempDir())
+	if err == nil {
+		err = restore(ctx, d, s, userID, result)
+	}
+	cleanup()
+
+	record.Scheduler = result.Scheduler
+	if err != nil {
+		result.Error = err.Error()
+		record.State, record.Error = RestoreFailed, err.Error()
+	} else {
+		record.State, record.CompletedAt = RestoreComplete, time.Now()
+	}
+	if herr := appendRestoreHistory(record); herr != nil {
+		log.Errorf("append restore history of %s: %v", cid, herr)
+	}
+	return result, err
+}
+
+// restore tries the schedulers in turn until one accepts the CAR
+func restore(ctx context.Context, d *Downloader, s *StoredCAR, userID string, result *restoreResult) error {
+	if s == nil {
+		return errors.Errorf("%s is not in the archive", result.Cid)
+	}
+	result.Path = s.Path()
+
+	if err := verifyStored(s); err != nil {
+		return errors.Wrap(err, "archived copy is corrupted")
+	}
+
+	var err error
+	for _, scheduler := range d.candidateSchedulers() {
+		result.Scheduler = scheduler.Uuid
+		result.AlreadyExists, err = restoreCAR(ctx, scheduler, s, userID)
+		if err == nil {
+			return nil
+		}
+		log.Warnf("restore %s through scheduler %s: %v", s.Cid, scheduler.Uuid, err)
+	}
+
+	if err == nil {
+		err = errors.New("no scheduler found")
+	}
+	return err
+}
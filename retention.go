@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// retainDays is the number of days backup directories are kept, 0 keeps them forever
+	retainDays int
+	// retainArchiveDir receives a tar archive of every expired directory before it's deleted
+	retainArchiveDir string
+	// legalHoldPath is a cid list of assets exempt from retention
+	legalHoldPath string
+	// retainMigrate is the cold target, w3s or arweave, expired CARs are uploaded to before they're deleted
+	retainMigrate string
+
+	legalHold *cidList
+)
+
+// retentionReport sums up a retention run
+type retentionReport struct {
+	Dirs      int   `json:"dirs"`
+	CARs      int   `json:"cars"`
+	Held      int   `json:"held"`
+	Reclaimed int64 `json:"reclaimed"`
+	// Removed are the cids whose CARs were deleted
+	Removed []string `json:"-"`
+	// Freed are the bytes deleted per directory
+	Freed map[string]int64 `json:"-"`
+}
+
+// dirDate parses the day of the backup directory dir
+func dirDate(dir string) (time.Time, error) {
+	name := filepath.Base(dir)
+	if len(name) < len(dirDateTimeFormat) {
+		return time.Time{}, errors.Errorf("%s is no backup directory", dir)
+	}
+	return time.ParseInLocation(dirDateTimeFormat, name[:len(dirDateTimeFormat)], time.Local)
+}
+
+// expiredDirs returns the backup directories of days older than retainDays
+func expiredDirs(root string, now time.Time) ([]string, error) {
+	files, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	y, m, d := now.AddDate(0, 0, -retainDays).Date()
+	cutoff := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+
+	var out []string
+	for _, f := range files {
+		if !isBackupDir(root, f) {
+			continue
+		}
+
+		day, err := dirDate(f.Name())
+		if err != nil || !day.Before(cutoff) {
+			continue
+		}
+		out = append(out, filepath.Join(root, f.Name()))
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// applyRetention deletes the backup directories older than retainDays, archiving them to retainArchiveDir first
+// when set. CARs on legal hold and the bases of retained delta CARs are kept, only the other CARs of their directory
+// are deleted.
+func applyRetention(now time.Time, dryRun bool) (*retentionReport, error) {
+	dirs, err := expiredDirs(BackupOutPath, now)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &retentionReport{Freed: make(map[string]int64)}
+	if len(dirs) == 0 {
+		return report, nil
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make(map[string]struct{}, len(dirs))
+	for _, dir := range dirs {
+		expired[dir] = struct{}{}
+	}
+
+	keep := retainedCARs(stored, expired)
+
+	byDir := make(map[string][]*StoredCAR)
+	for _, s := range stored {
+		byDir[s.Dir] = append(byDir[s.Dir], s)
+	}
+
+	for _, dir := range dirs {
+		var remove []*StoredCAR
+		var held int
+		for _, s := range byDir[dir] {
+			if _, ok := keep[s.Path()]; ok {
+				held++
+				continue
+			}
+			remove = append(remove, s)
+		}
+
+		if len(remove) > 0 && !dryRun {
+			if err := migrateDir(dir, remove); err != nil {
+				log.Errorf("retention: migrate %s: %v, keep it", dir, err)
+				continue
+			}
+		}
+
+		var reclaimed int64
+		if held == 0 {
+			if reclaimed, err = getDirSize(dir); err != nil {
+				return report, err
+			}
+			if !dryRun {
+				if err := removeBackupDir(dir); err != nil {
+					return report, err
+				}
+			}
+		} else {
+			for _, s := range remove {
+				size, err := removeStored(s, dryRun)
+				if err != nil {
+					return report, errors.Wrapf(err, "remove %s", s.Path())
+				}
+				reclaimed += size
+			}
+		}
+
+		for _, s := range remove {
+			report.Removed = append(report.Removed, s.Cid)
+		}
+
+		log.Infof("retention: %s expired, removed %d CARs, kept %d held, reclaimed %s", dir, len(remove), held, units.BytesSize(float64(reclaimed)))
+		report.Dirs++
+		report.CARs += len(remove)
+		report.Held += held
+		report.Reclaimed += reclaimed
+		report.Freed[dir] += reclaimed
+	}
+	return report, nil
+}
+
+// migrationFile records where the CARs deleted by the retention policy were moved to, one json MigrationRecord per
+// line, as their manifest is deleted with them
+var migrationFile = filepath.Join(BackupOutPath, "migrations.jsonl")
+
+// MigrationRecord is the new location of a CAR deleted from the archive
+type MigrationRecord struct {
+	Cid    string `json:"cid"`
+	Dir    string `json:"dir"`
+	SHA256 string `json:"sha256,omitempty"`
+	Size   int64  `json:"size"`
+	Target string `json:"target"`
+	// IDs locate the copy on the target, the tar archive path or the identifiers returned by the upload
+	IDs        []string  `json:"ids"`
+	MigratedAt time.Time `json:"migrated_at"`
+}
+
+// migrateDir copies the CARs about to be deleted to the tar archive of retainArchiveDir and uploads the ones not
+// uploaded yet to retainMigrate, then records their new locations. Nothing is recorded unless every copy succeeded.
+func migrateDir(dir string, cars []*StoredCAR) error {
+	var records []*MigrationRecord
+	add := func(s *StoredCAR, target string, ids []string) {
+		records = append(records, &MigrationRecord{
+			Cid:        s.Cid,
+			Dir:        filepath.Base(dir),
+			SHA256:     s.SHA256,
+			Size:       s.Size,
+			Target:     target,
+			IDs:        ids,
+			MigratedAt: time.Now(),
+		})
+	}
+
+	if retainArchiveDir != "" {
+		archive := filepath.Join(retainArchiveDir, filepath.Base(dir)+".tar")
+		if _, err := exportTar(archive, cars, 0); err != nil {
+			return errors.Wrap(err, "archive")
+		}
+		for _, s := range cars {
+			add(s, "tar", []string{archive})
+		}
+	}
+
+	if retainMigrate != "" {
+		for _, s := range cars {
+			if !s.uploaded(retainMigrate) {
+				var err error
+				switch retainMigrate {
+				case UploadW3S:
+					err = uploadW3S(context.Background(), s)
+				case UploadArweave:
+					err = uploadArweave(context.Background(), s)
+				default:
+					err = errors.Errorf("unknown migration target %s", retainMigrate)
+				}
+				if err != nil {
+					return errors.Wrapf(err, "upload %s", s.Cid)
+				}
+			}
+
+			// the latest upload to the target locates the copy
+			for i := len(s.Uploads) - 1; i >= 0; i-- {
+				if s.Uploads[i].Target == retainMigrate {
+					add(s, retainMigrate, s.Uploads[i].IDs)
+					break
+				}
+			}
+		}
+	}
+
+	return appendMigrations(records)
+}
+
+func appendMigrations(records []*MigrationRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+
+	f, err := os.OpenFile(migrationFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		// the records are the only trace of the CARs once they're deleted
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// retainedCARs returns the paths of the expired CARs which have to be kept, because they're on legal hold or hold
+// blocks of a kept delta CAR
+func retainedCARs(stored []*StoredCAR, expired map[string]struct{}) map[string]struct{} {
+	byCid := make(map[string][]*StoredCAR)
+	for _, s := range stored {
+		byCid[s.Cid] = append(byCid[s.Cid], s)
+	}
+
+	keep := make(map[string]struct{})
+	var queue []*StoredCAR
+	for _, s := range stored {
+		if _, ok := expired[s.Dir]; !ok || legalHold.contains(s.Cid) {
+			queue = append(queue, s)
+		}
+	}
+
+	seen := make(map[string]struct{})
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[s.Path()]; ok {
+			continue
+		}
+		seen[s.Path()] = struct{}{}
+
+		if _, ok := expired[s.Dir]; ok {
+			keep[s.Path()] = struct{}{}
+		}
+		for _, base := range s.Base {
+			queue = append(queue, byCid[base]...)
+		}
+	}
+	return keep
+}
+
+// removeStored deletes the CAR and its sidecars and removes it from the manifest, returning the bytes reclaimed
+func removeStored(s *StoredCAR, dryRun bool) (int64, error) {
+	// a packed CAR frees its aggregate along with the last CAR of it
+	if s.aggregated() {
+		if dryRun {
+			return 0, nil
+		}
+		if err := removeFromManifest(s.Dir, s.Cid); err != nil {
+			return 0, err
+		}
+		return pruneAggregate(s.Dir, s.Aggregate)
+	}
+
+	var size int64
+	for _, suffix := range append([]string{""}, sidecarSuffixes...) {
+		st, err := os.Stat(s.Path() + suffix)
+		if err != nil {
+			continue
+		}
+		size += st.Size()
+
+		if !dryRun {
+			if err := os.Remove(s.Path() + suffix); err != nil {
+				return size, err
+			}
+		}
+	}
+
+	if dryRun {
+		return size, nil
+	}
+	return size, removeFromManifest(s.Dir, s.Cid)
+}
+
+// retentionLk serializes the daily retention runs and those of the control plane
+var retentionLk sync.Mutex
+
+var errRetentionDisabled = errors.New("retention is disabled, retain_days is not set")
+
+// prune applies the retention policy once, dropping the deleted CARs from the block index. -dry-run reports what
+// would be deleted.
+func (d *Downloader) prune(dryRun bool) (*retentionReport, error) {
+	if retainDays <= 0 {
+		return nil, errRetentionDisabled
+	}
+
+	retentionLk.Lock()
+	defer retentionLk.Unlock()
+
+	report, err := applyRetention(time.Now(), dryRun)
+	if report != nil && report.CARs > 0 && !dryRun {
+		d.blocks.remove(report.Removed)
+		d.dirSize.free(report.Freed)
+
+		retentionReclaimed.Add(report.Reclaimed)
+		log.Infof("retention: removed %d CARs of %d directories, reclaimed %s", report.CARs, report.Dirs, units.BytesSize(float64(report.Reclaimed)))
+	}
+	return report, err
+}
+
+// retain applies the retention policy once a day
+func (d *Downloader) retain() {
+	for {
+		if _, err := d.prune(false); err != nil {
+			log.Errorf("retention: %v", err)
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// retentionCmd applies the retention policy once, -dry-run reports what would be deleted
+func retentionCmd(args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report the expired directories without deleting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if retainDays <= 0 {
+		return errors.New("usage: --retain_days <n> retention [-dry-run]")
+	}
+
+	if err := loadLegalHold(); err != nil {
+		return err
+	}
+
+	report, err := applyRetention(time.Now(), *dryRun)
+	if report != nil {
+		fmt.Fprintf(os.Stderr, "%d directories expired, %d CARs removed, %d held, %s reclaimed\n",
+			report.Dirs, report.CARs, report.Held, units.BytesSize(float64(report.Reclaimed)))
+	}
+	return err
+}
+
+func loadLegalHold() error {
+	if legalHoldPath == "" {
+		return nil
+	}
+
+	list, err := newCidList(legalHoldPath)
+	if err != nil {
+		return errors.Wrap(err, "load legal hold")
+	}
+	legalHold = list
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ipld/go-car/v2"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var ErrRoundTripMismatch = errors.New("round trip content mismatch")
+
+// verifyRoundTrip fetches the asset of the stored CAR back from the network into tmpDir and compares it with the
+// archived copy. Identical bytes pass, so does a different serialization carrying the same set of blocks.
+func (d *Downloader) verifyRoundTrip(ctx context.Context, s *StoredCAR, tmpDir string) error {
+	s, cleanup, err := completeCAR(s, tmpDir)
+	if err != nil {
+		return errors.Wrap(err, "materialize delta CAR")
+	}
+	defer cleanup()
+
+	tmp := filepath.Join(tmpDir, s.Cid+".roundtrip.car")
+	defer os.Remove(tmp)
+
+	local, err := readChecksum(s.Path())
+	if err != nil {
+		if local, err = fileChecksum(s.Path()); err != nil {
+			return err
+		}
+	}
+
+	var lastErr error
+	for _, scheduler := range d.candidateSchedulers() {
+		downloadInfos, err := d.getDownloadInfos(ctx, scheduler, s.Cid)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, downloadInfo := range downloadInfos.SourceList {
+			fetched, err := fetchCAR(ctx, downloadInfo.Address, s.Cid, downloadInfo.Tk, tmp, 0)
+			if err == nil {
+				err = verifyCAR(tmp, s.Cid)
+			}
+			if err != nil {
+				log.Warnf("round trip %s from %s: %v", s.Cid, downloadInfo.NodeID, err)
+				lastErr = err
+				continue
+			}
+
+			if fetched.SHA256 == local {
+				return nil
+			}
+			return sameBlocks(s.Path(), tmp)
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = ErrCARFileNotFound
+	}
+	return errors.Wrapf(lastErr, "fetch %s back from the network", s.Cid)
+}
+
+// sameBlocks compares the sets of blocks of two CARs
+func sameBlocks(a, b string) error {
+	blocksA, err := blockSet(a)
+	if err != nil {
+		return err
+	}
+	blocksB, err := blockSet(b)
+	if err != nil {
+		return err
+	}
+
+	if len(blocksA) != len(blocksB) {
+		return errors.Wrapf(ErrRoundTripMismatch, "%d archived blocks, %d fetched", len(blocksA), len(blocksB))
+	}
+	for hash := range blocksA {
+		if _, ok := blocksB[hash]; !ok {
+			return errors.Wrap(ErrRoundTripMismatch, "archived block missing from the network copy")
+		}
+	}
+	return nil
+}
+
+// blockSet returns the multihashes of the blocks of the CAR at path
+func blockSet(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br, err := car.NewBlockReader(f, car.WithTrustedCAR(true))
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidCAR, "read header: %v", err)
+	}
+
+	out := make(map[string]struct{})
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidCAR, "read block: %v", err)
+		}
+		out[string(blk.Cid().Hash())] = struct{}{}
+	}
+}
+
+// roundTripResult is printed as a json line for every checked CAR
+type roundTripResult struct {
+	Cid   string `json:"cid"`
+	Path  string `json:"path"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func roundTripCmd(args []string) error {
+	fs := flag.NewFlagSet("roundtrip", flag.ExitOnError)
+	tmpDir := fs.String("tmp", os.TempDir(), "directory the network copies are fetched into")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: roundtrip [-tmp dir] <cid>...")
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return err
+	}
+
+	byCid := make(map[string]*StoredCAR)
+	for _, s := range stored {
+		byCid[s.Cid] = s
+	}
+
+	registry, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+
+	d := newDownloader(token, areaId, registry, concurrent)
+	defer d.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	var failed int
+	for _, cid := range fs.Args() {
+		result := &roundTripResult{Cid: cid}
+
+		s, ok := byCid[cid]
+		if ok {
+			result.Path = s.Path()
+			err = d.verifyRoundTrip(context.Background(), s, *tmpDir)
+		} else {
+			err = errors.Errorf("%s is not in the archive", cid)
+		}
+
+		result.OK = err == nil
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		enc.Encode(result)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d round trips failed", failed, fs.NArg())
+	}
+	return nil
+}
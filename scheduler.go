@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"github.com/Filecoin-Titan/titan/api"
+	"github.com/Filecoin-Titan/titan/api/client"
+	"github.com/Filecoin-Titan/titan/api/types"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type Scheduler struct {
+	Uuid   string
+	AreaId string
+	// Key is the discovery key the scheduler config was loaded from
+	Key    string
+	Api    api.Scheduler
+	Closer func()
+
+	lk          sync.RWMutex
+	cfg         *types.SchedulerCfg
+	accessToken string
+	// failures counts the consecutive reconnects and failed client constructions, reset by a successful call
+	failures      int
+	nextReconnect time.Time
+	// incompatible is set when the scheduler major api version differs from the bundled client
+	incompatible bool
+}
+
+// API returns the current rpc client, which may be replaced when the access token is refreshed.
+func (s *Scheduler) API() api.Scheduler {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	return s.Api
+}
+
+// errSchedulerUnauthorized is the 401 response of a scheduler which rejected the access token
+var errSchedulerUnauthorized = errors.New("scheduler rejected the access token, http status 401")
+
+// authStatusTransport fails the rpc requests answered with 401 with errSchedulerUnauthorized, the jsonrpc client only
+// reports the status in the text of the error decoding the empty body
+type authStatusTransport struct {
+	http.RoundTripper
+}
+
+func (t authStatusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		return nil, errSchedulerUnauthorized
+	}
+	return resp, nil
+}
+
+var schedulerHTTPClient = sync.OnceValue(func() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 100
+	return &http.Client{Transport: authStatusTransport{transport}}
+})
+
+func newSchedulerAPI(cfg *types.SchedulerCfg) (api.Scheduler, func(), error) {
+	// https protocol still in test, we use http for now.
+	schedulerURL := strings.Replace(cfg.SchedulerURL, "https", "http", 1)
+	headers := http.Header{}
+	headers.Add("Authorization", "Bearer "+cfg.AccessToken)
+	return client.NewScheduler(context.Background(), schedulerURL, headers, jsonrpc.WithHTTPClient(schedulerHTTPClient()))
+}
+
+// FetchSchedulers returns the schedulers of the area, or of every area in all-areas mode. The rpc clients are not
+// dialed until a scheduler is first used.
+func FetchSchedulers(registry *SchedulerRegistry, areaId string) ([]*Scheduler, error) {
+	_, err := registry.loadSchedulerConfigs()
+	if err != nil {
+		log.Errorf("load scheduer configs: %v", err)
+		return nil, err
+	}
+
+	var out []*Scheduler
+
+	registry.lk.Lock()
+	defer registry.lk.Unlock()
+
+	for key, SchedulerCfg := range registry.configMap {
+		if !isAllAreas(areaId) && SchedulerCfg.AreaID != areaId {
+			continue
+		}
+
+		out = append(out, &Scheduler{
+			Uuid:        strings.Replace(SchedulerCfg.SchedulerURL, "https", "http", 1),
+			AreaId:      SchedulerCfg.AreaID,
+			Key:         key,
+			cfg:         SchedulerCfg,
+			accessToken: SchedulerCfg.AccessToken,
+		})
+	}
+
+	log.Infof("fetch %d schedulers", len(out))
+
+	return out, nil
+}
+
+// client returns the rpc client, the scheduler is dialed and its api version checked on first use.
+func (s *Scheduler) client() (api.Scheduler, error) {
+	if schedulerApi := s.API(); schedulerApi != nil {
+		return schedulerApi, nil
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.Api != nil {
+		return s.Api, nil
+	}
+
+	if s.incompatible {
+		return nil, errors.Errorf("scheduler %s api version incompatible", s.Uuid)
+	}
+
+	now := time.Now()
+	if now.Before(s.nextReconnect) {
+		return nil, errors.Errorf("create scheduler %s client backed off until %s", s.Uuid, s.nextReconnect.Format(time.RFC3339))
+	}
+
+	schedulerApi, closer, err := newSchedulerAPI(s.cfg)
+	if err != nil {
+		s.failures++
+		s.nextReconnect = now.Add(reconnectBackoff(s.failures))
+		schedulerReconnectFailures.Add(s.Uuid, 1)
+		return nil, errors.Wrapf(err, "create scheduler rpc client, retry after %s", s.nextReconnect.Format(time.RFC3339))
+	}
+
+	if err := checkSchedulerVersion(s.Uuid, schedulerApi); err != nil {
+		closer()
+		s.incompatible = true
+		return nil, err
+	}
+
+	s.Api = schedulerApi
+	s.Closer = closer
+
+	log.Infof("connected scheduler %s of area %s", s.Uuid, s.AreaId)
+	return schedulerApi, nil
+}
+
+// Close closes the rpc client, the scheduler is dialed again on next use.
+func (s *Scheduler) Close() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.Closer != nil {
+		s.Closer()
+	}
+
+	s.Api = nil
+	s.Closer = nil
+}
+
+// sameConfig reports whether the scheduler was built from an equal config, so its client can be kept on refresh.
+func (s *Scheduler) sameConfig(cfg *types.SchedulerCfg) bool {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	return s.cfg.SchedulerURL == cfg.SchedulerURL && s.cfg.AreaID == cfg.AreaID && s.accessToken == cfg.AccessToken
+}
+
+// refreshAccessToken reloads the scheduler config and rebuilds the rpc client when the access token was rotated.
+func (s *Scheduler) refreshAccessToken(registry *SchedulerRegistry) error {
+	cfg, err := registry.reloadSchedulerConfig(s.Key)
+	if err != nil {
+		return err
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if cfg.AccessToken == s.accessToken {
+		return errors.Errorf("access token of scheduler %s not changed", s.Uuid)
+	}
+
+	schedulerApi, closer, err := newSchedulerAPI(cfg)
+	if err != nil {
+		return errors.Wrap(err, "create scheduler rpc client")
+	}
+
+	if s.Closer != nil {
+		s.Closer()
+	}
+
+	s.Api = schedulerApi
+	s.Closer = closer
+	s.cfg = cfg
+	s.accessToken = cfg.AccessToken
+	s.incompatible = checkSchedulerVersion(s.Uuid, schedulerApi) != nil
+
+	log.Infof("scheduler %s rpc client rebuilt with the rotated access token", s.Uuid)
+	return nil
+}
+
+// reconnect closes the rpc client and builds a new one after a transport error. Consecutive reconnects are spaced out
+// by an exponential backoff, until a call succeeds again.
+func (s *Scheduler) reconnect(cause error) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	now := time.Now()
+	if now.Before(s.nextReconnect) {
+		return errors.Errorf("reconnect scheduler %s backed off until %s", s.Uuid, s.nextReconnect.Format(time.RFC3339))
+	}
+
+	s.failures++
+	s.nextReconnect = now.Add(reconnectBackoff(s.failures))
+
+	log.Warnf("scheduler %s transport error: %v, reconnect (attempt %d)", s.Uuid, cause, s.failures)
+
+	schedulerApi, closer, err := newSchedulerAPI(s.cfg)
+	if err != nil {
+		schedulerReconnectFailures.Add(s.Uuid, 1)
+		return errors.Wrap(err, "create scheduler rpc client")
+	}
+
+	if s.Closer != nil {
+		s.Closer()
+	}
+
+	s.Api = schedulerApi
+	s.Closer = closer
+	schedulerReconnects.Add(s.Uuid, 1)
+
+	return nil
+}
+
+// markHealthy resets the reconnect backoff after a successful call
+func (s *Scheduler) markHealthy() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.failures = 0
+	s.nextReconnect = time.Time{}
+}
+
+// reconnectBackoff doubles from one second for every consecutive failure, up to five minutes
+func reconnectBackoff(failures int) time.Duration {
+	backoff := time.Second
+	for i := 1; i < failures && backoff < 5*time.Minute; i++ {
+		backoff *= 2
+	}
+	return min(backoff, 5*time.Minute)
+}
+
+// isTransportError reports whether the rpc call failed because the connection to the scheduler is broken.
+func isTransportError(err error) bool {
+	if err == nil || errors.Is(err, ErrSchedulerTimeout) || isAuthError(err) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	msg := err.Error()
+	for _, s := range []string{"connection refused", "connection reset", "broken pipe", "EOF", "websocket", "no such host"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthError reports whether the rpc call was rejected by the scheduler because of an invalid access token.
+func isAuthError(err error) bool {
+	return errors.Is(err, errSchedulerUnauthorized)
+}
+
+// Usable reports whether the scheduler can be handed to the download path: its api is compatible with the bundled
+// client, and it's either connected or not waiting for the backoff of a failed client construction.
+func (s *Scheduler) Usable() bool {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	return !s.incompatible && (s.Api != nil || !time.Now().Before(s.nextReconnect))
+}
+
+// checkSchedulerVersion compares the scheduler api version with the bundled client. A different major version is
+// returned as error since every rpc would fail to decode, a different minor version is only logged.
+func checkSchedulerVersion(uuid string, schedulerApi api.Scheduler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), schedulerTimeout)
+	defer cancel()
+
+	v, err := schedulerApi.Version(ctx)
+	if err != nil {
+		log.Warnf("get version of scheduler %s: %v, skip the compatibility check", uuid, err)
+		return nil
+	}
+
+	major, minor, _ := v.APIVersion.Ints()
+	expectMajor, expectMinor, _ := api.SchedulerAPIVersion0.Ints()
+
+	if major != expectMajor {
+		log.Errorf("scheduler %s api version %s (%s) is incompatible with the bundled client %s, it won't be used",
+			uuid, v.APIVersion, v.Version, api.SchedulerAPIVersion0)
+		return errors.Errorf("incompatible scheduler api version %s", v.APIVersion)
+	}
+
+	if minor != expectMinor {
+		log.Warnf("scheduler %s api version %s (%s) differs from the bundled client %s, some calls may fail",
+			uuid, v.APIVersion, v.Version, api.SchedulerAPIVersion0)
+	}
+
+	return nil
+}
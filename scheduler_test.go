@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsAuthError(t *testing.T) {
+	status := http.StatusUnauthorized
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	_, err := schedulerHTTPClient().Post(srv.URL, "application/json", nil)
+	if !isAuthError(err) {
+		t.Fatalf("401 response: %v, want an auth error", err)
+	}
+	if isTransportError(err) {
+		t.Fatalf("401 response: %v is no transport error", err)
+	}
+
+	// an rpc error mentioning a token or 401 is no rejection of the token
+	if isAuthError(errors.New("RPC error (1): asset 401 not found in jwt cache")) {
+		t.Fatal("rpc error text taken for an auth error")
+	}
+
+	status = http.StatusOK
+	resp, err := schedulerHTTPClient().Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
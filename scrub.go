@@ -0,0 +1,209 @@
+package main
+
+import (
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// scrubFraction is the fraction of the stored CARs re-verified per day, 0 disables the scrubber
+	scrubFraction float64
+	// scrubRepair queues the asset of a corrupted CAR to be downloaded again
+	scrubRepair bool
+)
+
+const scrubInterval = time.Hour
+
+var ErrPieceMismatch = errors.New("piece cid mismatch")
+
+// scrub re-verifies a random share of the stored CARs every hour, so that scrubFraction of the archive is checked
+// per day and silent disk rot is detected.
+func (d *Downloader) scrub() {
+	ticker := time.NewTicker(scrubInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stored, err := loadInventory(BackupOutPath)
+		if err != nil {
+			log.Errorf("scrub: load inventory: %v", err)
+			continue
+		}
+
+		count := int(math.Ceil(float64(len(stored)) * scrubFraction * float64(scrubInterval) / float64(24*time.Hour)))
+		count = min(count, len(stored))
+
+		rand.Shuffle(len(stored), func(i, j int) { stored[i], stored[j] = stored[j], stored[i] })
+
+		var corrupted int
+		// the CARs of a tenant are reported with its token
+		reports := make(map[*Downloader][]*VerificationReport)
+		tally := make(bitrotTally)
+		for _, s := range stored[:count] {
+			owner := d.owner(s.Dir)
+			if owner == nil {
+				log.Warnf("scrub: tenant %s of %s isn't configured, its CARs are neither repaired nor reported", dirTenant(s.Dir), s.Dir)
+			}
+
+			err := verifyStored(s)
+			if err != nil && repairFromParity(s) {
+				err = nil
+			}
+			if err != nil {
+				corrupted++
+				log.Errorf("scrub: %s corrupted: %v", s.Path(), err)
+				scrubCorrupted.Add(1)
+
+				if qerr := d.quarantine(s, err); qerr != nil {
+					log.Errorf("scrub: quarantine %s: %v", s.Path(), qerr)
+				} else if scrubRepair && owner != nil {
+					owner.repair(s)
+				}
+			}
+			scrubChecked.Add(1)
+			tally.add(s.Dir, err != nil)
+
+			if reportVerification && owner != nil {
+				reports[owner] = append(reports[owner], newVerificationReport(s, err))
+			}
+		}
+
+		log.Infof("scrub: checked %d of %d CARs, %d corrupted", count, len(stored), corrupted)
+		recordBitrot(tally)
+
+		for owner, reports := range reports {
+			if err := pushVerification(owner.token, reports); err != nil {
+				log.Errorf("scrub: push verification: %v", err)
+			}
+		}
+	}
+}
+
+// verifyStored checks a stored CAR against its sidecar checksum, or its manifest entry when the sidecar is gone
+func verifyStored(s *StoredCAR) error {
+	if !s.aggregated() {
+		err := verifyChecksum(s.Path())
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return verifyEntry(s)
+}
+
+// verifyEntry checks a stored CAR against the checksum of its manifest entry. CARs stored before checksums were
+// written are parsed and checked against the piece cid of their manifest entry.
+func verifyEntry(s *StoredCAR) error {
+	if s.aggregated() {
+		return verifyAggregated(s)
+	}
+
+	if s.SHA256 != "" {
+		sum, err := fileChecksum(s.Path())
+		if err != nil {
+			return err
+		}
+		if sum != s.SHA256 {
+			return errors.Wrapf(ErrChecksumMismatch, "recorded %s, computed %s", s.SHA256, sum)
+		}
+		return nil
+	}
+
+	verify := verifyCAR
+	if len(s.Base) > 0 {
+		verify = verifyPartialCAR
+	}
+	if err := verify(s.Path(), s.Cid); err != nil {
+		return err
+	}
+
+	if s.PieceCID == "" {
+		return nil
+	}
+
+	pieceCid, _, err := computePiece(s.Path())
+	if err != nil {
+		return err
+	}
+
+	if pieceCid != s.PieceCID {
+		return errors.Wrapf(ErrPieceMismatch, "recorded %s, computed %s", s.PieceCID, pieceCid)
+	}
+	return nil
+}
+
+// repair queues the asset of the quarantined CAR to be downloaded again, d is the downloader owning its directory
+func (d *Downloader) repair(s *StoredCAR) {
+	endTime, err := time.ParseInLocation(dirDateTimeFormat, filepath.Base(s.Dir)[:len(dirDateTimeFormat)], time.Local)
+	if err != nil {
+		log.Errorf("scrub: parse date of %s: %v", s.Dir, err)
+		return
+	}
+
+	log.Infof("scrub: queue %s to repair", s.Cid)
+	asset := &model.Asset{Cid: s.Cid, TotalSize: s.Size, EndTime: endTime}
+	go d.dispatch([]*model.Asset{asset})
+}
+
+// computePiece computes the piece cid and padded piece size of the file at path
+func computePiece(path string) (string, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	cp := &commp.Calc{}
+	if _, err := io.Copy(cp, f); err != nil {
+		return "", 0, err
+	}
+
+	return digestPiece(cp)
+}
+
+func newVerificationReport(s *StoredCAR, err error) *VerificationReport {
+	report := &VerificationReport{
+		Cid:        s.Cid,
+		PieceCID:   s.PieceCID,
+		PieceSize:  s.PieceSize,
+		Verified:   err == nil,
+		VerifiedAt: time.Now(),
+	}
+
+	report.SHA256, _ = readChecksum(s.Path())
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
+
+// repairFromParity repairs the corrupted CAR from its parity sidecar and verifies it again
+func repairFromParity(s *StoredCAR) bool {
+	// the repair rewrites the CAR in place, replicas would copy a half repaired file
+	if replicationFriendly {
+		return false
+	}
+
+	if _, err := os.Stat(s.Path() + paritySuffix); err != nil {
+		return false
+	}
+
+	n, err := repairParity(s.Path())
+	if err != nil {
+		log.Errorf("scrub: repair %s from parity: %v", s.Path(), err)
+		return false
+	}
+
+	if err := verifyStored(s); err != nil {
+		log.Errorf("scrub: %s still corrupted after repairing %d shards: %v", s.Path(), n, err)
+		return false
+	}
+
+	log.Infof("scrub: repaired %d shards of %s from parity", n, s.Path())
+	return true
+}
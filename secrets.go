@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultScheme = "vault:"
+	awsSMScheme = "awssm:"
+)
+
+// secretsRefresh is the period the secret references are fetched again in, 0 fetches them at startup only
+var secretsRefresh = 10 * time.Minute
+
+var (
+	slk sync.Mutex
+	// secretRefs are the references of the flags given as secrets, by flag name, guarded by slk
+	secretRefs = make(map[string]string)
+	// rotatedSecrets are the values fetched by rotateSecrets, by flag name, guarded by slk. The flags aren't set once
+	// running, they're read without synchronization.
+	rotatedSecrets = make(map[string]string)
+)
+
+// isSecretRef reports whether a flag value references a secret, vault:<path>#<field>, awssm:<secret id>[#<field>]
+// or keyring:<name>
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, vaultScheme) || strings.HasPrefix(value, awsSMScheme) || strings.HasPrefix(value, keyringScheme)
+}
+
+// fetchSecret fetches the value of a secret reference
+func fetchSecret(ref string) (string, error) {
+	path, field, _ := strings.Cut(ref, "#")
+
+	switch {
+	case strings.HasPrefix(path, vaultScheme):
+		return fetchVaultSecret(strings.TrimPrefix(path, vaultScheme), field)
+	case strings.HasPrefix(path, awsSMScheme):
+		return fetchAWSSecret(strings.TrimPrefix(path, awsSMScheme), field)
+	case strings.HasPrefix(path, keyringScheme):
+		return keyringGet(strings.TrimPrefix(path, keyringScheme))
+	}
+	return "", fmt.Errorf("unknown secret reference %s", ref)
+}
+
+// resolveSecretFlags replaces the flags given as secret references with the secrets, so credentials need not appear
+// in the process arguments
+func resolveSecretFlags() error {
+	var refs []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) {
+		if isSecretRef(f.Value.String()) {
+			refs = append(refs, f)
+		}
+	})
+
+	for _, f := range refs {
+		ref := f.Value.String()
+		value, err := fetchSecret(ref)
+		if err != nil {
+			return fmt.Errorf("fetch secret of %s: %w", f.Name, err)
+		}
+		if err := flag.Set(f.Name, value); err != nil {
+			return fmt.Errorf("set %s: %w", f.Name, err)
+		}
+
+		slk.Lock()
+		secretRefs[f.Name] = ref
+		slk.Unlock()
+		log.Infof("%s fetched from %s", f.Name, strings.SplitN(ref, ":", 2)[0])
+	}
+	return nil
+}
+
+// secretFlagged reports whether the flag was given as a secret reference
+func secretFlagged(name string) bool {
+	slk.Lock()
+	defer slk.Unlock()
+
+	_, ok := secretRefs[name]
+	return ok
+}
+
+// secret is the current value of the credential flag name, as rotated by rotateSecrets. The credentials read after
+// startup go through it.
+func secret(name string) string {
+	slk.Lock()
+	value, ok := rotatedSecrets[name]
+	slk.Unlock()
+	if ok {
+		return value
+	}
+	return flag.Lookup(name).Value.String()
+}
+
+// rotateSecrets fetches the secret references again every secretsRefresh. A rotated storage api token is used by the
+// next request, the etcd password and the w3s token by the next connection or upload. The other credentials are read
+// at startup, they take effect on the next restart.
+func rotateSecrets() {
+	for range time.Tick(secretsRefresh) {
+		slk.Lock()
+		refs := make(map[string]string, len(secretRefs))
+		for name, ref := range secretRefs {
+			refs[name] = ref
+		}
+		slk.Unlock()
+
+		for name, ref := range refs {
+			value, err := fetchSecret(ref)
+			if err != nil {
+				log.Errorf("fetch secret of %s: %v", name, err)
+				continue
+			}
+			if secret(name) == value {
+				continue
+			}
+
+			log.Infof("secret of %s rotated", name)
+			slk.Lock()
+			rotatedSecrets[name] = value
+			slk.Unlock()
+
+			// main keeps a token source for a token given as secret
+			if name == "token" && storageTokens != nil {
+				storageTokens.set(value)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// shardIndex and shardCount split the jobs statically between shardCount instances, 0 count takes every job
+	shardIndex int
+	shardCount int
+	// shardPrefix is the etcd prefix the instances register under, the live members split the jobs when set
+	shardPrefix string
+	// shardID identifies the instance among the members, the hostname by default
+	shardID string
+)
+
+// shards is the membership the jobs are split by, nil takes every job
+var shards atomic.Pointer[shardRing]
+
+// shardRing assigns every cid to one member by rendezvous hashing, a change of the membership only moves the cids
+// of the members joining or leaving
+type shardRing struct {
+	self    string
+	members []string
+}
+
+// ownsShard reports whether the instance is the member the cid is assigned to
+func ownsShard(cid string) bool {
+	r := shards.Load()
+	return r == nil || r.owner(cid) == r.self
+}
+
+func (r *shardRing) owner(cid string) string {
+	var owner string
+	var best uint64
+	for _, m := range r.members {
+		sum := sha256.Sum256([]byte(m + "\x00" + cid))
+		if score := binary.BigEndian.Uint64(sum[:8]); owner == "" || score > best {
+			owner, best = m, score
+		}
+	}
+	return owner
+}
+
+// staticShards builds the ring of the shard flags, the members are the indexes
+func staticShards(index, count int) (*shardRing, error) {
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("shard_index %d out of range 0-%d", index, count-1)
+	}
+
+	r := &shardRing{self: strconv.Itoa(index)}
+	for i := 0; i < count; i++ {
+		r.members = append(r.members, strconv.Itoa(i))
+	}
+	return r, nil
+}
+
+// joinShards registers the instance under prefix with a lease and keeps the ring in line with the registered
+// members. The process exits when the lease is lost, the others have taken over its share by then.
+func joinShards(ctx context.Context, addresses []string, prefix, id string, ttl int) error {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   addresses,
+		DialTimeout: 5 * time.Second,
+		Username:    user,
+		Password:    secret("password"),
+	})
+	if err != nil {
+		return err
+	}
+
+	session, err := concurrency.NewSession(cli, concurrency.WithTTL(ttl))
+	if err != nil {
+		cli.Close()
+		return err
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	if _, err := cli.Put(ctx, prefix+id, id, clientv3.WithLease(session.Lease())); err != nil {
+		session.Close()
+		cli.Close()
+		return err
+	}
+
+	rev, err := loadShards(ctx, cli, prefix, id)
+	if err != nil {
+		session.Close()
+		cli.Close()
+		return err
+	}
+
+	go func() {
+		<-session.Done()
+		log.Fatal("shard lease lost, exit as the other members took over the share")
+	}()
+
+	go func() {
+		for resp := range cli.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1)) {
+			if err := resp.Err(); err != nil {
+				log.Errorf("watch shard members: %v", err)
+				continue
+			}
+			if _, err := loadShards(ctx, cli, prefix, id); err != nil {
+				log.Errorf("load shard members: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// loadShards replaces the ring with the members registered under prefix, it returns the revision read at
+func loadShards(ctx context.Context, cli *clientv3.Client, prefix, id string) (int64, error) {
+	resp, err := cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	r := &shardRing{self: id}
+	for _, kv := range resp.Kvs {
+		r.members = append(r.members, strings.TrimPrefix(string(kv.Key), prefix))
+	}
+	slices.Sort(r.members)
+	if !slices.Contains(r.members, id) {
+		return 0, fmt.Errorf("%s not registered under %s", id, prefix)
+	}
+
+	if old := shards.Load(); old == nil || !slices.Equal(old.members, r.members) {
+		log.Infof("shard members: %s, this instance is %s", strings.Join(r.members, ", "), id)
+	}
+	shards.Store(r)
+	return resp.Header.Revision, nil
+}
+
+// defaultShardID is the hostname, stable across restarts so the assignment of the cids is too
+func defaultShardID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return strconv.Itoa(os.Getpid())
+	}
+	return hostname
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardRingOwner(t *testing.T) {
+	r, err := staticShards(0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owned := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		c := fmt.Sprintf("bafy%d", i)
+		owner := r.owner(c)
+		if owner != r.owner(c) {
+			t.Fatalf("%s is assigned to %s, then to %s", c, owner, r.owner(c))
+		}
+		owned[owner]++
+	}
+
+	// rendezvous hashing spreads the cids evenly
+	for _, m := range r.members {
+		if owned[m] < 800 || owned[m] > 1200 {
+			t.Errorf("member %s owns %d of 4000 cids", m, owned[m])
+		}
+	}
+}
+
+func TestShardRingMembershipChange(t *testing.T) {
+	before := &shardRing{members: []string{"a", "b", "c"}}
+	after := &shardRing{members: []string{"a", "b", "c", "d"}}
+
+	// only the cids of the joining member move
+	for i := 0; i < 1000; i++ {
+		c := fmt.Sprintf("bafy%d", i)
+		if owner := after.owner(c); owner != "d" && owner != before.owner(c) {
+			t.Errorf("%s moved from %s to %s", c, before.owner(c), owner)
+		}
+	}
+}
+
+func TestShardRingEmpty(t *testing.T) {
+	if owner := (&shardRing{}).owner("bafy"); owner != "" {
+		t.Errorf("empty ring assigns to %q", owner)
+	}
+	if _, err := staticShards(4, 4); err == nil {
+		t.Error("shard_index 4 of 4 accepted")
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// signatureSuffix marks the detached signature of a manifest
+const signatureSuffix = ".sig"
+
+var ErrBadSignature = errors.New("bad manifest signature")
+
+var (
+	// manifestKeyPath is the file of the hex encoded ed25519 private key manifests are signed with, empty disables signing
+	manifestKeyPath string
+	manifestKey     ed25519.PrivateKey
+)
+
+// ManifestSignature signs the sha256 of the whole manifest, so removed lines are detected too. The state of the
+// digest is kept along, an append hashes its own line only.
+type ManifestSignature struct {
+	PublicKey string    `json:"public_key"`
+	Signature string    `json:"signature"`
+	SignedAt  time.Time `json:"signed_at"`
+	// Digest is the hex sha256 of the manifest the signature is over, older signatures are over the manifest itself
+	Digest string `json:"digest,omitempty"`
+	// Size is the length of the manifest the digest is over
+	Size int64 `json:"size,omitempty"`
+	// State is the marshaled sha256 state the next append resumes
+	State []byte `json:"state,omitempty"`
+}
+
+// loadManifestKey reads the private key, either as seed or as full ed25519 private key
+func loadManifestKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifestKey(string(data), path)
+}
+
+// parseManifestKey decodes a hex encoded key, name is the origin of the key in errors
+func parseManifestKey(data, name string) (ed25519.PrivateKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode key %s", name)
+	}
+
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return key, nil
+	default:
+		return nil, errors.Errorf("key %s has %d bytes, want a %d bytes seed or %d bytes private key", name, len(key), ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+}
+
+// signManifest rewrites the signature of the manifest of dir after line was appended to it, the caller holds
+// manifestLk
+func signManifest(dir string, line []byte) error {
+	path := filepath.Join(dir, manifestFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	h, err := resumeDigest(path, info.Size()-int64(len(line)))
+	if err == nil {
+		h.Write(line)
+	} else if h, err = fileDigest(path); err != nil {
+		return err
+	}
+
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	digest := h.Sum(nil)
+
+	sig := &ManifestSignature{
+		PublicKey: hex.EncodeToString(manifestKey.Public().(ed25519.PublicKey)),
+		Signature: hex.EncodeToString(ed25519.Sign(manifestKey, digest)),
+		SignedAt:  time.Now(),
+		Digest:    hex.EncodeToString(digest),
+		Size:      info.Size(),
+		State:     state,
+	}
+
+	out, err := json.Marshal(sig)
+	if err != nil {
+		return err
+	}
+
+	tmp := stagingPath(path + signatureSuffix)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(out)
+	if err == nil && durable {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path+signatureSuffix)
+}
+
+// resumeDigest restores the digest state of the signature of the manifest at path, which must be over size bytes
+// and signed with manifestKey. The manifest is hashed again by the caller otherwise, a signature of an older
+// version for one.
+func resumeDigest(path string, size int64) (hash.Hash, error) {
+	raw, err := os.ReadFile(path + signatureSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig ManifestSignature
+	if err := json.Unmarshal(raw, &sig); err != nil {
+		return nil, err
+	}
+	if sig.Size != size || len(sig.State) == 0 {
+		return nil, errors.Errorf("signature is over %d bytes, manifest has %d", sig.Size, size)
+	}
+
+	digest, _ := hex.DecodeString(sig.Digest)
+	signature, _ := hex.DecodeString(sig.Signature)
+	if !ed25519.Verify(manifestKey.Public().(ed25519.PublicKey), digest, signature) {
+		return nil, ErrBadSignature
+	}
+
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(sig.State); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return nil, errors.Errorf("digest state doesn't match the signed digest")
+	}
+	return h, nil
+}
+
+// fileDigest hashes the file at path
+func fileDigest(path string) (hash.Hash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// verifyManifestSignature checks the manifest of dir against its signature and the public key
+func verifyManifestSignature(dir string, publicKey ed25519.PublicKey) error {
+	path := filepath.Join(dir, manifestFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	raw, err := os.ReadFile(path + signatureSuffix)
+	if err != nil {
+		return err
+	}
+
+	var sig ManifestSignature
+	if err := json.Unmarshal(raw, &sig); err != nil {
+		return errors.Wrapf(ErrBadSignature, "decode %s: %v", path+signatureSuffix, err)
+	}
+
+	signature, err := hex.DecodeString(sig.Signature)
+	if err != nil {
+		return errors.Wrapf(ErrBadSignature, "decode signature: %v", err)
+	}
+
+	signed := data
+	if sig.Digest != "" {
+		sum := sha256.Sum256(data)
+		if digest := hex.EncodeToString(sum[:]); digest != sig.Digest {
+			return errors.Wrapf(ErrBadSignature, "manifest digest %s, signed %s", digest, sig.Digest)
+		}
+		signed = sum[:]
+	}
+
+	if !ed25519.Verify(publicKey, signed, signature) {
+		return errors.Wrapf(ErrBadSignature, "signed at %s", sig.SignedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// manifestFinding is printed as a json line for every failed check
+type manifestFinding struct {
+	Dir   string `json:"dir"`
+	Cid   string `json:"cid,omitempty"`
+	Error string `json:"error"`
+}
+
+func verifyManifestCmd(args []string) error {
+	fs := flag.NewFlagSet("verify-manifest", flag.ExitOnError)
+	publicKeyHex := fs.String("pubkey", "", "hex encoded ed25519 public key the manifests were signed with")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	publicKey, err := hex.DecodeString(*publicKeyHex)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("usage: verify-manifest -pubkey <hex public key> [dir...]")
+	}
+
+	dirs := fs.Args()
+	if len(dirs) == 0 {
+		entries, err := os.ReadDir(BackupOutPath)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if isBackupDir(BackupOutPath, e) {
+				if _, err := os.Stat(filepath.Join(BackupOutPath, e.Name(), manifestFile)); err == nil {
+					dirs = append(dirs, filepath.Join(BackupOutPath, e.Name()))
+				}
+			}
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var checked, failed int
+	for _, dir := range dirs {
+		if err := verifyManifestSignature(dir, publicKey); err != nil {
+			failed++
+			enc.Encode(&manifestFinding{Dir: dir, Error: err.Error()})
+			// the entries of a tampered manifest prove nothing
+			continue
+		}
+
+		entries, err := readManifest(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			checked++
+			// the sidecars aren't signed, only the entry is trusted
+			if err := verifyEntry(&StoredCAR{Dir: dir, ManifestEntry: entry}); err != nil {
+				failed++
+				enc.Encode(&manifestFinding{Dir: dir, Cid: entry.Cid, Error: err.Error()})
+			}
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "verified %d manifests with %d CARs, %d failures\n", len(dirs), checked, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d failures", failed)
+	}
+	return nil
+}
+
+func manifestKeyCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: manifest-key <private key file>")
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(args[0], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, hex.EncodeToString(privateKey.Seed()))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hex.EncodeToString(publicKey))
+	return nil
+}
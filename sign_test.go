@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withManifestKey(t *testing.T) ed25519.PublicKey {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := manifestKey
+	manifestKey = private
+	t.Cleanup(func() { manifestKey = old })
+	return public
+}
+
+func TestManifestSignature(t *testing.T) {
+	public := withManifestKey(t)
+	dir := t.TempDir()
+
+	// every append resumes the digest of the previous signature
+	for _, c := range []string{"bafyone", "bafytwo", "bafythree"} {
+		if err := appendManifest(dir, &ManifestEntry{Cid: c, Size: 42, BackupTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyManifestSignature(dir, public); err != nil {
+			t.Fatalf("after appending %s: %v", c, err)
+		}
+	}
+
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyManifestSignature(dir, other); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("verified with another key: %v", err)
+	}
+}
+
+func TestManifestSignatureTampered(t *testing.T) {
+	public := withManifestKey(t)
+	dir := t.TempDir()
+
+	for _, c := range []string{"bafyone", "bafytwo"} {
+		if err := appendManifest(dir, &ManifestEntry{Cid: c, Size: 42, BackupTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, manifestFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a removed line is detected as well as a changed one
+	first := data[:len(data)/2]
+	if err := os.WriteFile(path, first, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyManifestSignature(dir, public); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("verified a truncated manifest: %v", err)
+	}
+}
+
+func TestManifestSignatureRehashes(t *testing.T) {
+	public := withManifestKey(t)
+	dir := t.TempDir()
+
+	if err := appendManifest(dir, &ManifestEntry{Cid: "bafyone", BackupTime: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a line appended without signing leaves a signature over fewer bytes, the next append hashes the whole manifest
+	key := manifestKey
+	manifestKey = nil
+	if err := appendManifest(dir, &ManifestEntry{Cid: "bafytwo", BackupTime: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	manifestKey = key
+
+	if err := appendManifest(dir, &ManifestEntry{Cid: "bafythree", BackupTime: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyManifestSignature(dir, public); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"math/rand"
+	"time"
+)
+
+var (
+	// spotCheckCARs is the number of stored CARs sampled every hour, 0 disables the spot check
+	spotCheckCARs int
+	// spotCheckBlocks is the number of blocks verified in every sampled CAR
+	spotCheckBlocks = 16
+)
+
+const spotCheckInterval = time.Hour
+
+// spotCheck verifies spotCheckBlocks random blocks of spotCheckCARs random stored CARs every hour. It's a cheap
+// statistical assurance for archives too large to be scrubbed completely.
+func (d *Downloader) spotCheck() {
+	ticker := time.NewTicker(spotCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stored, err := loadInventory(BackupOutPath)
+		if err != nil {
+			log.Errorf("spot check: load inventory: %v", err)
+			continue
+		}
+
+		rand.Shuffle(len(stored), func(i, j int) { stored[i], stored[j] = stored[j], stored[i] })
+
+		var blocks, failed int
+		for _, s := range stored[:min(spotCheckCARs, len(stored))] {
+			var n int
+			if s.aggregated() {
+				// packed CARs are small, they are checked whole
+				err = verifyAggregated(s)
+			} else {
+				n, err = spotCheckCAR(s.Path(), spotCheckBlocks)
+			}
+			blocks += n
+			spotCheckedBlocks.Add(int64(n))
+			if err == nil {
+				continue
+			}
+
+			failed++
+			spotCheckFailures.Add(1)
+			log.Errorf("spot check: %s: %v", s.Path(), err)
+
+			if errors.Is(err, ErrHashMismatch) || errors.Is(err, ErrChecksumMismatch) {
+				if qerr := d.quarantine(s, err); qerr != nil {
+					log.Errorf("spot check: quarantine %s: %v", s.Path(), qerr)
+				}
+			}
+		}
+
+		log.Infof("spot check: verified %d blocks of %d CARs, %d failed", blocks, min(spotCheckCARs, len(stored)), failed)
+	}
+}
+
+// spotCheckCAR verifies the hash of up to k random blocks of the CAR at path, located by its sidecar index. It
+// returns the number of verified blocks.
+func spotCheckCAR(path string, k int) (int, error) {
+	idx, err := readIndex(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "read index")
+	}
+
+	iterable, ok := idx.(index.IterableIndex)
+	if !ok {
+		return 0, errors.Errorf("index codec %x not iterable", idx.Codec())
+	}
+
+	// reservoir sampling of the block offsets
+	var offsets []uint64
+	var seen int
+	err = iterable.ForEach(func(_ multihash.Multihash, offset uint64) error {
+		seen++
+		if len(offsets) < k {
+			offsets = append(offsets, offset)
+		} else if i := rand.Intn(seen); i < k {
+			offsets[i] = offset
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	reader, err := car.OpenReader(path)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	data, err := reader.DataReader()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, offset := range offsets {
+		c, block, err := readSection(data, offset)
+		if err != nil {
+			return i, errors.Wrapf(ErrInvalidCAR, "read block at %d: %v", offset, err)
+		}
+
+		if err := verifyBlockHash(c, block); err != nil {
+			return i, err
+		}
+	}
+
+	return len(offsets), nil
+}
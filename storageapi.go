@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// storageAPITimeout bounds a single request to the storage api, including reading the response
+	storageAPITimeout = 30 * time.Second
+	// storageAPIRetries is how many times a failed storage api request is retried
+	storageAPIRetries = 5
+)
+
+// storageClient is shared by all storage api calls, so connections are kept alive between polls. It's created on
+// first use, after the flags are parsed
+var storageClient = sync.OnceValue(func() *http.Client {
+	return &http.Client{
+		Timeout: storageAPITimeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: dialTCP(&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}),
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          16,
+			MaxIdleConnsPerHost:   8,
+			IdleConnTimeout:       90 * time.Second,
+			TLSClientConfig:       storageTLS,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 20 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+})
+
+// retryable reports whether a storage api response status may succeed when the request is sent again
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// retryAfter is the delay the server asked for in the Retry-After header, in seconds or as a date, 0 when absent
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// apiBackoff doubles from half a second for every attempt up to a minute, with jitter so daemons
+// restarted together don't retry in lockstep. The shift is capped as the minute is reached by then, larger ones would
+// overflow.
+func apiBackoff(attempt int) time.Duration {
+	backoff := min(500*time.Millisecond<<min(attempt, 7), time.Minute)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// doStorageAPI sends a request to the storage api with token, or the current one of storageTokens, retrying network
+// errors, 429 and 5xx responses with backoff. A 401 renews the token and retries. The body of the returned response
+// has status 200 and must be closed by the caller
+func doStorageAPI(method, url, token string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt <= storageAPIRetries; attempt++ {
+		if attempt > 0 {
+			storageAPIRetried.Add(1)
+		}
+
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+
+		req, err := http.NewRequest(method, url, reader)
+		if err != nil {
+			return nil, err
+		}
+		bearer := currentToken(token)
+		req.Header.Add("Authorization", "Bearer "+bearer)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		wait := apiBackoff(attempt)
+		resp, err := storageClient().Do(req)
+		if err != nil {
+			lastErr = err
+		} else {
+			if resp.StatusCode == http.StatusOK {
+				return resp, nil
+			}
+
+			// drain the body so the connection is reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+
+			lastErr = fmt.Errorf("status: %d %v", resp.StatusCode, resp.Status)
+
+			// an expired token is renewed and the request sent again at once
+			if resp.StatusCode == http.StatusUnauthorized && storageTokens != nil && attempt < storageAPIRetries && storageTokens.invalidate(bearer) {
+				log.Warnf("%s %s: %v, retry with renewed token", method, url, lastErr)
+				continue
+			}
+
+			if !retryable(resp.StatusCode) {
+				return nil, lastErr
+			}
+
+			if after := retryAfter(resp, time.Now()); after > 0 {
+				wait = min(after, 5*time.Minute)
+			}
+		}
+
+		if attempt < storageAPIRetries {
+			log.Warnf("%s %s: %v, retry in %s", method, url, lastErr, wait)
+			time.Sleep(wait)
+		}
+	}
+
+	return nil, fmt.Errorf("after %d retries: %w", storageAPIRetries, lastErr)
+}
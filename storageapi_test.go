@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPIBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		want := min(500*time.Millisecond<<min(attempt, 7), time.Minute)
+		for i := 0; i < 20; i++ {
+			// the jitter keeps the backoff between half and the whole of it
+			if got := apiBackoff(attempt); got < want/2 || got > want {
+				t.Fatalf("attempt %d: backoff %s, want %s to %s", attempt, got, want/2, want)
+			}
+		}
+	}
+}
+
+func TestAPIBackoffLarge(t *testing.T) {
+	// a shift by the attempt alone overflows long before
+	for _, attempt := range []int{63, 64, 1000, 1 << 30} {
+		if got := apiBackoff(attempt); got < 30*time.Second || got > time.Minute {
+			t.Errorf("attempt %d: backoff %s", attempt, got)
+		}
+	}
+}
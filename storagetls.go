@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// storageAPICert and storageAPIKey are the client certificate presented to the storage api besides the token
+	storageAPICert string
+	storageAPIKey  string
+	// storageAPICA verifies the storage api in place of the system roots when set
+	storageAPICA string
+)
+
+// storageTLS is the TLS config of the storage api client, nil uses the defaults
+var storageTLS *tls.Config
+
+// loadStorageTLS builds the TLS config of the storage api client from the flags
+func loadStorageTLS() (*tls.Config, error) {
+	if storageAPICert == "" && storageAPIKey == "" && storageAPICA == "" {
+		return nil, nil
+	}
+	if (storageAPICert == "") != (storageAPIKey == "") {
+		return nil, fmt.Errorf("storage_api_cert and storage_api_key are given together")
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if storageAPICA != "" {
+		data, err := os.ReadFile(storageAPICA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", storageAPICA)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if storageAPICert != "" {
+		c := &clientCert{certFile: storageAPICert, keyFile: storageAPIKey}
+		if _, err := c.get(nil); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = c.get
+	}
+	return cfg, nil
+}
+
+// clientCert is a client certificate read again when its files change, so short lived certificates renewed on disk
+// are picked up by the next connection
+type clientCert struct {
+	certFile, keyFile string
+
+	lk      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *clientCert) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			log.Errorf("stat storage api client certificate: %v", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		// a renewal caught between writing the certificate and the key, the previous pair is still valid
+		if c.cert != nil {
+			log.Errorf("reload storage api client certificate: %v", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+
+	if c.cert != nil {
+		log.Infof("storage api client certificate reloaded from %s", c.certFile)
+	}
+	c.cert, c.modTime = &cert, modTime
+	return c.cert, nil
+}
+
+// latestModTime is the modification time of the most recently changed of files
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tarEpoch is the modification time of the manifests in tar archives, so the same selection always packs into the
+// same bytes
+var tarEpoch = time.Unix(0, 0).UTC()
+
+// exportTar packs the selected CARs into tar archives at out. The CARs are sorted by directory and cid and every
+// archive ends with a manifest.jsonl of its CARs, delta CARs are stored complete. With maxSize set the CARs are split
+// into archives of at most maxSize bytes of CARs, named out-000.tar, out-001.tar...
+func exportTar(out string, selected []*StoredCAR, maxSize int64) ([]string, error) {
+	selected = append([]*StoredCAR(nil), selected...)
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].Dir != selected[j].Dir {
+			return selected[i].Dir < selected[j].Dir
+		}
+		return selected[i].Cid < selected[j].Cid
+	})
+
+	var volumes [][]*StoredCAR
+	var size int64
+	for _, s := range selected {
+		if len(volumes) == 0 || (maxSize > 0 && size > 0 && size+s.Size > maxSize) {
+			volumes = append(volumes, nil)
+			size = 0
+		}
+		volumes[len(volumes)-1] = append(volumes[len(volumes)-1], s)
+		size += s.Size
+	}
+
+	var paths []string
+	for i, volume := range volumes {
+		path := out
+		if maxSize > 0 {
+			path = fmt.Sprintf("%s-%03d.tar", strings.TrimSuffix(out, ".tar"), i)
+		}
+
+		if err := writeTar(path, volume); err != nil {
+			return paths, errors.Wrapf(err, "write %s", path)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func writeTar(path string, selected []*StoredCAR) error {
+	f, err := os.Create(path + partSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + partSuffix)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	var manifest bytes.Buffer
+	for i, s := range selected {
+		fmt.Fprintf(os.Stderr, "tar %d/%d: %s\n", i+1, len(selected), s.Cid)
+
+		entry, err := addTarCAR(tw, s)
+		if err != nil {
+			return errors.Wrapf(err, "add %s", s.Cid)
+		}
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		manifest.Write(append(data, '\n'))
+	}
+
+	if err := addTarFile(tw, manifestFile, tarEpoch, int64(manifest.Len()), &manifest); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+partSuffix, path)
+}
+
+// addTarCAR adds the CAR of s as <dir>/<cid>.car and returns its manifest entry, delta CARs are materialized
+func addTarCAR(tw *tar.Writer, s *StoredCAR) (*ManifestEntry, error) {
+	full, cleanup, err := completeCAR(s, os.TempDir())
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	f, err := os.Open(full.Path())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Join(filepath.Base(s.Dir), s.Cid+".car")
+	if err := addTarFile(tw, name, full.BackupTime.UTC().Truncate(time.Second), st.Size(), f); err != nil {
+		return nil, err
+	}
+
+	entry := *full.ManifestEntry
+	entry.Uploads = nil
+	return &entry, nil
+}
+
+// addTarFile writes a regular file with fixed ownership and mode, so only the content and mtime end up in the header
+func addTarFile(tw *tar.Writer, name string, modTime time.Time, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"github.com/docker/go-units"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Tenant is a Titan account backed up by the process besides the one of the flags, with its own token, area,
+// backup directories and quota
+type Tenant struct {
+	// Name namespaces the backup directories of the tenant, named <date><letter>.<name>
+	Name string
+	// Token is the storage api token of the account, a secret reference is resolved at startup
+	Token  string
+	AreaID string
+	// Concurrent is the size of the worker pool of the tenant, --concurrent when 0
+	Concurrent int
+	// Quota is the byte budget of the backup directories of the tenant, new jobs are deferred beyond it. 0 is
+	// unlimited.
+	Quota int64
+}
+
+var tenantNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// loadTenants reads the Tenants section of the config file
+func loadTenants() ([]*Tenant, error) {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+
+	names := make(map[string]struct{})
+	for _, t := range cfg.Tenants {
+		if !tenantNameRegexp.MatchString(t.Name) {
+			return nil, fmt.Errorf("tenant name %q must be lowercase letters, digits, _ or -", t.Name)
+		}
+		if _, ok := names[t.Name]; ok {
+			return nil, fmt.Errorf("duplicate tenant %s", t.Name)
+		}
+		names[t.Name] = struct{}{}
+
+		if isSecretRef(t.Token) {
+			value, err := fetchSecret(t.Token)
+			if err != nil {
+				return nil, fmt.Errorf("fetch token of tenant %s: %w", t.Name, err)
+			}
+			t.Token = value
+		}
+		if t.Token == "" {
+			return nil, fmt.Errorf("tenant %s has no token", t.Name)
+		}
+		if t.Concurrent == 0 {
+			t.Concurrent = concurrent
+		}
+	}
+	return cfg.Tenants, nil
+}
+
+// newTenantDownloader creates the downloader of a tenant. It shares the directory sizes, the block index and the
+// claimed disk space with the downloader of the flags, which runs the maintenance of the whole archive.
+func newTenantDownloader(parent *Downloader, t *Tenant) *Downloader {
+	d := newDownloader(t.Token, t.AreaID, parent.registry, t.Concurrent)
+	d.dirSize = parent.dirSize
+	d.blocks = parent.blocks
+	d.parent = parent
+	d.tenant = t.Name
+	d.tenantQuota = t.Quota
+	parent.tenants = append(parent.tenants, d)
+	return d
+}
+
+// dirTenant returns the tenant of the backup directory dir, named <date><letter>.<name>, "" for the account of the
+// flags
+func dirTenant(dir string) string {
+	_, name, _ := strings.Cut(filepath.Base(dir), ".")
+	return name
+}
+
+// owner returns the downloader of the account the backup directory dir belongs to, so the maintenance of the parent
+// repairs and reports a CAR with the token, queue and directories of its tenant. It's nil for a tenant no longer
+// configured.
+func (d *Downloader) owner(dir string) *Downloader {
+	name := dirTenant(dir)
+	if name == "" {
+		return d
+	}
+	for _, t := range d.tenants {
+		if t.tenant == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// namespace is the suffix of the backup directories of the tenant, none for the account of the flags
+func (d *Downloader) namespace() string {
+	if d.tenant == "" {
+		return ""
+	}
+	return "." + d.tenant
+}
+
+// overQuota reports whether storing size more bytes exceeds the quota of the tenant
+func (d *Downloader) overQuota(size int64) bool {
+	if d.tenantQuota <= 0 {
+		return false
+	}
+
+	suffix := d.namespace()
+	used := d.dirSize.sum(func(dir string) bool { return strings.HasSuffix(dir, suffix) })
+	if used+size <= d.tenantQuota {
+		return false
+	}
+
+	log.Warnf("deferred: tenant %s uses %s of %s, no room for %s", d.tenant, units.BytesSize(float64(used)),
+		units.BytesSize(float64(d.tenantQuota)), units.BytesSize(float64(size)))
+	return true
+}
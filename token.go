@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// tokenFile holds the storage api token, it's read again whenever it changes
+	tokenFile string
+	// tokenRefreshURL is an OAuth token endpoint the storage api token is renewed at with a refresh token grant
+	tokenRefreshURL string
+	// refreshTokenFile holds the refresh token, it's rewritten when the endpoint rotates it
+	refreshTokenFile string
+	// tokenClientID is sent with the refresh token grant when set
+	tokenClientID string
+	// tokenRenewBefore is how long before its expiry the token is renewed
+	tokenRenewBefore = 5 * time.Minute
+)
+
+// storageTokens provides the storage api token in place of --token when a token file or refresh url is given
+var storageTokens *tokenSource
+
+// tokenSource keeps the storage api token current
+type tokenSource struct {
+	// rlk serializes the refreshes, a rotated refresh token is only valid once
+	rlk    sync.Mutex
+	lk     sync.Mutex
+	token  string
+	expiry time.Time
+	// modTime is the modification time of tokenFile the token was read at
+	modTime time.Time
+}
+
+// newTokenSource starts from the token file, or the static token until the first refresh
+func newTokenSource(static string) (*tokenSource, error) {
+	s := &tokenSource{token: static, expiry: jwtExpiry(static)}
+	if tokenFile != "" {
+		if err := s.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	if tokenRefreshURL != "" && (s.token == "" || s.expiring(time.Now())) {
+		if err := s.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// currentToken is the token the storage api is called with. The token of the flags is replaced by the current one
+// of storageTokens when configured, the tokens of the tenants are used as given.
+func currentToken(given string) string {
+	if storageTokens == nil || given != token {
+		return given
+	}
+	return storageTokens.get()
+}
+
+func (s *tokenSource) get() string {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if tokenFile != "" {
+		if err := s.reloadLocked(); err != nil {
+			log.Errorf("reload %s: %v", tokenFile, err)
+		}
+	}
+	return s.token
+}
+
+// set replaces the token, with a token rotated in a secrets backend
+func (s *tokenSource) set(token string) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.token, s.expiry = token, jwtExpiry(token)
+}
+
+func (s *tokenSource) reload() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.reloadLocked()
+}
+
+// reloadLocked reads tokenFile when it changed since the last read
+func (s *tokenSource) reloadLocked() error {
+	info, err := os.Stat(tokenFile)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("%s is empty", tokenFile)
+	}
+
+	if s.modTime != (time.Time{}) {
+		log.Infof("storage api token changed in %s", tokenFile)
+	}
+	s.token, s.expiry, s.modTime = token, jwtExpiry(token), info.ModTime()
+	return nil
+}
+
+// expiring reports whether the token expires within tokenRenewBefore, a token of unknown expiry never does
+func (s *tokenSource) expiring(now time.Time) bool {
+	return !s.expiry.IsZero() && now.Add(tokenRenewBefore).After(s.expiry)
+}
+
+// tokenResponse is the response of an OAuth token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refresh renews the token at tokenRefreshURL, the rotated refresh token is saved to refreshTokenFile
+func (s *tokenSource) refresh() error {
+	s.rlk.Lock()
+	defer s.rlk.Unlock()
+	return s.refreshLocked()
+}
+
+// refreshLocked renews the token, the caller holds rlk
+func (s *tokenSource) refreshLocked() error {
+	data, err := os.ReadFile(refreshTokenFile)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {strings.TrimSpace(string(data))}}
+	if tokenClientID != "" {
+		form.Set("client_id", tokenClientID)
+	}
+
+	resp, err := storageClient().PostForm(tokenRefreshURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("refresh token: status %d: %s", resp.StatusCode, body)
+	}
+
+	var ret tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return err
+	}
+	if ret.AccessToken == "" {
+		return fmt.Errorf("refresh token: no access token in response")
+	}
+
+	if ret.RefreshToken != "" {
+		tmp := refreshTokenFile + ".tmp"
+		if err := os.WriteFile(tmp, []byte(ret.RefreshToken), 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, refreshTokenFile); err != nil {
+			return err
+		}
+	}
+
+	expiry := jwtExpiry(ret.AccessToken)
+	if ret.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(ret.ExpiresIn) * time.Second)
+	}
+
+	s.lk.Lock()
+	s.token, s.expiry = ret.AccessToken, expiry
+	s.lk.Unlock()
+
+	log.Infof("storage api token renewed, expires %s", expiry.Format(time.RFC3339))
+	return nil
+}
+
+// invalidate is called when the storage api rejected the token. It renews the token at once unless a request
+// rejected at the same time renewed it already, and reports whether a different one is to be tried.
+func (s *tokenSource) invalidate(rejected string) bool {
+	if tokenRefreshURL != "" {
+		s.rlk.Lock()
+		if s.get() == rejected {
+			if err := s.refreshLocked(); err != nil {
+				log.Errorf("renew rejected storage api token: %v", err)
+			}
+		}
+		s.rlk.Unlock()
+	}
+	return s.get() != rejected
+}
+
+// renew refreshes the token ahead of its expiry. Without a refresh url it only warns, the token file is expected
+// to be replaced by whatever issues the tokens.
+func (s *tokenSource) renew() {
+	for attempt := 0; ; {
+		if tokenFile != "" {
+			if err := s.reload(); err != nil {
+				log.Errorf("reload %s: %v", tokenFile, err)
+			}
+		}
+
+		s.lk.Lock()
+		wait := time.Until(s.expiry.Add(-tokenRenewBefore))
+		unknown := s.expiry.IsZero()
+		s.lk.Unlock()
+
+		if unknown {
+			wait = time.Minute
+		}
+		if wait > 0 {
+			time.Sleep(min(wait, time.Minute))
+			continue
+		}
+
+		if tokenRefreshURL == "" {
+			s.lk.Lock()
+			log.Warnf("storage api token expires %s, replace %s", s.expiry.Format(time.RFC3339), tokenFile)
+			s.lk.Unlock()
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		if err := s.refresh(); err != nil {
+			log.Errorf("renew storage api token: %v", err)
+			time.Sleep(apiBackoff(attempt))
+			attempt++
+			continue
+		}
+		attempt = 0
+	}
+}
+
+// jwtExpiry is the exp claim of a JWT, zero for tokens of other formats. The signature isn't checked, the expiry
+// only schedules the renewal.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
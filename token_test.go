@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withTokenEndpoint serves refresh token grants, every grant issues the next access token and rotates the refresh
+// token. It returns the number of grants served.
+func withTokenEndpoint(t *testing.T, refreshToken string) *atomic.Int32 {
+	var grants atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" {
+			http.Error(w, "unsupported grant", http.StatusBadRequest)
+			return
+		}
+		n := grants.Add(1)
+		if got, want := r.FormValue("refresh_token"), fmt.Sprintf("%s%d", refreshToken, n-1); got != want {
+			http.Error(w, "invalid refresh token "+got, http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&tokenResponse{
+			AccessToken:  fmt.Sprintf("access%d", n),
+			ExpiresIn:    3600,
+			RefreshToken: fmt.Sprintf("%s%d", refreshToken, n),
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	oldURL, oldFile := tokenRefreshURL, refreshTokenFile
+	tokenRefreshURL = srv.URL
+	refreshTokenFile = filepath.Join(t.TempDir(), "refresh_token")
+	t.Cleanup(func() { tokenRefreshURL, refreshTokenFile = oldURL, oldFile })
+
+	if err := os.WriteFile(refreshTokenFile, []byte(refreshToken+"0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &grants
+}
+
+func TestTokenRefresh(t *testing.T) {
+	grants := withTokenEndpoint(t, "refresh")
+
+	// no token to start from, the first one is fetched at once
+	s, err := newTokenSource("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.get(); got != "access1" {
+		t.Fatalf("token %s, want access1", got)
+	}
+	if s.expiring(time.Now()) || !s.expiring(time.Now().Add(time.Hour)) {
+		t.Errorf("expiry %s, want in an hour", s.expiry)
+	}
+
+	// the rotated refresh token is the one sent next
+	data, err := os.ReadFile(refreshTokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "refresh1" {
+		t.Fatalf("refresh token file %q, want the rotated token", data)
+	}
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.get(); got != "access2" || grants.Load() != 2 {
+		t.Fatalf("token %s after %d grants, want access2 after 2", got, grants.Load())
+	}
+}
+
+func TestTokenInvalidate(t *testing.T) {
+	grants := withTokenEndpoint(t, "refresh")
+	s := &tokenSource{token: "rejected"}
+
+	if !s.invalidate("rejected") {
+		t.Fatal("no other token to try after the rejection")
+	}
+	// a request rejected with the same token meanwhile doesn't renew it again
+	if !s.invalidate("rejected") {
+		t.Fatal("the renewed token isn't tried")
+	}
+	if got := s.get(); got != "access1" || grants.Load() != 1 {
+		t.Fatalf("token %s after %d grants, want access1 after 1", got, grants.Load())
+	}
+}
+
+func TestTokenRefreshRejected(t *testing.T) {
+	withTokenEndpoint(t, "refresh")
+	// the refresh token was revoked
+	if err := os.WriteFile(refreshTokenFile, []byte("revoked"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &tokenSource{token: "rejected"}
+	if s.invalidate("rejected") {
+		t.Fatal("the rejected token is tried again")
+	}
+	if _, err := newTokenSource(""); err == nil {
+		t.Fatal("a token source without a token started")
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+
+	if got := jwtExpiry("header." + payload + ".signature"); !got.Equal(exp) {
+		t.Errorf("expiry %s, want %s", got, exp)
+	}
+	for _, token := range []string{"opaque", "a.b", "header.!!.signature"} {
+		if got := jwtExpiry(token); !got.IsZero() {
+			t.Errorf("%s: expiry %s, want none", token, got)
+		}
+	}
+}
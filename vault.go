@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// vaultAddr is the address of the HashiCorp Vault server secrets are fetched from
+	vaultAddr = os.Getenv("VAULT_ADDR")
+	// vaultTokenFile holds the vault token, VAULT_TOKEN is used when empty
+	vaultTokenFile string
+)
+
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// vaultToken is read on every fetch, so an agent renewing the token file is followed
+func vaultToken() (string, error) {
+	if vaultTokenFile == "" {
+		if token := os.Getenv("VAULT_TOKEN"); token != "" {
+			return token, nil
+		}
+		return "", fmt.Errorf("no vault token, set VAULT_TOKEN or vault_token_file")
+	}
+
+	data, err := os.ReadFile(vaultTokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// fetchVaultSecret reads field of the secret at path, e.g. secret/data/backup for a KV v2 engine mounted at secret
+func fetchVaultSecret(path, field string) (string, error) {
+	if vaultAddr == "" {
+		return "", fmt.Errorf("no vault address, set VAULT_ADDR or vault_addr")
+	}
+	if field == "" {
+		return "", fmt.Errorf("vault secret %s: no field given", path)
+	}
+
+	token, err := vaultToken()
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(vaultAddr, "/"), strings.Trim(path, "/"))
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Add("X-Vault-Namespace", ns)
+	}
+
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault secret %s: status: %d %v", path, resp.StatusCode, resp.Status)
+	}
+
+	var ret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return "", err
+	}
+
+	// a KV v2 engine nests the secret in data.data next to its metadata
+	fields := ret.Data
+	if nested, ok := ret.Data["data"]; ok && ret.Data["metadata"] != nil {
+		fields = nil
+		if err := json.Unmarshal(nested, &fields); err != nil {
+			return "", err
+		}
+	}
+
+	raw, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("vault secret %s field %s is not a string", path, field)
+	}
+	return value, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/gnasnik/titan-explorer/core/generated/model"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strings"
+
+	_ "github.com/ipld/go-codec-dagpb"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	_ "github.com/ipld/go-ipld-prime/codec/dagjson"
+	_ "github.com/ipld/go-ipld-prime/codec/raw"
+)
+
+var (
+	ErrInvalidCAR    = errors.New("invalid CAR")
+	ErrRootMismatch  = errors.New("CAR roots don't include the requested cid")
+	ErrHashMismatch  = errors.New("block hash mismatch")
+	ErrIncompleteDAG = errors.New("incomplete DAG")
+
+	ErrAssetHashMismatch = errors.New("asset hash mismatch")
+)
+
+// verifyDAG walks the DAG from the root when verifying a CAR and requires every linked block to be present
+var verifyDAG bool
+
+// verifyCAR parses the CAR file, validating the header, that the roots include the requested root cid, the varint
+// framing of every section, that the multihash of every block matches its cid and that every block decodes with its
+// codec. Blocks of codecs without a registered decoder are only checked for framing and hash. With verifyDAG, every
+// block linked from the root must be present too.
+func verifyCAR(path string, root string) error {
+	return checkCAR(path, root, verifyDAG)
+}
+
+// verifyPartialCAR verifies a CAR lacking blocks by design, a delta CAR, which has no complete DAG to walk
+func verifyPartialCAR(path string, root string) error {
+	return checkCAR(path, root, false)
+}
+
+// checkCAR verifies the CAR at path, walking the DAG from root when dag is set
+func checkCAR(path string, root string, dag bool) error {
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return errors.Wrapf(err, "decode root cid %s", root)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br, err := car.NewBlockReader(f, car.WithTrustedCAR(true))
+	if err != nil {
+		return errors.Wrapf(ErrInvalidCAR, "read header: %v", err)
+	}
+
+	if !containsCid(br.Roots, rootCid) {
+		return errors.Wrapf(ErrRootMismatch, "want %s, got %v", rootCid, br.Roots)
+	}
+
+	var blocks int
+	links := make(dagLinks)
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(ErrInvalidCAR, "read block %d: %v", blocks, err)
+		}
+
+		if err := verifyBlockHash(blk.Cid(), blk.RawData()); err != nil {
+			return err
+		}
+
+		decoder, err := multicodec.LookupDecoder(blk.Cid().Prefix().Codec)
+		if err == nil {
+			nb := basicnode.Prototype.Any.NewBuilder()
+			if err := decoder(nb, bytes.NewReader(blk.RawData())); err != nil {
+				return errors.Wrapf(ErrInvalidCAR, "decode block %s: %v", blk.Cid(), err)
+			}
+
+			if dag {
+				selected, err := traversal.SelectLinks(nb.Build())
+				if err != nil {
+					return errors.Wrapf(ErrInvalidCAR, "select links of %s: %v", blk.Cid(), err)
+				}
+				links.add(blk.Cid(), selected)
+			}
+		} else if dag {
+			links.add(blk.Cid(), nil)
+		}
+		blocks++
+	}
+
+	if blocks == 0 {
+		return errors.Wrap(ErrInvalidCAR, "no block")
+	}
+
+	if dag {
+		return links.complete(rootCid)
+	}
+
+	return nil
+}
+
+// dagLinks keeps the links of every block of a CAR, keyed by multihash so CIDv0 and CIDv1 links match
+type dagLinks map[string][]cid.Cid
+
+func (d dagLinks) add(c cid.Cid, links []datamodel.Link) {
+	var cids []cid.Cid
+	for _, l := range links {
+		if cl, ok := l.(cidlink.Link); ok {
+			cids = append(cids, cl.Cid)
+		}
+	}
+	d[string(c.Hash())] = cids
+}
+
+// complete walks the DAG from root and reports the first referenced block missing from the CAR
+func (d dagLinks) complete(root cid.Cid) error {
+	visited := make(map[string]struct{})
+	queue := []cid.Cid{root}
+
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+
+		// identity cids carry their data inline
+		if c.Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+
+		key := string(c.Hash())
+		if _, ok := visited[key]; ok {
+			continue
+		}
+		visited[key] = struct{}{}
+
+		links, ok := d[key]
+		if !ok {
+			return errors.Wrapf(ErrIncompleteDAG, "block %s missing", c)
+		}
+		queue = append(queue, links...)
+	}
+
+	return nil
+}
+
+// verifyBlockHash recomputes the multihash of data and compares it with the one of c
+func verifyBlockHash(c cid.Cid, data []byte) error {
+	hashed, err := c.Prefix().Sum(data)
+	if err != nil {
+		return errors.Wrapf(err, "hash block %s", c)
+	}
+
+	if !bytes.Equal(hashed.Hash(), c.Hash()) {
+		return errors.Wrapf(ErrHashMismatch, "block %s, got %s", c, hashed)
+	}
+	return nil
+}
+
+// blockLinks decodes the block c and returns the cids it links to, blocks of codecs without a registered decoder have
+// no links
+func blockLinks(c cid.Cid, data []byte) ([]cid.Cid, error) {
+	decoder, err := multicodec.LookupDecoder(c.Prefix().Codec)
+	if err != nil {
+		return nil, nil
+	}
+
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := decoder(nb, bytes.NewReader(data)); err != nil {
+		return nil, errors.Wrapf(ErrInvalidCAR, "decode block %s: %v", c, err)
+	}
+
+	links, err := traversal.SelectLinks(nb.Build())
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidCAR, "select links of %s: %v", c, err)
+	}
+
+	var out []cid.Cid
+	for _, l := range links {
+		if cl, ok := l.(cidlink.Link); ok {
+			out = append(out, cl.Cid)
+		}
+	}
+	return out, nil
+}
+
+// containsCid reports whether cids include c, a CIDv0 and CIDv1 of the same codec and multihash are equal
+func containsCid(cids []cid.Cid, c cid.Cid) bool {
+	for _, r := range cids {
+		if r.Equals(c) || (r.Prefix().Codec == c.Prefix().Codec && bytes.Equal(r.Hash(), c.Hash())) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAssetHash hashes the stored CAR against the hash the scheduler recorded for the asset. A multihash is matched
+// against the root block of the CAR, rehashed with the function of the recorded one, any other hash against the
+// sha256 of the CAR. Assets without a hash pass.
+func checkAssetHash(asset *model.Asset, s *StoredCAR) error {
+	if asset.Hash == "" {
+		return nil
+	}
+
+	expected, err := hex.DecodeString(asset.Hash)
+	if err != nil {
+		return errors.Wrapf(ErrAssetHashMismatch, "recorded hash %s is no hex", asset.Hash)
+	}
+
+	decoded, err := multihash.Decode(expected)
+	if err != nil {
+		sum := s.SHA256
+		if sum == "" {
+			if sum, err = fileChecksum(s.Path()); err != nil {
+				return err
+			}
+		}
+		if !strings.EqualFold(sum, asset.Hash) {
+			return errors.Wrapf(ErrAssetHashMismatch, "recorded %s, stored %s", asset.Hash, sum)
+		}
+		return nil
+	}
+
+	rootCid, err := cid.Decode(asset.Cid)
+	if err != nil {
+		return errors.Wrapf(err, "decode root cid %s", asset.Cid)
+	}
+
+	block, err := readStoredBlock(s, rootCid)
+	if err != nil {
+		return errors.Wrap(err, "read root block")
+	}
+
+	hashed, err := multihash.Sum(block, decoded.Code, decoded.Length)
+	if err != nil {
+		return errors.Wrap(err, "hash root block")
+	}
+
+	if !bytes.Equal(hashed, expected) {
+		return errors.Wrapf(ErrAssetHashMismatch, "recorded %s, stored %s", asset.Hash, hex.EncodeToString(hashed))
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/multiformats/go-multihash"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testBlock is a block of a CAR written by writeTestCAR
+type testBlock struct {
+	cid  cid.Cid
+	data []byte
+}
+
+// jsonBlock encodes a dag-json block of name linking to links
+func jsonBlock(t *testing.T, name string, links ...cid.Cid) testBlock {
+	var refs []string
+	for _, l := range links {
+		refs = append(refs, fmt.Sprintf(`{"/":"%s"}`, l))
+	}
+	data := []byte(fmt.Sprintf(`{"links":[%s],"name":"%s"}`, strings.Join(refs, ","), name))
+	return rawJSONBlock(t, data)
+}
+
+// rawJSONBlock hashes data as a dag-json block without checking it decodes
+func rawJSONBlock(t *testing.T, data []byte) testBlock {
+	c, err := cid.NewPrefixV1(cid.DagJSON, multihash.SHA2_256).Sum(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testBlock{cid: c, data: data}
+}
+
+// writeTestCAR writes the blocks as a CARv1 of root into a temp dir
+func writeTestCAR(t *testing.T, root cid.Cid, blocks ...testBlock) string {
+	path := filepath.Join(t.TempDir(), root.String()+".car")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := storage.NewWritable(f, []cid.Cid{root}, car.WriteAsCarV1(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blocks {
+		if err := w.Put(context.Background(), b.cid.KeyString(), b.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testDAG is a root linking to two leaves
+func testDAG(t *testing.T) (testBlock, []testBlock) {
+	left, right := jsonBlock(t, "left"), jsonBlock(t, "right")
+	root := jsonBlock(t, "root", left.cid, right.cid)
+	return root, []testBlock{root, left, right}
+}
+
+func TestVerifyCAR(t *testing.T) {
+	root, blocks := testDAG(t)
+	path := writeTestCAR(t, root.cid, blocks...)
+
+	if err := verifyCAR(path, root.cid.String()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyCARTruncated(t *testing.T) {
+	root, blocks := testDAG(t)
+	path := writeTestCAR(t, root.cid, blocks...)
+
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cut into the last block
+	if err := os.Truncate(path, st.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyCAR(path, root.cid.String()); !errors.Is(err, ErrInvalidCAR) {
+		t.Fatalf("truncated CAR: %v, want ErrInvalidCAR", err)
+	}
+}
+
+func TestVerifyCARGarbage(t *testing.T) {
+	root, _ := testDAG(t)
+	path := filepath.Join(t.TempDir(), "garbage.car")
+	if err := os.WriteFile(path, []byte("<html>502 Bad Gateway</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyCAR(path, root.cid.String()); !errors.Is(err, ErrInvalidCAR) {
+		t.Fatalf("garbage response: %v, want ErrInvalidCAR", err)
+	}
+}
+
+func TestVerifyCARUndecodableBlock(t *testing.T) {
+	// the hash matches, the block isn't dag-json though
+	broken := rawJSONBlock(t, []byte(`{"links":[`))
+	path := writeTestCAR(t, broken.cid, broken)
+
+	if err := verifyCAR(path, broken.cid.String()); !errors.Is(err, ErrInvalidCAR) {
+		t.Fatalf("undecodable block: %v, want ErrInvalidCAR", err)
+	}
+}
+
+func TestVerifyCARNoBlock(t *testing.T) {
+	root, _ := testDAG(t)
+	path := writeTestCAR(t, root.cid)
+
+	if err := verifyCAR(path, root.cid.String()); !errors.Is(err, ErrInvalidCAR) {
+		t.Fatalf("CAR without blocks: %v, want ErrInvalidCAR", err)
+	}
+}
+
+func TestVerifyCARRootMismatch(t *testing.T) {
+	root, blocks := testDAG(t)
+	other := jsonBlock(t, "other")
+	// a valid CAR, of another DAG
+	path := writeTestCAR(t, other.cid, append(blocks, other)...)
+
+	if err := verifyCAR(path, root.cid.String()); !errors.Is(err, ErrRootMismatch) {
+		t.Fatalf("CAR of another root: %v, want ErrRootMismatch", err)
+	}
+}
+
+func TestContainsCidVersions(t *testing.T) {
+	mh, err := multihash.Sum([]byte("titan"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v0 := cid.NewCidV0(mh)
+	v1 := cid.NewCidV1(cid.DagProtobuf, mh)
+	raw := cid.NewCidV1(cid.Raw, mh)
+
+	if !containsCid([]cid.Cid{v1}, v0) || !containsCid([]cid.Cid{v0}, v1) {
+		t.Error("the CIDv0 and CIDv1 of a block don't match")
+	}
+	if containsCid([]cid.Cid{raw}, v0) {
+		t.Error("the cid of another codec matches")
+	}
+}
+
+func TestVerifyCARBitFlip(t *testing.T) {
+	root, blocks := testDAG(t)
+	path := writeTestCAR(t, root.cid, blocks...)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip a bit of a leaf, it still decodes but no longer hashes to its cid
+	i := bytes.Index(data, []byte(`"right"`))
+	if i < 0 {
+		t.Fatal("leaf not found in the CAR")
+	}
+	data[i+1] ^= 0x20
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyCAR(path, root.cid.String()); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("flipped bit: %v, want ErrHashMismatch", err)
+	}
+}
+
+func TestVerifyBlockHash(t *testing.T) {
+	b := jsonBlock(t, "leaf")
+	if err := verifyBlockHash(b.cid, b.data); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyBlockHash(b.cid, append(b.data, ' ')); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("altered block: %v, want ErrHashMismatch", err)
+	}
+}
+
+func withVerifyDAG(t *testing.T) {
+	old := verifyDAG
+	verifyDAG = true
+	t.Cleanup(func() { verifyDAG = old })
+}
+
+func TestVerifyCARIncompleteDAG(t *testing.T) {
+	root, blocks := testDAG(t)
+	// the right leaf is missing
+	path := writeTestCAR(t, root.cid, blocks[:2]...)
+
+	// every block present is fine, the walk is optional
+	if err := verifyCAR(path, root.cid.String()); err != nil {
+		t.Fatalf("without the DAG walk: %v", err)
+	}
+
+	withVerifyDAG(t)
+	if err := verifyCAR(path, root.cid.String()); !errors.Is(err, ErrIncompleteDAG) {
+		t.Fatalf("missing leaf: %v, want ErrIncompleteDAG", err)
+	}
+
+	// a delta CAR lacks blocks by design
+	if err := verifyPartialCAR(path, root.cid.String()); err != nil {
+		t.Fatalf("partial CAR: %v", err)
+	}
+}
+
+func TestVerifyCARCompleteDAG(t *testing.T) {
+	withVerifyDAG(t)
+
+	root, blocks := testDAG(t)
+	// a shared leaf is linked twice, the blocks in any order
+	shared := jsonBlock(t, "shared")
+	middle := jsonBlock(t, "middle", shared.cid)
+	top := jsonBlock(t, "top", root.cid, middle.cid, shared.cid)
+	path := writeTestCAR(t, top.cid, append([]testBlock{shared, middle}, append(blocks, top)...)...)
+
+	if err := verifyCAR(path, top.cid.String()); err != nil {
+		t.Fatal(err)
+	}
+}
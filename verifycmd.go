@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// verifyCursor is persisted while the verify command runs, so an interrupted run resumes where it stopped
+type verifyCursor struct {
+	// Last is the path of the last CAR verified in path order, every CAR before it is done. A path survives CARs
+	// quarantined or added meanwhile, an index wouldn't.
+	Last      string    `json:"last,omitempty"`
+	Verified  int       `json:"verified"`
+	Total     int       `json:"total"`
+	Completed bool      `json:"completed,omitempty"`
+	Corrupted int       `json:"corrupted"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// verifyFinding is printed as a json line for every corrupted CAR
+type verifyFinding struct {
+	Path  string `json:"path"`
+	Cid   string `json:"cid"`
+	Error string `json:"error"`
+}
+
+func verifyCmd(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	workers := fs.Int("workers", 4, "number of CARs verified in parallel")
+	cursorPath := fs.String("cursor", filepath.Join(BackupOutPath, ".verify-cursor.json"), "file persisting the progress of the run")
+	reset := fs.Bool("reset", false, "start over instead of resuming from the cursor")
+	quarantineCorrupted := fs.Bool("quarantine", false, "move corrupted CARs into the quarantine directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return err
+	}
+
+	// a stable order lets the cursor survive restarts
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Path() < stored[j].Path() })
+
+	cursor := &verifyCursor{StartedAt: time.Now()}
+	if !*reset {
+		if data, err := os.ReadFile(*cursorPath); err == nil {
+			if err := json.Unmarshal(data, cursor); err != nil {
+				return fmt.Errorf("decode cursor %s: %w", *cursorPath, err)
+			}
+		}
+	}
+
+	// the previous run completed, start a new one
+	if cursor.Completed {
+		cursor = &verifyCursor{StartedAt: time.Now()}
+	}
+
+	// resume after the last verified path, whether or not it's still in the inventory
+	start := 0
+	if cursor.Last != "" {
+		start = sort.Search(len(stored), func(i int) bool { return stored[i].Path() > cursor.Last })
+		fmt.Fprintf(os.Stderr, "resuming after %s\n", cursor.Last)
+	}
+	cursor.Total = len(stored)
+
+	var (
+		lk   sync.Mutex
+		next = start
+		done = make(map[int]bool)
+		enc  = json.NewEncoder(os.Stdout)
+	)
+
+	save := func() {
+		cursor.UpdatedAt = time.Now()
+		data, err := json.Marshal(cursor)
+		if err == nil {
+			err = os.WriteFile(*cursorPath, data, 0664)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "save cursor: %v\n", err)
+		}
+	}
+
+	// advance moves the cursor over the contiguous finished CARs, completions arrive out of order
+	advance := func() {
+		for done[next] {
+			delete(done, next)
+			cursor.Last = stored[next].Path()
+			cursor.Verified++
+			next++
+		}
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				s := stored[i]
+				err := verifyStored(s)
+
+				lk.Lock()
+				if err != nil {
+					cursor.Corrupted++
+					enc.Encode(&verifyFinding{Path: s.Path(), Cid: s.Cid, Error: err.Error()})
+				}
+				done[i] = true
+				advance()
+				lk.Unlock()
+
+				if err != nil && *quarantineCorrupted {
+					if qerr := quarantine(s, err); qerr != nil {
+						fmt.Fprintf(os.Stderr, "quarantine %s: %v\n", s.Path(), qerr)
+					}
+				}
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				lk.Lock()
+				fmt.Fprintf(os.Stderr, "verified %d/%d CARs, %d corrupted\n", cursor.Verified, cursor.Total, cursor.Corrupted)
+				save()
+				lk.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for i := start; i < len(stored); i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(stop)
+
+	lk.Lock()
+	defer lk.Unlock()
+	cursor.Completed = true
+	save()
+
+	fmt.Fprintf(os.Stderr, "verified %d CARs, %d corrupted\n", cursor.Verified, cursor.Corrupted)
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// volumeOf identifies the volume by the directory where device ids are not available
+func volumeOf(dir string) string {
+	return dir
+}
+
+// freeSpace is not supported, the low disk safeguard stays off
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space not supported on this platform")
+}
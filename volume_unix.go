@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// volumeOf identifies the device dir is stored on
+func volumeOf(dir string) string {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return dir
+	}
+
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return dir
+	}
+	return fmt.Sprintf("dev-%d", uint64(sys.Dev))
+}
+
+// freeSpace returns the bytes available to unprivileged users on the volume of dir
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// extraRoots are directories on further volumes new backup directories are placed on besides BackupOutPath
+	extraRoots string
+	// placement picks the volume of a new asset, free for the most free space or load for the fewest running writes
+	placement = "free"
+)
+
+// outputRoots lists BackupOutPath and the extra output roots. A backup directory placed on an extra root is linked
+// into BackupOutPath, so the archive keeps being read through one tree.
+func outputRoots() []string {
+	roots := []string{BackupOutPath}
+	for _, root := range strings.Split(extraRoots, ",") {
+		if root = strings.TrimSpace(root); root != "" {
+			roots = append(roots, filepath.Clean(root))
+		}
+	}
+	return roots
+}
+
+// rootOf returns the output root the backup directory dir is stored on
+func rootOf(dir string) string {
+	if target, err := os.Readlink(dir); err == nil {
+		return filepath.Dir(target)
+	}
+	return BackupOutPath
+}
+
+// stagingDirOf is the staging directory on the volume of root, so staged CARs are renamed into place
+func stagingDirOf(root string) string {
+	if root == BackupOutPath {
+		return stagingDir
+	}
+	return filepath.Join(root, ".titan-backup-staging")
+}
+
+// isBackupDir reports whether the entry of BackupOutPath is a directory, following the links to the extra roots
+func isBackupDir(root string, e os.DirEntry) bool {
+	if e.Type()&os.ModeSymlink == 0 {
+		return e.IsDir()
+	}
+	info, err := os.Stat(filepath.Join(root, e.Name()))
+	return err == nil && info.IsDir()
+}
+
+// removeBackupDir removes the backup directory dir along with its link when it's stored on an extra root
+func removeBackupDir(dir string) error {
+	target, err := os.Readlink(dir)
+	if err != nil {
+		return os.RemoveAll(dir)
+	}
+
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	return os.Remove(dir)
+}
+
+// mkBackupDir creates the backup directory dir on root
+func mkBackupDir(dir, root string) error {
+	if root == BackupOutPath {
+		return os.Mkdir(dir, 0775)
+	}
+
+	target := filepath.Join(root, filepath.Base(dir))
+	if err := os.Mkdir(target, 0775); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return os.Symlink(target, dir)
+}
+
+// outputFreeSpace is the largest free space of the output roots, the space left for the next asset
+func outputFreeSpace() (int64, error) {
+	var best int64
+	var lastErr error
+	ok := false
+	for _, root := range outputRoots() {
+		free, err := freeSpace(root)
+		if err != nil {
+			lastErr = fmt.Errorf("free space of %s: %w", root, err)
+			continue
+		}
+		best = max(best, free)
+		ok = true
+	}
+
+	if !ok {
+		return 0, lastErr
+	}
+	return best, nil
+}
+
+// pickRoot chooses the output root of a new asset by placement and claims a running write on it, released by
+// endWrite. A root whose free space is unknown is only chosen for free placement when no other is known.
+func (d *Downloader) pickRoot() string {
+	roots := outputRoots()
+
+	d.dlk.Lock()
+	defer d.dlk.Unlock()
+
+	if d.writes == nil {
+		d.writes = make(map[string]int)
+	}
+
+	best, bestFree := roots[0], int64(-1)
+	for i, root := range roots {
+		free, err := freeSpace(root)
+		if err != nil {
+			free = -1
+		}
+
+		better := i == 0 || free > bestFree
+		if i > 0 && placement == "load" && d.writes[root] != d.writes[best] {
+			better = d.writes[root] < d.writes[best]
+		}
+		if better {
+			best, bestFree = root, free
+		}
+	}
+
+	d.writes[best]++
+	return best
+}
+
+// endWrite releases the write claimed by pickRoot
+func (d *Downloader) endWrite(root string) {
+	d.dlk.Lock()
+	d.writes[root]--
+	d.dlk.Unlock()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// w3sToken enables uploading every verified CAR to web3.storage/Storacha
+	w3sToken    string
+	w3sEndpoint = "https://api.web3.storage"
+	// w3sShardSize is the largest CAR accepted by a single upload, larger CARs are split into shards of the same root
+	w3sShardSize int64 = 100 << 20
+	// w3sGateway serves the DAGs uploaded to w3s as CARs, the migrated CARs are restored from it
+	w3sGateway = "https://w3s.link"
+)
+
+// UploadW3S is the target of the uploads to web3.storage/Storacha
+const UploadW3S = "w3s"
+
+// carCodec is the multicodec of the cid of a CAR file itself
+const carCodec = 0x0202
+
+var ErrUploadMismatch = errors.New("uploaded CAR doesn't match")
+
+// Upload is a copy of a stored CAR on a remote target
+type Upload struct {
+	Target string `json:"target"`
+	// IDs are the identifiers returned by the target, one per shard
+	IDs        []string  `json:"ids"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+func (s *StoredCAR) uploaded(target string) bool {
+	for _, u := range s.Uploads {
+		if u.Target == target {
+			return true
+		}
+	}
+	return false
+}
+
+// recordUpload appends the entry of s with the upload added to its manifest, the latest entry of a cid wins
+func recordUpload(s *StoredCAR, upload *Upload) error {
+	entry := *s.ManifestEntry
+	entry.Uploads = append(append([]*Upload(nil), s.Uploads...), upload)
+	if err := appendManifest(s.Dir, &entry); err != nil {
+		return err
+	}
+	s.ManifestEntry = &entry
+	return nil
+}
+
+// w3sUploadResult is the response of the car upload api
+type w3sUploadResult struct {
+	Cid    string `json:"cid"`
+	CarCid string `json:"carCid"`
+}
+
+// uploadW3S uploads the stored CAR, sharded when larger than w3sShardSize, and records the returned identifiers
+func uploadW3S(ctx context.Context, s *StoredCAR) error {
+	full, cleanup, err := completeCAR(s, os.TempDir())
+	if err != nil {
+		return errors.Wrap(err, "materialize delta CAR")
+	}
+	defer cleanup()
+
+	var ids []string
+	err = shardCAR(full.Path(), w3sShardSize, func(shard []byte) error {
+		id, err := postW3S(ctx, shard)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return recordUpload(s, &Upload{Target: UploadW3S, IDs: ids, UploadedAt: time.Now()})
+}
+
+// shardCAR splits the CAR at path into CARv1 shards of at most maxSize bytes, each with the roots of the CAR, and
+// passes them to fn in order
+func shardCAR(path string, maxSize int64, fn func(shard []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br, err := carv2.NewBlockReader(f, carv2.WithTrustedCAR(true))
+	if err != nil {
+		return errors.Wrapf(ErrInvalidCAR, "read header: %v", err)
+	}
+
+	// a shard is buffered whole
+	buffers.acquire(maxSize)
+	defer buffers.release(maxSize)
+
+	var buf bytes.Buffer
+	var w storage.WritableCar
+	var blocks int
+	flush := func() error {
+		if w == nil {
+			return nil
+		}
+		if err := w.Finalize(); err != nil {
+			return err
+		}
+		err := fn(buf.Bytes())
+		buf.Reset()
+		w, blocks = nil, 0
+		return err
+	}
+
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(ErrInvalidCAR, "read block: %v", err)
+		}
+
+		section := int64(len(blk.Cid().Bytes()) + len(blk.RawData()) + 10)
+		if blocks > 0 && int64(buf.Len())+section > maxSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		if w == nil {
+			if w, err = storage.NewWritable(&buf, br.Roots, carv2.WriteAsCarV1(true)); err != nil {
+				return err
+			}
+		}
+
+		if err := w.Put(context.Background(), blk.Cid().KeyString(), blk.RawData()); err != nil {
+			return err
+		}
+		blocks++
+	}
+	return flush()
+}
+
+// postW3S uploads a CAR to the car api of w3sEndpoint and returns its identifier
+func postW3S(ctx context.Context, car []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(w3sEndpoint, "/")+"/car", bytes.NewReader(car))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+secret("w3s_token"))
+	req.Header.Set("Content-Type", "application/vnd.ipld.car")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "upload CAR")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return "", errors.Errorf("upload CAR: status %d %s", resp.StatusCode, msg)
+	}
+
+	var result w3sUploadResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrap(err, "decode upload response")
+	}
+
+	// the cid of the shard itself identifies it, the root cid is the same for every shard
+	if result.CarCid != "" {
+		if err := verifyCarCid(result.CarCid, car); err != nil {
+			return "", err
+		}
+		return result.CarCid, nil
+	}
+	if _, err := cid.Decode(result.Cid); err != nil {
+		return "", errors.Errorf("upload response has no valid cid: %q", result.Cid)
+	}
+	return result.Cid, nil
+}
+
+// verifyCarCid checks the cid the api computed for the uploaded CAR against the sent bytes
+func verifyCarCid(carCid string, car []byte) error {
+	got, err := cid.Decode(carCid)
+	if err != nil {
+		return errors.Wrapf(err, "decode car cid %s", carCid)
+	}
+
+	sum, err := multihash.Sum(car, multihash.SHA2_256, -1)
+	if err != nil {
+		return err
+	}
+
+	if want := cid.NewCidV1(carCodec, sum); !got.Equals(want) {
+		return errors.Wrapf(ErrUploadMismatch, "api reports %s, sent %s", got, want)
+	}
+	return nil
+}
+
+// w3sUploadCmd uploads the selected CARs not uploaded yet, to back fill the CARs stored before w3s_token was set
+func w3sUploadCmd(args []string) error {
+	fs := flag.NewFlagSet("w3s-upload", flag.ExitOnError)
+	date := fs.String("date", "", "upload every CAR backed up for the day, formatted as "+dirDateTimeFormat)
+	force := fs.Bool("force", false, "upload CARs already uploaded again")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if w3sToken == "" || (*date == "" && fs.NArg() == 0) {
+		return fmt.Errorf("usage: --w3s_token <token> w3s-upload [-force] <cid...|-date %s>", dirDateTimeFormat)
+	}
+
+	stored, err := loadInventory(BackupOutPath)
+	if err != nil {
+		return err
+	}
+
+	selected, err := selectStored(stored, *date, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var failed int
+	for i, s := range selected {
+		if s.uploaded(UploadW3S) && !*force {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "upload %d/%d: %s\n", i+1, len(selected), s.Cid)
+
+		result := &exportResult{Cid: s.Cid, Path: s.Path()}
+		if err := uploadW3S(context.Background(), s); err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		enc.Encode(result)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uploads failed", failed, len(selected))
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// writeBehindDepth is the number of copyBufferSize chunks queued between the network and the disk of a download,
+// 0 writes every chunk before the next is read
+var writeBehindDepth = 16
+
+// writeBehind copies src to dst with the reads and the writes in their own goroutines, connected by a queue of depth
+// chunks. A disk stalling for a moment doesn't stop reading the stream into a timeout, and a source stalling
+// doesn't leave the queued chunks unwritten. The chunks are claimed from the buffer limiter up front.
+func writeBehind(dst io.Writer, src io.Reader, depth int) (int64, error) {
+	slab, free := buffers.alloc(copyBufferSize * (depth + 1))
+	defer free()
+
+	// one chunk more than the queue holds is filled by the reader meanwhile
+	pool := make(chan []byte, depth+1)
+	for i := 0; i <= depth; i++ {
+		pool <- slab[i*copyBufferSize : (i+1)*copyBufferSize : (i+1)*copyBufferSize]
+	}
+
+	full := make(chan []byte, depth+1)
+	failed := make(chan struct{})
+	done := make(chan error, 1)
+
+	go func() {
+		var err error
+		for chunk := range full {
+			if err == nil {
+				if _, err = dst.Write(chunk); err != nil {
+					close(failed)
+				}
+			}
+			pool <- chunk[:cap(chunk)]
+		}
+		done <- err
+	}()
+
+	var read int64
+	var rerr error
+	for rerr == nil {
+		var chunk []byte
+		select {
+		case chunk = <-pool:
+		case <-failed:
+		}
+		if chunk == nil {
+			break
+		}
+
+		n, err := io.ReadFull(src, chunk)
+		if n > 0 {
+			read += int64(n)
+			full <- chunk[:n]
+		} else {
+			pool <- chunk
+		}
+
+		switch {
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			rerr = io.EOF
+		case err != nil:
+			rerr = err
+		}
+	}
+	close(full)
+
+	if werr := <-done; werr != nil {
+		return read, werr
+	}
+	if rerr != io.EOF {
+		return read, rerr
+	}
+	return read, nil
+}